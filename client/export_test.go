@@ -0,0 +1,9 @@
+package client
+
+import "net"
+
+// Runs the session's accept loop on the listener, returning once the loop exits.
+func (s *Session) AcceptConnections(listener net.Listener) {
+	s.wg.Add(1)
+	s.acceptConnections(listener)
+}
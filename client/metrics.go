@@ -0,0 +1,70 @@
+package client
+
+import (
+	"encoding/hex"
+	"runtime"
+
+	"github.com/MlkMahmud/hail/metrics"
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+/*
+Registers the metrics of the session with a registry: the transfers and peers of every torrent, the connections shared by the torrents
+and the number of goroutines. They are computed from the torrents' stats every time the registry is written.
+*/
+func (s *Session) registerMetrics(registry *metrics.Registry) {
+	torrentLabels := []string{"info_hash"}
+
+	registry.NewGaugeFunc("hail_torrent_info", "Name of every torrent of the session, always 1.", []string{"info_hash", "name"}, func() []metrics.Sample {
+		samples := []metrics.Sample{}
+
+		for _, t := range s.Torrents() {
+			infoHash := t.InfoHash()
+			samples = append(samples, metrics.Sample{LabelValues: []string{hex.EncodeToString(infoHash[:]), t.Name()}, Value: 1})
+		}
+
+		return samples
+	})
+
+	registry.NewCounterFunc("hail_torrent_downloaded_bytes_total", "Number of bytes of verified pieces downloaded, by torrent.", torrentLabels, s.torrentSamples(func(stats torrent.Stats) float64 {
+		return float64(stats.Downloaded)
+	}))
+
+	registry.NewCounterFunc("hail_torrent_uploaded_bytes_total", "Number of bytes uploaded to peers, by torrent.", torrentLabels, s.torrentSamples(func(stats torrent.Stats) float64 {
+		return float64(stats.Uploaded)
+	}))
+
+	registry.NewCounterFunc("hail_torrent_wasted_bytes_total", "Number of bytes of pieces that failed hash verification, by torrent.", torrentLabels, s.torrentSamples(func(stats torrent.Stats) float64 {
+		return float64(stats.Wasted)
+	}))
+
+	registry.NewGaugeFunc("hail_torrent_peers_connected", "Number of connected peers, by torrent.", torrentLabels, s.torrentSamples(func(stats torrent.Stats) float64 {
+		return float64(stats.ConnectedPeers)
+	}))
+
+	registry.NewGaugeFunc("hail_torrent_peers_known", "Number of peers known, connected or not, by torrent.", torrentLabels, s.torrentSamples(func(stats torrent.Stats) float64 {
+		return float64(stats.KnownPeers)
+	}))
+
+	registry.NewGaugeFunc("hail_peer_connections", "Number of peer connections of every torrent of the session.", nil, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(s.connectionLimiter.NumOfConnections())}}
+	})
+
+	registry.NewGaugeFunc("hail_goroutines", "Number of goroutines of the process.", nil, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(runtime.NumGoroutine())}}
+	})
+}
+
+// Returns a function that collects a value of the stats of every torrent of the session, labelled with the torrent's info hash.
+func (s *Session) torrentSamples(value func(stats torrent.Stats) float64) func() []metrics.Sample {
+	return func() []metrics.Sample {
+		samples := []metrics.Sample{}
+
+		for _, t := range s.Torrents() {
+			infoHash := t.InfoHash()
+			samples = append(samples, metrics.Sample{LabelValues: []string{hex.EncodeToString(infoHash[:])}, Value: value(t.Stats())})
+		}
+
+		return samples
+	}
+}
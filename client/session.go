@@ -0,0 +1,586 @@
+package client
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/MlkMahmud/hail/dht"
+	"github.com/MlkMahmud/hail/logging"
+	"github.com/MlkMahmud/hail/metrics"
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+/*
+A set of torrents sharing the same resources: the listener peers connect to, our peer Id, the DHT node,
+and the connection and bandwidth limits.
+
+Torrents are registered by info hash. Incoming connections are handed to the torrent whose info hash the peer sends in its handshake.
+*/
+type Session struct {
+	config Config
+
+	listener net.Listener
+	dht      *dht.DHT
+	peerId   [20]byte
+
+	connectionLimiter *torrent.ConnectionLimiter
+	downloadLimiter   *torrent.RateLimiter
+	uploadLimiter     *torrent.RateLimiter
+	// The bus the session's torrents publish their events on.
+	events *torrent.EventBus
+	// The metrics recorded by the session's torrents. Nil unless `Config.Metrics` is set.
+	metrics *torrent.Metrics
+	logger  *slog.Logger
+
+	mutex *sync.Mutex
+	// Torrents in the order they were added.
+	torrents []*torrent.Torrent
+	// Torrents keyed by every info hash peers may use for them (see `Torrent.SwarmInfoHashes`).
+	torrentsByInfoHash map[[sha1.Size]byte]*torrent.Torrent
+	// Whether each torrent is removed once it reaches its seeding goal.
+	removeAfterSeeding map[*torrent.Torrent]bool
+	closed             bool
+
+	ctx        context.Context
+	cancelFunc context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+type Config struct {
+	// Directory torrents are downloaded to, unless set in their options.
+	DownloadDir string
+	// TCP address peers connect to, e.g ":6881". A random port is used if empty.
+	ListenAddress string
+
+	// Maximum number of peer connections of all torrents. Defaults to 200.
+	MaxConnections int
+	// Maximum number of peer connections of a single torrent. Defaults to 50.
+	MaxConnectionsPerTorrent int
+	// Maximum rates, in bytes per second, at which data is downloaded from and uploaded to peers. Rates are unlimited if 0.
+	DownloadRateLimit int
+	UploadRateLimit   int
+
+	// Disables peer discovery through the DHT.
+	DisableDHT bool
+	DHT        dht.Config
+
+	// When finished torrents stop seeding, unless set in their options.
+	Seeding SeedingPolicy
+	// Directory the transfer history of every torrent is saved to, so the seeding goals account for previous runs. Nothing is saved if empty.
+	StateDir string
+
+	/*
+		Logger of the session, passed on to its torrents and to the DHT node unless `DHT.Logger` is set.
+		Records are tagged with the component that logged them (see the `logging` package). Defaults to `slog.Default()`.
+	*/
+	Logger *slog.Logger
+
+	/*
+		Registry the metrics of the session and of its torrents are registered with. No metrics are recorded if nil.
+		A registry can only be used by a single session.
+	*/
+	Metrics *metrics.Registry
+}
+
+// The seeding goals of torrents, and what is done with torrents that reach them.
+type SeedingPolicy struct {
+	torrent.SeedingGoals
+	// Removes torrents from the session once they reach a goal, instead of pausing them. Their files are kept.
+	Remove bool
+}
+
+// Options of a torrent added to a session.
+type TorrentOptions struct {
+	// Directory the torrent's files are downloaded to. Defaults to the session's download directory.
+	OutputDir string
+	// Trackers to announce to in addition to the torrent's trackers. Ignored for private torrents.
+	Trackers []string
+	// Announces to one tracker in every tier of the announce list.
+	AnnounceToAllTiers bool
+	// Adds the torrent without starting it.
+	Paused bool
+	// Overrides the session's seeding policy.
+	Seeding *SeedingPolicy
+}
+
+const (
+	defaultMaxConnections           = 200
+	defaultMaxConnectionsPerTorrent = 50
+	defaultDHTAddress               = ":6881"
+
+	// Interval between checks for torrents that reached their seeding goal and must be removed.
+	seedingPolicyInterval = time.Second
+	// Interval between saves of the transfer history of the torrents.
+	stateSaveInterval = time.Minute
+
+	// Bounds of the delay before accepting again after a failed `Accept`, doubled on every consecutive failure.
+	minAcceptRetryDelay = 5 * time.Millisecond
+	maxAcceptRetryDelay = time.Second
+)
+
+var (
+	ErrSessionClosed   = errors.New("session is closed")
+	ErrTorrentExists   = errors.New("torrent has already been added to the session")
+	ErrTorrentNotFound = errors.New("torrent not found")
+)
+
+func NewSession(config Config) (*Session, error) {
+	if config.MaxConnections <= 0 {
+		config.MaxConnections = defaultMaxConnections
+	}
+
+	if config.MaxConnectionsPerTorrent <= 0 {
+		config.MaxConnectionsPerTorrent = defaultMaxConnectionsPerTorrent
+	}
+
+	listener, err := net.Listen("tcp", config.ListenAddress)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for incoming peer connections: %w", err)
+	}
+
+	var mutex sync.Mutex
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+
+	s := &Session{
+		config:   config,
+		listener: listener,
+
+		connectionLimiter: torrent.NewConnectionLimiter(config.MaxConnections),
+		downloadLimiter:   torrent.NewRateLimiter(config.DownloadRateLimit),
+		uploadLimiter:     torrent.NewRateLimiter(config.UploadRateLimit),
+		events:            torrent.NewEventBus(),
+		logger:            logging.Component(config.Logger, logging.ComponentSession),
+
+		mutex:              &mutex,
+		torrentsByInfoHash: make(map[[sha1.Size]byte]*torrent.Torrent),
+		removeAfterSeeding: make(map[*torrent.Torrent]bool),
+
+		ctx:        ctx,
+		cancelFunc: cancelFunc,
+	}
+
+	s.peerId = torrent.GeneratePeerId()
+
+	if !config.DisableDHT {
+		dhtConfig := config.DHT
+
+		if dhtConfig.Address == "" {
+			dhtConfig.Address = defaultDHTAddress
+		}
+
+		if len(dhtConfig.BootstrapNodes) == 0 {
+			dhtConfig.BootstrapNodes = dht.DefaultBootstrapNodes
+		}
+
+		if dhtConfig.Logger == nil {
+			dhtConfig.Logger = config.Logger
+		}
+
+		node, err := dht.New(dhtConfig)
+
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to start DHT node: %w", err)
+		}
+
+		s.dht = node
+	}
+
+	if config.Metrics != nil {
+		s.metrics = torrent.NewMetrics(config.Metrics)
+		s.registerMetrics(config.Metrics)
+	}
+
+	s.wg.Add(2)
+	go s.acceptConnections(s.listener)
+	go s.maintainTorrents()
+
+	return s, nil
+}
+
+// Returns the address peers connect to.
+func (s *Session) ListenAddr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Returns the directory torrents are downloaded to, unless set in their options.
+func (s *Session) DownloadDir() string {
+	return s.config.DownloadDir
+}
+
+func (s *Session) PeerId() [20]byte {
+	return s.peerId
+}
+
+// Subscribes to the events of every torrent in the session. A buffer size of 0 or less uses the default size (256 events).
+func (s *Session) Subscribe(bufferSize int) *torrent.Subscription {
+	return s.events.Subscribe(bufferSize)
+}
+
+/*
+Adds a torrent to the session and starts it, unless `options.Paused` is set.
+
+The source is a path to a ".torrent" file, an HTTP URL or a magnet link. Returns `ErrTorrentExists` along with the torrent that was
+already added if the torrent's info hash is taken.
+*/
+func (s *Session) AddTorrent(src string, options TorrentOptions) (*torrent.Torrent, error) {
+	trrnt, err := torrent.NewTorrent(src)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t := &trrnt
+
+	if options.OutputDir == "" {
+		options.OutputDir = s.config.DownloadDir
+	}
+
+	if options.Seeding == nil {
+		options.Seeding = &s.config.Seeding
+	}
+
+	history, err := s.loadTransferHistory(t.InfoHash())
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.AddTrackers(options.Trackers); err != nil && !errors.Is(err, torrent.ErrPrivateTorrent) {
+		return nil, err
+	}
+
+	t.SetOutputDir(options.OutputDir)
+	t.SetAnnounceToAllTiers(options.AnnounceToAllTiers)
+	t.SetPeerId(s.peerId)
+	t.SetListenPort(uint16(s.listener.Addr().(*net.TCPAddr).Port))
+	t.SetMaxPeerConnections(s.config.MaxConnectionsPerTorrent)
+	t.UseConnectionLimiter(s.connectionLimiter)
+	t.UseRateLimiters(s.downloadLimiter, s.uploadLimiter)
+	t.UseEventBus(s.events)
+	t.UseMetrics(s.metrics)
+
+	if s.config.Logger != nil {
+		t.SetLogger(s.config.Logger)
+	}
+
+	t.SetTransferHistory(history)
+	t.SetSeedingGoals(options.Seeding.SeedingGoals)
+
+	if s.dht != nil {
+		t.UseDHT(s.dht)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil, ErrSessionClosed
+	}
+
+	infoHashes := t.SwarmInfoHashes()
+
+	for _, infoHash := range infoHashes {
+		if existing, exists := s.torrentsByInfoHash[infoHash]; exists {
+			return existing, ErrTorrentExists
+		}
+	}
+
+	for _, infoHash := range infoHashes {
+		s.torrentsByInfoHash[infoHash] = t
+	}
+
+	s.torrents = append(s.torrents, t)
+	s.removeAfterSeeding[t] = options.Seeding.Remove
+
+	if options.Paused {
+		t.Pause()
+	}
+
+	t.Start()
+
+	return t, nil
+}
+
+// Returns the torrent with the info hash, which may be any of the info hashes of a hybrid torrent.
+func (s *Session) Torrent(infoHash [sha1.Size]byte) (*torrent.Torrent, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	t, ok := s.torrentsByInfoHash[infoHash]
+
+	if !ok {
+		return nil, ErrTorrentNotFound
+	}
+
+	return t, nil
+}
+
+// Returns the torrents of the session, in the order they were added.
+func (s *Session) Torrents() []*torrent.Torrent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]*torrent.Torrent{}, s.torrents...)
+}
+
+// Stops a torrent and removes it from the session. Its downloaded files and its transfer history are deleted if `deleteData` is set.
+func (s *Session) RemoveTorrent(infoHash [sha1.Size]byte, deleteData bool) error {
+	s.mutex.Lock()
+
+	t, ok := s.torrentsByInfoHash[infoHash]
+
+	if !ok {
+		s.mutex.Unlock()
+		return ErrTorrentNotFound
+	}
+
+	for _, swarmInfoHash := range t.SwarmInfoHashes() {
+		delete(s.torrentsByInfoHash, swarmInfoHash)
+	}
+
+	for index, entry := range s.torrents {
+		if entry == t {
+			s.torrents = append(s.torrents[:index], s.torrents[index+1:]...)
+			break
+		}
+	}
+
+	delete(s.removeAfterSeeding, t)
+
+	s.mutex.Unlock()
+
+	t.Stop()
+
+	// The history is kept with the data, so the torrent's totals are restored if it is added again.
+	if !deleteData {
+		return s.saveTransferHistory(t)
+	}
+
+	if err := s.deleteTransferHistory(t.InfoHash()); err != nil {
+		return err
+	}
+
+	return t.DeleteData()
+}
+
+// Pauses a torrent, see `Torrent.Pause`.
+func (s *Session) Pause(infoHash [sha1.Size]byte) error {
+	t, err := s.Torrent(infoHash)
+
+	if err != nil {
+		return err
+	}
+
+	t.Pause()
+
+	return nil
+}
+
+func (s *Session) Resume(infoHash [sha1.Size]byte) error {
+	t, err := s.Torrent(infoHash)
+
+	if err != nil {
+		return err
+	}
+
+	t.Resume()
+
+	return nil
+}
+
+// Sets the maximum rates, in bytes per second, at which data is downloaded from and uploaded to peers. A rate of 0 removes the limit.
+func (s *Session) SetRateLimits(download int, upload int) {
+	s.downloadLimiter.SetRate(download)
+	s.uploadLimiter.SetRate(upload)
+}
+
+// Returns the maximum download and upload rates, in bytes per second. A rate of 0 means there is no limit.
+func (s *Session) RateLimits() (int, int) {
+	return s.downloadLimiter.Rate(), s.uploadLimiter.Rate()
+}
+
+// Sets the maximum number of peer connections of all torrents.
+func (s *Session) SetMaxConnections(max int) {
+	s.connectionLimiter.SetMax(max)
+}
+
+func (s *Session) MaxConnections() int {
+	return s.connectionLimiter.Max()
+}
+
+/*
+Stops every torrent, notifying their trackers, and releases the session's resources.
+
+Returns the context's error if the torrents didn't stop before the context is done. The session's resources are released either way.
+*/
+func (s *Session) Close(ctx context.Context) error {
+	s.mutex.Lock()
+
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+
+	s.closed = true
+	torrents := s.torrents
+	s.torrents = nil
+	clear(s.torrentsByInfoHash)
+
+	s.mutex.Unlock()
+
+	s.cancelFunc()
+	s.listener.Close()
+
+	var wg sync.WaitGroup
+
+	for _, t := range torrents {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			t.Stop()
+
+			if err := s.saveTransferHistory(t); err != nil {
+				s.logger.Error("failed to save transfer history", logging.InfoHashKey, infoHashString(t), logging.ErrorKey, err)
+			}
+		}()
+	}
+
+	doneCh := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		s.wg.Wait()
+		close(doneCh)
+	}()
+
+	var err error
+
+	select {
+	case <-doneCh:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if s.dht != nil {
+		s.dht.Close()
+	}
+
+	return err
+}
+
+/*
+Removes the torrents that reached their seeding goal if their policy says so, and periodically saves the transfer history of every torrent.
+
+Torrents pause themselves once they reach their seeding goal, see `Torrent.SetSeedingGoals`.
+*/
+func (s *Session) maintainTorrents() {
+	defer s.wg.Done()
+
+	policyTicker := time.NewTicker(seedingPolicyInterval)
+	defer policyTicker.Stop()
+
+	saveTicker := time.NewTicker(stateSaveInterval)
+	defer saveTicker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			{
+				return
+			}
+
+		case <-policyTicker.C:
+			{
+				for _, t := range s.Torrents() {
+					s.mutex.Lock()
+					remove := s.removeAfterSeeding[t]
+					s.mutex.Unlock()
+
+					if !remove || !t.HasReachedSeedingGoal() {
+						continue
+					}
+
+					s.logger.Info("removing torrent that reached its seeding goal", logging.InfoHashKey, infoHashString(t), "name", t.Name())
+
+					if err := s.RemoveTorrent(t.InfoHash(), false); err != nil && !errors.Is(err, ErrTorrentNotFound) {
+						s.logger.Error("failed to remove torrent", logging.InfoHashKey, infoHashString(t), logging.ErrorKey, err)
+					}
+				}
+			}
+
+		case <-saveTicker.C:
+			{
+				for _, t := range s.Torrents() {
+					if err := s.saveTransferHistory(t); err != nil {
+						s.logger.Error("failed to save transfer history", logging.InfoHashKey, infoHashString(t), logging.ErrorKey, err)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Accepts connections from peers and hands them to the torrent they want, until the listener is closed.
+func (s *Session) acceptConnections(listener net.Listener) {
+	defer s.wg.Done()
+
+	var retryDelay time.Duration
+
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			if s.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			// Errors such as running out of file descriptors are temporary, so wait before trying again instead of spinning.
+			retryDelay = min(max(2*retryDelay, minAcceptRetryDelay), maxAcceptRetryDelay)
+			s.logger.Warn("failed to accept incoming peer connection", logging.ErrorKey, err, "retryDelay", retryDelay)
+
+			select {
+			case <-s.ctx.Done():
+				{
+					return
+				}
+
+			case <-time.After(retryDelay):
+			}
+
+			continue
+		}
+
+		retryDelay = 0
+		go s.handleConnection(conn)
+	}
+}
+
+// Hands an incoming connection to the torrent the peer wants. The connection is closed if there is no such torrent.
+func (s *Session) handleConnection(conn net.Conn) {
+	infoHash, replayConn, err := torrent.ReadHandshakeInfoHash(conn)
+
+	if err != nil {
+		s.metrics.HandshakeFailed(err)
+		return
+	}
+
+	t, err := s.Torrent(infoHash)
+
+	if err != nil {
+		s.metrics.HandshakeFailed(torrent.ErrUnknownInfoHash)
+		replayConn.Close()
+		return
+	}
+
+	t.HandleIncomingConnection(replayConn)
+}
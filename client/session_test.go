@@ -0,0 +1,474 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/MlkMahmud/hail/bencode"
+	"github.com/MlkMahmud/hail/client"
+	"github.com/MlkMahmud/hail/metrics"
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+const testPieceLength = 16 * 1024
+
+// Writes the ".torrent" file of a single file torrent and returns its path.
+func writeTorrentFile(t *testing.T, name string) string {
+	t.Helper()
+
+	data := bytes.Repeat([]byte(name), testPieceLength/len(name)+1)
+
+	return writeMetainfo(t, name, data, map[string]any{"announce": "http://127.0.0.1:1/announce"})
+}
+
+// Writes the ".torrent" file of a single file torrent that is downloaded from a web seed, and returns its path and data.
+func writeWebSeedTorrentFile(t *testing.T, name string) (string, []byte) {
+	t.Helper()
+
+	data := bytes.Repeat([]byte(name), 2*testPieceLength/len(name))
+	srcDir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(srcDir, name), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(srcDir)))
+	t.Cleanup(server.Close)
+
+	return writeMetainfo(t, name, data, map[string]any{"url-list": server.URL + "/"}), data
+}
+
+func writeMetainfo(t *testing.T, name string, data []byte, metainfo map[string]any) string {
+	t.Helper()
+
+	pieces := strings.Builder{}
+
+	for offset := 0; offset < len(data); offset += testPieceLength {
+		hash := sha1.Sum(data[offset:min(offset+testPieceLength, len(data))])
+		pieces.Write(hash[:])
+	}
+
+	metainfo["info"] = map[string]any{
+		"length":       len(data),
+		"name":         name,
+		"piece length": testPieceLength,
+		"pieces":       pieces.String(),
+	}
+
+	encoded, err := bencode.EncodeValue(metainfo)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), name+".torrent")
+
+	if err := os.WriteFile(path, []byte(encoded), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func newTestSession(t *testing.T) *client.Session {
+	t.Helper()
+
+	return newTestSessionWithConfig(t, client.Config{})
+}
+
+func newTestSessionWithConfig(t *testing.T, config client.Config) *client.Session {
+	t.Helper()
+
+	config.DownloadDir = t.TempDir()
+	config.ListenAddress = "127.0.0.1:0"
+	config.DisableDHT = true
+
+	session, err := client.NewSession(config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		session.Close(ctx)
+	})
+
+	return session
+}
+
+// Sends a handshake for the info hash to the session and returns the handshake it responds with.
+func handshake(t *testing.T, address net.Addr, infoHash [20]byte) ([]byte, error) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", address.String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	message := append([]byte{19}, "BitTorrent protocol"...)
+	message = append(message, make([]byte, 8)...)
+	message = append(message, infoHash[:]...)
+	message = append(message, "-TS0001-000000000000"...)
+
+	if _, err := conn.Write(message); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response := make([]byte, len(message))
+
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func TestSessionManagesTorrents(t *testing.T) {
+	session := newTestSession(t)
+	first, err := session.AddTorrent(writeTorrentFile(t, "first"), client.TorrentOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := session.AddTorrent(writeTorrentFile(t, "second"), client.TorrentOptions{Paused: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.AddTorrent(writeTorrentFile(t, "first"), client.TorrentOptions{}); !errors.Is(err, client.ErrTorrentExists) {
+		t.Fatalf("expected adding a torrent twice to fail with '%v', but got '%v'", client.ErrTorrentExists, err)
+	}
+
+	if torrents := session.Torrents(); len(torrents) != 2 || torrents[0] != first || torrents[1] != second {
+		t.Fatalf("expected the session's torrents to be [first second], but got %v", torrents)
+	}
+
+	if !second.IsPaused() {
+		t.Fatal("expected torrent added with the 'Paused' option to be paused")
+	}
+
+	if err := session.Resume(second.InfoHash()); err != nil {
+		t.Fatal(err)
+	}
+
+	if second.IsPaused() {
+		t.Fatal("expected resumed torrent not to be paused")
+	}
+
+	if err := session.Pause(first.InfoHash()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !first.IsPaused() {
+		t.Fatal("expected paused torrent to be paused")
+	}
+
+	if err := session.RemoveTorrent(first.InfoHash(), true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := session.Pause(first.InfoHash()); !errors.Is(err, client.ErrTorrentNotFound) {
+		t.Fatalf("expected pausing a removed torrent to fail with '%v', but got '%v'", client.ErrTorrentNotFound, err)
+	}
+
+	if torrents := session.Torrents(); len(torrents) != 1 || torrents[0] != second {
+		t.Fatalf("expected the session's torrents to be [second], but got %v", torrents)
+	}
+}
+
+func TestSessionRoutesIncomingConnections(t *testing.T) {
+	session := newTestSession(t)
+	trrnt, err := session.AddTorrent(writeTorrentFile(t, "routed"), client.TorrentOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infoHash := trrnt.InfoHash()
+	response, err := handshake(t, session.ListenAddr(), infoHash)
+
+	if err != nil {
+		t.Fatalf("expected the session to respond to a handshake for one of its torrents, but got '%v'", err)
+	}
+
+	peerId := session.PeerId()
+
+	if !bytes.Equal(response[28:48], infoHash[:]) || !bytes.Equal(response[48:], peerId[:]) {
+		t.Fatalf("expected handshake with the torrent's info hash and the session's peer id, but got %q", response)
+	}
+
+	if _, err := handshake(t, session.ListenAddr(), [20]byte{1}); err == nil {
+		t.Fatal("expected connections for unknown torrents to be closed")
+	}
+
+	conn, err := net.Dial("tcp", session.ListenAddr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	// As long as the beginning of a handshake, so the session has read everything when it closes the connection.
+	if _, err := conn.Write(bytes.Repeat([]byte{'x'}, 48)); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected connections with invalid handshakes to be closed, but got '%v'", err)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	session := newTestSession(t)
+
+	if _, err := session.AddTorrent(writeTorrentFile(t, "closed"), client.TorrentOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := session.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.AddTorrent(writeTorrentFile(t, "other"), client.TorrentOptions{}); !errors.Is(err, client.ErrSessionClosed) {
+		t.Fatalf("expected adding a torrent to a closed session to fail with '%v', but got '%v'", client.ErrSessionClosed, err)
+	}
+
+	if _, err := net.Dial("tcp", session.ListenAddr().String()); err == nil {
+		t.Fatal("expected the session to stop listening once closed")
+	}
+}
+
+// A listener whose first `failures` calls to `Accept` fail with a temporary error, and every later call as if it was closed.
+type failingListener struct {
+	net.Listener
+	failures int
+	accepts  []time.Time
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.accepts = append(l.accepts, time.Now())
+
+	if len(l.accepts) <= l.failures {
+		return nil, syscall.EMFILE
+	}
+
+	return nil, net.ErrClosed
+}
+
+func TestSessionRetriesFailedAccepts(t *testing.T) {
+	session := newTestSession(t)
+	listener := &failingListener{failures: 3}
+	doneCh := make(chan struct{})
+
+	go func() {
+		session.AcceptConnections(listener)
+		close(doneCh)
+	}()
+
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the session to stop accepting connections once the listener is closed")
+	}
+
+	if len(listener.accepts) != listener.failures+1 {
+		t.Fatalf("expected %d calls to 'Accept', but got %d", listener.failures+1, len(listener.accepts))
+	}
+
+	for index := 1; index < len(listener.accepts); index++ {
+		if delay := listener.accepts[index].Sub(listener.accepts[index-1]); delay < time.Millisecond {
+			t.Fatalf("expected the session to wait before accepting again after a failure, but it waited %v", delay)
+		}
+	}
+}
+
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionPersistsTransferHistory(t *testing.T) {
+	stateDir := t.TempDir()
+	path, data := writeWebSeedTorrentFile(t, "history")
+	session := newTestSessionWithConfig(t, client.Config{StateDir: stateDir})
+	trrnt, err := session.AddTorrent(path, client.TorrentOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the torrent to be seeding", trrnt.IsSeeding)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := session.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newTestSessionWithConfig(t, client.Config{StateDir: stateDir})
+	trrnt, err = restarted.AddTorrent(path, client.TorrentOptions{Paused: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if history := trrnt.TransferHistory(); history.Downloaded != int64(len(data)) || history.SeedingTime <= 0 {
+		t.Fatalf("expected the transfer history of the previous session to be restored, but got %+v", history)
+	}
+}
+
+func TestSessionKeepsTransferHistoryOfRemovedTorrents(t *testing.T) {
+	path, data := writeWebSeedTorrentFile(t, "removed")
+	session := newTestSessionWithConfig(t, client.Config{StateDir: t.TempDir()})
+	trrnt, err := session.AddTorrent(path, client.TorrentOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the torrent to be seeding", trrnt.IsSeeding)
+
+	for _, deleteData := range []bool{false, true} {
+		if err := session.RemoveTorrent(trrnt.InfoHash(), deleteData); err != nil {
+			t.Fatal(err)
+		}
+
+		if trrnt, err = session.AddTorrent(path, client.TorrentOptions{Paused: true}); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := int64(len(data))
+
+		// The history is only deleted along with the data.
+		if deleteData {
+			expected = 0
+		}
+
+		if history := trrnt.TransferHistory(); history.Downloaded != expected {
+			t.Fatalf("expected %d bytes downloaded after removing the torrent (deleteData: %v), but got %d", expected, deleteData, history.Downloaded)
+		}
+	}
+}
+
+func TestSessionRemovesTorrentsAfterSeedingGoal(t *testing.T) {
+	path, _ := writeWebSeedTorrentFile(t, "goal")
+	session := newTestSession(t)
+
+	trrnt, err := session.AddTorrent(path, client.TorrentOptions{
+		Seeding: &client.SeedingPolicy{SeedingGoals: torrent.SeedingGoals{SeedTime: time.Nanosecond}, Remove: true},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the torrent to be removed", func() bool { return len(session.Torrents()) == 0 })
+
+	if !trrnt.HasReachedSeedingGoal() {
+		t.Fatal("expected removed torrent to have reached its seeding goal")
+	}
+}
+
+func TestSessionMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	session := newTestSessionWithConfig(t, client.Config{Metrics: registry})
+	path, data := writeWebSeedTorrentFile(t, "metrics")
+	trrnt, err := session.AddTorrent(path, client.TorrentOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the torrent to be seeding", trrnt.IsSeeding)
+
+	if _, err := handshake(t, session.ListenAddr(), [20]byte{1}); err == nil {
+		t.Fatal("expected the handshake for an unknown torrent to be rejected")
+	}
+
+	// Announce URLs of private trackers contain the user's passkey.
+	privatePath := writeMetainfo(t, "private", []byte("private"), map[string]any{"announce": "http://127.0.0.1:1/secret-passkey/announce?passkey=secret-passkey"})
+
+	if _, err := session.AddTorrent(privatePath, client.TorrentOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(registry.Handler())
+	defer server.Close()
+
+	infoHash := trrnt.InfoHash()
+	expected := []string{
+		fmt.Sprintf("hail_torrent_downloaded_bytes_total{info_hash=\"%x\"} %d\n", infoHash, len(data)),
+		fmt.Sprintf("hail_torrent_info{info_hash=\"%x\",name=\"metrics\"} 1\n", infoHash),
+		"hail_peer_handshake_failures_total{reason=\"unknown_info_hash\"} 1\n",
+		"hail_piece_verification_duration_seconds_count 2\n",
+		"hail_disk_write_duration_seconds_count 2\n",
+		"hail_tracker_announce_failures_total{tracker=\"http://127.0.0.1:1\"} ",
+		"hail_goroutines ",
+	}
+
+	waitFor(t, "the metrics to be recorded", func() bool {
+		res, err := http.Get(server.URL)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Contains(string(body), "secret-passkey") {
+			t.Fatal("expected announce URLs not to be exposed by the metrics")
+		}
+
+		for _, line := range expected {
+			if !strings.Contains(string(body), line) {
+				return false
+			}
+		}
+
+		return true
+	})
+}
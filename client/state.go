@@ -0,0 +1,94 @@
+package client
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+// Returns the path of the file the transfer history of a torrent is saved to, or an empty string if the session doesn't save it.
+func (s *Session) transferHistoryPath(infoHash [sha1.Size]byte) string {
+	if s.config.StateDir == "" {
+		return ""
+	}
+
+	return filepath.Join(s.config.StateDir, hex.EncodeToString(infoHash[:])+".json")
+}
+
+// Returns the info hash of a torrent as hex, as it is shown in logs.
+func infoHashString(t *torrent.Torrent) string {
+	infoHash := t.InfoHash()
+
+	return hex.EncodeToString(infoHash[:])
+}
+
+// Loads the saved transfer history of a torrent. Returns an empty history if none was saved.
+func (s *Session) loadTransferHistory(infoHash [sha1.Size]byte) (torrent.TransferHistory, error) {
+	var history torrent.TransferHistory
+
+	path := s.transferHistoryPath(infoHash)
+
+	if path == "" {
+		return history, nil
+	}
+
+	content, err := os.ReadFile(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return history, nil
+	}
+
+	if err != nil {
+		return history, fmt.Errorf("failed to load transfer history: %w", err)
+	}
+
+	if err := json.Unmarshal(content, &history); err != nil {
+		return history, fmt.Errorf("failed to parse transfer history file '%s': %w", path, err)
+	}
+
+	return history, nil
+}
+
+func (s *Session) saveTransferHistory(t *torrent.Torrent) error {
+	path := s.transferHistoryPath(t.InfoHash())
+
+	if path == "" {
+		return nil
+	}
+
+	content, err := json.Marshal(t.TransferHistory())
+
+	if err != nil {
+		return fmt.Errorf("failed to encode transfer history: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to save transfer history: %w", err)
+	}
+
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("failed to save transfer history: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Session) deleteTransferHistory(infoHash [sha1.Size]byte) error {
+	path := s.transferHistoryPath(infoHash)
+
+	if path == "" {
+		return nil
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete transfer history: %w", err)
+	}
+
+	return nil
+}
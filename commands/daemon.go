@@ -0,0 +1,70 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/MlkMahmud/hail/client"
+	"github.com/MlkMahmud/hail/daemon"
+	"github.com/MlkMahmud/hail/metrics"
+	"github.com/urfave/cli/v2"
+)
+
+func HandleDaemonCommand(ctx *cli.Context) error {
+	sessionConfig := client.Config{
+		DownloadDir:       ctx.String("out_path"),
+		ListenAddress:     ctx.String("listen"),
+		MaxConnections:    ctx.Int("max-connections"),
+		DownloadRateLimit: ctx.Int("download-rate"),
+		UploadRateLimit:   ctx.Int("upload-rate"),
+		DisableDHT:        ctx.Bool("no-dht"),
+		DHT:               newDHTConfig(ctx.StringSlice("dht-bootstrap-node")),
+		Logger:            slog.Default(),
+	}
+
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		sessionConfig.StateDir = filepath.Join(cacheDir, "hail", "torrents")
+	}
+
+	if ctx.Bool("metrics") {
+		sessionConfig.Metrics = metrics.NewRegistry()
+	}
+
+	session, err := client.NewSession(sessionConfig)
+
+	if err != nil {
+		return err
+	}
+
+	d, err := daemon.New(daemon.Config{
+		Address: ctx.String("api"),
+		Token:   ctx.String("token"),
+		Session: session,
+		Logger:  slog.Default(),
+		Metrics: sessionConfig.Metrics,
+	})
+
+	if err != nil {
+		session.Close(context.Background())
+		return err
+	}
+
+	slog.Info("daemon listening", "api", fmt.Sprintf("http://%s/api/v1", d.Addr()), "peers", session.ListenAddr().String())
+
+	signalCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	<-signalCtx.Done()
+	slog.Info("shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	return errors.Join(d.Close(shutdownCtx), session.Close(shutdownCtx))
+}
@@ -1,20 +1,195 @@
 package commands
 
 import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/MlkMahmud/hail/client"
+	"github.com/MlkMahmud/hail/dht"
+	"github.com/MlkMahmud/hail/downloader"
+	"github.com/MlkMahmud/hail/logging"
+	"github.com/MlkMahmud/hail/metrics"
 	"github.com/MlkMahmud/hail/torrent"
 	"github.com/urfave/cli/v2"
 )
 
+// Maximum amount of time spent stopping the session's torrents once we are interrupted.
+const shutdownTimeout = 10 * time.Second
+
 func HandleDownloadCommand(ctx *cli.Context) error {
-	src := ctx.Args().First()
+	if ctx.NArg() == 0 {
+		return fmt.Errorf("at least one torrent is required")
+	}
+
+	sessionConfig := client.Config{
+		DownloadDir:   ctx.String("out_path"),
+		ListenAddress: ":6881",
+		DisableDHT:    ctx.Bool("no-dht"),
+		DHT:           newDHTConfig(ctx.StringSlice("dht-bootstrap-node")),
+		Seeding: client.SeedingPolicy{
+			SeedingGoals: torrent.SeedingGoals{
+				Ratio:    ctx.Float64("seed-ratio"),
+				SeedTime: ctx.Duration("seed-time"),
+				IdleTime: ctx.Duration("seed-idle-time"),
+			},
+			Remove: ctx.Bool("remove-after-seeding"),
+		},
+		Logger: slog.Default(),
+	}
+
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		sessionConfig.StateDir = filepath.Join(cacheDir, "hail", "torrents")
+	}
+
+	if ctx.IsSet("metrics-addr") {
+		sessionConfig.Metrics = metrics.NewRegistry()
+	}
+
+	session, err := client.NewSession(sessionConfig)
+
+	if err != nil {
+		return err
+	}
 
-	trrnt, err := torrent.NewTorrent(src)
+	queueConfig := downloader.Config{
+		MaxActiveDownloads: ctx.Int("max-active-downloads"),
+		MaxActiveSeeds:     ctx.Int("max-active-seeds"),
+		StallTimeout:       ctx.Duration("stall-timeout"),
+		Logger:             slog.Default(),
+	}
+
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		queueConfig.QueuePath = filepath.Join(cacheDir, "hail", "queue.json")
+	}
+
+	queue, err := downloader.NewDownloadManager(queueConfig)
 
 	if err != nil {
+		session.Close(context.Background())
 		return err
 	}
 
-	trrnt.Start()
+	if sessionConfig.Metrics != nil {
+		registerQueueMetrics(sessionConfig.Metrics, queue)
+		metricsServer, err := startMetricsServer(ctx.String("metrics-addr"), sessionConfig.Metrics)
+
+		if err != nil {
+			session.Close(context.Background())
+			return err
+		}
+
+		defer metricsServer.Close()
+	}
+
+	// Torrents are added paused, the queue starts them.
+	for _, src := range ctx.Args().Slice() {
+		trrnt, err := session.AddTorrent(src, client.TorrentOptions{
+			Trackers:           ctx.StringSlice("tracker"),
+			AnnounceToAllTiers: ctx.Bool("announce-to-all-tiers"),
+			Paused:             true,
+		})
+
+		if err != nil {
+			session.Close(context.Background())
+			return fmt.Errorf("failed to add torrent '%s': %w", src, err)
+		}
+
+		if trrnt.IsPrivate() {
+			slog.Info("torrent is private: extra trackers are ignored and peers are only requested from its trackers", "name", trrnt.Name())
+		}
+
+		if err := queue.Add(trrnt); err != nil {
+			slog.Warn("failed to queue torrent", "name", trrnt.Name(), logging.ErrorKey, err)
+		}
+	}
+
+	queue.Start()
+
+	signalCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	display := newProgressDisplay(os.Stdout, ctx.Bool("quiet"), ctx.Bool("json-progress"), ctx.Bool("full-screen"))
+	showProgress(signalCtx, display, session, queue)
+
+	queue.Stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	return session.Close(shutdownCtx)
+}
+
+// Updates the progress display until the context is done.
+func showProgress(ctx context.Context, display *progressDisplay, session *client.Session, queue *downloader.DownloadManager) {
+	interval := display.interval()
+
+	if interval == 0 {
+		<-ctx.Done()
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	display.start()
+	defer display.stop()
+
+	for {
+		display.update(progressEntries(session, queue), time.Now())
+
+		select {
+		case <-ctx.Done():
+			{
+				return
+			}
+
+		case <-ticker.C:
+		}
+	}
+}
+
+// Returns the torrents of the session in queue order, along with their queue state and stats.
+func progressEntries(session *client.Session, queue *downloader.DownloadManager) []progressEntry {
+	entries := []progressEntry{}
+
+	for _, queueEntry := range queue.Queue() {
+		trrnt, err := session.Torrent(queueEntry.Torrent.InfoHash())
+
+		// Torrents removed after reaching their seeding goal.
+		if err != nil {
+			continue
+		}
+
+		entries = append(entries, progressEntry{
+			name:     trrnt.Name(),
+			infoHash: trrnt.InfoHash(),
+			state:    queueEntry.State,
+			stats:    trrnt.Stats(),
+		})
+	}
+
+	return entries
+}
+
+func newDHTConfig(bootstrapNodes []string) dht.Config {
+	if len(bootstrapNodes) == 0 {
+		bootstrapNodes = dht.DefaultBootstrapNodes
+	}
+
+	config := dht.Config{
+		Address:        ":6881",
+		BootstrapNodes: bootstrapNodes,
+	}
+
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		config.RoutingTablePath = filepath.Join(cacheDir, "hail", "dht.json")
+	}
 
-	return nil
+	return config
 }
@@ -0,0 +1,18 @@
+package commands
+
+import (
+	"io"
+	"time"
+
+	"github.com/MlkMahmud/hail/downloader"
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+var FormatBytes = formatBytes
+var FormatProgressBar = formatProgressBar
+
+// Writes the "--json-progress" line of a torrent.
+func WriteJSONProgress(w io.Writer, name string, state downloader.QueueState, stats torrent.Stats, now time.Time) {
+	display := &progressDisplay{out: w, mode: progressJSON}
+	display.update([]progressEntry{{name: name, state: state, stats: stats}}, now)
+}
@@ -0,0 +1,37 @@
+package commands
+
+import (
+	"log/slog"
+
+	"github.com/MlkMahmud/hail/logging"
+	"github.com/urfave/cli/v2"
+)
+
+// Creates the logger configured by the global logging flags, and makes it the default logger of every command.
+func SetupLogging(ctx *cli.Context) error {
+	level, err := logging.ParseLevel(ctx.String("log-level"))
+
+	if err != nil {
+		return err
+	}
+
+	componentLevels, err := logging.ParseComponentLevels(ctx.StringSlice("log-component-level"))
+
+	if err != nil {
+		return err
+	}
+
+	logger, err := logging.NewLogger(logging.Config{
+		Level:           level,
+		ComponentLevels: componentLevels,
+		Format:          ctx.String("log-format"),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	slog.SetDefault(logger)
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/MlkMahmud/hail/downloader"
+	"github.com/MlkMahmud/hail/logging"
+	"github.com/MlkMahmud/hail/metrics"
+)
+
+// Serves the registry's metrics on "http://<address>/metrics" until the returned server is closed.
+func startMetricsServer(address string, registry *metrics.Registry) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on metrics address: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", registry.Handler())
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("failed to serve metrics", logging.ErrorKey, err)
+		}
+	}()
+
+	slog.Info("serving metrics", "url", fmt.Sprintf("http://%s/metrics", listener.Addr()))
+
+	return server, nil
+}
+
+// Registers the number of torrents of the download queue in every state.
+func registerQueueMetrics(registry *metrics.Registry, queue *downloader.DownloadManager) {
+	states := []downloader.QueueState{downloader.Queued, downloader.Downloading, downloader.Stalled, downloader.Seeding, downloader.Completed}
+
+	registry.NewGaugeFunc("hail_queue_torrents", "Number of torrents of the download queue, by state.", []string{"state"}, func() []metrics.Sample {
+		counts := make(map[downloader.QueueState]int)
+
+		for _, entry := range queue.Queue() {
+			counts[entry.State] += 1
+		}
+
+		samples := []metrics.Sample{}
+
+		for _, state := range states {
+			samples = append(samples, metrics.Sample{LabelValues: []string{state.String()}, Value: float64(counts[state])})
+		}
+
+		return samples
+	})
+}
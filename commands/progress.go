@@ -0,0 +1,358 @@
+package commands
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/MlkMahmud/hail/downloader"
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+type progressMode int
+
+// A torrent shown by the progress display, in queue order.
+type progressEntry struct {
+	name     string
+	infoHash [20]byte
+	state    downloader.QueueState
+	stats    torrent.Stats
+}
+
+/*
+Shows the progress of the torrents of the download command.
+
+Progress bars are redrawn in place on terminals. When the output isn't a terminal, the progress is printed
+as plain lines instead, at a slower pace, so logs of scripts stay readable.
+*/
+type progressDisplay struct {
+	out  io.Writer
+	mode progressMode
+	// Number of lines drawn by the previous update, which are overwritten by the next one.
+	numOfLines int
+}
+
+// A line of the "--json-progress" output, describing the progress of a single torrent.
+type progressRecord struct {
+	Time         time.Time `json:"time"`
+	InfoHash     string    `json:"infoHash"`
+	Name         string    `json:"name"`
+	State        string    `json:"state"`
+	Progress     float64   `json:"progress"`
+	Downloaded   int64     `json:"downloaded"`
+	Uploaded     int64     `json:"uploaded"`
+	DownloadRate float64   `json:"downloadRate"`
+	UploadRate   float64   `json:"uploadRate"`
+	// Estimated number of seconds until the download completes, -1 if unknown.
+	ETA   float64 `json:"eta"`
+	Peers int     `json:"peers"`
+}
+
+const (
+	// Nothing is shown.
+	progressQuiet progressMode = iota
+	// A progress bar per torrent, redrawn in place.
+	progressBars
+	// The progress bars, followed by the peers and files of every torrent. Uses the terminal's alternate screen.
+	progressFullScreen
+	// A line of progress per torrent, for outputs that aren't terminals.
+	progressPlain
+	// A JSON object per torrent and per update.
+	progressJSON
+)
+
+const (
+	progressBarWidth  = 30
+	maxNameLength     = 32
+	maxListedPeers    = 10
+	maxListedFiles    = 10
+	progressInterval  = time.Second
+	plainModeInterval = 10 * time.Second
+)
+
+// ANSI escape sequences used to draw on terminals.
+const (
+	clearLine       = "\x1b[2K"
+	clearScreen     = "\x1b[H\x1b[2J"
+	enterAltScreen  = "\x1b[?1049h\x1b[?25l"
+	leaveAltScreen  = "\x1b[?25h\x1b[?1049l"
+	moveCursorUpFmt = "\x1b[%dA"
+	carriageReturn  = "\r"
+)
+
+// Picks the mode of the display from the command's flags. Terminal modes fall back to plain lines when stdout isn't a terminal.
+func newProgressDisplay(out *os.File, quiet bool, jsonProgress bool, fullScreen bool) *progressDisplay {
+	mode := progressBars
+
+	switch {
+	case quiet:
+		{
+			mode = progressQuiet
+		}
+
+	case jsonProgress:
+		{
+			mode = progressJSON
+		}
+
+	case !isTerminal(out):
+		{
+			mode = progressPlain
+		}
+
+	case fullScreen:
+		{
+			mode = progressFullScreen
+		}
+	}
+
+	return &progressDisplay{out: out, mode: mode}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Returns the interval between updates of the display, or 0 if nothing is shown.
+func (d *progressDisplay) interval() time.Duration {
+	switch d.mode {
+	case progressQuiet:
+		return 0
+	case progressPlain:
+		return plainModeInterval
+	default:
+		return progressInterval
+	}
+}
+
+func (d *progressDisplay) start() {
+	if d.mode == progressFullScreen {
+		fmt.Fprint(d.out, enterAltScreen)
+	}
+}
+
+// Restores the terminal. The last progress bars are kept on screen.
+func (d *progressDisplay) stop() {
+	if d.mode == progressFullScreen {
+		fmt.Fprint(d.out, leaveAltScreen)
+	}
+}
+
+func (d *progressDisplay) update(entries []progressEntry, now time.Time) {
+	switch d.mode {
+	case progressJSON:
+		{
+			encoder := json.NewEncoder(d.out)
+
+			for _, entry := range entries {
+				encoder.Encode(newProgressRecord(entry, now))
+			}
+		}
+
+	case progressPlain:
+		{
+			for _, entry := range entries {
+				fmt.Fprintln(d.out, formatProgressLine(entry))
+			}
+		}
+
+	case progressBars:
+		{
+			frame := strings.Builder{}
+
+			if d.numOfLines > 0 {
+				fmt.Fprintf(&frame, moveCursorUpFmt, d.numOfLines)
+			}
+
+			for _, entry := range entries {
+				frame.WriteString(carriageReturn + clearLine + formatProgressLine(entry) + "\n")
+			}
+
+			d.numOfLines = len(entries)
+			io.WriteString(d.out, frame.String())
+		}
+
+	case progressFullScreen:
+		{
+			io.WriteString(d.out, clearScreen+formatFullScreen(entries))
+		}
+	}
+}
+
+func newProgressRecord(entry progressEntry, now time.Time) progressRecord {
+	eta := -1.0
+
+	if entry.stats.ETA != torrent.UnknownETA {
+		eta = entry.stats.ETA.Seconds()
+	}
+
+	return progressRecord{
+		Time:         now,
+		InfoHash:     hex.EncodeToString(entry.infoHash[:]),
+		Name:         entry.name,
+		State:        entry.state.String(),
+		Progress:     progress(entry.stats),
+		Downloaded:   entry.stats.Downloaded,
+		Uploaded:     entry.stats.Uploaded,
+		DownloadRate: entry.stats.DownloadRate,
+		UploadRate:   entry.stats.UploadRate,
+		ETA:          eta,
+		Peers:        entry.stats.ConnectedPeers,
+	}
+}
+
+// Returns the fraction of the torrent's pieces that have been downloaded, between 0 and 1.
+func progress(stats torrent.Stats) float64 {
+	if stats.NumOfPieces == 0 {
+		return 0
+	}
+
+	return float64(stats.PiecesCompleted) / float64(stats.NumOfPieces)
+}
+
+// Formats a line such as "name [=======>      ]  45.2%  ↓ 1.2 MiB/s  ↑ 30.0 KiB/s  ETA 3m20s  12 peers  downloading".
+func formatProgressLine(entry progressEntry) string {
+	fraction := progress(entry.stats)
+
+	return fmt.Sprintf(
+		"%-*s %s %5.1f%%  ↓ %10s  ↑ %10s  ETA %-8s %3d peers  %s",
+		maxNameLength,
+		truncate(entry.name, maxNameLength),
+		formatProgressBar(fraction, progressBarWidth),
+		fraction*100,
+		formatRate(entry.stats.DownloadRate),
+		formatRate(entry.stats.UploadRate),
+		formatETA(entry.stats.ETA),
+		entry.stats.ConnectedPeers,
+		entry.state,
+	)
+}
+
+// Lists the peers and files of every torrent below its progress bar.
+func formatFullScreen(entries []progressEntry) string {
+	screen := strings.Builder{}
+
+	for _, entry := range entries {
+		screen.WriteString(formatProgressLine(entry) + "\n\n")
+
+		if len(entry.stats.Peers) > 0 {
+			fmt.Fprintf(&screen, "  %-22s %-20s %10s %10s  %s\n", "PEER", "CLIENT", "DOWN", "UP", "FLAGS")
+		}
+
+		for index, peer := range entry.stats.Peers {
+			if index == maxListedPeers {
+				fmt.Fprintf(&screen, "  ... and %d more peers\n", len(entry.stats.Peers)-maxListedPeers)
+				break
+			}
+
+			fmt.Fprintf(&screen, "  %-22s %-20s %10s %10s  %s\n", peer.Address, truncate(peer.Client, 20), formatRate(peer.DownloadRate), formatRate(peer.UploadRate), formatPeerFlags(peer))
+		}
+
+		if len(entry.stats.Files) > 0 {
+			fmt.Fprintf(&screen, "\n  %-50s %10s %7s\n", "FILE", "SIZE", "DONE")
+		}
+
+		for index, f := range entry.stats.Files {
+			if index == maxListedFiles {
+				fmt.Fprintf(&screen, "  ... and %d more files\n", len(entry.stats.Files)-maxListedFiles)
+				break
+			}
+
+			done := 100.0
+
+			if f.Length > 0 {
+				done = float64(f.BytesCompleted) / float64(f.Length) * 100
+			}
+
+			fmt.Fprintf(&screen, "  %-50s %10s %6.1f%%\n", truncate(f.Path, 50), formatBytes(float64(f.Length)), done)
+		}
+
+		screen.WriteString("\n")
+	}
+
+	return screen.String()
+}
+
+/*
+Formats the choke and interest flags of a peer, in the style of other clients:
+
+	d: we are interested, the peer is choking us. D: we are interested and unchoked
+	u: the peer is interested, we are choking it. U: the peer is interested and unchoked
+*/
+func formatPeerFlags(peer torrent.PeerStats) string {
+	flags := ""
+
+	switch {
+	case peer.AmInterested && peer.PeerChoking:
+		flags += "d"
+	case peer.AmInterested:
+		flags += "D"
+	}
+
+	switch {
+	case peer.PeerInterested && peer.AmChoking:
+		flags += "u"
+	case peer.PeerInterested:
+		flags += "U"
+	}
+
+	return flags
+}
+
+func formatProgressBar(fraction float64, width int) string {
+	filled := int(fraction * float64(width))
+
+	switch {
+	case filled >= width:
+		return "[" + strings.Repeat("=", width) + "]"
+	case filled == 0:
+		return "[" + strings.Repeat(" ", width) + "]"
+	default:
+		return "[" + strings.Repeat("=", filled-1) + ">" + strings.Repeat(" ", width-filled) + "]"
+	}
+}
+
+// Formats a number of bytes with binary units, e.g "1.5 MiB".
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	unit := 0
+
+	for n >= 1024 && unit < len(units)-1 {
+		n /= 1024
+		unit += 1
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d B", int(n))
+	}
+
+	return fmt.Sprintf("%.1f %s", n, units[unit])
+}
+
+func formatRate(bytesPerSecond float64) string {
+	return formatBytes(bytesPerSecond) + "/s"
+}
+
+func formatETA(eta time.Duration) string {
+	if eta == torrent.UnknownETA {
+		return "-"
+	}
+
+	return eta.Round(time.Second).String()
+}
+
+func truncate(s string, length int) string {
+	runes := []rune(s)
+
+	if len(runes) <= length {
+		return s
+	}
+
+	return string(runes[:length-1]) + "…"
+}
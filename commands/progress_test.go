@@ -0,0 +1,62 @@
+package commands_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/MlkMahmud/hail/commands"
+	"github.com/MlkMahmud/hail/downloader"
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+func TestFormatProgress(t *testing.T) {
+	bars := map[float64]string{
+		0:    "[          ]",
+		0.45: "[===>      ]",
+		1:    "[==========]",
+	}
+
+	for fraction, expected := range bars {
+		if bar := commands.FormatProgressBar(fraction, 10); bar != expected {
+			t.Fatalf("expected progress bar of %.2f to be %q, but got %q", fraction, expected, bar)
+		}
+	}
+
+	sizes := map[float64]string{
+		512:             "512 B",
+		1536:            "1.5 KiB",
+		3 * 1024 * 1024: "3.0 MiB",
+	}
+
+	for size, expected := range sizes {
+		if formatted := commands.FormatBytes(size); formatted != expected {
+			t.Fatalf("expected %.0f bytes to be formatted as %q, but got %q", size, expected, formatted)
+		}
+	}
+}
+
+func TestJSONProgress(t *testing.T) {
+	output := bytes.Buffer{}
+	stats := torrent.Stats{PiecesCompleted: 1, NumOfPieces: 4, Downloaded: 1024, DownloadRate: 512, ETA: torrent.UnknownETA, ConnectedPeers: 2}
+
+	commands.WriteJSONProgress(&output, "progress", downloader.Downloading, stats, time.Now())
+	commands.WriteJSONProgress(&output, "progress", downloader.Seeding, torrent.Stats{ETA: 0}, time.Now())
+
+	lines := bytes.Split(bytes.TrimSpace(output.Bytes()), []byte("\n"))
+
+	if len(lines) != 2 {
+		t.Fatalf("expected a JSON object per line, but got %q", output.String())
+	}
+
+	record := map[string]any{}
+
+	if err := json.Unmarshal(lines[0], &record); err != nil {
+		t.Fatal(err)
+	}
+
+	if record["name"] != "progress" || record["state"] != "downloading" || record["progress"] != 0.25 || record["eta"] != -1.0 || record["peers"] != 2.0 {
+		t.Fatalf("unexpected progress record %v", record)
+	}
+}
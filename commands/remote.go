@@ -0,0 +1,291 @@
+package commands
+
+import (
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/MlkMahmud/hail/daemon"
+	"github.com/urfave/cli/v2"
+)
+
+// Returns a client of the daemon named by the "remote" command's flags.
+func newRemoteClient(ctx *cli.Context) *daemon.Client {
+	return daemon.NewClient(ctx.String("url"), ctx.String("token"))
+}
+
+// Reports whether a torrent source is fetched by the daemon itself, rather than uploaded to it.
+func isRemoteSource(src string) bool {
+	u, err := url.Parse(src)
+
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https" || u.Scheme == "magnet")
+}
+
+func HandleRemoteAddCommand(ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		return fmt.Errorf("at least one torrent is required")
+	}
+
+	remote := newRemoteClient(ctx)
+
+	for _, src := range ctx.Args().Slice() {
+		req := daemon.AddTorrentRequest{Source: src, OutputDir: ctx.String("out_path"), Paused: ctx.Bool("paused")}
+
+		var summary daemon.TorrentSummary
+		var err error
+
+		if isRemoteSource(src) {
+			summary, err = remote.Add(ctx.Context, req)
+		} else {
+			summary, err = remote.AddFile(ctx.Context, src, req)
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to add torrent '%s': %w", src, err)
+		}
+
+		fmt.Printf("added %s %s\n", summary.InfoHash, summary.Name)
+	}
+
+	return nil
+}
+
+func HandleRemoteListCommand(ctx *cli.Context) error {
+	summaries, err := newRemoteClient(ctx).List(ctx.Context)
+
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INFO HASH\tNAME\tSTATUS\tDONE\tDOWN\tUP\tETA\tPEERS")
+
+	for _, summary := range summaries {
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%.1f%%\t%s\t%s\t%s\t%d\n",
+			summary.InfoHash,
+			truncate(summary.Name, maxNameLength),
+			remoteStatus(summary),
+			summary.Progress*100,
+			formatRate(summary.DownloadRate),
+			formatRate(summary.UploadRate),
+			formatRemoteETA(summary.ETA),
+			summary.Peers,
+		)
+	}
+
+	return w.Flush()
+}
+
+func HandleRemoteShowCommand(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return fmt.Errorf("expected the info hash of a torrent")
+	}
+
+	details, err := newRemoteClient(ctx).Get(ctx.Context, ctx.Args().First())
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Name:       %s\n", details.Name)
+	fmt.Printf("Info hash:  %s\n", details.InfoHash)
+	fmt.Printf("Status:     %s\n", remoteStatus(details.TorrentSummary))
+	fmt.Printf("Progress:   %.1f%% (%d/%d pieces)\n", details.Progress*100, details.PiecesCompleted, details.NumOfPieces)
+	fmt.Printf("Downloaded: %s (%s wasted)\n", formatBytes(float64(details.Downloaded)), formatBytes(float64(details.Wasted)))
+	fmt.Printf("Uploaded:   %s\n", formatBytes(float64(details.Uploaded)))
+	fmt.Printf("Rates:      ↓ %s  ↑ %s\n", formatRate(details.DownloadRate), formatRate(details.UploadRate))
+	fmt.Printf("Peers:      %d connected, %d known\n", details.Peers, details.KnownPeers)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "\nINDEX\tFILE\tSIZE\tDONE\tPRIORITY")
+
+	for _, f := range details.Files {
+		done := 100.0
+
+		if f.Length > 0 {
+			done = float64(f.BytesCompleted) / float64(f.Length) * 100
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%.1f%%\t%s\n", f.Index, f.Path, formatBytes(float64(f.Length)), done, f.Priority)
+	}
+
+	if len(details.Trackers) > 0 {
+		fmt.Fprintln(w, "\nTIER\tTRACKER\tSEEDERS\tLEECHERS\tERROR")
+	}
+
+	for _, tracker := range details.Trackers {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%s\n", tracker.Tier, tracker.URL, tracker.Seeders, tracker.Leechers, tracker.LastError)
+	}
+
+	if len(details.PeerList) > 0 {
+		fmt.Fprintln(w, "\nPEER\tCLIENT\tDOWN\tUP")
+	}
+
+	for _, peer := range details.PeerList {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", peer.Address, peer.Client, formatRate(peer.DownloadRate), formatRate(peer.UploadRate))
+	}
+
+	return w.Flush()
+}
+
+func HandleRemotePauseCommand(ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		return fmt.Errorf("expected the info hash of at least one torrent")
+	}
+
+	remote := newRemoteClient(ctx)
+
+	for _, infoHash := range ctx.Args().Slice() {
+		if err := remote.Pause(ctx.Context, infoHash); err != nil {
+			return fmt.Errorf("failed to pause torrent '%s': %w", infoHash, err)
+		}
+	}
+
+	return nil
+}
+
+func HandleRemoteResumeCommand(ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		return fmt.Errorf("expected the info hash of at least one torrent")
+	}
+
+	remote := newRemoteClient(ctx)
+
+	for _, infoHash := range ctx.Args().Slice() {
+		if err := remote.Resume(ctx.Context, infoHash); err != nil {
+			return fmt.Errorf("failed to resume torrent '%s': %w", infoHash, err)
+		}
+	}
+
+	return nil
+}
+
+func HandleRemoteRemoveCommand(ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		return fmt.Errorf("expected the info hash of at least one torrent")
+	}
+
+	remote := newRemoteClient(ctx)
+
+	for _, infoHash := range ctx.Args().Slice() {
+		if err := remote.Remove(ctx.Context, infoHash, ctx.Bool("delete-data")); err != nil {
+			return fmt.Errorf("failed to remove torrent '%s': %w", infoHash, err)
+		}
+	}
+
+	return nil
+}
+
+func HandleRemotePriorityCommand(ctx *cli.Context) error {
+	if ctx.NArg() < 3 {
+		return fmt.Errorf("expected the info hash of a torrent, a priority and the index of at least one file")
+	}
+
+	args := ctx.Args().Slice()
+	files := []int{}
+
+	for _, arg := range args[2:] {
+		index, err := strconv.Atoi(arg)
+
+		if err != nil {
+			return fmt.Errorf("invalid file index '%s'", arg)
+		}
+
+		files = append(files, index)
+	}
+
+	_, err := newRemoteClient(ctx).SetFilePriority(ctx.Context, args[0], args[1], files)
+
+	return err
+}
+
+// Prints the daemon's limits, after updating the ones set with flags.
+func HandleRemoteLimitsCommand(ctx *cli.Context) error {
+	remote := newRemoteClient(ctx)
+	update := daemon.LimitsUpdate{}
+
+	if ctx.IsSet("download-rate") {
+		downloadRate := ctx.Int("download-rate")
+		update.DownloadRate = &downloadRate
+	}
+
+	if ctx.IsSet("upload-rate") {
+		uploadRate := ctx.Int("upload-rate")
+		update.UploadRate = &uploadRate
+	}
+
+	if ctx.IsSet("max-connections") {
+		maxConnections := ctx.Int("max-connections")
+		update.MaxConnections = &maxConnections
+	}
+
+	var limits daemon.Limits
+	var err error
+
+	if update == (daemon.LimitsUpdate{}) {
+		limits, err = remote.Limits(ctx.Context)
+	} else {
+		limits, err = remote.SetLimits(ctx.Context, update)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Download rate:   %s\n", formatRateLimit(limits.DownloadRate))
+	fmt.Printf("Upload rate:     %s\n", formatRateLimit(limits.UploadRate))
+	fmt.Printf("Max connections: %d\n", limits.MaxConnections)
+
+	return nil
+}
+
+// Prints the events of the daemon's torrents, one line per event, until interrupted.
+func HandleRemoteEventsCommand(ctx *cli.Context) error {
+	signalCtx, stop := signal.NotifyContext(ctx.Context, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return newRemoteClient(ctx).Events(signalCtx, ctx.Args().First(), func(event daemon.Event) {
+		fields := []string{}
+
+		for _, key := range slices.Sorted(maps.Keys(event.Data)) {
+			fields = append(fields, fmt.Sprintf("%s=%v", key, event.Data[key]))
+		}
+
+		fmt.Printf("%s %s %-17s %s\n", event.Time.Format(time.TimeOnly), event.InfoHash, event.Type, strings.Join(fields, " "))
+	})
+}
+
+func remoteStatus(summary daemon.TorrentSummary) string {
+	if summary.Paused {
+		return "paused"
+	}
+
+	return summary.Status
+}
+
+func formatRemoteETA(seconds float64) string {
+	if seconds < 0 {
+		return "-"
+	}
+
+	return formatETA(time.Duration(seconds * float64(time.Second)))
+}
+
+func formatRateLimit(bytesPerSecond int) string {
+	if bytesPerSecond == 0 {
+		return "unlimited"
+	}
+
+	return formatRate(float64(bytesPerSecond))
+}
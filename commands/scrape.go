@@ -0,0 +1,44 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/MlkMahmud/hail/torrent"
+	"github.com/urfave/cli/v2"
+)
+
+func HandleScrapeCommand(ctx *cli.Context) error {
+	src := ctx.Args().First()
+
+	if src == "" {
+		return fmt.Errorf("a path to a \".torrent\" file or a magnet link is required")
+	}
+
+	trrnt, err := torrent.NewTorrent(src)
+
+	if err != nil {
+		return err
+	}
+
+	results := trrnt.Scrape()
+
+	if len(results) == 0 {
+		return fmt.Errorf("torrent does not have any trackers")
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "TRACKER\tSEEDERS\tLEECHERS\tCOMPLETED")
+
+	for _, result := range results {
+		if result.Error != nil {
+			fmt.Fprintf(writer, "%s\terror: %v\t\t\n", result.Tracker, result.Error)
+			continue
+		}
+
+		fmt.Fprintf(writer, "%s\t%d\t%d\t%d\n", result.Tracker, result.Seeders, result.Leechers, result.Completed)
+	}
+
+	return writer.Flush()
+}
@@ -0,0 +1,43 @@
+package commands
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/MlkMahmud/hail/tracker"
+	"github.com/urfave/cli/v2"
+)
+
+func HandleTrackerCommand(ctx *cli.Context) error {
+	trckr, err := tracker.New(tracker.Config{
+		AllowlistDir: ctx.String("allowlist"),
+		HTTPAddress:  ctx.String("http"),
+		Interval:     ctx.Duration("interval"),
+		PeerTimeout:  ctx.Duration("peer-timeout"),
+		UDPAddress:   ctx.String("udp"),
+		Logger:       slog.Default(),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if addr := trckr.HTTPAddr(); addr != nil {
+		slog.Info("HTTP tracker listening", "announce", fmt.Sprintf("http://%s/announce", addr), "stats", fmt.Sprintf("http://%s/stats", addr))
+	}
+
+	if addr := trckr.UDPAddr(); addr != nil {
+		slog.Info("UDP tracker listening", "announce", fmt.Sprintf("udp://%s", addr))
+	}
+
+	signalsCh := make(chan os.Signal, 1)
+	signal.Notify(signalsCh, syscall.SIGINT, syscall.SIGTERM)
+
+	<-signalsCh
+	slog.Info("shutting down")
+
+	return trckr.Close()
+}
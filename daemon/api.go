@@ -0,0 +1,497 @@
+package daemon
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/MlkMahmud/hail/client"
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+// A torrent, as listed by the API.
+type TorrentSummary struct {
+	InfoHash string `json:"infoHash"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Paused   bool   `json:"paused"`
+	// Fraction of the torrent's pieces that have been downloaded, between 0 and 1.
+	Progress     float64 `json:"progress"`
+	Downloaded   int64   `json:"downloaded"`
+	Uploaded     int64   `json:"uploaded"`
+	DownloadRate float64 `json:"downloadRate"`
+	UploadRate   float64 `json:"uploadRate"`
+	// Estimated number of seconds until the download completes, -1 if unknown.
+	ETA   float64 `json:"eta"`
+	Peers int     `json:"peers"`
+}
+
+// A torrent along with its files, peers and trackers.
+type TorrentDetails struct {
+	TorrentSummary
+	Wasted          int64 `json:"wasted"`
+	PiecesCompleted int   `json:"piecesCompleted"`
+	NumOfPieces     int   `json:"numOfPieces"`
+	KnownPeers      int   `json:"knownPeers"`
+
+	Files    []FileDetails    `json:"files"`
+	PeerList []PeerDetails    `json:"peerList"`
+	Trackers []TrackerDetails `json:"trackers"`
+}
+
+type FileDetails struct {
+	// Index of the file, used to set its priority.
+	Index          int    `json:"index"`
+	Path           string `json:"path"`
+	Length         int    `json:"length"`
+	BytesCompleted int    `json:"bytesCompleted"`
+	// "skip", "normal" or "high".
+	Priority string `json:"priority"`
+}
+
+type PeerDetails struct {
+	Address      string  `json:"address"`
+	Client       string  `json:"client"`
+	DownloadRate float64 `json:"downloadRate"`
+	UploadRate   float64 `json:"uploadRate"`
+}
+
+type TrackerDetails struct {
+	URL       string `json:"url"`
+	Tier      int    `json:"tier"`
+	LastError string `json:"lastError,omitempty"`
+	Seeders   int    `json:"seeders"`
+	Leechers  int    `json:"leechers"`
+}
+
+/*
+The body of requests adding a torrent from an HTTP URL or a magnet link.
+
+Torrent files are uploaded as the "torrent" field of a "multipart/form-data" request instead, whose "outputDir" and "paused"
+fields have the same meaning.
+*/
+type AddTorrentRequest struct {
+	Source string `json:"source"`
+	// Directory the torrent's files are downloaded to. Defaults to the session's download directory.
+	OutputDir string `json:"outputDir,omitempty"`
+	Paused    bool   `json:"paused,omitempty"`
+}
+
+// The body of requests setting the priority of some of a torrent's files.
+type SetPriorityRequest struct {
+	// Indexes of the files, see `FileDetails.Index`.
+	Files []int `json:"files"`
+	// "skip", "normal" or "high".
+	Priority string `json:"priority"`
+}
+
+// The limits of the session. Rates are in bytes per second, 0 meaning unlimited.
+type Limits struct {
+	DownloadRate   int `json:"downloadRate"`
+	UploadRate     int `json:"uploadRate"`
+	MaxConnections int `json:"maxConnections"`
+}
+
+// The body of requests updating the session's limits. The limits that aren't set are left unchanged.
+type LimitsUpdate struct {
+	DownloadRate   *int `json:"downloadRate,omitempty"`
+	UploadRate     *int `json:"uploadRate,omitempty"`
+	MaxConnections *int `json:"maxConnections,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+const (
+	// Maximum size of uploaded torrent files.
+	maxTorrentFileSize = 10 << 20
+	// Maximum size of JSON request bodies.
+	maxRequestBodySize = 1 << 20
+)
+
+func (d *Daemon) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /api/v1/torrents", d.handleListTorrents)
+	mux.HandleFunc("POST /api/v1/torrents", d.handleAddTorrent)
+	mux.HandleFunc("GET /api/v1/torrents/{infoHash}", d.handleGetTorrent)
+	mux.HandleFunc("DELETE /api/v1/torrents/{infoHash}", d.handleRemoveTorrent)
+	mux.HandleFunc("POST /api/v1/torrents/{infoHash}/pause", d.handlePauseTorrent)
+	mux.HandleFunc("POST /api/v1/torrents/{infoHash}/resume", d.handleResumeTorrent)
+	mux.HandleFunc("PUT /api/v1/torrents/{infoHash}/priority", d.handleSetPriority)
+	mux.HandleFunc("GET /api/v1/limits", d.handleGetLimits)
+	mux.HandleFunc("PUT /api/v1/limits", d.handleSetLimits)
+	mux.HandleFunc("GET /api/v1/events", d.handleEvents)
+	mux.HandleFunc("POST /transmission/rpc", d.handleTransmissionRPC)
+
+	if d.config.Metrics != nil {
+		mux.Handle("GET /metrics", d.config.Metrics.Handler())
+	}
+
+	return d.authenticate(mux)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+// Maps the errors of the session and of its torrents to HTTP status codes.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, client.ErrTorrentNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, client.ErrTorrentExists), errors.Is(err, torrent.ErrMetadataUnknown):
+		return http.StatusConflict
+	case errors.Is(err, client.ErrSessionClosed):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func parseInfoHash(value string) ([sha1.Size]byte, error) {
+	var infoHash [sha1.Size]byte
+
+	if len(value) != 2*sha1.Size {
+		return infoHash, fmt.Errorf("info hash '%s' must be %d hexadecimal characters long", value, 2*sha1.Size)
+	}
+
+	if _, err := hex.Decode(infoHash[:], []byte(value)); err != nil {
+		return infoHash, fmt.Errorf("info hash '%s' is not hexadecimal: %w", value, err)
+	}
+
+	return infoHash, nil
+}
+
+// Returns the torrent named by the request's "infoHash" path parameter. Writes an error response if there's none.
+func (d *Daemon) requestedTorrent(w http.ResponseWriter, r *http.Request) (*torrent.Torrent, bool) {
+	infoHash, err := parseInfoHash(r.PathValue("infoHash"))
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+
+	t, err := d.config.Session.Torrent(infoHash)
+
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return nil, false
+	}
+
+	return t, true
+}
+
+func newTorrentSummary(t *torrent.Torrent, stats torrent.Stats) TorrentSummary {
+	infoHash := t.InfoHash()
+	summary := TorrentSummary{
+		InfoHash:     hex.EncodeToString(infoHash[:]),
+		Name:         t.Name(),
+		Status:       stats.Status.String(),
+		Paused:       t.IsPaused(),
+		Downloaded:   stats.Downloaded,
+		Uploaded:     stats.Uploaded,
+		DownloadRate: stats.DownloadRate,
+		UploadRate:   stats.UploadRate,
+		ETA:          -1,
+		Peers:        stats.ConnectedPeers,
+	}
+
+	if stats.NumOfPieces > 0 {
+		summary.Progress = float64(stats.PiecesCompleted) / float64(stats.NumOfPieces)
+	}
+
+	if stats.ETA != torrent.UnknownETA {
+		summary.ETA = stats.ETA.Seconds()
+	}
+
+	return summary
+}
+
+func newTorrentDetails(t *torrent.Torrent) TorrentDetails {
+	stats := t.Stats()
+	details := TorrentDetails{
+		TorrentSummary:  newTorrentSummary(t, stats),
+		Wasted:          stats.Wasted,
+		PiecesCompleted: stats.PiecesCompleted,
+		NumOfPieces:     stats.NumOfPieces,
+		KnownPeers:      stats.KnownPeers,
+		Files:           []FileDetails{},
+		PeerList:        []PeerDetails{},
+		Trackers:        []TrackerDetails{},
+	}
+
+	for index, f := range stats.Files {
+		details.Files = append(details.Files, FileDetails{
+			Index:          index,
+			Path:           f.Path,
+			Length:         f.Length,
+			BytesCompleted: f.BytesCompleted,
+			Priority:       f.Priority.String(),
+		})
+	}
+
+	for _, peer := range stats.Peers {
+		details.PeerList = append(details.PeerList, PeerDetails{
+			Address:      peer.Address,
+			Client:       peer.Client,
+			DownloadRate: peer.DownloadRate,
+			UploadRate:   peer.UploadRate,
+		})
+	}
+
+	for _, tracker := range stats.Trackers {
+		details.Trackers = append(details.Trackers, TrackerDetails{
+			URL:       tracker.URL,
+			Tier:      tracker.Tier,
+			LastError: tracker.LastError,
+			Seeders:   tracker.Seeders,
+			Leechers:  tracker.Leechers,
+		})
+	}
+
+	return details
+}
+
+func (d *Daemon) handleListTorrents(w http.ResponseWriter, r *http.Request) {
+	summaries := []TorrentSummary{}
+
+	for _, t := range d.config.Session.Torrents() {
+		summaries = append(summaries, newTorrentSummary(t, t.Stats()))
+	}
+
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+func (d *Daemon) handleGetTorrent(w http.ResponseWriter, r *http.Request) {
+	t, ok := d.requestedTorrent(w, r)
+
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newTorrentDetails(t))
+}
+
+/*
+Adds a torrent from an uploaded torrent file, an HTTP URL or a magnet link.
+
+Paths on the daemon's host aren't accepted as sources, so clients can't make the daemon read arbitrary files.
+*/
+func (d *Daemon) handleAddTorrent(w http.ResponseWriter, r *http.Request) {
+	var req AddTorrentRequest
+	var source string
+	var err error
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		source, err = parseAddTorrentRequest(r, &req)
+	} else {
+		source, err = saveUploadedTorrent(w, r, &req)
+
+		if err == nil {
+			defer os.Remove(source)
+		}
+	}
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	t, err := d.config.Session.AddTorrent(source, client.TorrentOptions{OutputDir: req.OutputDir, Paused: req.Paused})
+
+	if err != nil {
+		status := errorStatus(err)
+
+		// Sources that can't be loaded, e.g invalid torrent files or unreachable URLs.
+		if status == http.StatusInternalServerError {
+			status = http.StatusBadRequest
+		}
+
+		writeError(w, status, err)
+		return
+	}
+
+	d.logger.Info("added torrent", "name", t.Name())
+	writeJSON(w, http.StatusCreated, newTorrentSummary(t, t.Stats()))
+}
+
+// Reports whether a torrent source is fetched from the network (an HTTP URL or a magnet link), rather than read from the daemon's host.
+func isRemoteSource(source string) bool {
+	u, err := url.Parse(source)
+
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https" || u.Scheme == "magnet")
+}
+
+// Decodes a JSON request body into `req` and returns the source of the torrent.
+func parseAddTorrentRequest(r *http.Request, req *AddTorrentRequest) (string, error) {
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestBodySize)).Decode(req); err != nil {
+		return "", fmt.Errorf("failed to parse request body: %w", err)
+	}
+
+	if !isRemoteSource(req.Source) {
+		return "", fmt.Errorf("source '%s' must be an HTTP URL or a magnet link, torrent files must be uploaded", req.Source)
+	}
+
+	return req.Source, nil
+}
+
+// Writes the torrent file uploaded in a multipart form to a temporary file and returns its path. The form's other fields are stored in `req`.
+func saveUploadedTorrent(w http.ResponseWriter, r *http.Request, req *AddTorrentRequest) (string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxTorrentFileSize+maxRequestBodySize)
+
+	if err := r.ParseMultipartForm(maxTorrentFileSize); err != nil {
+		return "", fmt.Errorf("expected a JSON body or a multipart form: %w", err)
+	}
+
+	req.OutputDir = r.FormValue("outputDir")
+	req.Paused, _ = strconv.ParseBool(r.FormValue("paused"))
+
+	upload, _, err := r.FormFile("torrent")
+
+	if err != nil {
+		return "", fmt.Errorf("expected the torrent file in the 'torrent' field: %w", err)
+	}
+
+	defer upload.Close()
+
+	f, err := os.CreateTemp("", "hail-*.torrent")
+
+	if err != nil {
+		return "", fmt.Errorf("failed to save uploaded torrent file: %w", err)
+	}
+
+	defer f.Close()
+
+	if _, err := io.Copy(f, upload); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to save uploaded torrent file: %w", err)
+	}
+
+	return f.Name(), nil
+}
+
+// Removes a torrent. Its files are deleted if the "deleteData" query parameter is true.
+func (d *Daemon) handleRemoveTorrent(w http.ResponseWriter, r *http.Request) {
+	t, ok := d.requestedTorrent(w, r)
+
+	if !ok {
+		return
+	}
+
+	deleteData, _ := strconv.ParseBool(r.URL.Query().Get("deleteData"))
+
+	if err := d.config.Session.RemoveTorrent(t.InfoHash(), deleteData); err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	d.logger.Info("removed torrent", "name", t.Name(), "deleteData", deleteData)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Daemon) handlePauseTorrent(w http.ResponseWriter, r *http.Request) {
+	t, ok := d.requestedTorrent(w, r)
+
+	if !ok {
+		return
+	}
+
+	t.Pause()
+	writeJSON(w, http.StatusOK, newTorrentSummary(t, t.Stats()))
+}
+
+func (d *Daemon) handleResumeTorrent(w http.ResponseWriter, r *http.Request) {
+	t, ok := d.requestedTorrent(w, r)
+
+	if !ok {
+		return
+	}
+
+	t.Resume()
+	writeJSON(w, http.StatusOK, newTorrentSummary(t, t.Stats()))
+}
+
+func (d *Daemon) handleSetPriority(w http.ResponseWriter, r *http.Request) {
+	t, ok := d.requestedTorrent(w, r)
+
+	if !ok {
+		return
+	}
+
+	var req SetPriorityRequest
+
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestBodySize)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("failed to parse request body: %w", err))
+		return
+	}
+
+	priority, err := torrent.ParseFilePriority(req.Priority)
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	for _, index := range req.Files {
+		if err := t.SetFilePriority(index, priority); err != nil {
+			status := errorStatus(err)
+
+			if status == http.StatusInternalServerError {
+				status = http.StatusBadRequest
+			}
+
+			writeError(w, status, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, newTorrentDetails(t))
+}
+
+func (d *Daemon) limits() Limits {
+	downloadRate, uploadRate := d.config.Session.RateLimits()
+
+	return Limits{DownloadRate: downloadRate, UploadRate: uploadRate, MaxConnections: d.config.Session.MaxConnections()}
+}
+
+func (d *Daemon) handleGetLimits(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.limits())
+}
+
+// Updates the limits set in the request body, see `LimitsUpdate`.
+func (d *Daemon) handleSetLimits(w http.ResponseWriter, r *http.Request) {
+	// The limits omitted from the body keep their current value.
+	limits := d.limits()
+
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestBodySize)).Decode(&limits); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("failed to parse request body: %w", err))
+		return
+	}
+
+	if limits.DownloadRate < 0 || limits.UploadRate < 0 || limits.MaxConnections <= 0 {
+		writeError(w, http.StatusBadRequest, errors.New("rates can't be negative and the maximum number of connections must be positive"))
+		return
+	}
+
+	d.config.Session.SetRateLimits(limits.DownloadRate, limits.UploadRate)
+	d.config.Session.SetMaxConnections(limits.MaxConnections)
+	d.logger.Info("updated limits", "downloadRate", limits.DownloadRate, "uploadRate", limits.UploadRate, "maxConnections", limits.MaxConnections)
+
+	writeJSON(w, http.StatusOK, limits)
+}
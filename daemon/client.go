@@ -0,0 +1,246 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A client of the daemon's API.
+type Client struct {
+	// URL of the daemon, e.g "http://127.0.0.1:9091".
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+func NewClient(baseURL string, token string) *Client {
+	return &Client{baseURL: strings.TrimSuffix(baseURL, "/"), token: token, httpClient: &http.Client{}}
+}
+
+/*
+Sends a request to the API and decodes the JSON response into `result`, unless it is nil.
+
+Error responses are returned as errors carrying the daemon's error message.
+*/
+func (c *Client) do(ctx context.Context, method string, path string, contentType string, body io.Reader, result any) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	res, err := c.httpClient.Do(req)
+
+	if err != nil {
+		return fmt.Errorf("failed to reach daemon: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		var errRes errorResponse
+
+		if err := json.NewDecoder(res.Body).Decode(&errRes); err != nil || errRes.Error == "" {
+			return fmt.Errorf("daemon responded with status '%s'", res.Status)
+		}
+
+		return fmt.Errorf("daemon responded with status '%s': %s", res.Status, errRes.Error)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+		return fmt.Errorf("failed to parse daemon response: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Client) doJSON(ctx context.Context, method string, path string, body any, result any) error {
+	encoded, err := json.Marshal(body)
+
+	if err != nil {
+		return fmt.Errorf("failed to encode request body: %w", err)
+	}
+
+	return c.do(ctx, method, path, "application/json", bytes.NewReader(encoded), result)
+}
+
+// Adds a torrent from an HTTP URL or a magnet link.
+func (c *Client) Add(ctx context.Context, req AddTorrentRequest) (TorrentSummary, error) {
+	var summary TorrentSummary
+
+	err := c.doJSON(ctx, http.MethodPost, "/api/v1/torrents", req, &summary)
+
+	return summary, err
+}
+
+// Uploads a torrent file to the daemon and adds it. `req.Source` is ignored.
+func (c *Client) AddFile(ctx context.Context, path string, req AddTorrentRequest) (TorrentSummary, error) {
+	var summary TorrentSummary
+
+	content, err := os.ReadFile(path)
+
+	if err != nil {
+		return summary, fmt.Errorf("failed to read torrent file: %w", err)
+	}
+
+	body := bytes.Buffer{}
+	form := multipart.NewWriter(&body)
+
+	part, err := form.CreateFormFile("torrent", filepath.Base(path))
+
+	if err == nil {
+		_, err = part.Write(content)
+	}
+
+	if err == nil && req.OutputDir != "" {
+		err = form.WriteField("outputDir", req.OutputDir)
+	}
+
+	if err == nil {
+		err = form.WriteField("paused", strconv.FormatBool(req.Paused))
+	}
+
+	if err == nil {
+		err = form.Close()
+	}
+
+	if err != nil {
+		return summary, fmt.Errorf("failed to encode torrent file: %w", err)
+	}
+
+	err = c.do(ctx, http.MethodPost, "/api/v1/torrents", form.FormDataContentType(), &body, &summary)
+
+	return summary, err
+}
+
+func (c *Client) List(ctx context.Context) ([]TorrentSummary, error) {
+	summaries := []TorrentSummary{}
+
+	err := c.do(ctx, http.MethodGet, "/api/v1/torrents", "", nil, &summaries)
+
+	return summaries, err
+}
+
+// Returns the details of the torrent with the hex encoded info hash.
+func (c *Client) Get(ctx context.Context, infoHash string) (TorrentDetails, error) {
+	var details TorrentDetails
+
+	err := c.do(ctx, http.MethodGet, "/api/v1/torrents/"+url.PathEscape(infoHash), "", nil, &details)
+
+	return details, err
+}
+
+func (c *Client) Pause(ctx context.Context, infoHash string) error {
+	return c.do(ctx, http.MethodPost, "/api/v1/torrents/"+url.PathEscape(infoHash)+"/pause", "", nil, nil)
+}
+
+func (c *Client) Resume(ctx context.Context, infoHash string) error {
+	return c.do(ctx, http.MethodPost, "/api/v1/torrents/"+url.PathEscape(infoHash)+"/resume", "", nil, nil)
+}
+
+// Removes a torrent. Its files are deleted if `deleteData` is set.
+func (c *Client) Remove(ctx context.Context, infoHash string, deleteData bool) error {
+	path := "/api/v1/torrents/" + url.PathEscape(infoHash) + "?deleteData=" + strconv.FormatBool(deleteData)
+
+	return c.do(ctx, http.MethodDelete, path, "", nil, nil)
+}
+
+// Sets the priority ("skip", "normal" or "high") of some of a torrent's files, identified by their index.
+func (c *Client) SetFilePriority(ctx context.Context, infoHash string, priority string, files []int) (TorrentDetails, error) {
+	var details TorrentDetails
+
+	err := c.doJSON(ctx, http.MethodPut, "/api/v1/torrents/"+url.PathEscape(infoHash)+"/priority", SetPriorityRequest{Files: files, Priority: priority}, &details)
+
+	return details, err
+}
+
+func (c *Client) Limits(ctx context.Context) (Limits, error) {
+	var limits Limits
+
+	err := c.do(ctx, http.MethodGet, "/api/v1/limits", "", nil, &limits)
+
+	return limits, err
+}
+
+// Updates the session's limits and returns all of them.
+func (c *Client) SetLimits(ctx context.Context, update LimitsUpdate) (Limits, error) {
+	var updated Limits
+
+	err := c.doJSON(ctx, http.MethodPut, "/api/v1/limits", update, &updated)
+
+	return updated, err
+}
+
+/*
+Streams the events of the daemon's torrents to `handler` until the context is done or the daemon closes the stream.
+
+Only the events of a single torrent are streamed if `infoHash` isn't empty.
+*/
+func (c *Client) Events(ctx context.Context, infoHash string, handler func(event Event)) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/api/v1/events?infoHash="+url.QueryEscape(infoHash), nil)
+
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "text/event-stream")
+
+	res, err := c.httpClient.Do(req)
+
+	if err != nil {
+		return fmt.Errorf("failed to reach daemon: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("daemon responded with status '%s'", res.Status)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+
+		// Event names, comments and the blank lines between events are skipped: the data holds the whole event.
+		if !ok {
+			continue
+		}
+
+		var event Event
+
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return fmt.Errorf("failed to parse event: %w", err)
+		}
+
+		handler(event)
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,153 @@
+package daemon
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MlkMahmud/hail/client"
+	"github.com/MlkMahmud/hail/logging"
+	"github.com/MlkMahmud/hail/metrics"
+)
+
+/*
+Serves an HTTP API controlling the torrents of a session, so a long-running client can be managed remotely.
+
+Every request must carry the daemon's token as a bearer token ("Authorization: Bearer <token>"), or as the password of HTTP
+basic authentication for Transmission clients. Browsers' `EventSource` can't set headers, so the token is also accepted in the
+"token" query parameter.
+*/
+type Daemon struct {
+	config Config
+
+	listener   net.Listener
+	httpServer *http.Server
+	logger     *slog.Logger
+	startedAt  time.Time
+
+	// Sent back by clients of the Transmission RPC protocol to prove their requests aren't forged, see `handleTransmissionRPC`.
+	rpcSessionId string
+	rpcIds       *rpcTorrentIds
+
+	// Cancelled when the daemon is closed, which ends the open event streams.
+	ctx        context.Context
+	cancelFunc context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+type Config struct {
+	// TCP address the API listens on, e.g "127.0.0.1:9091".
+	Address string
+	// Secret clients authenticate with. Required.
+	Token string
+	// The session whose torrents are controlled through the API.
+	Session *client.Session
+	// Logger of the daemon, whose records are tagged with the "daemon" component. Defaults to `slog.Default()`.
+	Logger *slog.Logger
+	// Registry whose metrics are served on "/metrics" in the Prometheus text format. Metrics aren't served if nil.
+	Metrics *metrics.Registry
+}
+
+func New(config Config) (*Daemon, error) {
+	if config.Token == "" {
+		return nil, fmt.Errorf("a token is required to authenticate clients")
+	}
+
+	if config.Session == nil {
+		return nil, fmt.Errorf("a session is required")
+	}
+
+	rpcSessionId, err := newRPCSessionId()
+
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", config.Address)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on API address: %w", err)
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+
+	d := &Daemon{
+		config:   config,
+		listener: listener,
+		logger:   logging.Component(config.Logger, logging.ComponentDaemon),
+
+		startedAt:    time.Now(),
+		rpcSessionId: rpcSessionId,
+		rpcIds:       newRPCTorrentIds(),
+
+		ctx:        ctx,
+		cancelFunc: cancelFunc,
+	}
+
+	d.httpServer = &http.Server{Handler: d.httpHandler(), ReadHeaderTimeout: 10 * time.Second}
+
+	d.wg.Add(1)
+
+	go func() {
+		defer d.wg.Done()
+
+		if err := d.httpServer.Serve(d.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			d.logger.Error("API server stopped", logging.ErrorKey, err)
+		}
+	}()
+
+	return d, nil
+}
+
+// Returns the address the API listens on.
+func (d *Daemon) Addr() net.Addr {
+	return d.listener.Addr()
+}
+
+/*
+Stops serving the API, waiting for the requests being handled until the context is done. Open event streams are closed.
+
+The session is left running.
+*/
+func (d *Daemon) Close(ctx context.Context) error {
+	d.cancelFunc()
+	err := d.httpServer.Shutdown(ctx)
+
+	if err != nil {
+		d.httpServer.Close()
+	}
+
+	d.wg.Wait()
+
+	return err
+}
+
+// Rejects requests that don't carry the daemon's token.
+func (d *Daemon) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if !ok {
+			_, token, ok = r.BasicAuth()
+		}
+
+		if !ok {
+			token = r.URL.Query().Get("token")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(d.config.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hail"`)
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
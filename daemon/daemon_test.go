@@ -0,0 +1,245 @@
+package daemon_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MlkMahmud/hail/bencode"
+	"github.com/MlkMahmud/hail/client"
+	"github.com/MlkMahmud/hail/daemon"
+)
+
+const (
+	testPieceLength = 16 * 1024
+	testToken       = "secret"
+)
+
+// Writes the ".torrent" file of a two-file torrent that is downloaded from a web seed, and returns its path.
+func writeWebSeedTorrentFile(t *testing.T, name string) string {
+	t.Helper()
+
+	srcDir := t.TempDir()
+	data := []byte{}
+	files := []any{}
+
+	if err := os.MkdirAll(filepath.Join(srcDir, name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fileName := range []string{"a.bin", "b.bin"} {
+		fileData := bytes.Repeat([]byte{fileName[0]}, testPieceLength)
+
+		if err := os.WriteFile(filepath.Join(srcDir, name, fileName), fileData, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		data = append(data, fileData...)
+		files = append(files, map[string]any{"length": len(fileData), "path": []any{fileName}})
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(srcDir)))
+	t.Cleanup(server.Close)
+
+	pieces := strings.Builder{}
+
+	for offset := 0; offset < len(data); offset += testPieceLength {
+		hash := sha1.Sum(data[offset:min(offset+testPieceLength, len(data))])
+		pieces.Write(hash[:])
+	}
+
+	encoded, err := bencode.EncodeValue(map[string]any{
+		"url-list": server.URL + "/",
+		"info": map[string]any{
+			"files":        files,
+			"name":         name,
+			"piece length": testPieceLength,
+			"pieces":       pieces.String(),
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), name+".torrent")
+
+	if err := os.WriteFile(path, []byte(encoded), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// Starts a daemon with a session downloading to a temporary directory, and returns a client of its API along with the download directory.
+func newTestDaemon(t *testing.T) (*daemon.Daemon, *daemon.Client, string) {
+	t.Helper()
+
+	downloadDir := t.TempDir()
+	session, err := client.NewSession(client.Config{DownloadDir: downloadDir, ListenAddress: "127.0.0.1:0", DisableDHT: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := daemon.New(daemon.Config{Address: "127.0.0.1:0", Token: testToken, Session: session})
+
+	if err != nil {
+		session.Close(context.Background())
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		d.Close(context.Background())
+		session.Close(context.Background())
+	})
+
+	return d, daemon.NewClient("http://"+d.Addr().String(), testToken), downloadDir
+}
+
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDaemonRequiresToken(t *testing.T) {
+	d, _, _ := newTestDaemon(t)
+
+	if _, err := daemon.NewClient("http://"+d.Addr().String(), "wrong").List(context.Background()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected requests with the wrong token to be unauthorized, but got '%v'", err)
+	}
+
+	if _, err := daemon.New(daemon.Config{Address: "127.0.0.1:0"}); err == nil {
+		t.Fatal("expected a daemon without a token to be rejected")
+	}
+}
+
+func TestDaemonAPI(t *testing.T) {
+	ctx := context.Background()
+	_, remote, downloadDir := newTestDaemon(t)
+
+	eventsCtx, cancelEvents := context.WithCancel(ctx)
+	defer cancelEvents()
+
+	eventsCh := make(chan daemon.Event, 100)
+
+	go remote.Events(eventsCtx, "", func(event daemon.Event) {
+		eventsCh <- event
+	})
+
+	// The stream is subscribed to once the daemon has responded, which the client doesn't report.
+	time.Sleep(100 * time.Millisecond)
+
+	summary, err := remote.AddFile(ctx, writeWebSeedTorrentFile(t, "remote"), daemon.AddTorrentRequest{Paused: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !summary.Paused || summary.Name != "remote" {
+		t.Fatalf("expected the torrent to be added paused, but got %+v", summary)
+	}
+
+	if _, err := remote.AddFile(ctx, writeWebSeedTorrentFile(t, "remote"), daemon.AddTorrentRequest{}); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Fatalf("expected adding the torrent twice to conflict, but got '%v'", err)
+	}
+
+	if _, err := remote.Add(ctx, daemon.AddTorrentRequest{Source: "/etc/passwd"}); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Fatalf("expected paths on the daemon's host to be rejected, but got '%v'", err)
+	}
+
+	details, err := remote.SetFilePriority(ctx, summary.InfoHash, "skip", []int{1})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(details.Files) != 2 || details.Files[0].Priority != "normal" || details.Files[1].Priority != "skip" {
+		t.Fatalf("expected the second file to be skipped, but got %+v", details.Files)
+	}
+
+	if _, err := remote.SetFilePriority(ctx, summary.InfoHash, "skip", []int{2}); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Fatalf("expected setting the priority of a file that doesn't exist to fail, but got '%v'", err)
+	}
+
+	if err := remote.Resume(ctx, summary.InfoHash); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the torrent to be seeding", func() bool {
+		summaries, err := remote.List(ctx)
+		return err == nil && len(summaries) == 1 && summaries[0].Status == "seeding"
+	})
+
+	details, err = remote.Get(ctx, summary.InfoHash)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if details.Files[0].BytesCompleted != details.Files[0].Length || details.Files[1].BytesCompleted != 0 {
+		t.Fatalf("expected only the first file to be downloaded, but got %+v", details.Files)
+	}
+
+	for finished := false; !finished; {
+		select {
+		case event := <-eventsCh:
+			{
+				finished = event.Type == "torrentFinished" && event.InfoHash == summary.InfoHash
+			}
+
+		case <-time.After(5 * time.Second):
+			{
+				t.Fatal("timed out waiting for the 'torrentFinished' event")
+			}
+		}
+	}
+
+	if err := remote.Pause(ctx, summary.InfoHash); err != nil {
+		t.Fatal(err)
+	}
+
+	if details, err := remote.Get(ctx, summary.InfoHash); err != nil || !details.Paused || details.Status != "finished" {
+		t.Fatalf("expected the torrent to be paused, but got %+v (%v)", details, err)
+	}
+
+	downloadRate := 1000
+
+	limits, err := remote.SetLimits(ctx, daemon.LimitsUpdate{DownloadRate: &downloadRate})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if limits.DownloadRate != 1000 || limits.UploadRate != 0 || limits.MaxConnections != 200 {
+		t.Fatalf("expected only the download rate to change, but got %+v", limits)
+	}
+
+	if err := remote.Remove(ctx, summary.InfoHash, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := remote.Get(ctx, summary.InfoHash); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected the removed torrent to be gone, but got '%v'", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(downloadDir, "remote")); !os.IsNotExist(err) {
+		t.Fatalf("expected the torrent's files to be deleted, but got '%v'", err)
+	}
+}
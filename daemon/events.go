@@ -0,0 +1,185 @@
+package daemon
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+/*
+An event of the session's torrents, as sent on the event stream.
+
+The stream is made of server-sent events whose name is the event's type, e.g "pieceVerified", and whose data is the JSON event.
+*/
+type Event struct {
+	Type     string    `json:"type"`
+	InfoHash string    `json:"infoHash"`
+	Time     time.Time `json:"time"`
+	// The fields specific to the type of event, e.g "index" for "pieceVerified" events.
+	Data map[string]any `json:"data"`
+}
+
+const (
+	// Number of events buffered for every client of the event stream. Events are dropped if a client falls behind.
+	eventBufferSize = 1024
+	// Interval between comments sent on idle event streams, so proxies don't close them.
+	keepAliveInterval = 30 * time.Second
+)
+
+func newEvent(event torrent.Event) Event {
+	base := event.Base()
+	e := Event{InfoHash: hex.EncodeToString(base.InfoHash[:]), Time: base.Time, Data: map[string]any{}}
+
+	switch event := event.(type) {
+	case torrent.PeerConnected:
+		{
+			e.Type = "peerConnected"
+			e.Data["peer"] = event.Peer
+		}
+
+	case torrent.PeerDisconnected:
+		{
+			e.Type = "peerDisconnected"
+			e.Data["peer"] = event.Peer
+			e.Data["reason"] = event.Reason
+		}
+
+	case torrent.TrackerAnnounced:
+		{
+			e.Type = "trackerAnnounced"
+			e.Data["tracker"] = event.Tracker
+			e.Data["peers"] = event.Peers
+			e.Data["interval"] = event.Interval.Seconds()
+		}
+
+	case torrent.TrackerError:
+		{
+			e.Type = "trackerError"
+			e.Data["tracker"] = event.Tracker
+			e.Data["error"] = event.Err.Error()
+		}
+
+	case torrent.MetadataReceived:
+		{
+			e.Type = "metadataReceived"
+			e.Data["name"] = event.Name
+		}
+
+	case torrent.PieceVerified:
+		{
+			e.Type = "pieceVerified"
+			e.Data["index"] = event.Index
+		}
+
+	case torrent.HashFailed:
+		{
+			e.Type = "hashFailed"
+			e.Data["index"] = event.Index
+			e.Data["peer"] = event.Peer
+		}
+
+	case torrent.FileCompleted:
+		{
+			e.Type = "fileCompleted"
+			e.Data["path"] = event.Path
+		}
+
+	case torrent.TorrentFinished:
+		{
+			e.Type = "torrentFinished"
+		}
+
+	case torrent.StateChanged:
+		{
+			e.Type = "stateChanged"
+			e.Data["from"] = event.From.String()
+			e.Data["to"] = event.To.String()
+		}
+
+	default:
+		{
+			e.Type = "unknown"
+		}
+	}
+
+	return e
+}
+
+/*
+Streams the events of the session's torrents as server-sent events, until the client disconnects or the daemon is closed.
+
+Only the events of a single torrent are sent if the "infoHash" query parameter is set.
+*/
+func (d *Daemon) handleEvents(w http.ResponseWriter, r *http.Request) {
+	var infoHash string
+
+	if value := r.URL.Query().Get("infoHash"); value != "" {
+		if _, err := parseInfoHash(value); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		infoHash = strings.ToLower(value)
+	}
+
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	sub := d.config.Session.Subscribe(eventBufferSize)
+	defer sub.Unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			{
+				return
+			}
+
+		case <-d.ctx.Done():
+			{
+				return
+			}
+
+		case <-ticker.C:
+			{
+				fmt.Fprint(w, ": keep-alive\n\n")
+				flusher.Flush()
+			}
+
+		case event := <-sub.Events():
+			{
+				e := newEvent(event)
+
+				if infoHash != "" && e.InfoHash != infoHash {
+					continue
+				}
+
+				data, err := json.Marshal(e)
+
+				if err != nil {
+					continue
+				}
+
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+				flusher.Flush()
+			}
+		}
+	}
+}
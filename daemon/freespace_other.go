@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !windows
+
+package daemon
+
+import "errors"
+
+func diskSpace(path string) (int64, int64, error) {
+	return 0, 0, errors.New("free space can't be measured on this platform")
+}
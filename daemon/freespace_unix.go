@@ -0,0 +1,16 @@
+//go:build linux || darwin
+
+package daemon
+
+import "syscall"
+
+// Returns the number of bytes available to unprivileged users, and the total size, of the file system holding the path.
+func diskSpace(path string) (int64, int64, error) {
+	var stat syscall.Statfs_t
+
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), int64(stat.Blocks) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,32 @@
+package daemon
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// Returns the number of bytes available to the user, and the total size, of the volume holding the path.
+func diskSpace(path string) (int64, int64, error) {
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var available, total, free uint64
+
+	ok, _, err := getDiskFreeSpaceEx.Call(
+		uintptr(unsafe.Pointer(pathPtr)),
+		uintptr(unsafe.Pointer(&available)),
+		uintptr(unsafe.Pointer(&total)),
+		uintptr(unsafe.Pointer(&free)),
+	)
+
+	if ok == 0 {
+		return 0, 0, err
+	}
+
+	return int64(available), int64(total), nil
+}
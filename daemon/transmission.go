@@ -0,0 +1,769 @@
+package daemon
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/MlkMahmud/hail/client"
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+// A request of the Transmission RPC protocol.
+type rpcRequest struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       any             `json:"tag,omitempty"`
+}
+
+type rpcResponse struct {
+	Result    string `json:"result"`
+	Arguments any    `json:"arguments"`
+	Tag       any    `json:"tag,omitempty"`
+}
+
+// Assigns the numeric ids Transmission clients use to refer to torrents. Ids are never reused while the daemon runs.
+type rpcTorrentIds struct {
+	mutex  *sync.Mutex
+	ids    map[[20]byte]int
+	added  map[[20]byte]time.Time
+	nextId int
+}
+
+// The torrent fields of the "torrent-get" method, computed from a snapshot of the torrent.
+type rpcTorrent struct {
+	id      int
+	t       *torrent.Torrent
+	stats   torrent.Stats
+	added   time.Time
+	wanted  []bool
+	paused  bool
+	hasInfo bool
+}
+
+const (
+	// Version of the RPC protocol we implement, the one of Transmission 3.00.
+	rpcVersion        = 17
+	rpcVersionMinimum = 1
+	rpcSessionIdKey   = "X-Transmission-Session-Id"
+
+	// Transmission's torrent statuses.
+	rpcStatusStopped  = 0
+	rpcStatusDownload = 4
+	rpcStatusSeed     = 6
+
+	// Transmission's speeds are in kB/s.
+	rpcSpeedBytes = 1000
+)
+
+var errUnknownMethod = errors.New("method name not recognized")
+
+func newRPCTorrentIds() *rpcTorrentIds {
+	var mutex sync.Mutex
+
+	return &rpcTorrentIds{mutex: &mutex, ids: make(map[[20]byte]int), added: make(map[[20]byte]time.Time), nextId: 1}
+}
+
+// Returns the id of a torrent and the time it was first seen, assigning a new id to torrents that don't have one yet.
+func (ri *rpcTorrentIds) id(infoHash [20]byte) (int, time.Time) {
+	ri.mutex.Lock()
+	defer ri.mutex.Unlock()
+
+	if id, ok := ri.ids[infoHash]; ok {
+		return id, ri.added[infoHash]
+	}
+
+	id := ri.nextId
+	ri.nextId += 1
+	ri.ids[infoHash] = id
+	ri.added[infoHash] = time.Now()
+
+	return id, ri.added[infoHash]
+}
+
+func newRPCSessionId() (string, error) {
+	buffer := make([]byte, 24)
+
+	if _, err := rand.Read(buffer); err != nil {
+		return "", fmt.Errorf("failed to generate RPC session id: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buffer), nil
+}
+
+/*
+Handles a request of the Transmission RPC protocol, so Transmission's web interfaces and remotes work with the daemon.
+
+Only the methods needed to list, add, start, stop and remove torrents are supported. Other methods are answered with an error result,
+as Transmission does for methods it doesn't know. Transmission clients authenticate with HTTP basic authentication: the daemon's token
+is their password, with any user name.
+
+Requests must carry the RPC session id in the "X-Transmission-Session-Id" header. Requests that don't are answered with a 409 status
+and the session id, which clients send again with the header set. This prevents cross-site request forgery.
+*/
+func (d *Daemon) handleTransmissionRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(rpcSessionIdKey) != d.rpcSessionId {
+		w.Header().Set(rpcSessionIdKey, d.rpcSessionId)
+		http.Error(w, fmt.Sprintf("Invalid session id.\n\n%s: %s", rpcSessionIdKey, d.rpcSessionId), http.StatusConflict)
+		return
+	}
+
+	var req rpcRequest
+
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxTorrentFileSize+maxRequestBodySize)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("failed to parse request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Arguments) == 0 {
+		req.Arguments = json.RawMessage("{}")
+	}
+
+	res := rpcResponse{Result: "success", Arguments: map[string]any{}, Tag: req.Tag}
+	arguments, err := d.callRPCMethod(req)
+
+	if err != nil {
+		res.Result = err.Error()
+	} else {
+		res.Arguments = arguments
+	}
+
+	w.Header().Set(rpcSessionIdKey, d.rpcSessionId)
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (d *Daemon) callRPCMethod(req rpcRequest) (any, error) {
+	switch req.Method {
+	case "session-get":
+		return d.rpcSessionGet(), nil
+	case "session-stats":
+		return d.rpcSessionStats(), nil
+	case "free-space":
+		return d.rpcFreeSpace(req.Arguments)
+	case "torrent-get":
+		return d.rpcTorrentGet(req.Arguments)
+	case "torrent-add":
+		return d.rpcTorrentAdd(req.Arguments)
+	case "torrent-start", "torrent-start-now":
+		return d.rpcTorrentAction(req.Arguments, (*torrent.Torrent).Resume)
+	case "torrent-stop":
+		return d.rpcTorrentAction(req.Arguments, (*torrent.Torrent).Pause)
+	case "torrent-remove":
+		return d.rpcTorrentRemove(req.Arguments)
+	default:
+		return nil, errUnknownMethod
+	}
+}
+
+func (d *Daemon) rpcSessionGet() map[string]any {
+	downloadRate, uploadRate := d.config.Session.RateLimits()
+
+	return map[string]any{
+		"version":                  "3.00 (hail)",
+		"rpc-version":              rpcVersion,
+		"rpc-version-minimum":      rpcVersionMinimum,
+		"session-id":               d.rpcSessionId,
+		"download-dir":             d.config.Session.DownloadDir(),
+		"peer-port":                d.config.Session.ListenAddr().(*net.TCPAddr).Port,
+		"peer-limit-global":        d.config.Session.MaxConnections(),
+		"speed-limit-down":         downloadRate / rpcSpeedBytes,
+		"speed-limit-down-enabled": downloadRate > 0,
+		"speed-limit-up":           uploadRate / rpcSpeedBytes,
+		"speed-limit-up-enabled":   uploadRate > 0,
+		"units": map[string]any{
+			"speed-units":  []string{"kB/s", "MB/s", "GB/s", "TB/s"},
+			"speed-bytes":  rpcSpeedBytes,
+			"size-units":   []string{"kB", "MB", "GB", "TB"},
+			"size-bytes":   1000,
+			"memory-units": []string{"KiB", "MiB", "GiB", "TiB"},
+			"memory-bytes": 1024,
+		},
+	}
+}
+
+// Reports the transfers of the current run of the daemon, and of all the runs of its torrents in the cumulative stats.
+func (d *Daemon) rpcSessionStats() map[string]any {
+	torrents := d.config.Session.Torrents()
+	secondsActive := int64(time.Since(d.startedAt).Seconds())
+	downloadSpeed, uploadSpeed := 0.0, 0.0
+	activeTorrents, pausedTorrents := 0, 0
+	downloaded, uploaded := int64(0), int64(0)
+	downloadedEver, uploadedEver := int64(0), int64(0)
+
+	for _, t := range torrents {
+		stats := t.Stats()
+		history := t.TransferHistory()
+
+		downloadSpeed += stats.DownloadRate
+		uploadSpeed += stats.UploadRate
+		downloaded += stats.Downloaded
+		uploaded += stats.Uploaded
+		downloadedEver += history.Downloaded
+		uploadedEver += history.Uploaded
+
+		if t.IsPaused() {
+			pausedTorrents += 1
+		} else {
+			activeTorrents += 1
+		}
+	}
+
+	return map[string]any{
+		"activeTorrentCount": activeTorrents,
+		"pausedTorrentCount": pausedTorrents,
+		"torrentCount":       len(torrents),
+		"downloadSpeed":      int64(downloadSpeed),
+		"uploadSpeed":        int64(uploadSpeed),
+		"current-stats": map[string]any{
+			"downloadedBytes": downloaded,
+			"uploadedBytes":   uploaded,
+			"filesAdded":      len(torrents),
+			"sessionCount":    1,
+			"secondsActive":   secondsActive,
+		},
+		"cumulative-stats": map[string]any{
+			"downloadedBytes": downloadedEver,
+			"uploadedBytes":   uploadedEver,
+			"filesAdded":      len(torrents),
+			"sessionCount":    1,
+			"secondsActive":   secondsActive,
+		},
+	}
+}
+
+func (d *Daemon) rpcFreeSpace(arguments json.RawMessage) (any, error) {
+	var args struct {
+		Path string `json:"path"`
+	}
+
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %w", err)
+	}
+
+	available, total, err := diskSpace(args.Path)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get free space of '%s': %w", args.Path, err)
+	}
+
+	return map[string]any{"path": args.Path, "size-bytes": available, "total_size": total}, nil
+}
+
+/*
+Returns the torrents the "ids" argument refers to: a single id, a list of ids and info hashes, or "recently-active" for the torrents
+that are transferring data. Every torrent is returned if the argument is omitted.
+*/
+func (d *Daemon) rpcTorrents(rawIds json.RawMessage) ([]*torrent.Torrent, error) {
+	torrents := d.config.Session.Torrents()
+
+	if len(rawIds) == 0 {
+		return torrents, nil
+	}
+
+	var single any
+	var list []any
+
+	if err := json.Unmarshal(rawIds, &single); err != nil {
+		return nil, fmt.Errorf("invalid ids: %w", err)
+	}
+
+	switch ids := single.(type) {
+	case string:
+		{
+			if ids != "recently-active" {
+				list = []any{ids}
+				break
+			}
+
+			active := []*torrent.Torrent{}
+
+			for _, t := range torrents {
+				if stats := t.Stats(); stats.DownloadRate >= 1 || stats.UploadRate >= 1 {
+					active = append(active, t)
+				}
+			}
+
+			return active, nil
+		}
+
+	case []any:
+		{
+			list = ids
+		}
+
+	default:
+		{
+			list = []any{ids}
+		}
+	}
+
+	selected := []*torrent.Torrent{}
+
+	for _, t := range torrents {
+		infoHash := t.InfoHash()
+		id, _ := d.rpcIds.id(infoHash)
+		hashString := hex.EncodeToString(infoHash[:])
+
+		for _, value := range list {
+			if number, ok := value.(float64); ok && int(number) == id {
+				selected = append(selected, t)
+				break
+			}
+
+			if hash, ok := value.(string); ok && hash == hashString {
+				selected = append(selected, t)
+				break
+			}
+		}
+	}
+
+	return selected, nil
+}
+
+func (d *Daemon) rpcTorrentGet(arguments json.RawMessage) (any, error) {
+	var args struct {
+		Fields []string        `json:"fields"`
+		Ids    json.RawMessage `json:"ids"`
+		Format string          `json:"format"`
+	}
+
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %w", err)
+	}
+
+	torrents, err := d.rpcTorrents(args.Ids)
+
+	if err != nil {
+		return nil, err
+	}
+
+	objects := []any{}
+	table := []any{args.Fields}
+
+	for _, t := range torrents {
+		snapshot := d.newRPCTorrent(t)
+		object := map[string]any{}
+		row := []any{}
+
+		for _, field := range args.Fields {
+			value, ok := snapshot.field(field)
+
+			if ok {
+				object[field] = value
+			}
+
+			row = append(row, value)
+		}
+
+		objects = append(objects, object)
+		table = append(table, row)
+	}
+
+	if args.Format == "table" {
+		return map[string]any{"torrents": table}, nil
+	}
+
+	return map[string]any{"torrents": objects}, nil
+}
+
+func (d *Daemon) newRPCTorrent(t *torrent.Torrent) *rpcTorrent {
+	id, added := d.rpcIds.id(t.InfoHash())
+	stats := t.Stats()
+	priorities, err := t.FilePriorities()
+	wanted := make([]bool, len(stats.Files))
+
+	for index := range wanted {
+		wanted[index] = err == nil && priorities[index] != torrent.PrioritySkip
+	}
+
+	return &rpcTorrent{id: id, t: t, stats: stats, added: added, wanted: wanted, paused: t.IsPaused(), hasInfo: stats.NumOfPieces > 0}
+}
+
+// Returns the total size of the torrent's files, and the size of the files that aren't skipped along with the number of their bytes left.
+func (rt *rpcTorrent) sizes() (int64, int64, int64) {
+	total, wanted, left := int64(0), int64(0), int64(0)
+
+	for index, f := range rt.stats.Files {
+		total += int64(f.Length)
+
+		if rt.wanted[index] {
+			wanted += int64(f.Length)
+			left += int64(f.Length - f.BytesCompleted)
+		}
+	}
+
+	return total, wanted, left
+}
+
+func (rt *rpcTorrent) status() int {
+	switch {
+	case rt.paused:
+		return rpcStatusStopped
+	case rt.stats.Status == torrent.StatusSeeding:
+		return rpcStatusSeed
+	case rt.stats.Status == torrent.StatusFinished:
+		return rpcStatusStopped
+	default:
+		return rpcStatusDownload
+	}
+}
+
+// Returns the value of a field of the "torrent-get" method. Returns false for fields we don't support, which are left out of the response.
+func (rt *rpcTorrent) field(name string) (any, bool) {
+	infoHash := rt.t.InfoHash()
+	total, wanted, left := rt.sizes()
+
+	switch name {
+	case "id":
+		return rt.id, true
+	case "hashString":
+		return hex.EncodeToString(infoHash[:]), true
+	case "name":
+		return rt.t.Name(), true
+	case "status":
+		return rt.status(), true
+	case "error":
+		return 0, true
+	case "errorString":
+		return "", true
+	case "addedDate":
+		return rt.added.Unix(), true
+	case "downloadDir":
+		return rt.t.OutputDir(), true
+	case "totalSize":
+		return total, true
+	case "sizeWhenDone":
+		return wanted, true
+	case "leftUntilDone":
+		return left, true
+	case "haveValid":
+		return wanted - left, true
+	case "percentDone":
+		if wanted == 0 {
+			return 0.0, true
+		}
+
+		return float64(wanted-left) / float64(wanted), true
+	case "metadataPercentComplete":
+		if rt.hasInfo {
+			return 1.0, true
+		}
+
+		return 0.0, true
+	case "isFinished":
+		return rt.stats.Status == torrent.StatusFinished && rt.paused, true
+	case "isStalled":
+		return false, true
+	case "recheckProgress":
+		return 0.0, true
+	case "queuePosition":
+		return rt.id, true
+	case "rateDownload":
+		return int64(rt.stats.DownloadRate), true
+	case "rateUpload":
+		return int64(rt.stats.UploadRate), true
+	case "eta":
+		if rt.stats.ETA == torrent.UnknownETA {
+			return -1, true
+		}
+
+		return int64(rt.stats.ETA.Seconds()), true
+	case "downloadedEver":
+		return rt.stats.Downloaded, true
+	case "uploadedEver":
+		return rt.stats.Uploaded, true
+	case "corruptEver":
+		return rt.stats.Wasted, true
+	case "uploadRatio":
+		if rt.stats.Downloaded == 0 {
+			return -1.0, true
+		}
+
+		return float64(rt.stats.Uploaded) / float64(rt.stats.Downloaded), true
+	case "pieceCount":
+		return rt.stats.NumOfPieces, true
+	case "peersConnected":
+		return rt.stats.ConnectedPeers, true
+	case "peersGettingFromUs":
+		return rt.countPeers(func(peer torrent.PeerStats) bool { return peer.UploadRate >= 1 }), true
+	case "peersSendingToUs":
+		return rt.countPeers(func(peer torrent.PeerStats) bool { return peer.DownloadRate >= 1 }), true
+	case "webseedsSendingToUs":
+		return 0, true
+	case "isPrivate":
+		return rt.t.IsPrivate(), true
+	case "files":
+		return rt.files(), true
+	case "fileStats":
+		return rt.fileStats(), true
+	case "priorities":
+		priorities := []int{}
+
+		for _, f := range rt.stats.Files {
+			priorities = append(priorities, rpcPriority(f.Priority))
+		}
+
+		return priorities, true
+	case "wanted":
+		wantedFiles := []int{}
+
+		for _, isWanted := range rt.wanted {
+			if isWanted {
+				wantedFiles = append(wantedFiles, 1)
+			} else {
+				wantedFiles = append(wantedFiles, 0)
+			}
+		}
+
+		return wantedFiles, true
+	case "peers":
+		return rt.peers(), true
+	case "trackers":
+		return rt.trackers(false), true
+	case "trackerStats":
+		return rt.trackers(true), true
+	default:
+		return nil, false
+	}
+}
+
+func (rt *rpcTorrent) countPeers(filter func(peer torrent.PeerStats) bool) int {
+	count := 0
+
+	for _, peer := range rt.stats.Peers {
+		if filter(peer) {
+			count += 1
+		}
+	}
+
+	return count
+}
+
+// Transmission has no priority for skipped files, which are reported as unwanted instead.
+func rpcPriority(priority torrent.FilePriority) int {
+	if priority == torrent.PriorityHigh {
+		return 1
+	}
+
+	return 0
+}
+
+func (rt *rpcTorrent) files() []map[string]any {
+	files := []map[string]any{}
+
+	for _, f := range rt.stats.Files {
+		files = append(files, map[string]any{"name": f.Path, "length": f.Length, "bytesCompleted": f.BytesCompleted})
+	}
+
+	return files
+}
+
+func (rt *rpcTorrent) fileStats() []map[string]any {
+	fileStats := []map[string]any{}
+
+	for index, f := range rt.stats.Files {
+		fileStats = append(fileStats, map[string]any{"bytesCompleted": f.BytesCompleted, "wanted": rt.wanted[index], "priority": rpcPriority(f.Priority)})
+	}
+
+	return fileStats
+}
+
+func (rt *rpcTorrent) peers() []map[string]any {
+	peers := []map[string]any{}
+
+	for _, peer := range rt.stats.Peers {
+		host, port, _ := net.SplitHostPort(peer.Address)
+		portNumber, _ := strconv.Atoi(port)
+		flags := ""
+
+		if peer.AmInterested && !peer.PeerChoking {
+			flags += "D"
+		}
+
+		if peer.PeerInterested && !peer.AmChoking {
+			flags += "U"
+		}
+
+		peers = append(peers, map[string]any{
+			"address":            host,
+			"port":               portNumber,
+			"clientName":         peer.Client,
+			"rateToClient":       int64(peer.DownloadRate),
+			"rateToPeer":         int64(peer.UploadRate),
+			"flagStr":            flags,
+			"isEncrypted":        false,
+			"isDownloadingFrom":  peer.DownloadRate >= 1,
+			"isUploadingTo":      peer.UploadRate >= 1,
+			"clientIsChoked":     peer.PeerChoking,
+			"clientIsInterested": peer.AmInterested,
+			"peerIsChoked":       peer.AmChoking,
+			"peerIsInterested":   peer.PeerInterested,
+		})
+	}
+
+	return peers
+}
+
+// Returns the torrent's trackers, along with the status of their announcements if `withStats` is set ("trackerStats" field).
+func (rt *rpcTorrent) trackers(withStats bool) []map[string]any {
+	trackers := []map[string]any{}
+
+	for index, tracker := range rt.stats.Trackers {
+		entry := map[string]any{"id": index, "announce": tracker.URL, "tier": tracker.Tier, "scrape": ""}
+
+		if withStats {
+			lastAnnounceTime, nextAnnounceTime := int64(0), int64(0)
+
+			if !tracker.LastAnnounce.IsZero() {
+				lastAnnounceTime = tracker.LastAnnounce.Unix()
+			}
+
+			if !tracker.NextAnnounce.IsZero() {
+				nextAnnounceTime = tracker.NextAnnounce.Unix()
+			}
+
+			result := "Success"
+
+			if tracker.LastError != "" {
+				result = tracker.LastError
+			}
+
+			entry["host"] = tracker.URL
+			entry["hasAnnounced"] = lastAnnounceTime != 0
+			entry["lastAnnounceTime"] = lastAnnounceTime
+			entry["lastAnnounceSucceeded"] = lastAnnounceTime != 0 && tracker.LastError == ""
+			entry["lastAnnounceResult"] = result
+			entry["nextAnnounceTime"] = nextAnnounceTime
+			entry["seederCount"] = tracker.Seeders
+			entry["leecherCount"] = tracker.Leechers
+		}
+
+		trackers = append(trackers, entry)
+	}
+
+	return trackers
+}
+
+/*
+Adds a torrent from the "filename" argument, an HTTP URL or a magnet link, or from the base64 encoded "metainfo" argument.
+
+As with the JSON API, paths on the daemon's host aren't accepted as sources.
+*/
+func (d *Daemon) rpcTorrentAdd(arguments json.RawMessage) (any, error) {
+	var args struct {
+		Filename    string `json:"filename"`
+		Metainfo    string `json:"metainfo"`
+		DownloadDir string `json:"download-dir"`
+		Paused      bool   `json:"paused"`
+	}
+
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %w", err)
+	}
+
+	source := args.Filename
+
+	if args.Metainfo != "" {
+		metainfo, err := base64.StdEncoding.DecodeString(args.Metainfo)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid metainfo: %w", err)
+		}
+
+		f, err := os.CreateTemp("", "hail-*.torrent")
+
+		if err == nil {
+			_, err = f.Write(metainfo)
+			f.Close()
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to save metainfo: %w", err)
+		}
+
+		defer os.Remove(f.Name())
+		source = f.Name()
+	} else if !isRemoteSource(source) {
+		return nil, fmt.Errorf("filename '%s' must be an HTTP URL or a magnet link, torrent files must be sent as metainfo", source)
+	}
+
+	t, err := d.config.Session.AddTorrent(source, client.TorrentOptions{OutputDir: args.DownloadDir, Paused: args.Paused})
+
+	if errors.Is(err, client.ErrTorrentExists) {
+		return map[string]any{"torrent-duplicate": d.rpcTorrentSummary(t)}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	d.logger.Info("added torrent", "name", t.Name())
+
+	return map[string]any{"torrent-added": d.rpcTorrentSummary(t)}, nil
+}
+
+func (d *Daemon) rpcTorrentSummary(t *torrent.Torrent) map[string]any {
+	infoHash := t.InfoHash()
+	id, _ := d.rpcIds.id(infoHash)
+
+	return map[string]any{"id": id, "name": t.Name(), "hashString": hex.EncodeToString(infoHash[:])}
+}
+
+func (d *Daemon) rpcTorrentAction(arguments json.RawMessage, action func(t *torrent.Torrent)) (any, error) {
+	var args struct {
+		Ids json.RawMessage `json:"ids"`
+	}
+
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %w", err)
+	}
+
+	torrents, err := d.rpcTorrents(args.Ids)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range torrents {
+		action(t)
+	}
+
+	return map[string]any{}, nil
+}
+
+func (d *Daemon) rpcTorrentRemove(arguments json.RawMessage) (any, error) {
+	var args struct {
+		Ids             json.RawMessage `json:"ids"`
+		DeleteLocalData bool            `json:"delete-local-data"`
+	}
+
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %w", err)
+	}
+
+	torrents, err := d.rpcTorrents(args.Ids)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range torrents {
+		if err := d.config.Session.RemoveTorrent(t.InfoHash(), args.DeleteLocalData); err != nil && !errors.Is(err, client.ErrTorrentNotFound) {
+			return nil, err
+		}
+
+		d.logger.Info("removed torrent", "name", t.Name(), "deleteData", args.DeleteLocalData)
+	}
+
+	return map[string]any{}, nil
+}
@@ -0,0 +1,190 @@
+package daemon_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+)
+
+// A client of the Transmission RPC protocol, which goes through the session id handshake like Transmission's clients.
+type rpcClient struct {
+	t         *testing.T
+	url       string
+	sessionId string
+}
+
+type rpcResult struct {
+	Result    string         `json:"result"`
+	Arguments map[string]any `json:"arguments"`
+	Tag       float64        `json:"tag"`
+}
+
+func (c *rpcClient) post(body []byte) *http.Response {
+	c.t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	req.SetBasicAuth("transmission", testToken)
+	req.Header.Set("X-Transmission-Session-Id", c.sessionId)
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return res
+}
+
+func (c *rpcClient) call(method string, arguments map[string]any) rpcResult {
+	c.t.Helper()
+
+	body, err := json.Marshal(map[string]any{"method": method, "arguments": arguments, "tag": 7})
+
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	res := c.post(body)
+
+	if res.StatusCode == http.StatusConflict {
+		res.Body.Close()
+		c.sessionId = res.Header.Get("X-Transmission-Session-Id")
+		res = c.post(body)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		c.t.Fatalf("expected status 200 for method '%s', but got %d", method, res.StatusCode)
+	}
+
+	var result rpcResult
+
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		c.t.Fatal(err)
+	}
+
+	if result.Tag != 7 {
+		c.t.Fatalf("expected the request's tag to be sent back, but got %v", result.Tag)
+	}
+
+	return result
+}
+
+// Returns the first torrent of a "torrent-get" response.
+func firstTorrent(t *testing.T, result rpcResult) map[string]any {
+	t.Helper()
+
+	torrents, ok := result.Arguments["torrents"].([]any)
+
+	if result.Result != "success" || !ok || len(torrents) == 0 {
+		t.Fatalf("expected a torrent, but got %+v", result)
+	}
+
+	return torrents[0].(map[string]any)
+}
+
+func TestTransmissionRPC(t *testing.T) {
+	d, _, downloadDir := newTestDaemon(t)
+	url := "http://" + d.Addr().String() + "/transmission/rpc"
+
+	req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader([]byte(`{"method":"session-get"}`)))
+	req.SetBasicAuth("transmission", testToken)
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusConflict || res.Header.Get("X-Transmission-Session-Id") == "" {
+		t.Fatalf("expected requests without a session id to get one with a 409 status, but got %d", res.StatusCode)
+	}
+
+	rpc := &rpcClient{t: t, url: url}
+
+	if session := rpc.call("session-get", nil); session.Arguments["rpc-version"] != 17.0 || session.Arguments["download-dir"] != downloadDir {
+		t.Fatalf("unexpected session: %+v", session)
+	}
+
+	metainfo, err := os.ReadFile(writeWebSeedTorrentFile(t, "transmission"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(metainfo)
+	added := rpc.call("torrent-add", map[string]any{"metainfo": encoded, "paused": true})
+	addedTorrent, ok := added.Arguments["torrent-added"].(map[string]any)
+
+	if !ok || addedTorrent["name"] != "transmission" {
+		t.Fatalf("expected the torrent to be added, but got %+v", added)
+	}
+
+	if duplicate := rpc.call("torrent-add", map[string]any{"metainfo": encoded}); duplicate.Arguments["torrent-duplicate"] == nil {
+		t.Fatalf("expected the torrent to be reported as a duplicate, but got %+v", duplicate)
+	}
+
+	if rejected := rpc.call("torrent-add", map[string]any{"filename": "/etc/passwd"}); rejected.Result == "success" {
+		t.Fatal("expected paths on the daemon's host to be rejected")
+	}
+
+	id := addedTorrent["id"]
+	fields := []string{"id", "name", "hashString", "status", "percentDone", "totalSize", "files", "fileStats", "unknownField"}
+
+	torrent := firstTorrent(t, rpc.call("torrent-get", map[string]any{"ids": []any{id}, "fields": fields}))
+
+	if torrent["status"] != 0.0 || torrent["totalSize"] != float64(2*testPieceLength) || len(torrent["files"].([]any)) != 2 {
+		t.Fatalf("expected a stopped torrent with 2 files, but got %+v", torrent)
+	}
+
+	if _, ok := torrent["unknownField"]; ok {
+		t.Fatal("expected unknown fields to be left out")
+	}
+
+	rpc.call("torrent-start", map[string]any{"ids": []any{addedTorrent["hashString"]}})
+
+	waitFor(t, "the torrent to be seeding", func() bool {
+		torrent := firstTorrent(t, rpc.call("torrent-get", map[string]any{"ids": id, "fields": fields}))
+		return torrent["status"] == 6.0 && torrent["percentDone"] == 1.0
+	})
+
+	if table := rpc.call("torrent-get", map[string]any{"fields": []string{"id", "name"}, "format": "table"}); len(table.Arguments["torrents"].([]any)) != 2 {
+		t.Fatalf("expected a header row and a torrent row, but got %+v", table)
+	}
+
+	stats := rpc.call("session-stats", nil)
+
+	if stats.Arguments["torrentCount"] != 1.0 || stats.Arguments["current-stats"].(map[string]any)["downloadedBytes"] != float64(2*testPieceLength) {
+		t.Fatalf("unexpected session stats: %+v", stats)
+	}
+
+	if freeSpace := rpc.call("free-space", map[string]any{"path": downloadDir}); freeSpace.Result != "success" || freeSpace.Arguments["size-bytes"].(float64) <= 0 {
+		t.Fatalf("expected the free space of the download directory, but got %+v", freeSpace)
+	}
+
+	if unknown := rpc.call("torrent-reannounce", nil); unknown.Result != "method name not recognized" {
+		t.Fatalf("expected unknown methods to be reported, but got %+v", unknown)
+	}
+
+	rpc.call("torrent-stop", map[string]any{"ids": id})
+
+	if torrent := firstTorrent(t, rpc.call("torrent-get", map[string]any{"ids": id, "fields": fields})); torrent["status"] != 0.0 {
+		t.Fatalf("expected the torrent to be stopped, but got %+v", torrent)
+	}
+
+	rpc.call("torrent-remove", map[string]any{"ids": []any{id}, "delete-local-data": true})
+
+	if remaining := rpc.call("torrent-get", map[string]any{"fields": fields}); len(remaining.Arguments["torrents"].([]any)) != 0 {
+		t.Fatalf("expected the torrent to be removed, but got %+v", remaining)
+	}
+}
@@ -0,0 +1,708 @@
+package dht
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/MlkMahmud/hail/logging"
+)
+
+/*
+A node in the Mainline DHT (BEP 5).
+
+The node answers queries from other nodes and performs iterative lookups on behalf of
+torrents to find peers for an info hash and to announce that we are downloading it.
+*/
+type DHT struct {
+	config Config
+	conn   *net.UDPConn
+	id     NodeId
+
+	peerStore     *peerStore
+	routingTable  *routingTable
+	tokenManager  *tokenManager
+	transactionId uint32
+
+	mutex        sync.Mutex
+	transactions map[string]*transaction
+
+	logger *slog.Logger
+
+	ctx        context.Context
+	cancelFunc context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+type Config struct {
+	// UDP address to listen on, e.g ":6881".
+	Address string
+	// "host:port" addresses of the nodes used to join the DHT when the routing table is empty.
+	BootstrapNodes []string
+	// Node Id to use. A random Id is used if neither this field nor a persisted routing table provides one.
+	NodeId *NodeId
+	// Maximum amount of time to wait for a response to a query.
+	QueryTimeout time.Duration
+	// Path to the file used to persist the routing table between sessions. Persistence is disabled if empty.
+	RoutingTablePath string
+	// Logger of the node, whose records are tagged with the "dht" component. Defaults to `slog.Default()`.
+	Logger *slog.Logger
+}
+
+type transaction struct {
+	address    netip.AddrPort
+	responseCh chan *message
+}
+
+// The JSON representation of a persisted routing table.
+type savedRoutingTable struct {
+	Id    string      `json:"id"`
+	Nodes []savedNode `json:"nodes"`
+}
+
+type savedNode struct {
+	Address string `json:"address"`
+	Id      string `json:"id"`
+}
+
+const (
+	defaultQueryTimeout = 2 * time.Second
+	maxMessageSize      = 65536
+
+	bucketRefreshInterval = 15 * time.Minute
+)
+
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+var ErrNoNodes = errors.New("routing table does not contain any nodes")
+
+func New(config Config) (*DHT, error) {
+	if config.QueryTimeout == 0 {
+		config.QueryTimeout = defaultQueryTimeout
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", config.Address)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve DHT address: %w", err)
+	}
+
+	conn, err := net.ListenUDP("udp4", addr)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on DHT address: %w", err)
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+
+	d := &DHT{
+		config:       config,
+		conn:         conn,
+		peerStore:    newPeerStore(),
+		tokenManager: newTokenManager(),
+		transactions: make(map[string]*transaction),
+		logger:       logging.Component(config.Logger, logging.ComponentDHT),
+
+		ctx:        ctx,
+		cancelFunc: cancelFunc,
+	}
+
+	saved, err := loadRoutingTable(config.RoutingTablePath)
+
+	if err != nil {
+		d.logger.Warn("failed to load routing table", logging.ErrorKey, err)
+	}
+
+	switch {
+	case config.NodeId != nil:
+		d.id = *config.NodeId
+	case saved != nil:
+		d.id, err = ParseNodeId(saved.Id)
+
+		if err != nil {
+			d.id = NewRandomNodeId()
+		}
+	default:
+		d.id = NewRandomNodeId()
+	}
+
+	d.routingTable = newRoutingTable(d.id)
+
+	if saved != nil {
+		for _, entry := range saved.Nodes {
+			id, err := ParseNodeId(entry.Id)
+
+			if err != nil {
+				continue
+			}
+
+			address, err := netip.ParseAddrPort(entry.Address)
+
+			if err != nil {
+				continue
+			}
+
+			d.routingTable.add(Node{Id: id, Address: address})
+		}
+	}
+
+	d.wg.Add(2)
+	go d.readMessages()
+	go d.refreshBuckets()
+
+	return d, nil
+}
+
+func loadRoutingTable(path string) (*savedRoutingTable, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var saved savedRoutingTable
+
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse routing table file '%s': %w", path, err)
+	}
+
+	return &saved, nil
+}
+
+func (d *DHT) Addr() net.Addr {
+	return d.conn.LocalAddr()
+}
+
+func (d *DHT) Id() NodeId {
+	return d.id
+}
+
+func (d *DHT) NumOfNodes() int {
+	return d.routingTable.size()
+}
+
+// Pings the node at the given "host:port" address in the background and adds it to the routing table if it responds.
+func (d *DHT) AddNode(address string) {
+	go func() {
+		addr, err := net.ResolveUDPAddr("udp4", address)
+
+		if err != nil {
+			return
+		}
+
+		ctx, cancelFunc := context.WithTimeout(d.ctx, d.config.QueryTimeout)
+		defer cancelFunc()
+
+		d.Ping(ctx, addr.AddrPort())
+	}()
+}
+
+/*
+Joins the DHT by looking up our own node Id.
+
+If the routing table is empty, the bootstrap nodes are queried first to discover the initial set of nodes.
+*/
+func (d *DHT) Bootstrap(ctx context.Context) error {
+	if d.routingTable.size() == 0 {
+		var wg sync.WaitGroup
+
+		for _, address := range d.config.BootstrapNodes {
+			addr, err := net.ResolveUDPAddr("udp4", address)
+
+			if err != nil {
+				d.logger.Warn("failed to resolve bootstrap node", "node", address, logging.ErrorKey, err)
+				continue
+			}
+
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+				d.findNode(ctx, addr.AddrPort(), d.id)
+			}()
+		}
+
+		wg.Wait()
+	}
+
+	if _, err := d.FindNode(ctx, d.id); err != nil {
+		return fmt.Errorf("failed to bootstrap DHT: %w", err)
+	}
+
+	return nil
+}
+
+// Persists the routing table and stops the node.
+func (d *DHT) Close() error {
+	var saveErr error
+
+	if d.config.RoutingTablePath != "" {
+		saveErr = d.SaveRoutingTable(d.config.RoutingTablePath)
+	}
+
+	d.cancelFunc()
+	closeErr := d.conn.Close()
+	d.wg.Wait()
+
+	return errors.Join(saveErr, closeErr)
+}
+
+// Writes our node Id and the nodes in the routing table to the file at the given path.
+func (d *DHT) SaveRoutingTable(path string) error {
+	saved := savedRoutingTable{Id: d.id.String(), Nodes: []savedNode{}}
+
+	for _, node := range d.routingTable.nodes() {
+		saved.Nodes = append(saved.Nodes, savedNode{Address: node.Address.String(), Id: node.Id.String()})
+	}
+
+	content, err := json.Marshal(saved)
+
+	if err != nil {
+		return fmt.Errorf("failed to encode routing table: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to save routing table: %w", err)
+	}
+
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("failed to save routing table: %w", err)
+	}
+
+	return nil
+}
+
+// Finds the K nodes closest to the target in the DHT.
+func (d *DHT) FindNode(ctx context.Context, target NodeId) ([]Node, error) {
+	result, err := d.lookup(ctx, target, func(ctx context.Context, node Node) (*lookupResponse, error) {
+		nodes, err := d.findNode(ctx, node.Address, target)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &lookupResponse{nodes: nodes}, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result.closest, nil
+}
+
+// Finds peers for the info hash by querying the nodes closest to it.
+func (d *DHT) GetPeers(ctx context.Context, infoHash [20]byte) ([]netip.AddrPort, error) {
+	result, err := d.getPeers(ctx, infoHash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result.peers, nil
+}
+
+/*
+Finds peers for the info hash and announces that we are accepting connections for it on the given port.
+
+The announcement is sent to the closest nodes that responded to our "get_peers" queries, using the tokens they returned.
+*/
+func (d *DHT) Announce(ctx context.Context, infoHash [20]byte, port uint16) ([]netip.AddrPort, error) {
+	result, err := d.getPeers(ctx, infoHash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+
+	for _, node := range result.closest {
+		token, ok := result.tokens[node.Id]
+
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if err := d.announcePeer(ctx, node.Address, infoHash, port, token); err != nil {
+				d.logger.Debug("failed to announce to node", "node", node.Address.String(), logging.ErrorKey, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return result.peers, nil
+}
+
+func (d *DHT) getPeers(ctx context.Context, infoHash [20]byte) (*lookupResult, error) {
+	return d.lookup(ctx, NodeId(infoHash), func(ctx context.Context, node Node) (*lookupResponse, error) {
+		response, err := d.query(ctx, node.Address, getPeersMethod, map[string]any{
+			"info_hash": string(infoHash[:]),
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		lookupResponse := &lookupResponse{}
+		lookupResponse.token, _ = response["token"].(string)
+
+		if values, ok := response["values"].([]any); ok {
+			for _, value := range values {
+				compactPeer, ok := value.(string)
+
+				if !ok {
+					continue
+				}
+
+				address, err := decodeCompactPeer([]byte(compactPeer))
+
+				if err != nil {
+					continue
+				}
+
+				lookupResponse.peers = append(lookupResponse.peers, address)
+			}
+		}
+
+		if compactNodes, ok := response["nodes"].(string); ok {
+			nodes, err := decodeCompactNodes(compactNodes)
+
+			if err != nil {
+				return nil, err
+			}
+
+			lookupResponse.nodes = nodes
+		}
+
+		return lookupResponse, nil
+	})
+}
+
+// Sends a "ping" query and returns the Id of the node that responded.
+func (d *DHT) Ping(ctx context.Context, address netip.AddrPort) (NodeId, error) {
+	response, err := d.query(ctx, address, pingMethod, map[string]any{})
+
+	if err != nil {
+		return NodeId{}, err
+	}
+
+	return getNodeId(response)
+}
+
+func (d *DHT) findNode(ctx context.Context, address netip.AddrPort, target NodeId) ([]Node, error) {
+	response, err := d.query(ctx, address, findNodeMethod, map[string]any{
+		"target": string(target[:]),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	compactNodes, ok := response["nodes"].(string)
+
+	if !ok {
+		return nil, fmt.Errorf("'find_node' response does not include a 'nodes' property")
+	}
+
+	return decodeCompactNodes(compactNodes)
+}
+
+func (d *DHT) announcePeer(ctx context.Context, address netip.AddrPort, infoHash [20]byte, port uint16, token string) error {
+	_, err := d.query(ctx, address, announcePeerMethod, map[string]any{
+		"implied_port": 0,
+		"info_hash":    string(infoHash[:]),
+		"port":         int(port),
+		"token":        token,
+	})
+
+	return err
+}
+
+/*
+Sends a query to the node at the given address and waits for its response.
+
+Nodes that respond are added to the routing table; nodes that fail to respond are marked as failed.
+*/
+func (d *DHT) query(ctx context.Context, address netip.AddrPort, method string, arguments map[string]any) (map[string]any, error) {
+	address = unmap(address)
+	arguments["id"] = string(d.id[:])
+
+	d.mutex.Lock()
+	d.transactionId += 1
+	transactionIdBuffer := make([]byte, 4)
+	binary.BigEndian.PutUint32(transactionIdBuffer, d.transactionId)
+	transactionId := string(transactionIdBuffer)
+
+	t := &transaction{address: address, responseCh: make(chan *message, 1)}
+	d.transactions[transactionId] = t
+	d.mutex.Unlock()
+
+	defer func() {
+		d.mutex.Lock()
+		delete(d.transactions, transactionId)
+		d.mutex.Unlock()
+	}()
+
+	msg := &message{TransactionId: transactionId, Type: queryMessageType, Method: method, Arguments: arguments}
+
+	if err := d.send(address, msg); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(d.config.QueryTimeout)
+	defer timer.Stop()
+
+	select {
+	case response := <-t.responseCh:
+		{
+			if response.Type == errorMessageType {
+				return nil, &krpcError{code: response.ErrorCode, message: response.ErrorMessage}
+			}
+
+			id, err := getNodeId(response.Response)
+
+			if err != nil {
+				return nil, fmt.Errorf("received an invalid '%s' response from %s: %w", method, address, err)
+			}
+
+			d.routingTable.add(Node{Id: id, Address: address})
+
+			return response.Response, nil
+		}
+
+	case <-timer.C:
+		{
+			d.markFailed(address)
+			return nil, fmt.Errorf("'%s' query to %s timed out", method, address)
+		}
+
+	case <-ctx.Done():
+		{
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (d *DHT) markFailed(address netip.AddrPort) {
+	for _, node := range d.routingTable.nodes() {
+		if node.Address == address {
+			d.routingTable.markFailed(node.Id)
+			return
+		}
+	}
+}
+
+// Converts IPv4-mapped IPv6 addresses (as returned when resolving some IPv4 addresses) to plain IPv4 addresses.
+func unmap(address netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(address.Addr().Unmap(), address.Port())
+}
+
+func (d *DHT) send(address netip.AddrPort, msg *message) error {
+	data, err := msg.encode()
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := d.conn.WriteToUDPAddrPort(data, address); err != nil {
+		return fmt.Errorf("failed to send KRPC message to %s: %w", address, err)
+	}
+
+	return nil
+}
+
+func (d *DHT) readMessages() {
+	defer d.wg.Done()
+
+	buffer := make([]byte, maxMessageSize)
+
+	for {
+		n, address, err := d.conn.ReadFromUDPAddrPort(buffer)
+
+		if err != nil {
+			if d.ctx.Err() != nil {
+				return
+			}
+
+			continue
+		}
+
+		msg, err := decodeMessage(buffer[:n])
+
+		if err != nil {
+			continue
+		}
+
+		address = unmap(address)
+
+		if msg.Type == queryMessageType {
+			d.handleQuery(address, msg)
+			continue
+		}
+
+		d.mutex.Lock()
+		t, ok := d.transactions[msg.TransactionId]
+		d.mutex.Unlock()
+
+		if !ok || t.address != address {
+			continue
+		}
+
+		select {
+		case t.responseCh <- msg:
+		default:
+		}
+	}
+}
+
+func (d *DHT) handleQuery(address netip.AddrPort, msg *message) {
+	id, err := getNodeId(msg.Arguments)
+
+	if err != nil {
+		d.sendError(address, msg.TransactionId, protocolErrorCode, err.Error())
+		return
+	}
+
+	response := map[string]any{"id": string(d.id[:])}
+
+	switch msg.Method {
+	case pingMethod:
+		{
+		}
+
+	case findNodeMethod:
+		{
+			target, ok := msg.Arguments["target"].(string)
+
+			if !ok || len(target) != len(NodeId{}) {
+				d.sendError(address, msg.TransactionId, protocolErrorCode, "'target' property must be a 20-byte string")
+				return
+			}
+
+			response["nodes"] = encodeCompactNodes(d.routingTable.closest(NodeId([]byte(target)), K))
+		}
+
+	case getPeersMethod:
+		{
+			infoHash, err := getInfoHash(msg.Arguments)
+
+			if err != nil {
+				d.sendError(address, msg.TransactionId, protocolErrorCode, err.Error())
+				return
+			}
+
+			response["token"] = d.tokenManager.generate(address.Addr())
+
+			if peers := d.peerStore.get(infoHash); len(peers) > 0 {
+				values := []any{}
+
+				for _, peer := range peers {
+					if compactPeer, err := encodeCompactPeer(peer); err == nil {
+						values = append(values, string(compactPeer))
+					}
+				}
+
+				response["values"] = values
+			} else {
+				response["nodes"] = encodeCompactNodes(d.routingTable.closest(NodeId(infoHash), K))
+			}
+		}
+
+	case announcePeerMethod:
+		{
+			infoHash, err := getInfoHash(msg.Arguments)
+
+			if err != nil {
+				d.sendError(address, msg.TransactionId, protocolErrorCode, err.Error())
+				return
+			}
+
+			token, _ := msg.Arguments["token"].(string)
+
+			if !d.tokenManager.validate(token, address.Addr()) {
+				d.sendError(address, msg.TransactionId, protocolErrorCode, "invalid token")
+				return
+			}
+
+			port := address.Port()
+
+			// If "implied_port" is set, the source port of the UDP packet is used as the peer's port.
+			if impliedPort, _ := msg.Arguments["implied_port"].(int); impliedPort != 1 {
+				announcedPort, ok := msg.Arguments["port"].(int)
+
+				if !ok || announcedPort <= 0 || announcedPort > 65535 {
+					d.sendError(address, msg.TransactionId, protocolErrorCode, "'port' property must be a valid port number")
+					return
+				}
+
+				port = uint16(announcedPort)
+			}
+
+			d.peerStore.add(infoHash, netip.AddrPortFrom(address.Addr(), port))
+		}
+
+	default:
+		{
+			d.sendError(address, msg.TransactionId, methodUnknownErrorCode, "method unknown")
+			return
+		}
+	}
+
+	d.routingTable.add(Node{Id: id, Address: address})
+	d.send(address, &message{TransactionId: msg.TransactionId, Type: responseMessageType, Response: response})
+}
+
+func (d *DHT) sendError(address netip.AddrPort, transactionId string, code int, errorMessage string) {
+	d.send(address, &message{TransactionId: transactionId, Type: errorMessageType, ErrorCode: code, ErrorMessage: errorMessage})
+}
+
+// Periodically looks up a random Id in buckets that have not changed recently to keep the routing table fresh.
+func (d *DHT) refreshBuckets() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			{
+				return
+			}
+
+		case <-ticker.C:
+			{
+				for _, index := range d.routingTable.staleBuckets(bucketRefreshInterval) {
+					d.FindNode(d.ctx, d.routingTable.randomIdInBucket(index))
+				}
+			}
+		}
+	}
+}
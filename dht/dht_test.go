@@ -0,0 +1,155 @@
+package dht_test
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MlkMahmud/hail/dht"
+)
+
+func newNetwork(t *testing.T, size int) []*dht.DHT {
+	t.Helper()
+
+	nodes := []*dht.DHT{}
+
+	for i := range size {
+		config := dht.Config{Address: "127.0.0.1:0", QueryTimeout: 500 * time.Millisecond}
+
+		if i > 0 {
+			config.BootstrapNodes = []string{nodes[0].Addr().String()}
+		}
+
+		node, err := dht.New(config)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() { node.Close() })
+		nodes = append(nodes, node)
+	}
+
+	for _, node := range nodes[1:] {
+		if err := node.Bootstrap(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return nodes
+}
+
+func TestBootstrap(t *testing.T) {
+	nodes := newNetwork(t, 10)
+
+	for index, node := range nodes {
+		if node.NumOfNodes() == 0 {
+			t.Errorf("expected node %d to have a non-empty routing table", index)
+		}
+	}
+}
+
+func TestFindNode(t *testing.T) {
+	nodes := newNetwork(t, 20)
+	target := nodes[len(nodes)-1].Id()
+
+	closest, err := nodes[1].FindNode(context.Background(), target)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(closest) == 0 || closest[0].Id != target {
+		t.Errorf("expected the closest node to the target to be the target itself, but got %v", closest)
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	nodes := newNetwork(t, 20)
+	infoHash := sha1.Sum([]byte("hail"))
+
+	announcers := []*dht.DHT{nodes[3], nodes[7], nodes[11]}
+
+	for index, node := range announcers {
+		if _, err := node.Announce(context.Background(), infoHash, uint16(6881+index)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	peers, err := nodes[15].GetPeers(context.Background(), infoHash)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for index := range announcers {
+		expectedPeer := netip.MustParseAddrPort(fmt.Sprintf("127.0.0.1:%d", 6881+index))
+		found := false
+
+		for _, peer := range peers {
+			if peer == expectedPeer {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Errorf("expected peers %v to include %s", peers, expectedPeer)
+		}
+	}
+}
+
+func TestGetPeersWithEmptyRoutingTable(t *testing.T) {
+	node, err := dht.New(dht.Config{Address: "127.0.0.1:0"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer node.Close()
+
+	if _, err := node.GetPeers(context.Background(), sha1.Sum([]byte("hail"))); err != dht.ErrNoNodes {
+		t.Errorf("expected error to be '%v', but got '%v'", dht.ErrNoNodes, err)
+	}
+}
+
+func TestRoutingTablePersistence(t *testing.T) {
+	nodes := newNetwork(t, 5)
+	path := filepath.Join(t.TempDir(), "dht.json")
+
+	node, err := dht.New(dht.Config{Address: "127.0.0.1:0", BootstrapNodes: []string{nodes[0].Addr().String()}, RoutingTablePath: path})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := node.Bootstrap(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	numOfNodes := node.NumOfNodes()
+	id := node.Id()
+
+	if err := node.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restoredNode, err := dht.New(dht.Config{Address: "127.0.0.1:0", RoutingTablePath: path})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer restoredNode.Close()
+
+	if restoredNode.Id() != id {
+		t.Errorf("expected restored node Id to be %s, but got %s", id, restoredNode.Id())
+	}
+
+	if restoredNode.NumOfNodes() != numOfNodes {
+		t.Errorf("expected restored routing table to contain %d nodes, but got %d", numOfNodes, restoredNode.NumOfNodes())
+	}
+}
@@ -0,0 +1,179 @@
+package dht
+
+import (
+	"fmt"
+
+	"github.com/MlkMahmud/hail/bencode"
+)
+
+/*
+A KRPC message, a bencoded dictionary sent over UDP.
+
+Every message has a transaction Id ("t") chosen by the querying node and echoed in the response,
+and a type ("y") which is one of "q" (query), "r" (response) or "e" (error).
+Queries carry the method name in "q" and its arguments in "a", responses carry their return values in "r"
+and errors carry a list containing an error code and a message in "e".
+*/
+type message struct {
+	TransactionId string
+	Type          string
+
+	Method    string
+	Arguments map[string]any
+	Response  map[string]any
+
+	ErrorCode    int
+	ErrorMessage string
+}
+
+type krpcError struct {
+	code    int
+	message string
+}
+
+const (
+	queryMessageType    = "q"
+	responseMessageType = "r"
+	errorMessageType    = "e"
+)
+
+const (
+	pingMethod         = "ping"
+	findNodeMethod     = "find_node"
+	getPeersMethod     = "get_peers"
+	announcePeerMethod = "announce_peer"
+)
+
+const (
+	genericErrorCode       = 201
+	serverErrorCode        = 202
+	protocolErrorCode      = 203
+	methodUnknownErrorCode = 204
+)
+
+func (e *krpcError) Error() string {
+	return fmt.Sprintf("KRPC error %d: %s", e.code, e.message)
+}
+
+func decodeMessage(data []byte) (*message, error) {
+	decodedValue, _, err := bencode.DecodeValue(data)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode KRPC message: %w", err)
+	}
+
+	dict, ok := decodedValue.(map[string]any)
+
+	if !ok {
+		return nil, fmt.Errorf("expected KRPC message to be a dictionary, but received '%T'", decodedValue)
+	}
+
+	msg := &message{}
+
+	if msg.TransactionId, ok = dict["t"].(string); !ok {
+		return nil, fmt.Errorf("KRPC message is missing the 't' (transaction Id) property")
+	}
+
+	if msg.Type, ok = dict["y"].(string); !ok {
+		return nil, fmt.Errorf("KRPC message is missing the 'y' (message type) property")
+	}
+
+	switch msg.Type {
+	case queryMessageType:
+		{
+			if msg.Method, ok = dict["q"].(string); !ok {
+				return nil, fmt.Errorf("KRPC query is missing the 'q' (method name) property")
+			}
+
+			if msg.Arguments, ok = dict["a"].(map[string]any); !ok {
+				return nil, fmt.Errorf("KRPC query is missing the 'a' (arguments) property")
+			}
+		}
+
+	case responseMessageType:
+		{
+			if msg.Response, ok = dict["r"].(map[string]any); !ok {
+				return nil, fmt.Errorf("KRPC response is missing the 'r' (return values) property")
+			}
+		}
+
+	case errorMessageType:
+		{
+			list, ok := dict["e"].([]any)
+
+			if !ok || len(list) != 2 {
+				return nil, fmt.Errorf("KRPC error must contain an 'e' property with an error code and message")
+			}
+
+			msg.ErrorCode, _ = list[0].(int)
+			msg.ErrorMessage, _ = list[1].(string)
+		}
+
+	default:
+		{
+			return nil, fmt.Errorf("KRPC message type '%s' is invalid", msg.Type)
+		}
+	}
+
+	return msg, nil
+}
+
+func (m *message) encode() ([]byte, error) {
+	dict := map[string]any{
+		"t": m.TransactionId,
+		"y": m.Type,
+	}
+
+	switch m.Type {
+	case queryMessageType:
+		{
+			dict["q"] = m.Method
+			dict["a"] = m.Arguments
+		}
+
+	case responseMessageType:
+		{
+			dict["r"] = m.Response
+		}
+
+	case errorMessageType:
+		{
+			dict["e"] = []any{m.ErrorCode, m.ErrorMessage}
+		}
+	}
+
+	bencodedString, err := bencode.EncodeValue(dict)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode KRPC message: %w", err)
+	}
+
+	return []byte(bencodedString), nil
+}
+
+// Returns the node Id stored in the "id" property of a query's arguments or a response's return values.
+func getNodeId(dict map[string]any) (NodeId, error) {
+	var id NodeId
+	value, ok := dict["id"].(string)
+
+	if !ok || len(value) != len(id) {
+		return id, fmt.Errorf("expected 'id' property to be a %d-byte string", len(id))
+	}
+
+	copy(id[:], value)
+
+	return id, nil
+}
+
+func getInfoHash(dict map[string]any) ([20]byte, error) {
+	var infoHash [20]byte
+	value, ok := dict["info_hash"].(string)
+
+	if !ok || len(value) != len(infoHash) {
+		return infoHash, fmt.Errorf("expected 'info_hash' property to be a %d-byte string", len(infoHash))
+	}
+
+	copy(infoHash[:], value)
+
+	return infoHash, nil
+}
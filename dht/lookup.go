@@ -0,0 +1,149 @@
+package dht
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"sync"
+)
+
+type lookupResponse struct {
+	nodes []Node
+	peers []netip.AddrPort
+	token string
+}
+
+type lookupResult struct {
+	// The K closest nodes to the target that responded to our queries.
+	closest []Node
+	peers   []netip.AddrPort
+	// Write tokens returned by the nodes that responded to "get_peers" queries.
+	tokens map[NodeId]string
+}
+
+type lookupQueryFunc func(ctx context.Context, node Node) (*lookupResponse, error)
+
+const (
+	// Number of concurrent queries sent during a lookup.
+	alpha = 3
+)
+
+/*
+Performs an iterative lookup for the target.
+
+Starting with the closest nodes in the routing table, the lookup repeatedly queries the alpha closest nodes
+that have not been queried yet, adding the nodes returned in their responses to the list of candidates.
+The lookup ends when the K closest candidates have all been queried.
+*/
+func (d *DHT) lookup(ctx context.Context, target NodeId, queryFunc lookupQueryFunc) (*lookupResult, error) {
+	candidates := d.routingTable.closest(target, K)
+
+	if len(candidates) == 0 {
+		return nil, ErrNoNodes
+	}
+
+	result := &lookupResult{tokens: make(map[NodeId]string)}
+	seenNodes := make(map[NodeId]struct{})
+	seenPeers := make(map[netip.AddrPort]struct{})
+	queriedNodes := make(map[NodeId]bool)
+	respondedNodes := make(map[NodeId]struct{})
+
+	for _, node := range candidates {
+		seenNodes[node.Id] = struct{}{}
+	}
+
+	sortByDistance := func(nodes []Node) {
+		slices.SortFunc(nodes, func(a Node, b Node) int {
+			if target.closer(a.Id, b.Id) {
+				return -1
+			}
+
+			if target.closer(b.Id, a.Id) {
+				return 1
+			}
+
+			return 0
+		})
+	}
+
+	var mutex sync.Mutex
+
+	for ctx.Err() == nil {
+		sortByDistance(candidates)
+		pendingNodes := []Node{}
+		numOfClosestNodes := 0
+
+		// Only the K closest nodes that have responded (or are yet to be queried) count towards the end of the lookup.
+		for _, node := range candidates {
+			if numOfClosestNodes >= K || len(pendingNodes) >= alpha {
+				break
+			}
+
+			if !queriedNodes[node.Id] {
+				pendingNodes = append(pendingNodes, node)
+				numOfClosestNodes += 1
+				continue
+			}
+
+			if _, ok := respondedNodes[node.Id]; ok {
+				numOfClosestNodes += 1
+			}
+		}
+
+		if len(pendingNodes) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+
+		for _, node := range pendingNodes {
+			queriedNodes[node.Id] = true
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				response, err := queryFunc(ctx, node)
+
+				if err != nil {
+					return
+				}
+
+				mutex.Lock()
+				defer mutex.Unlock()
+
+				respondedNodes[node.Id] = struct{}{}
+
+				if response.token != "" {
+					result.tokens[node.Id] = response.token
+				}
+
+				for _, peer := range response.peers {
+					if _, ok := seenPeers[peer]; !ok {
+						seenPeers[peer] = struct{}{}
+						result.peers = append(result.peers, peer)
+					}
+				}
+
+				for _, newNode := range response.nodes {
+					if _, ok := seenNodes[newNode.Id]; ok || newNode.Id == d.id {
+						continue
+					}
+
+					seenNodes[newNode.Id] = struct{}{}
+					candidates = append(candidates, newNode)
+				}
+			}()
+		}
+
+		wg.Wait()
+	}
+
+	for _, node := range candidates {
+		if _, ok := respondedNodes[node.Id]; ok && len(result.closest) < K {
+			result.closest = append(result.closest, node)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,163 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"net"
+	"net/netip"
+	"time"
+)
+
+type NodeId [sha1.Size]byte
+
+type Node struct {
+	Id      NodeId
+	Address netip.AddrPort
+
+	failedQueries int
+	lastSeen      time.Time
+}
+
+const (
+	compactNodeSize = sha1.Size + compactPeerSize
+	compactPeerSize = 6
+)
+
+func NewRandomNodeId() NodeId {
+	var id NodeId
+
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(fmt.Sprintf("failed to generate random node Id: %v", err))
+	}
+
+	return id
+}
+
+func ParseNodeId(str string) (NodeId, error) {
+	var id NodeId
+	decoded, err := hex.DecodeString(str)
+
+	if err != nil {
+		return id, fmt.Errorf("failed to decode hex encoded node Id: %w", err)
+	}
+
+	if len(decoded) != sha1.Size {
+		return id, fmt.Errorf("node Id must be %d bytes long, but received %d bytes", sha1.Size, len(decoded))
+	}
+
+	copy(id[:], decoded)
+
+	return id, nil
+}
+
+func (id NodeId) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Returns the XOR distance between two node Ids.
+func (id NodeId) distance(other NodeId) NodeId {
+	var result NodeId
+
+	for i := range id {
+		result[i] = id[i] ^ other[i]
+	}
+
+	return result
+}
+
+// Returns the number of leading bits shared by both node Ids.
+func (id NodeId) commonPrefixLength(other NodeId) int {
+	distance := id.distance(other)
+
+	for i, b := range distance {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+
+	return len(id) * 8
+}
+
+// Reports whether `a` is closer to the node Id than `b`.
+func (id NodeId) closer(a NodeId, b NodeId) bool {
+	distanceA := id.distance(a)
+	distanceB := id.distance(b)
+
+	return bytes.Compare(distanceA[:], distanceB[:]) < 0
+}
+
+func (n *Node) isBad() bool {
+	return n.failedQueries >= maxFailedQueries
+}
+
+func encodeCompactPeer(address netip.AddrPort) ([]byte, error) {
+	if !address.Addr().Unmap().Is4() {
+		return nil, fmt.Errorf("address '%s' is not an IPv4 address", address)
+	}
+
+	buffer := make([]byte, compactPeerSize)
+	ip := address.Addr().Unmap().As4()
+
+	copy(buffer, ip[:])
+	binary.BigEndian.PutUint16(buffer[net.IPv4len:], address.Port())
+
+	return buffer, nil
+}
+
+func decodeCompactPeer(buffer []byte) (netip.AddrPort, error) {
+	if len(buffer) != compactPeerSize {
+		return netip.AddrPort{}, fmt.Errorf("compact peer info must be %d bytes long, but received %d bytes", compactPeerSize, len(buffer))
+	}
+
+	ip := netip.AddrFrom4([4]byte(buffer[:net.IPv4len]))
+	port := binary.BigEndian.Uint16(buffer[net.IPv4len:])
+
+	return netip.AddrPortFrom(ip, port), nil
+}
+
+/*
+Encodes a list of nodes in the "Compact node info" format.
+
+Each node is represented by its 20-byte node Id followed by its IP address and port in the "Compact IP-address/port info" format.
+*/
+func encodeCompactNodes(nodes []Node) string {
+	buffer := make([]byte, 0, len(nodes)*compactNodeSize)
+
+	for _, node := range nodes {
+		compactPeer, err := encodeCompactPeer(node.Address)
+
+		if err != nil {
+			continue
+		}
+
+		buffer = append(buffer, node.Id[:]...)
+		buffer = append(buffer, compactPeer...)
+	}
+
+	return string(buffer)
+}
+
+func decodeCompactNodes(str string) ([]Node, error) {
+	if len(str)%compactNodeSize != 0 {
+		return nil, fmt.Errorf("compact node info must be a multiple of %d bytes", compactNodeSize)
+	}
+
+	nodes := make([]Node, 0, len(str)/compactNodeSize)
+
+	for i := 0; i < len(str); i += compactNodeSize {
+		address, err := decodeCompactPeer([]byte(str[i+sha1.Size : i+compactNodeSize]))
+
+		if err != nil {
+			return nil, err
+		}
+
+		nodes = append(nodes, Node{Id: NodeId([]byte(str[i : i+sha1.Size])), Address: address})
+	}
+
+	return nodes, nil
+}
@@ -0,0 +1,130 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Stores the peers announced to us by other nodes.
+type peerStore struct {
+	mutex sync.Mutex
+	peers map[[20]byte]map[netip.AddrPort]time.Time
+}
+
+/*
+Generates and validates the write tokens handed out in "get_peers" responses.
+
+A token is the SHA-1 hash of the querying node's IP address concatenated with a secret that changes every five minutes.
+Tokens generated with the previous secret are still accepted, so a token remains valid for up to ten minutes.
+*/
+type tokenManager struct {
+	mutex          sync.Mutex
+	previousSecret []byte
+	rotatedAt      time.Time
+	secret         []byte
+}
+
+const (
+	maxPeersPerInfoHash = 100
+	// Number of peers returned in a "get_peers" response, chosen to keep responses within a single UDP datagram.
+	maxPeersPerResponse = 50
+	peerExpiry          = 30 * time.Minute
+
+	tokenRotationInterval = 5 * time.Minute
+	tokenSize             = 8
+)
+
+func newPeerStore() *peerStore {
+	return &peerStore{peers: make(map[[20]byte]map[netip.AddrPort]time.Time)}
+}
+
+func (ps *peerStore) add(infoHash [20]byte, address netip.AddrPort) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	peers, ok := ps.peers[infoHash]
+
+	if !ok {
+		peers = make(map[netip.AddrPort]time.Time)
+		ps.peers[infoHash] = peers
+	}
+
+	if _, exists := peers[address]; !exists && len(peers) >= maxPeersPerInfoHash {
+		return
+	}
+
+	peers[address] = time.Now()
+}
+
+func (ps *peerStore) get(infoHash [20]byte) []netip.AddrPort {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	addresses := []netip.AddrPort{}
+
+	for address, announcedAt := range ps.peers[infoHash] {
+		if time.Since(announcedAt) > peerExpiry {
+			delete(ps.peers[infoHash], address)
+			continue
+		}
+
+		if len(addresses) < maxPeersPerResponse {
+			addresses = append(addresses, address)
+		}
+	}
+
+	return addresses
+}
+
+func newTokenManager() *tokenManager {
+	return &tokenManager{secret: newSecret(), rotatedAt: time.Now()}
+}
+
+func newSecret() []byte {
+	secret := make([]byte, 16)
+	rand.Read(secret)
+
+	return secret
+}
+
+func (tm *tokenManager) rotate() {
+	if time.Since(tm.rotatedAt) < tokenRotationInterval {
+		return
+	}
+
+	tm.previousSecret = tm.secret
+	tm.secret = newSecret()
+	tm.rotatedAt = time.Now()
+}
+
+func generateToken(secret []byte, ip netip.Addr) string {
+	ipBytes := ip.Unmap().AsSlice()
+	hash := sha1.Sum(append(append([]byte{}, ipBytes...), secret...))
+
+	return string(hash[:tokenSize])
+}
+
+func (tm *tokenManager) generate(ip netip.Addr) string {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	tm.rotate()
+
+	return generateToken(tm.secret, ip)
+}
+
+func (tm *tokenManager) validate(token string, ip netip.Addr) bool {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	tm.rotate()
+
+	if token == generateToken(tm.secret, ip) {
+		return true
+	}
+
+	return tm.previousSecret != nil && token == generateToken(tm.previousSecret, ip)
+}
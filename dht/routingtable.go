@@ -0,0 +1,188 @@
+package dht
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	lastChanged time.Time
+	// nodes are ordered from least to most recently seen.
+	nodes []*Node
+}
+
+/*
+A Kademlia routing table.
+
+The table contains one bucket for every possible length of the prefix shared with our own node Id.
+Each bucket holds up to K nodes. When a bucket is full, good nodes are never evicted in favour of new ones;
+a new node only replaces a node that has failed to respond to multiple queries.
+*/
+type routingTable struct {
+	buckets [len(NodeId{}) * 8]bucket
+	id      NodeId
+	mutex   sync.Mutex
+}
+
+const (
+	// Maximum number of nodes in a bucket.
+	K = 8
+
+	maxFailedQueries = 2
+)
+
+func newRoutingTable(id NodeId) *routingTable {
+	return &routingTable{id: id}
+}
+
+func (rt *routingTable) bucketIndex(id NodeId) int {
+	return min(rt.id.commonPrefixLength(id), len(rt.buckets)-1)
+}
+
+/*
+Inserts a node that has been seen (responded to a query or sent us a query) into the routing table.
+
+Returns false if the node could not be added because its bucket is full of good nodes.
+*/
+func (rt *routingTable) add(node Node) bool {
+	if node.Id == rt.id || !node.Address.IsValid() {
+		return false
+	}
+
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	b := &rt.buckets[rt.bucketIndex(node.Id)]
+	now := time.Now()
+
+	for index, existingNode := range b.nodes {
+		if existingNode.Id != node.Id {
+			continue
+		}
+
+		existingNode.Address = node.Address
+		existingNode.failedQueries = 0
+		existingNode.lastSeen = now
+
+		b.nodes = append(slices.Delete(b.nodes, index, index+1), existingNode)
+		b.lastChanged = now
+
+		return true
+	}
+
+	newNode := &Node{Id: node.Id, Address: node.Address, lastSeen: now}
+
+	if len(b.nodes) < K {
+		b.nodes = append(b.nodes, newNode)
+		b.lastChanged = now
+
+		return true
+	}
+
+	for index, existingNode := range b.nodes {
+		if existingNode.isBad() {
+			b.nodes = append(slices.Delete(b.nodes, index, index+1), newNode)
+			b.lastChanged = now
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns up to `count` nodes ordered by their distance to the target.
+func (rt *routingTable) closest(target NodeId, count int) []Node {
+	nodes := rt.nodes()
+
+	slices.SortFunc(nodes, func(a Node, b Node) int {
+		if target.closer(a.Id, b.Id) {
+			return -1
+		}
+
+		if target.closer(b.Id, a.Id) {
+			return 1
+		}
+
+		return 0
+	})
+
+	return nodes[:min(count, len(nodes))]
+}
+
+// Records a query that the node failed to respond to. Bad nodes are removed once a replacement is available.
+func (rt *routingTable) markFailed(id NodeId) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	b := &rt.buckets[rt.bucketIndex(id)]
+
+	for index, node := range b.nodes {
+		if node.Id != id {
+			continue
+		}
+
+		node.failedQueries += 1
+
+		// Bad nodes in a bucket that isn't full don't need to be kept around as eviction candidates.
+		if node.isBad() && len(b.nodes) < K {
+			b.nodes = slices.Delete(b.nodes, index, index+1)
+		}
+
+		return
+	}
+}
+
+func (rt *routingTable) nodes() []Node {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	nodes := []Node{}
+
+	for _, b := range rt.buckets {
+		for _, node := range b.nodes {
+			if !node.isBad() {
+				nodes = append(nodes, *node)
+			}
+		}
+	}
+
+	return nodes
+}
+
+func (rt *routingTable) size() int {
+	return len(rt.nodes())
+}
+
+// Returns the indices of non-empty buckets that have not changed within the given duration.
+func (rt *routingTable) staleBuckets(maxAge time.Duration) []int {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	indices := []int{}
+
+	for index, b := range rt.buckets {
+		if len(b.nodes) > 0 && time.Since(b.lastChanged) > maxAge {
+			indices = append(indices, index)
+		}
+	}
+
+	return indices
+}
+
+// Returns a random node Id that falls into the bucket at the given index.
+func (rt *routingTable) randomIdInBucket(index int) NodeId {
+	id := NewRandomNodeId()
+	byteIndex := index / 8
+	bitIndex := index % 8
+
+	// Copy the shared prefix from our own Id, then flip the first bit after it.
+	copy(id[:byteIndex], rt.id[:byteIndex])
+
+	mask := byte(0xff) << (8 - bitIndex)
+	id[byteIndex] = (rt.id[byteIndex] & mask) | (id[byteIndex] &^ mask)
+	id[byteIndex] ^= (id[byteIndex] ^ ^rt.id[byteIndex]) & (0x80 >> bitIndex)
+
+	return id
+}
@@ -2,235 +2,502 @@ package downloader
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
+	"time"
 
-	"github.com/MlkMahmud/hail/torrent"
+	"github.com/MlkMahmud/hail/logging"
 )
 
-type DownloadManager struct {
-	downloadQueue []DownloadRequest
+// A torrent whose activity is controlled by a download manager. Implemented by `*torrent.Torrent`.
+type Torrent interface {
+	InfoHash() [sha1.Size]byte
+	BytesDownloaded() int64
+	IsFinished() bool
+	IsPaused() bool
+	HasReachedSeedingGoal() bool
+	Pause()
+	Resume()
 }
 
-type DownloadRequest struct {
-	completed chan bool
-	failed    chan bool
+type QueueState int
+
+/*
+A queue of torrents of which at most N are downloading and M are seeding at a time.
+
+Torrents are started in queue order: when an active torrent finishes downloading or stalls (no data was downloaded for a while),
+the next queued torrent is started. Seeds that reach their seeding goal give their slot to the next finished torrent.
+Torrents in the queue are paused and resumed by the manager, they shouldn't be paused or resumed directly.
+
+The order of the queue is saved to a file, so torrents that are added again after a restart get their previous position back.
+*/
+type DownloadManager struct {
+	config Config
 
-	dest                  string
-	name                  string
-	numOfPiecesDownloaded int
-	numOfPiecesToDownload int
-	peers                 []torrent.Peer
-	pieces                []torrent.Piece
-	tempDir               string
+	mutex   *sync.Mutex
+	entries map[[sha1.Size]byte]*queueEntry
+	// Info hashes in queue order. Includes the torrents loaded from the queue file that haven't been added again yet.
+	order [][sha1.Size]byte
 
-	context    context.Context
+	ctx        context.Context
 	cancelFunc context.CancelFunc
+	// Signals the scheduler that the queue changed.
+	updateCh chan struct{}
 
-	mutex *sync.Mutex
-	once  *sync.Once
+	logger *slog.Logger
 }
 
-type DownloadRequestConfig struct {
-	Dest   string
-	Name   string
-	Peers  []torrent.Peer
-	Pieces []torrent.Piece
+type Config struct {
+	// Maximum number of torrents downloading at a time. Defaults to 3, negative values remove the limit.
+	MaxActiveDownloads int
+	// Maximum number of finished torrents seeding at a time. Defaults to 3, negative values remove the limit.
+	MaxActiveSeeds int
+	// Amount of time without downloading any data after which a download is stalled.
+	// Stalled downloads keep running, but don't count towards `MaxActiveDownloads`. Defaults to 5 minutes.
+	StallTimeout time.Duration
+	// Path of the file the queue order is saved to. The order isn't saved if empty.
+	QueuePath string
+	// Logger of the manager, whose records are tagged with the "queue" component. Defaults to `slog.Default()`.
+	Logger *slog.Logger
 }
 
-func NewDownloadManager() *DownloadManager {
-	return new(DownloadManager)
+// A torrent and its state, in queue order.
+type QueueEntry struct {
+	Torrent Torrent
+	State   QueueState
 }
 
-func NewDownloadRequest(config DownloadRequestConfig) *DownloadRequest {
-	var mutex sync.Mutex
-	var once sync.Once
+type queueEntry struct {
+	torrent Torrent
+	state   QueueState
+
+	// Used to detect stalled downloads.
+	lastDownloaded int64
+	lastProgress   time.Time
+}
+
+type savedQueue struct {
+	InfoHashes []string `json:"infoHashes"`
+}
 
-	return &DownloadRequest{
-		completed: make(chan bool),
-		failed:    make(chan bool),
+const (
+	Queued QueueState = iota
+	Downloading
+	Stalled
+	Seeding
+	// Finished torrents that reached their seeding goal. They aren't started again by the manager.
+	Completed
+)
 
-		dest:                  config.Dest,
-		name:                  config.Name,
-		numOfPiecesDownloaded: 0,
-		numOfPiecesToDownload: len(config.Pieces),
-		peers:                 config.Peers,
-		pieces:                config.Pieces,
+const (
+	defaultMaxActiveDownloads = 3
+	defaultMaxActiveSeeds     = 3
+	defaultStallTimeout       = 5 * time.Minute
 
-		mutex: &mutex,
-		once:  &once,
+	schedulerInterval = time.Second
+)
+
+var (
+	ErrAlreadyQueued = errors.New("torrent is already in the queue")
+	ErrNotQueued     = errors.New("torrent is not in the queue")
+)
+
+func (s QueueState) String() string {
+	switch s {
+	case Queued:
+		return "queued"
+	case Downloading:
+		return "downloading"
+	case Stalled:
+		return "stalled"
+	case Seeding:
+		return "seeding"
+	case Completed:
+		return "completed"
+	default:
+		return "unknown"
 	}
 }
 
-func (dr *DownloadRequest) markAsCompleted() {
-	dr.once.Do(func() {
-		dr.completed <- true
-	})
-}
+// Creates a download manager, loading the queue order saved to `config.QueuePath` if the file exists.
+func NewDownloadManager(config Config) (*DownloadManager, error) {
+	if config.MaxActiveDownloads == 0 {
+		config.MaxActiveDownloads = defaultMaxActiveDownloads
+	}
 
-func (dr *DownloadRequest) markAsFailed() {
-	dr.once.Do(func() {
-		dr.failed <- true
-	})
-}
+	if config.MaxActiveSeeds == 0 {
+		config.MaxActiveSeeds = defaultMaxActiveSeeds
+	}
+
+	if config.StallTimeout <= 0 {
+		config.StallTimeout = defaultStallTimeout
+	}
 
-func (dr *DownloadRequest) mergeDownloadedPieces() error {
-	// todo: check if dest is a directory
-	destFile, err := os.OpenFile(dr.dest, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	order, err := loadQueue(config.QueuePath)
 
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	var mutex sync.Mutex
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+
+	return &DownloadManager{
+		config: config,
+
+		mutex:   &mutex,
+		entries: make(map[[sha1.Size]byte]*queueEntry),
+		order:   order,
+
+		ctx:        ctx,
+		cancelFunc: cancelFunc,
+		updateCh:   make(chan struct{}, 1),
+
+		logger: logging.Component(config.Logger, logging.ComponentQueue),
+	}, nil
+}
+
+func loadQueue(path string) ([][sha1.Size]byte, error) {
+	if path == "" {
+		return nil, nil
 	}
 
-	defer destFile.Close()
+	content, err := os.ReadFile(path)
 
-	entries, err := os.ReadDir(dr.tempDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, entry := range entries {
-		path := filepath.Join(dr.tempDir, entry.Name())
-		contents, err := os.ReadFile(path)
+	var saved savedQueue
+
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse queue file '%s': %w", path, err)
+	}
+
+	order := make([][sha1.Size]byte, 0, len(saved.InfoHashes))
 
-		if err != nil {
-			return nil
+	for _, entry := range saved.InfoHashes {
+		var infoHash [sha1.Size]byte
+
+		if decoded, err := hex.DecodeString(entry); err != nil || len(decoded) != sha1.Size {
+			return nil, fmt.Errorf("queue file '%s' contains an invalid info hash '%s'", path, entry)
+		} else {
+			copy(infoHash[:], decoded)
 		}
 
-		if _, err := destFile.Write(contents); err != nil {
-			return err
+		if !slices.Contains(order, infoHash) {
+			order = append(order, infoHash)
 		}
 	}
 
-	return nil
+	return order, nil
 }
 
-func (dr *DownloadRequest) startDownload() {
-	// return early if peers list is empty or there are no pieces to be downloaded
-	tempDir, err := os.MkdirTemp("", "")
+// Saves the queue order. The mutex must be held.
+func (dm *DownloadManager) saveQueue() error {
+	if dm.config.QueuePath == "" {
+		return nil
+	}
+
+	saved := savedQueue{InfoHashes: []string{}}
+
+	for _, infoHash := range dm.order {
+		saved.InfoHashes = append(saved.InfoHashes, hex.EncodeToString(infoHash[:]))
+	}
+
+	content, err := json.Marshal(saved)
 
 	if err != nil {
-		// handle error and move to next item
-		fmt.Println(err)
-	}
-
-	dr.tempDir = tempDir
-	dr.context, dr.cancelFunc = context.WithCancel(context.Background())
-
-	connectionPool := torrent.NewPeerConnectionPool()
-	connectionPool.InitPeerConnectionPool(dr.peers, len(dr.pieces))
-
-	piecesToDownload := make(chan torrent.Piece, dr.numOfPiecesToDownload)
-
-	for i := range dr.numOfPiecesToDownload {
-		piecesToDownload <- dr.pieces[i]
-	}
-
-	for _, connection := range connectionPool.Connections {
-		go func(ct context.Context, pc torrent.PeerConnection) {
-			for {
-				select {
-				case <-ct.Done():
-					{
-						return
-					}
-				case piece := <-piecesToDownload:
-					downloadedPiece, err := pc.DownloadPiece(piece)
-
-					if err != nil && pc.FailedAttempts >= torrent.MaxFailedAttempts {
-						fmt.Println(err)
-						piecesToDownload <- piece
-						connectionPool.RemovePeerConnectionFromPool(pc.PeerAddress, dr.markAsFailed)
-						return
-					}
-
-					if err != nil {
-						fmt.Println(err)
-						pc.FailedAttempts += 1
-						piecesToDownload <- piece
-						continue
-					}
-
-					if err := downloadedPiece.CheckHashIntegrity(); err != nil {
-						fmt.Println(err)
-						pc.FailedAttempts += 1
-						piecesToDownload <- piece
-						continue
-					}
-
-					if err := downloadedPiece.WriteToDisk(dr.tempDir); err != nil {
-						fmt.Println(err)
-						pc.FailedAttempts += 1
-						// todo: parse error to see if it's worth retrying.
-						piecesToDownload <- piece
-						continue
-					}
-					dr.updateProgress()
-				}
-			}
-		}(dr.context, connection)
+		return fmt.Errorf("failed to encode download queue: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dm.config.QueuePath), 0755); err != nil {
+		return fmt.Errorf("failed to save download queue: %w", err)
 	}
 
-	if err := dr.waitForCompletion(); err != nil {
-		// todo: collect errors and return to caller when function is done
-		fmt.Println(err)
+	if err := os.WriteFile(dm.config.QueuePath, content, 0644); err != nil {
+		return fmt.Errorf("failed to save download queue: %w", err)
 	}
 
-	defer os.RemoveAll(dr.tempDir)
+	return nil
 }
 
-func (dr *DownloadRequest) updateProgress() {
-	dr.mutex.Lock()
-	dr.numOfPiecesDownloaded = min(dr.numOfPiecesDownloaded+1, dr.numOfPiecesToDownload)
+// Notifies the scheduler that the queue changed, without waiting for it.
+func (dm *DownloadManager) notifyScheduler() {
+	select {
+	case dm.updateCh <- struct{}{}:
+	default:
+	}
+}
+
+/*
+Adds a torrent to the queue. Torrents that were in the queue when its order was saved get their previous position back,
+other torrents are added to the bottom of the queue.
+*/
+func (dm *DownloadManager) Add(t Torrent) error {
+	infoHash := t.InfoHash()
+
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
 
-	defer dr.mutex.Unlock()
+	if _, exists := dm.entries[infoHash]; exists {
+		return ErrAlreadyQueued
+	}
+
+	dm.entries[infoHash] = &queueEntry{torrent: t, state: Queued}
 
-	if dr.numOfPiecesDownloaded == dr.numOfPiecesToDownload {
-		dr.markAsCompleted()
-		return
+	if !slices.Contains(dm.order, infoHash) {
+		dm.order = append(dm.order, infoHash)
 	}
+
+	dm.notifyScheduler()
+
+	return dm.saveQueue()
 }
 
-func (dr *DownloadRequest) waitForCompletion() error {
-	select {
-	case <-dr.completed:
-		{
-			dr.mergeDownloadedPieces()
-			dr.cancelFunc()
-			return nil
-		}
+// Removes a torrent from the queue. The torrent is left as is, it is up to the caller to stop it.
+func (dm *DownloadManager) Remove(infoHash [sha1.Size]byte) error {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	if _, exists := dm.entries[infoHash]; !exists {
+		return ErrNotQueued
+	}
+
+	delete(dm.entries, infoHash)
+	dm.order = slices.DeleteFunc(dm.order, func(entry [sha1.Size]byte) bool { return entry == infoHash })
+	dm.notifyScheduler()
 
-	case <-dr.failed:
-		{
-			dr.cancelFunc()
-			// todo: find a way to return an error here
-			return nil
+	return dm.saveQueue()
+}
+
+// Returns the torrents of the queue and their state, in queue order.
+func (dm *DownloadManager) Queue() []QueueEntry {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	queue := []QueueEntry{}
+
+	for _, entry := range dm.queuedEntries() {
+		queue = append(queue, QueueEntry{Torrent: entry.torrent, State: entry.state})
+	}
 
+	return queue
+}
+
+// Returns the entries of the torrents that have been added, in queue order. The mutex must be held.
+func (dm *DownloadManager) queuedEntries() []*queueEntry {
+	entries := make([]*queueEntry, 0, len(dm.entries))
+
+	for _, infoHash := range dm.order {
+		if entry, ok := dm.entries[infoHash]; ok {
+			entries = append(entries, entry)
 		}
 	}
+
+	return entries
 }
 
-func (dm *DownloadManager) Dequeue() *DownloadRequest {
-	if len(dm.downloadQueue) == 0 {
+// Moves a torrent within the queue order. `move` receives the index of the torrent in `order` and returns the index it is moved to.
+func (dm *DownloadManager) move(infoHash [sha1.Size]byte, move func(index int) int) error {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	if _, exists := dm.entries[infoHash]; !exists {
+		return ErrNotQueued
+	}
+
+	index := slices.Index(dm.order, infoHash)
+	newIndex := move(index)
+
+	if newIndex == index {
 		return nil
 	}
 
-	dequeuedDownload := dm.downloadQueue[0]
-	dm.downloadQueue = dm.downloadQueue[1:]
+	dm.order = slices.Delete(dm.order, index, index+1)
+	dm.order = slices.Insert(dm.order, newIndex, infoHash)
+	dm.notifyScheduler()
 
-	return &dequeuedDownload
+	return dm.saveQueue()
 }
 
-func (dm *DownloadManager) Enqueue(req *DownloadRequest) {
-	dm.downloadQueue = append(dm.downloadQueue, *req)
+// Returns the index in `order` of the closest added torrent before (step -1) or after (step 1) the index, or the index itself if there is none.
+func (dm *DownloadManager) neighbourIndex(index int, step int) int {
+	for neighbour := index + step; neighbour >= 0 && neighbour < len(dm.order); neighbour += step {
+		if _, ok := dm.entries[dm.order[neighbour]]; ok {
+			return neighbour
+		}
+	}
+
+	return index
 }
 
-func (dm *DownloadManager) Start() {
-	for req := dm.Dequeue(); req != nil; req = dm.Dequeue() {
-		// todo: download multiple files concurrently ?
-		req.startDownload()
+func (dm *DownloadManager) MoveToTop(infoHash [sha1.Size]byte) error {
+	return dm.move(infoHash, func(int) int { return 0 })
+}
+
+// Moves the torrent before the torrent that precedes it in the queue.
+func (dm *DownloadManager) MoveUp(infoHash [sha1.Size]byte) error {
+	return dm.move(infoHash, func(index int) int { return dm.neighbourIndex(index, -1) })
+}
+
+// Moves the torrent after the torrent that follows it in the queue.
+func (dm *DownloadManager) MoveDown(infoHash [sha1.Size]byte) error {
+	return dm.move(infoHash, func(index int) int { return dm.neighbourIndex(index, 1) })
+}
+
+func (dm *DownloadManager) MoveToBottom(infoHash [sha1.Size]byte) error {
+	return dm.move(infoHash, func(int) int { return len(dm.order) - 1 })
+}
+
+// Reports whether another torrent can be active when `count` torrents already are.
+func withinLimit(count int, limit int) bool {
+	return limit < 0 || count < limit
+}
+
+/*
+Starts and pauses torrents so that the first torrents of the queue are active, within the limits.
+
+Downloads that stalled keep running but don't take a download slot, so the next queued download is started in their place.
+Torrents are paused before others are resumed, so connections are released before new ones are made.
+*/
+func (dm *DownloadManager) schedule(now time.Time) {
+	var toPause, toResume []Torrent
+
+	activeDownloads, activeSeeds := 0, 0
+
+	dm.mutex.Lock()
+
+	entries := dm.queuedEntries()
+	previousStates := make([]QueueState, len(entries))
+
+	for index, entry := range entries {
+		previousStates[index] = entry.state
+	}
+
+	for _, entry := range entries {
+		t := entry.torrent
+		running := !t.IsPaused()
+
+		if t.IsFinished() && t.HasReachedSeedingGoal() {
+			entry.state = Completed
+			continue
+		}
+
+		if t.IsFinished() {
+			if withinLimit(activeSeeds, dm.config.MaxActiveSeeds) {
+				activeSeeds += 1
+				entry.state = Seeding
+			} else {
+				entry.state = Queued
+			}
+
+			if running != (entry.state == Seeding) {
+				if running {
+					toPause = append(toPause, t)
+				} else {
+					toResume = append(toResume, t)
+				}
+			}
+
+			continue
+		}
+
+		if downloaded := t.BytesDownloaded(); downloaded != entry.lastDownloaded {
+			entry.lastDownloaded = downloaded
+			entry.lastProgress = now
+		}
+
+		if running && entry.state != Queued && now.Sub(entry.lastProgress) >= dm.config.StallTimeout {
+			entry.state = Stalled
+			continue
+		}
+
+		if !withinLimit(activeDownloads, dm.config.MaxActiveDownloads) {
+			entry.state = Queued
+
+			if running {
+				toPause = append(toPause, t)
+			}
+
+			continue
+		}
+
+		activeDownloads += 1
+
+		if entry.state != Downloading {
+			// The stall timeout starts once the torrent starts downloading.
+			entry.lastProgress = now
+			entry.state = Downloading
+		}
+
+		if !running {
+			toResume = append(toResume, t)
+		}
+	}
+
+	for index, entry := range entries {
+		if entry.state != previousStates[index] {
+			infoHash := entry.torrent.InfoHash()
+			dm.logger.Info("torrent changed state", logging.InfoHashKey, hex.EncodeToString(infoHash[:]), "from", previousStates[index].String(), "to", entry.state.String())
+		}
+	}
+
+	dm.mutex.Unlock()
+
+	for _, t := range toPause {
+		t.Pause()
+	}
+
+	for _, t := range toResume {
+		t.Resume()
 	}
 }
+
+// Starts scheduling the torrents of the queue in the background, until `Stop` is called.
+func (dm *DownloadManager) Start() {
+	ticker := time.NewTicker(schedulerInterval)
+
+	dm.schedule(time.Now())
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-dm.ctx.Done():
+				{
+					return
+				}
+
+			case <-ticker.C:
+				{
+					dm.schedule(time.Now())
+				}
+
+			case <-dm.updateCh:
+				{
+					dm.schedule(time.Now())
+				}
+			}
+		}
+	}()
+}
+
+// Stops scheduling torrents. The torrents are left as they are.
+func (dm *DownloadManager) Stop() {
+	dm.cancelFunc()
+}
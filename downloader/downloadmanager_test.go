@@ -0,0 +1,224 @@
+package downloader_test
+
+import (
+	"crypto/sha1"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MlkMahmud/hail/downloader"
+)
+
+type fakeTorrent struct {
+	mutex      sync.Mutex
+	infoHash   [sha1.Size]byte
+	downloaded int64
+	finished   bool
+	paused     bool
+	goal       bool
+}
+
+func newFakeTorrent(id byte) *fakeTorrent {
+	return &fakeTorrent{infoHash: [sha1.Size]byte{id}, paused: true}
+}
+
+func (f *fakeTorrent) InfoHash() [sha1.Size]byte {
+	return f.infoHash
+}
+
+func (f *fakeTorrent) BytesDownloaded() int64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.downloaded
+}
+
+func (f *fakeTorrent) IsFinished() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.finished
+}
+
+func (f *fakeTorrent) IsPaused() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.paused
+}
+
+func (f *fakeTorrent) HasReachedSeedingGoal() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.goal
+}
+
+func (f *fakeTorrent) Pause() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.paused = true
+}
+
+func (f *fakeTorrent) Resume() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.paused = false
+}
+
+func (f *fakeTorrent) update(downloaded int64, finished bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.downloaded = downloaded
+	f.finished = finished
+}
+
+func newManager(t *testing.T, config downloader.Config, torrents ...*fakeTorrent) *downloader.DownloadManager {
+	t.Helper()
+
+	dm, err := downloader.NewDownloadManager(config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, torrent := range torrents {
+		if err := dm.Add(torrent); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dm
+}
+
+// Returns the first byte of the info hash of every torrent in the queue, and their states.
+func queueOf(dm *downloader.DownloadManager) ([]byte, []downloader.QueueState) {
+	ids, states := []byte{}, []downloader.QueueState{}
+
+	for _, entry := range dm.Queue() {
+		ids = append(ids, entry.Torrent.InfoHash()[0])
+		states = append(states, entry.State)
+	}
+
+	return ids, states
+}
+
+func expectStates(t *testing.T, dm *downloader.DownloadManager, expected ...downloader.QueueState) {
+	t.Helper()
+
+	if _, states := queueOf(dm); !slices.Equal(states, expected) {
+		t.Fatalf("expected queue states %v, but got %v", expected, states)
+	}
+
+	for index, entry := range dm.Queue() {
+		if running := !entry.Torrent.IsPaused(); running != (entry.State != downloader.Queued && entry.State != downloader.Completed) {
+			t.Fatalf("expected torrent %d in state '%s' to be paused: %t", index, entry.State, entry.State == downloader.Queued)
+		}
+	}
+}
+
+func TestDownloadManagerLimitsActiveTorrents(t *testing.T) {
+	a, b, c, d := newFakeTorrent(1), newFakeTorrent(2), newFakeTorrent(3), newFakeTorrent(4)
+	dm := newManager(t, downloader.Config{MaxActiveDownloads: 2, MaxActiveSeeds: 1}, a, b, c, d)
+	now := time.Now()
+
+	dm.Schedule(now)
+	expectStates(t, dm, downloader.Downloading, downloader.Downloading, downloader.Queued, downloader.Queued)
+
+	a.update(100, true)
+	dm.Schedule(now.Add(time.Second))
+	expectStates(t, dm, downloader.Seeding, downloader.Downloading, downloader.Downloading, downloader.Queued)
+
+	b.update(100, true)
+	dm.Schedule(now.Add(2 * time.Second))
+	expectStates(t, dm, downloader.Seeding, downloader.Queued, downloader.Downloading, downloader.Downloading)
+
+	// Torrents pause themselves once they reach their seeding goal, and are left paused.
+	a.mutex.Lock()
+	a.goal, a.paused = true, true
+	a.mutex.Unlock()
+
+	dm.Schedule(now.Add(3 * time.Second))
+	expectStates(t, dm, downloader.Completed, downloader.Seeding, downloader.Downloading, downloader.Downloading)
+
+	if err := dm.Remove(a.InfoHash()); err != nil {
+		t.Fatal(err)
+	}
+
+	dm.Schedule(now.Add(4 * time.Second))
+	expectStates(t, dm, downloader.Seeding, downloader.Downloading, downloader.Downloading)
+}
+
+func TestDownloadManagerStartsNextTorrentWhenStalled(t *testing.T) {
+	a, b := newFakeTorrent(1), newFakeTorrent(2)
+	dm := newManager(t, downloader.Config{MaxActiveDownloads: 1, StallTimeout: time.Minute}, a, b)
+	now := time.Now()
+
+	dm.Schedule(now)
+	expectStates(t, dm, downloader.Downloading, downloader.Queued)
+
+	a.update(100, false)
+	dm.Schedule(now.Add(50 * time.Second))
+	expectStates(t, dm, downloader.Downloading, downloader.Queued)
+
+	dm.Schedule(now.Add(110 * time.Second))
+	expectStates(t, dm, downloader.Stalled, downloader.Downloading)
+
+	// The stalled torrent takes its slot back once it downloads data again.
+	a.update(200, false)
+	dm.Schedule(now.Add(120 * time.Second))
+	expectStates(t, dm, downloader.Downloading, downloader.Queued)
+}
+
+func TestDownloadManagerMovesAndPersistsQueue(t *testing.T) {
+	queuePath := filepath.Join(t.TempDir(), "queue.json")
+	a, b, c := newFakeTorrent(1), newFakeTorrent(2), newFakeTorrent(3)
+	dm := newManager(t, downloader.Config{QueuePath: queuePath}, a, b, c)
+
+	moves := []struct {
+		move     func([sha1.Size]byte) error
+		torrent  *fakeTorrent
+		expected []byte
+	}{
+		{dm.MoveToTop, c, []byte{3, 1, 2}},
+		{dm.MoveDown, c, []byte{1, 3, 2}},
+		{dm.MoveUp, b, []byte{1, 2, 3}},
+		{dm.MoveUp, a, []byte{1, 2, 3}},
+		{dm.MoveToBottom, a, []byte{2, 3, 1}},
+		{dm.MoveDown, a, []byte{2, 3, 1}},
+	}
+
+	for _, move := range moves {
+		if err := move.move(move.torrent.InfoHash()); err != nil {
+			t.Fatal(err)
+		}
+
+		if ids, _ := queueOf(dm); !slices.Equal(ids, move.expected) {
+			t.Fatalf("expected queue %v, but got %v", move.expected, ids)
+		}
+	}
+
+	if err := dm.MoveUp([sha1.Size]byte{9}); err != downloader.ErrNotQueued {
+		t.Fatalf("expected moving an unknown torrent to fail with '%v', but got '%v'", downloader.ErrNotQueued, err)
+	}
+
+	// Torrents get their saved position back when they are added again, whatever the order they are added in.
+	restored := newManager(t, downloader.Config{QueuePath: queuePath}, newFakeTorrent(4), newFakeTorrent(1))
+
+	if err := restored.Add(newFakeTorrent(3)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restored.Add(newFakeTorrent(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids, _ := queueOf(restored); !slices.Equal(ids, []byte{2, 3, 1, 4}) {
+		t.Fatalf("expected restored queue [2 3 1 4], but got %v", ids)
+	}
+}
@@ -0,0 +1,8 @@
+package downloader
+
+import "time"
+
+// Runs the scheduler once, as if the current time was `now`.
+func (dm *DownloadManager) Schedule(now time.Time) {
+	dm.schedule(now)
+}
@@ -0,0 +1,192 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Keys of the attributes attached to log records.
+const (
+	// The subsystem that logged the record, e.g "torrent", "peer" or "tracker".
+	ComponentKey = "component"
+	InfoHashKey  = "infohash"
+	PeerKey      = "peer"
+	PieceKey     = "piece"
+	TrackerKey   = "tracker"
+	ErrorKey     = "error"
+)
+
+// Components the loggers of this module are named after.
+const (
+	ComponentDaemon  = "daemon"
+	ComponentDHT     = "dht"
+	ComponentPeer    = "peer"
+	ComponentQueue   = "queue"
+	ComponentSession = "session"
+	ComponentTorrent = "torrent"
+	ComponentTracker = "tracker"
+	ComponentWebSeed = "webseed"
+)
+
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+type Config struct {
+	// Records below this level are discarded, unless their component has its own level. Defaults to `slog.LevelInfo`.
+	Level slog.Level
+	// Levels of individual components, overriding `Level`. The keys are the values of the "component" attribute.
+	ComponentLevels map[string]slog.Level
+	// Either "text" (the default) or "json".
+	Format string
+	// Writer records are written to. Defaults to standard error.
+	Output io.Writer
+}
+
+/*
+Filters records by the level of the component that logged them.
+
+The component of a logger is the value of its "component" attribute, set with `logger.With(logging.ComponentKey, ...)`.
+*/
+type componentHandler struct {
+	handler slog.Handler
+	// Level of the records that are kept.
+	level slog.Level
+
+	defaultLevel    slog.Level
+	componentLevels map[string]slog.Level
+}
+
+func NewLogger(config Config) (*slog.Logger, error) {
+	output := config.Output
+
+	if output == nil {
+		output = os.Stderr
+	}
+
+	// Records are filtered by the component handler, the underlying handler keeps all of them.
+	minLevel := config.Level
+
+	for _, level := range config.ComponentLevels {
+		minLevel = min(minLevel, level)
+	}
+
+	options := &slog.HandlerOptions{Level: minLevel}
+	var handler slog.Handler
+
+	switch config.Format {
+	case "", FormatText:
+		{
+			handler = slog.NewTextHandler(output, options)
+		}
+
+	case FormatJSON:
+		{
+			handler = slog.NewJSONHandler(output, options)
+		}
+
+	default:
+		{
+			return nil, fmt.Errorf("unsupported log format '%s': expected '%s' or '%s'", config.Format, FormatText, FormatJSON)
+		}
+	}
+
+	return slog.New(&componentHandler{
+		handler:         handler,
+		level:           config.Level,
+		defaultLevel:    config.Level,
+		componentLevels: config.ComponentLevels,
+	}), nil
+}
+
+/*
+Parses levels such as "debug", "info", "warn" or "error".
+
+Levels may be offset, e.g "debug-2" (see `slog.Level.UnmarshalText`).
+*/
+func ParseLevel(value string) (slog.Level, error) {
+	var level slog.Level
+
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return level, fmt.Errorf("invalid log level '%s': %w", value, err)
+	}
+
+	return level, nil
+}
+
+// Parses component levels of the form "<component>=<level>", e.g "tracker=debug".
+func ParseComponentLevels(values []string) (map[string]slog.Level, error) {
+	levels := make(map[string]slog.Level, len(values))
+
+	for _, value := range values {
+		component, levelValue, ok := strings.Cut(value, "=")
+
+		if !ok || component == "" {
+			return nil, fmt.Errorf("invalid component log level '%s': expected '<component>=<level>'", value)
+		}
+
+		level, err := ParseLevel(levelValue)
+
+		if err != nil {
+			return nil, err
+		}
+
+		levels[component] = level
+	}
+
+	return levels, nil
+}
+
+// Returns the logger, or `slog.Default()` if nil, with its component set.
+func Component(logger *slog.Logger, component string) *slog.Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return logger.With(ComponentKey, component)
+}
+
+func (h *componentHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level && h.handler.Enabled(ctx, level)
+}
+
+func (h *componentHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.handler.Handle(ctx, record)
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	level := h.level
+
+	for _, attr := range attrs {
+		if attr.Key != ComponentKey {
+			continue
+		}
+
+		level = h.defaultLevel
+
+		if componentLevel, ok := h.componentLevels[attr.Value.String()]; ok {
+			level = componentLevel
+		}
+	}
+
+	return &componentHandler{
+		handler:         h.handler.WithAttrs(attrs),
+		level:           level,
+		defaultLevel:    h.defaultLevel,
+		componentLevels: h.componentLevels,
+	}
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return &componentHandler{
+		handler:         h.handler.WithGroup(name),
+		level:           h.level,
+		defaultLevel:    h.defaultLevel,
+		componentLevels: h.componentLevels,
+	}
+}
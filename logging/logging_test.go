@@ -0,0 +1,71 @@
+package logging_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/MlkMahmud/hail/logging"
+)
+
+func TestComponentLevels(t *testing.T) {
+	levels, err := logging.ParseComponentLevels([]string{"tracker=debug", "peer=warn"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := bytes.Buffer{}
+	logger, err := logging.NewLogger(logging.Config{Level: slog.LevelInfo, ComponentLevels: levels, Format: logging.FormatJSON, Output: &output})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	torrentLogger := logging.Component(logger.With(logging.InfoHashKey, "abcd"), logging.ComponentTorrent)
+	trackerLogger := logging.Component(logger, logging.ComponentTracker)
+	peerLogger := logging.Component(logger, logging.ComponentPeer).With(logging.PeerKey, "127.0.0.1:6881")
+
+	torrentLogger.Debug("torrent debug")
+	torrentLogger.Info("torrent info")
+	trackerLogger.Debug("tracker debug")
+	peerLogger.Info("peer info")
+	peerLogger.Warn("peer warn")
+
+	messages := []string{}
+	records := strings.Split(strings.TrimSpace(output.String()), "\n")
+
+	for _, line := range records {
+		record := map[string]any{}
+
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+
+		messages = append(messages, record["msg"].(string))
+
+		if record["msg"] == "torrent info" && (record[logging.InfoHashKey] != "abcd" || record[logging.ComponentKey] != logging.ComponentTorrent) {
+			t.Fatalf("expected record to have the logger's attributes, but got %v", record)
+		}
+	}
+
+	expected := []string{"torrent info", "tracker debug", "peer warn"}
+
+	if strings.Join(messages, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected records %v to be logged, but got %v", expected, messages)
+	}
+}
+
+func TestParseComponentLevels(t *testing.T) {
+	for _, value := range []string{"tracker", "=debug", "tracker=loud"} {
+		if _, err := logging.ParseComponentLevels([]string{value}); err == nil {
+			t.Fatalf("expected parsing component level '%s' to fail", value)
+		}
+	}
+
+	if _, err := logging.NewLogger(logging.Config{Format: "xml"}); err == nil {
+		t.Fatal("expected unsupported log formats to be rejected")
+	}
+}
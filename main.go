@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"os"
+	"time"
 
 	"github.com/MlkMahmud/hail/commands"
 	"github.com/urfave/cli/v2"
@@ -21,13 +22,290 @@ func main() {
 						Name:     "out_path",
 						Aliases:  []string{"o"},
 						Required: true,
-						Usage:    "destination for torrent download",
+						Usage:    "directory the torrent's files are downloaded to",
+					},
+					&cli.BoolFlag{
+						Name:  "no-dht",
+						Usage: "disable peer discovery through the DHT",
+					},
+					&cli.StringSliceFlag{
+						Name:  "dht-bootstrap-node",
+						Usage: "\"host:port\" address of a node used to join the DHT (can be repeated)",
+					},
+					&cli.BoolFlag{
+						Name:  "announce-to-all-tiers",
+						Usage: "announce to one tracker in every tier of the announce list",
+					},
+					&cli.StringSliceFlag{
+						Name:  "tracker",
+						Usage: "URL of an extra tracker to announce to, ignored for private torrents (can be repeated)",
+					},
+					&cli.IntFlag{
+						Name:  "max-active-downloads",
+						Value: 3,
+						Usage: "maximum number of torrents downloading at a time (negative for no limit)",
+					},
+					&cli.IntFlag{
+						Name:  "max-active-seeds",
+						Value: 3,
+						Usage: "maximum number of finished torrents seeding at a time (negative for no limit)",
+					},
+					&cli.DurationFlag{
+						Name:  "stall-timeout",
+						Value: 5 * time.Minute,
+						Usage: "amount of time without receiving data after which the next queued torrent is started",
+					},
+					&cli.Float64Flag{
+						Name:  "seed-ratio",
+						Usage: "stop seeding once this share ratio (uploaded / downloaded) is reached (0 to disable)",
+					},
+					&cli.DurationFlag{
+						Name:  "seed-time",
+						Usage: "stop seeding after seeding for this long in total (0 to disable)",
+					},
+					&cli.DurationFlag{
+						Name:  "seed-idle-time",
+						Usage: "stop seeding after uploading nothing for this long (0 to disable)",
+					},
+					&cli.BoolFlag{
+						Name:  "remove-after-seeding",
+						Usage: "remove torrents that reach a seeding goal instead of pausing them (their files are kept)",
+					},
+					&cli.BoolFlag{
+						Name:    "quiet",
+						Aliases: []string{"q"},
+						Usage:   "don't show the progress of the torrents",
+					},
+					&cli.BoolFlag{
+						Name:  "json-progress",
+						Usage: "print the progress of every torrent as a JSON object per line, every second",
+					},
+					&cli.BoolFlag{
+						Name:  "full-screen",
+						Usage: "show the peers and files of the torrents along with their progress, using the whole terminal",
+					},
+					&cli.StringFlag{
+						Name:  "metrics-addr",
+						Usage: "address metrics are served on in the Prometheus text format, at \"/metrics\" (e.g \"127.0.0.1:9100\")",
+					},
+				},
+				Usage:     "downloads torrents, starting them in queue order",
+				UsageText: "Basic download -o <value> <torrent> [<torrent>...]",
+			},
+			{
+				Name:   "daemon",
+				Action: commands.HandleDaemonCommand,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "out_path",
+						Aliases:  []string{"o"},
+						Required: true,
+						Usage:    "directory torrents are downloaded to, unless set when they are added",
+					},
+					&cli.StringFlag{
+						Name:  "api",
+						Value: "127.0.0.1:9091",
+						Usage: "address the HTTP API listens on",
+					},
+					&cli.StringFlag{
+						Name:     "token",
+						EnvVars:  []string{"HAIL_TOKEN"},
+						Required: true,
+						Usage:    "secret clients of the API authenticate with, as a bearer token or as the password of Transmission clients",
+					},
+					&cli.StringFlag{
+						Name:  "listen",
+						Value: ":6881",
+						Usage: "address peers connect to",
+					},
+					&cli.IntFlag{
+						Name:  "max-connections",
+						Usage: "maximum number of peer connections of all torrents (defaults to 200)",
+					},
+					&cli.IntFlag{
+						Name:  "download-rate",
+						Usage: "maximum download rate in bytes per second (0 for no limit)",
+					},
+					&cli.IntFlag{
+						Name:  "upload-rate",
+						Usage: "maximum upload rate in bytes per second (0 for no limit)",
+					},
+					&cli.BoolFlag{
+						Name:  "no-dht",
+						Usage: "disable peer discovery through the DHT",
+					},
+					&cli.StringSliceFlag{
+						Name:  "dht-bootstrap-node",
+						Usage: "\"host:port\" address of a node used to join the DHT (can be repeated)",
+					},
+					&cli.BoolFlag{
+						Name:  "metrics",
+						Usage: "serve metrics in the Prometheus text format on the API, at \"/metrics\"",
 					},
 				},
-				Usage:     "downloads a torrent",
-				UsageText: "Basic download -o <value> <torrent>",
+				Usage:     "runs a long-lived client controlled through an HTTP API (see the remote command) and the Transmission RPC protocol",
+				UsageText: "Basic daemon -o <value> --token <value> [--api <address>]",
+			},
+			{
+				Name: "remote",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "url",
+						EnvVars: []string{"HAIL_URL"},
+						Value:   "http://127.0.0.1:9091",
+						Usage:   "URL of the daemon",
+					},
+					&cli.StringFlag{
+						Name:     "token",
+						EnvVars:  []string{"HAIL_TOKEN"},
+						Required: true,
+						Usage:    "token of the daemon",
+					},
+				},
+				Subcommands: []*cli.Command{
+					{
+						Name:   "add",
+						Action: commands.HandleRemoteAddCommand,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "out_path",
+								Aliases: []string{"o"},
+								Usage:   "directory on the daemon's host the torrents are downloaded to",
+							},
+							&cli.BoolFlag{
+								Name:  "paused",
+								Usage: "add the torrents without starting them",
+							},
+						},
+						Usage:     "adds torrent files, HTTP URLs of torrent files or magnet links",
+						UsageText: "Basic remote add [-o <value>] [--paused] <torrent> [<torrent>...]",
+					},
+					{
+						Name:      "list",
+						Action:    commands.HandleRemoteListCommand,
+						Usage:     "lists the torrents of the daemon",
+						UsageText: "Basic remote list",
+					},
+					{
+						Name:      "show",
+						Action:    commands.HandleRemoteShowCommand,
+						Usage:     "shows the files, trackers and peers of a torrent",
+						UsageText: "Basic remote show <info hash>",
+					},
+					{
+						Name:      "pause",
+						Action:    commands.HandleRemotePauseCommand,
+						Usage:     "pauses torrents",
+						UsageText: "Basic remote pause <info hash> [<info hash>...]",
+					},
+					{
+						Name:      "resume",
+						Action:    commands.HandleRemoteResumeCommand,
+						Usage:     "resumes paused torrents",
+						UsageText: "Basic remote resume <info hash> [<info hash>...]",
+					},
+					{
+						Name:   "remove",
+						Action: commands.HandleRemoteRemoveCommand,
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "delete-data",
+								Usage: "delete the downloaded files of the torrents",
+							},
+						},
+						Usage:     "removes torrents from the daemon",
+						UsageText: "Basic remote remove [--delete-data] <info hash> [<info hash>...]",
+					},
+					{
+						Name:      "priority",
+						Action:    commands.HandleRemotePriorityCommand,
+						Usage:     "sets the priority (skip, normal or high) of files of a torrent, identified by their index",
+						UsageText: "Basic remote priority <info hash> <priority> <file index> [<file index>...]",
+					},
+					{
+						Name:   "limits",
+						Action: commands.HandleRemoteLimitsCommand,
+						Flags: []cli.Flag{
+							&cli.IntFlag{
+								Name:  "download-rate",
+								Usage: "maximum download rate in bytes per second (0 for no limit)",
+							},
+							&cli.IntFlag{
+								Name:  "upload-rate",
+								Usage: "maximum upload rate in bytes per second (0 for no limit)",
+							},
+							&cli.IntFlag{
+								Name:  "max-connections",
+								Usage: "maximum number of peer connections of all torrents",
+							},
+						},
+						Usage:     "shows the limits of the daemon, after updating the ones that are set",
+						UsageText: "Basic remote limits [--download-rate <value>] [--upload-rate <value>] [--max-connections <value>]",
+					},
+					{
+						Name:      "events",
+						Action:    commands.HandleRemoteEventsCommand,
+						Usage:     "prints the events of the daemon's torrents as they happen",
+						UsageText: "Basic remote events [<info hash>]",
+					},
+				},
+				Usage: "controls a running daemon",
+			},
+			{
+				Name:      "scrape",
+				Action:    commands.HandleScrapeCommand,
+				Usage:     "prints the number of seeders, leechers and completed downloads reported by the torrent's trackers",
+				UsageText: "Basic scrape <torrent>",
+			},
+			{
+				Name:   "tracker",
+				Action: commands.HandleTrackerCommand,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "http",
+						Value: ":8000",
+						Usage: "address of the HTTP tracker (empty to disable)",
+					},
+					&cli.StringFlag{
+						Name:  "udp",
+						Value: ":6969",
+						Usage: "address of the UDP tracker (empty to disable)",
+					},
+					&cli.DurationFlag{
+						Name:  "interval",
+						Value: 30 * time.Minute,
+						Usage: "interval between announcements requested from peers",
+					},
+					&cli.DurationFlag{
+						Name:  "peer-timeout",
+						Usage: "amount of time after which peers that stopped announcing are removed (defaults to twice the interval)",
+					},
+					&cli.StringFlag{
+						Name:  "allowlist",
+						Usage: "directory of \".torrent\" files; if set, only these torrents are tracked",
+					},
+				},
+				Usage:     "runs a BitTorrent tracker serving the HTTP and UDP tracker protocols",
+				UsageText: "Basic tracker [--http <address>] [--udp <address>] [--allowlist <directory>]",
+			},
+		},
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "log-level",
+				Value: "info",
+				Usage: "minimum level of the logged records: \"debug\", \"info\", \"warn\" or \"error\"",
+			},
+			&cli.StringFlag{
+				Name:  "log-format",
+				Value: "text",
+				Usage: "format of the logged records: \"text\" or \"json\"",
+			},
+			&cli.StringSliceFlag{
+				Name:  "log-component-level",
+				Usage: "\"<component>=<level>\" level of the records of a single component (torrent, peer, tracker, webseed, dht, session, queue or daemon), overriding --log-level (can be repeated)",
 			},
 		},
+		Before:      commands.SetupLogging,
 		Description: "A basic BitTorrent client",
 		Usage:       "Download all your favourite torrents.",
 	}
@@ -0,0 +1,405 @@
+/*
+Package metrics records counters, gauges and histograms and exports them in the Prometheus text format,
+so they can be scraped without running any other service.
+*/
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+A set of metrics, written in the order they were registered (see `WriteText`).
+
+Registering a metric with an invalid name, a name that is already taken or invalid label names panics: metrics are
+registered once, when a component starts, so these are programming errors.
+*/
+type Registry struct {
+	mutex   *sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+// A single series of a metric computed at collection time, see `NewCounterFunc` and `NewGaugeFunc`.
+type Sample struct {
+	// The values of the metric's labels, in the order of the label names it was registered with.
+	LabelValues []string
+	Value       float64
+}
+
+// A counter, which only goes up. Its series are identified by the values of its labels.
+type Counter struct {
+	values *valueSet
+}
+
+// A gauge, whose value goes up and down. Its series are identified by the values of its labels.
+type Gauge struct {
+	values *valueSet
+}
+
+// A histogram, which counts observations in buckets. Its series are identified by the values of its labels.
+type Histogram struct {
+	descriptor
+	// Upper bounds of the buckets, in increasing order. The "+Inf" bucket is implicit.
+	buckets []float64
+
+	mutex  *sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type metric interface {
+	write(buffer *bytes.Buffer)
+}
+
+type descriptor struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+}
+
+type valueSet struct {
+	descriptor
+
+	mutex   *sync.Mutex
+	samples map[string]*Sample
+}
+
+type funcMetric struct {
+	descriptor
+	collect func() []Sample
+}
+
+type histogramSeries struct {
+	labelValues []string
+	// Number of observations in each bucket, not including the observations of the smaller buckets.
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Buckets of histograms of durations in seconds, from 1ms to 10s.
+var DurationBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRegexp  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+	helpReplacer       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func NewRegistry() *Registry {
+	var mutex sync.Mutex
+
+	return &Registry{
+		mutex: &mutex,
+		names: make(map[string]bool),
+	}
+}
+
+func (r *Registry) register(d descriptor, m metric) {
+	if !metricNameRegexp.MatchString(d.name) {
+		panic(fmt.Sprintf("invalid metric name '%s'", d.name))
+	}
+
+	for _, labelName := range d.labelNames {
+		if !labelNameRegexp.MatchString(labelName) || strings.HasPrefix(labelName, "__") || (d.kind == "histogram" && labelName == "le") {
+			panic(fmt.Sprintf("invalid label name '%s' for metric '%s'", labelName, d.name))
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.names[d.name] {
+		panic(fmt.Sprintf("metric '%s' is already registered", d.name))
+	}
+
+	r.names[d.name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+func newValueSet(name string, help string, kind string, labelNames []string) *valueSet {
+	var mutex sync.Mutex
+
+	return &valueSet{
+		descriptor: descriptor{name: name, help: help, kind: kind, labelNames: labelNames},
+		mutex:      &mutex,
+		samples:    make(map[string]*Sample),
+	}
+}
+
+func (r *Registry) NewCounter(name string, help string, labelNames ...string) *Counter {
+	values := newValueSet(name, help, "counter", labelNames)
+	r.register(values.descriptor, values)
+
+	return &Counter{values: values}
+}
+
+func (r *Registry) NewGauge(name string, help string, labelNames ...string) *Gauge {
+	values := newValueSet(name, help, "gauge", labelNames)
+	r.register(values.descriptor, values)
+
+	return &Gauge{values: values}
+}
+
+// Registers a histogram with the given bucket upper bounds, e.g `DurationBuckets`.
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	var mutex sync.Mutex
+
+	sortedBuckets := slices.Clone(buckets)
+	slices.Sort(sortedBuckets)
+
+	h := &Histogram{
+		descriptor: descriptor{name: name, help: help, kind: "histogram", labelNames: labelNames},
+		buckets:    slices.Compact(sortedBuckets),
+		mutex:      &mutex,
+		series:     make(map[string]*histogramSeries),
+	}
+
+	r.register(h.descriptor, h)
+
+	return h
+}
+
+// Registers a counter whose series are returned by `collect` every time the registry is written, e.g the totals kept by another component.
+func (r *Registry) NewCounterFunc(name string, help string, labelNames []string, collect func() []Sample) {
+	m := &funcMetric{descriptor: descriptor{name: name, help: help, kind: "counter", labelNames: labelNames}, collect: collect}
+	r.register(m.descriptor, m)
+}
+
+// Registers a gauge whose series are returned by `collect` every time the registry is written.
+func (r *Registry) NewGaugeFunc(name string, help string, labelNames []string, collect func() []Sample) {
+	m := &funcMetric{descriptor: descriptor{name: name, help: help, kind: "gauge", labelNames: labelNames}, collect: collect}
+	r.register(m.descriptor, m)
+}
+
+// Writes every metric in the Prometheus text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mutex.Unlock()
+
+	buffer := bytes.Buffer{}
+
+	for _, m := range metrics {
+		m.write(&buffer)
+	}
+
+	_, err := w.Write(buffer.Bytes())
+
+	return err
+}
+
+// Returns a handler that serves the registry's metrics, to be mounted on "/metrics".
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		r.WriteText(w)
+	})
+}
+
+// Increments the series identified by the label values by 1.
+func (c *Counter) Inc(labelValues ...string) {
+	c.values.add(labelValues, 1)
+}
+
+// Adds a value to the series identified by the label values. Negative values are ignored, counters only go up.
+func (c *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		return
+	}
+
+	c.values.add(labelValues, value)
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.values.set(labelValues, value)
+}
+
+func (g *Gauge) Add(value float64, labelValues ...string) {
+	g.values.add(labelValues, value)
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	key := h.seriesKey(labelValues)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	series, ok := h.series[key]
+
+	if !ok {
+		series = &histogramSeries{labelValues: slices.Clone(labelValues), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+
+	if index := sort.SearchFloat64s(h.buckets, value); index < len(h.buckets) {
+		series.counts[index] += 1
+	}
+
+	series.count += 1
+	series.sum += value
+}
+
+// Returns the key of the series identified by the label values. Panics if the number of values doesn't match the metric's labels.
+func (d descriptor) seriesKey(labelValues []string) string {
+	if len(labelValues) != len(d.labelNames) {
+		panic(fmt.Sprintf("metric '%s' expects %d label values, but got %d", d.name, len(d.labelNames), len(labelValues)))
+	}
+
+	return strings.Join(labelValues, "\xff")
+}
+
+func (vs *valueSet) sample(labelValues []string) *Sample {
+	key := vs.seriesKey(labelValues)
+	s, ok := vs.samples[key]
+
+	if !ok {
+		s = &Sample{LabelValues: slices.Clone(labelValues)}
+		vs.samples[key] = s
+	}
+
+	return s
+}
+
+func (vs *valueSet) add(labelValues []string, value float64) {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+
+	vs.sample(labelValues).Value += value
+}
+
+func (vs *valueSet) set(labelValues []string, value float64) {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+
+	vs.sample(labelValues).Value = value
+}
+
+func (vs *valueSet) write(buffer *bytes.Buffer) {
+	vs.mutex.Lock()
+	samples := []Sample{}
+
+	for _, s := range vs.samples {
+		samples = append(samples, *s)
+	}
+
+	vs.mutex.Unlock()
+
+	vs.writeSamples(buffer, samples)
+}
+
+func (m *funcMetric) write(buffer *bytes.Buffer) {
+	samples := []Sample{}
+
+	// Samples whose label values don't match the metric's labels are left out, rather than producing an invalid exposition.
+	for _, s := range m.collect() {
+		if len(s.LabelValues) == len(m.labelNames) {
+			samples = append(samples, s)
+		}
+	}
+
+	m.writeSamples(buffer, samples)
+}
+
+func (d descriptor) writeHeader(buffer *bytes.Buffer) {
+	fmt.Fprintf(buffer, "# HELP %s %s\n", d.name, helpReplacer.Replace(d.help))
+	fmt.Fprintf(buffer, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+// Writes the metric's header and samples, ordered by label values.
+func (d descriptor) writeSamples(buffer *bytes.Buffer, samples []Sample) {
+	slices.SortFunc(samples, func(a Sample, b Sample) int {
+		return slices.Compare(a.LabelValues, b.LabelValues)
+	})
+
+	d.writeHeader(buffer)
+
+	for _, s := range samples {
+		fmt.Fprintf(buffer, "%s%s %s\n", d.name, formatLabels(d.labelNames, s.LabelValues, "", ""), formatValue(s.Value))
+	}
+}
+
+func (h *Histogram) write(buffer *bytes.Buffer) {
+	h.mutex.Lock()
+	series := []histogramSeries{}
+
+	for _, s := range h.series {
+		series = append(series, histogramSeries{labelValues: s.labelValues, counts: slices.Clone(s.counts), count: s.count, sum: s.sum})
+	}
+
+	h.mutex.Unlock()
+
+	slices.SortFunc(series, func(a histogramSeries, b histogramSeries) int {
+		return slices.Compare(a.labelValues, b.labelValues)
+	})
+
+	h.writeHeader(buffer)
+
+	for _, s := range series {
+		cumulativeCount := uint64(0)
+
+		for index, upperBound := range h.buckets {
+			cumulativeCount += s.counts[index]
+			labels := formatLabels(h.labelNames, s.labelValues, "le", formatValue(upperBound))
+			fmt.Fprintf(buffer, "%s_bucket%s %d\n", h.name, labels, cumulativeCount)
+		}
+
+		fmt.Fprintf(buffer, "%s_bucket%s %d\n", h.name, formatLabels(h.labelNames, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(buffer, "%s_sum%s %s\n", h.name, formatLabels(h.labelNames, s.labelValues, "", ""), formatValue(s.sum))
+		fmt.Fprintf(buffer, "%s_count%s %d\n", h.name, formatLabels(h.labelNames, s.labelValues, "", ""), s.count)
+	}
+}
+
+// Formats the labels of a sample, e.g `{tracker="udp://tracker.example:6969"}`. An extra label is appended if its name isn't empty.
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	pairs := []string{}
+
+	for index, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelValueReplacer.Replace(values[index])))
+	}
+
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,116 @@
+package metrics_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/MlkMahmud/hail/metrics"
+)
+
+func TestRegistryWritesTextFormat(t *testing.T) {
+	registry := metrics.NewRegistry()
+
+	counter := registry.NewCounter("test_requests_total", "Number of requests.\nBy path.", "path")
+	counter.Inc("/b")
+	counter.Add(2, "/a")
+	counter.Add(-1, "/a")
+	counter.Inc("say \"hi\"\\")
+
+	gauge := registry.NewGauge("test_temperature", "Current temperature.")
+	gauge.Set(21.5)
+	gauge.Add(-1)
+
+	histogram := registry.NewHistogram("test_duration_seconds", "Duration.", []float64{1, 0.1}, "kind")
+	histogram.Observe(0.05, "read")
+	histogram.Observe(0.5, "read")
+	histogram.Observe(5, "read")
+
+	registry.NewGaugeFunc("test_queue_length", "Queue length.", []string{"queue"}, func() []metrics.Sample {
+		return []metrics.Sample{{LabelValues: []string{"b"}, Value: 2}, {LabelValues: []string{"a"}, Value: 1}, {Value: 3}}
+	})
+
+	output := strings.Builder{}
+
+	if err := registry.WriteText(&output); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_requests_total Number of requests.\nBy path.
+# TYPE test_requests_total counter
+test_requests_total{path="/a"} 2
+test_requests_total{path="/b"} 1
+test_requests_total{path="say \"hi\"\\"} 1
+# HELP test_temperature Current temperature.
+# TYPE test_temperature gauge
+test_temperature 20.5
+# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{kind="read",le="0.1"} 1
+test_duration_seconds_bucket{kind="read",le="1"} 2
+test_duration_seconds_bucket{kind="read",le="+Inf"} 3
+test_duration_seconds_sum{kind="read"} 5.55
+test_duration_seconds_count{kind="read"} 3
+# HELP test_queue_length Queue length.
+# TYPE test_queue_length gauge
+test_queue_length{queue="a"} 1
+test_queue_length{queue="b"} 2
+`
+
+	if output.String() != expected {
+		t.Fatalf("expected:\n%s\nbut got:\n%s", expected, output.String())
+	}
+}
+
+func TestRegistryHandler(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.NewCounter("test_total", "Test.").Inc()
+
+	server := httptest.NewServer(registry.Handler())
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/metrics")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain; version=0.0.4") || !strings.Contains(string(body), "\ntest_total 1\n") {
+		t.Fatalf("unexpected response: %s %q", res.Header.Get("Content-Type"), body)
+	}
+
+	res, err = http.Post(server.URL+"/metrics", "text/plain", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status 405, but got %d", res.StatusCode)
+	}
+}
+
+func TestRegistryRejectsDuplicateNames(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.NewCounter("test_total", "Test.")
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected registering a metric twice to panic")
+		}
+	}()
+
+	registry.NewGauge("test_total", "Test.")
+}
@@ -0,0 +1,480 @@
+package torrent
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MlkMahmud/hail/logging"
+	"github.com/MlkMahmud/hail/utils"
+)
+
+// The announce state and health of a single tracker.
+type trackerState struct {
+	url string
+	// Set for trackers that are not listed in the torrent's metainfo. Extra trackers are never announced to for private torrents.
+	extra bool
+
+	// Set once the tracker has been sent the 'completed' event.
+	completedSent bool
+	// Number of consecutive failed announcements.
+	failures     int
+	interval     time.Duration
+	lastAnnounce time.Time
+	lastError    error
+	leechers     int
+	minInterval  time.Duration
+	seeders      int
+	// Set once the tracker has been sent the 'started' event. Trackers that haven't been told we started are not told we stopped.
+	started bool
+	// Whether the torrent was incomplete when the 'started' event was sent. The 'completed' event is only sent in that case.
+	startedIncomplete bool
+	trackerId         string
+}
+
+/*
+A tier of the announce list (BEP 12).
+
+The order of the trackers within a tier is shuffled when the torrent is loaded, and trackers that respond
+are moved to the front of their tier so they are tried first in subsequent announcements.
+*/
+type trackerTier struct {
+	trackers []*trackerState
+}
+
+/*
+A set of tiers that are announced to as a unit: exactly one tracker of the group is announced to at a time.
+
+By default all the tiers of a torrent form a single group. When announcing to all tiers, every tier forms its own group.
+*/
+type announceGroup struct {
+	tiers []*trackerTier
+
+	// Set while an announcement is in progress.
+	announcing bool
+	// Number of consecutive announcements in which every tracker of the group failed, used to compute the retry delay.
+	failures     int
+	nextAnnounce time.Time
+}
+
+// Cumulative transfer counters reported to trackers.
+type transferCounters struct {
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+	// Number of bytes of pieces that passed hash verification.
+	verified atomic.Int64
+	// Number of bytes of pieces that failed hash verification.
+	wasted atomic.Int64
+}
+
+const (
+	// Used when the tracker's response does not include an interval.
+	defaultAnnounceInterval = 30 * time.Minute
+	// Number of trackers that can be announced to at the same time.
+	maxConcurrentAnnouncements = 5
+	// Delay before retrying a failed announcement, doubled after every consecutive failure.
+	trackerRetryDelay    = 15 * time.Second
+	maxTrackerRetryDelay = 30 * time.Minute
+	// Maximum amount of time spent notifying trackers that we are stopping.
+	stoppedAnnounceTimeout = 5 * time.Second
+	// Fraction of the maximum number of peer connections below which an incomplete torrent announces as often as trackers allow.
+	peerConnectionsLowWaterMark = 0.5
+
+	// Reported as the number of bytes left when the torrent's metadata has not been downloaded yet.
+	unknownLengthPlaceholder = 999
+)
+
+func newTrackerTiers(tiers [][]string) []*trackerTier {
+	trackerTiers := make([]*trackerTier, 0, len(tiers))
+
+	for _, tier := range tiers {
+		trackerTier := &trackerTier{}
+
+		for _, trackerUrl := range tier {
+			trackerTier.trackers = append(trackerTier.trackers, &trackerState{url: trackerUrl})
+		}
+
+		if len(trackerTier.trackers) > 0 {
+			trackerTiers = append(trackerTiers, trackerTier)
+		}
+	}
+
+	return trackerTiers
+}
+
+func newAnnounceGroups(tiers []*trackerTier, announceToAllTiers bool) []*announceGroup {
+	if len(tiers) == 0 {
+		return nil
+	}
+
+	if !announceToAllTiers {
+		return []*announceGroup{{tiers: tiers}}
+	}
+
+	groups := make([]*announceGroup, len(tiers))
+
+	for index, tier := range tiers {
+		groups[index] = &announceGroup{tiers: []*trackerTier{tier}}
+	}
+
+	return groups
+}
+
+// Returns a copy of the tier's trackers in their current order. Must be called with the torrent's mutex held.
+func (tt *trackerTier) entries() []*trackerState {
+	return append([]*trackerState{}, tt.trackers...)
+}
+
+// Moves the tracker to the front of the tier. Must be called with the torrent's mutex held.
+func (tt *trackerTier) promote(state *trackerState) {
+	index := slices.Index(tt.trackers, state)
+
+	if index <= 0 {
+		return
+	}
+
+	copy(tt.trackers[1:index+1], tt.trackers[:index])
+	tt.trackers[0] = state
+}
+
+// Reports whether the tracker failed to respond to its most recent announcement.
+func (ts *trackerState) isFailing() bool {
+	return ts.failures > 0
+}
+
+// Returns the delay before the next announcement after a failed one: 15 * 2 ^ n seconds (where n is the number of previous consecutive failures), capped at 30 minutes.
+func (ag *announceGroup) retryDelay() time.Duration {
+	delay := trackerRetryDelay * time.Duration(math.Pow(2, float64(ag.failures-1)))
+
+	return min(delay, maxTrackerRetryDelay)
+}
+
+// Returns the URLs of the trackers that failed to respond to their most recent announcement.
+func (tr *Torrent) failingTrackers() []string {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	urls := []string{}
+
+	for _, tier := range tr.trackerTiers {
+		for _, state := range tier.trackers {
+			if state.isFailing() {
+				urls = append(urls, state.url)
+			}
+		}
+	}
+
+	return urls
+}
+
+// Returns the number of bytes we still have to download, as reported to trackers.
+func (tr *Torrent) bytesLeft() int64 {
+	tr.mutex.Lock()
+	info := tr.info
+	tr.mutex.Unlock()
+
+	if info == nil {
+		return unknownLengthPlaceholder
+	}
+
+	return max(int64(info.length)-tr.counters.verified.Load(), 0)
+}
+
+func (tr *Torrent) newAnnounceRequest(event trackerEvent, trackerId string) announceRequest {
+	return announceRequest{
+		downloaded: tr.counters.downloaded.Load(),
+		event:      event,
+		infoHash:   tr.infoHash,
+		left:       tr.bytesLeft(),
+		trackerId:  trackerId,
+		uploaded:   tr.counters.uploaded.Load(),
+	}
+}
+
+/*
+Announces to a single tracker and updates its state with the result.
+
+Hybrid torrents are also announced with their truncated v2 info hash, and the peers of both swarms are returned.
+The tracker's state only reflects the announcement of the torrent's main info hash.
+If the tracker has alternatives in its tier, we give up on it sooner so the announcement can fall through to them.
+*/
+func (tr *Torrent) announce(state *trackerState, event trackerEvent, hasAlternatives bool) (*announceResponse, error) {
+	tr.mutex.Lock()
+	trackerId := state.trackerId
+	tr.mutex.Unlock()
+
+	announceReq := tr.newAnnounceRequest(event, trackerId)
+	announceReq.hasAlternatives = hasAlternatives
+	start := time.Now()
+	response, err := tr.sendAnnounceRequest(state.url, announceReq)
+	tr.metrics.announced(state.url, time.Since(start), err)
+
+	if err == nil {
+		for _, infoHash := range tr.SwarmInfoHashes()[1:] {
+			announceReq.infoHash = infoHash
+
+			if res, err := tr.sendAnnounceRequest(state.url, announceReq); err == nil {
+				response.peers = append(response.peers, res.peers...)
+			}
+		}
+	}
+
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	state.lastAnnounce = time.Now()
+	state.lastError = err
+
+	if err != nil {
+		state.failures += 1
+		tr.events.publish(TrackerError{EventBase: tr.newEventBase(), Tracker: state.url, Err: err})
+
+		return nil, err
+	}
+
+	tr.events.publish(TrackerAnnounced{EventBase: tr.newEventBase(), Tracker: state.url, Peers: len(response.peers), Interval: response.interval})
+
+	state.failures = 0
+	state.interval = response.interval
+	state.leechers = response.leechers
+	state.minInterval = response.minInterval
+	state.seeders = response.seeders
+
+	if response.trackerId != "" {
+		state.trackerId = response.trackerId
+	}
+
+	switch event {
+	case startedEvent:
+		state.started = true
+		state.startedIncomplete = announceReq.left > 0
+	case completedEvent:
+		state.completedSent = true
+	case stoppedEvent:
+		state.started = false
+	}
+
+	return response, nil
+}
+
+// Returns the event to send to a tracker in a regular announcement.
+func (tr *Torrent) nextTrackerEvent(state *trackerState) trackerEvent {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	switch {
+	case !state.started:
+		return startedEvent
+	case tr.isComplete() && state.startedIncomplete && !state.completedSent:
+		return completedEvent
+	default:
+		return noneEvent
+	}
+}
+
+/*
+Announces to the trackers of an announce group following the BEP 12 rules.
+
+Tiers are tried in order, and the trackers within a tier are tried in order. The first tracker that responds
+is moved to the front of its tier and the announcement ends there; we only fall through to the next tracker
+(and eventually the next tier) on failure.
+
+On success, the next announcement is scheduled after the interval requested by the tracker, or after the
+"min interval" if we need more peers. If every tracker fails, the next announcement is retried with exponential backoff.
+*/
+func (tr *Torrent) announceToGroup(group *announceGroup) {
+	var response *announceResponse
+	var respondingTracker *trackerState
+
+	for _, tier := range group.tiers {
+		tr.mutex.Lock()
+		trackers := tier.entries()
+		tr.mutex.Unlock()
+
+		for _, state := range trackers {
+			if state.extra && tr.IsPrivate() {
+				continue
+			}
+
+			res, err := tr.announce(state, tr.nextTrackerEvent(state), len(trackers) > 1)
+
+			if err != nil {
+				tr.trackerLogger.Warn("failed to announce to tracker", logging.TrackerKey, state.url, logging.ErrorKey, err)
+				continue
+			}
+
+			tr.mutex.Lock()
+			tier.promote(state)
+			tr.mutex.Unlock()
+
+			response = res
+			respondingTracker = state
+
+			break
+		}
+
+		if response != nil {
+			break
+		}
+	}
+
+	now := time.Now()
+
+	tr.mutex.Lock()
+
+	group.announcing = false
+
+	if response == nil {
+		group.failures += 1
+		group.nextAnnounce = now.Add(group.retryDelay())
+		tr.mutex.Unlock()
+
+		return
+	}
+
+	group.failures = 0
+
+	interval := respondingTracker.interval
+
+	if interval == 0 {
+		interval = defaultAnnounceInterval
+	}
+
+	if respondingTracker.minInterval > 0 && tr.needsPeers() {
+		interval = respondingTracker.minInterval
+	}
+
+	// Trackers may reject announcements made before their minimum interval has elapsed.
+	interval = max(interval, respondingTracker.minInterval)
+
+	group.nextAnnounce = now.Add(interval)
+	tr.mutex.Unlock()
+
+	select {
+	case <-tr.ctx.Done():
+	case tr.incomingPeersCh <- response.peers:
+	}
+}
+
+// Reports whether the torrent is downloading with so few peers that it should ask trackers for more as soon as they allow. The mutex must be held.
+func (tr *Torrent) needsPeers() bool {
+	lowWaterMark := int(float64(tr.maxPeerConnections) * peerConnectionsLowWaterMark)
+
+	return !tr.isComplete() && !tr.paused && len(tr.peerConnections) < max(lowWaterMark, 1)
+}
+
+// Reports whether the torrent finished downloading since the group's current tracker was last told about it.
+func (tr *Torrent) hasPendingCompletedEvent(group *announceGroup) bool {
+	if !tr.isComplete() {
+		return false
+	}
+
+	for _, tier := range group.tiers {
+		for _, state := range tier.trackers {
+			if state.started {
+				return state.startedIncomplete && !state.completedSent
+			}
+		}
+	}
+
+	return false
+}
+
+// Announces to every group whose next announcement is due. The 'completed' event is sent as soon as the torrent finishes downloading.
+func (tr *Torrent) announceToDueGroups(groups []*announceGroup, sem utils.Semaphore) {
+	now := time.Now()
+
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	// Trackers are told we stopped when the torrent is paused, and are announced to again once it is resumed.
+	if tr.paused {
+		return
+	}
+
+	for _, group := range groups {
+		if group.announcing {
+			continue
+		}
+
+		if now.Before(group.nextAnnounce) && !tr.hasPendingCompletedEvent(group) {
+			continue
+		}
+
+		group.announcing = true
+
+		go func() {
+			sem.Acquire()
+			defer sem.Release()
+
+			tr.announceToGroup(group)
+		}()
+	}
+}
+
+func (tr *Torrent) startAnnouncer() {
+	const schedulerInterval = time.Second
+	ticker := time.NewTicker(schedulerInterval)
+	sem := utils.NewSemaphore(maxConcurrentAnnouncements)
+	groups := newAnnounceGroups(tr.trackerTiers, tr.announceToAllTiers)
+
+	defer ticker.Stop()
+
+	tr.mutex.Lock()
+	tr.announceGroups = groups
+	tr.mutex.Unlock()
+
+	tr.announceToDueGroups(groups, sem)
+
+	for {
+		select {
+		case <-tr.ctx.Done():
+			{
+				return
+			}
+
+		case <-ticker.C:
+			{
+				tr.announceToDueGroups(groups, sem)
+			}
+		}
+	}
+}
+
+// Sends the 'stopped' event to every tracker that was sent the 'started' event, waiting at most `stoppedAnnounceTimeout`.
+func (tr *Torrent) announceStopped() {
+	var wg sync.WaitGroup
+
+	tr.mutex.Lock()
+
+	for _, tier := range tr.trackerTiers {
+		for _, state := range tier.trackers {
+			if !state.started {
+				continue
+			}
+
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+				tr.announce(state, stoppedEvent, false)
+			}()
+		}
+	}
+
+	tr.mutex.Unlock()
+
+	doneCh := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		close(doneCh)
+	}()
+
+	select {
+	case <-doneCh:
+	case <-time.After(stoppedAnnounceTimeout):
+	}
+}
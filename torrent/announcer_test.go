@@ -0,0 +1,309 @@
+package torrent_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MlkMahmud/hail/bencode"
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+/*
+An HTTP tracker serving several trackers, one per path: "<url>/<name>/announce".
+Trackers whose name starts with "bad" respond with a failure, the others with `response`.
+*/
+type fakeHTTPTracker struct {
+	server *httptest.Server
+	mutex  sync.Mutex
+	// Names of the trackers announced to, in order.
+	announced []string
+	// The query of every announcement, in order.
+	queries []url.Values
+}
+
+func newFakeHTTPTracker(t *testing.T, response map[string]any) *fakeHTTPTracker {
+	t.Helper()
+
+	if response == nil {
+		response = map[string]any{"interval": 1800, "peers": ""}
+	}
+
+	ft := &fakeHTTPTracker{}
+	ft.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.Split(strings.Trim(r.URL.Path, "/"), "/")[0]
+
+		ft.mutex.Lock()
+		ft.announced = append(ft.announced, name)
+		ft.queries = append(ft.queries, r.URL.Query())
+		ft.mutex.Unlock()
+
+		response := response
+
+		if strings.HasPrefix(name, "bad") {
+			response = map[string]any{"failure reason": "unregistered torrent"}
+		}
+
+		encoded, _ := bencode.EncodeValue(response)
+		w.Write([]byte(encoded))
+	}))
+
+	t.Cleanup(ft.server.Close)
+
+	return ft
+}
+
+// Returns the announce URLs of the trackers for every tier of names.
+func (ft *fakeHTTPTracker) tiers(names [][]string) [][]string {
+	tiers := [][]string{}
+
+	for _, tier := range names {
+		urls := []string{}
+
+		for _, name := range tier {
+			urls = append(urls, ft.server.URL+"/"+name+"/announce")
+		}
+
+		tiers = append(tiers, urls)
+	}
+
+	return tiers
+}
+
+func (ft *fakeHTTPTracker) announcedTo() []string {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+
+	return append([]string{}, ft.announced...)
+}
+
+func TestAnnounceTiers(t *testing.T) {
+	tests := []struct {
+		name  string
+		tiers [][]string
+		// The trackers expected to be announced to, in order.
+		expectedAnnounced []string
+		expectedTiers     [][]string
+	}{
+		{
+			name:              "first tracker responds",
+			tiers:             [][]string{{"a", "b"}, {"c"}},
+			expectedAnnounced: []string{"a"},
+			expectedTiers:     [][]string{{"a", "b"}, {"c"}},
+		},
+		{
+			name:              "responding tracker moves to the front of its tier",
+			tiers:             [][]string{{"bad1", "bad2", "a", "b"}},
+			expectedAnnounced: []string{"bad1", "bad2", "a"},
+			expectedTiers:     [][]string{{"a", "bad1", "bad2", "b"}},
+		},
+		{
+			name:              "falls through to the next tier",
+			tiers:             [][]string{{"bad1", "bad2"}, {"bad3", "a", "b"}, {"c"}},
+			expectedAnnounced: []string{"bad1", "bad2", "bad3", "a"},
+			expectedTiers:     [][]string{{"bad1", "bad2"}, {"a", "bad3", "b"}, {"c"}},
+		},
+		{
+			name:              "every tracker fails",
+			tiers:             [][]string{{"bad1", "bad2"}, {"bad3"}},
+			expectedAnnounced: []string{"bad1", "bad2", "bad3"},
+			expectedTiers:     [][]string{{"bad1", "bad2"}, {"bad3"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := newFakeHTTPTracker(t, nil)
+			trrnt := newTestTorrent(t)
+			trrnt.SetTrackerTiers(tracker.tiers(test.tiers))
+
+			tiers := trrnt.AnnounceToTiers()
+
+			if announced := tracker.announcedTo(); !reflect.DeepEqual(announced, test.expectedAnnounced) {
+				t.Errorf("expected to announce to %v, but announced to %v", test.expectedAnnounced, announced)
+			}
+
+			if expectedTiers := tracker.tiers(test.expectedTiers); !reflect.DeepEqual(tiers, expectedTiers) {
+				t.Errorf("expected tiers %v, but got %v", expectedTiers, tiers)
+			}
+		})
+	}
+}
+
+func TestAnnounceTiersWhileReadingStats(t *testing.T) {
+	tracker := newFakeHTTPTracker(t, nil)
+	trrnt := newTestTorrent(t)
+	tiers := tracker.tiers([][]string{{"bad1", "a"}, {"bad2", "b"}})
+	doneCh := make(chan struct{})
+	var wg sync.WaitGroup
+
+	trrnt.SetTrackerTiers(tiers)
+
+	// The tiers are reordered while the stats are being read, which the race detector reports if they aren't synchronized.
+	for range 4 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-doneCh:
+					return
+				default:
+					trrnt.Stats()
+				}
+			}
+		}()
+	}
+
+	// The responding tracker is moved to the front of its tier in every round.
+	for range 10 {
+		trrnt.SetTrackerTiers(tiers)
+
+		if tiers := trrnt.AnnounceToTiers(); len(tiers) != 2 || len(tiers[0]) != 2 {
+			t.Fatalf("expected 2 tiers of 2 trackers, but got %v", tiers)
+		}
+	}
+
+	close(doneCh)
+	wg.Wait()
+}
+
+func TestAnnounceSchedule(t *testing.T) {
+	tests := []struct {
+		name     string
+		tiers    [][]string
+		response map[string]any
+		// Number of announcements made before the next one is checked.
+		rounds int
+		// Number of peers the torrent is connected to, out of the default maximum of 10.
+		peerConnections int
+		expected        time.Duration
+	}{
+		{
+			name:     "interval requested by the tracker",
+			tiers:    [][]string{{"a"}},
+			response: map[string]any{"interval": 900, "peers": ""},
+			rounds:   1,
+			expected: 15 * time.Minute,
+		},
+		{
+			name:     "default interval",
+			tiers:    [][]string{{"a"}},
+			response: map[string]any{"peers": ""},
+			rounds:   1,
+			expected: 30 * time.Minute,
+		},
+		{
+			// The torrent has no peers, so it announces as often as the tracker allows.
+			name:     "min interval when more peers are needed",
+			tiers:    [][]string{{"bad", "a"}},
+			response: map[string]any{"interval": 1800, "min interval": 60, "peers": ""},
+			rounds:   1,
+			expected: time.Minute,
+		},
+		{
+			name:            "interval requested by the tracker when enough peers are connected",
+			tiers:           [][]string{{"a"}},
+			response:        map[string]any{"interval": 1800, "min interval": 60, "peers": ""},
+			rounds:          1,
+			peerConnections: 5,
+			expected:        30 * time.Minute,
+		},
+		{
+			name:            "never below the min interval",
+			tiers:           [][]string{{"a"}},
+			response:        map[string]any{"interval": 30, "min interval": 120, "peers": ""},
+			rounds:          1,
+			peerConnections: 10,
+			expected:        2 * time.Minute,
+		},
+		{
+			name:     "retry after every tracker failed",
+			tiers:    [][]string{{"bad1", "bad2"}, {"bad3"}},
+			rounds:   1,
+			expected: 15 * time.Second,
+		},
+		{
+			name:     "retry delay doubles after consecutive failures",
+			tiers:    [][]string{{"bad1"}},
+			rounds:   3,
+			expected: time.Minute,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := newFakeHTTPTracker(t, test.response)
+			trrnt := newTestTorrent(t)
+			trrnt.SetTrackerTiers(tracker.tiers(test.tiers))
+			trrnt.AddPlaceholderPeerConnections(test.peerConnections)
+
+			for range test.rounds {
+				trrnt.AnnounceToTiers()
+			}
+
+			if next := trrnt.NextAnnounceIn(); next > test.expected || next < test.expected-5*time.Second {
+				t.Fatalf("expected the next announcement in %v, but got %v", test.expected, next)
+			}
+		})
+	}
+}
+
+func TestAnnounceURLWithQuery(t *testing.T) {
+	tracker := newFakeHTTPTracker(t, nil)
+	trrnt := newTestTorrent(t)
+	trrnt.SetTrackerTiers([][]string{{tracker.server.URL + "/a/announce?passkey=a%2Fb&x=1"}})
+
+	trrnt.AnnounceToTiers()
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	infoHash := trrnt.InfoHash()
+
+	if len(tracker.queries) != 1 {
+		t.Fatalf("expected 1 announcement, but got %d", len(tracker.queries))
+	}
+
+	if query := tracker.queries[0]; query.Get("passkey") != "a/b" || query.Get("x") != "1" || query.Get("info_hash") != string(infoHash[:]) {
+		t.Fatalf("expected the tracker's query to be kept along with the announce parameters, but got %v", query)
+	}
+}
+
+func TestGetScrapeURL(t *testing.T) {
+	tests := map[string]string{
+		"http://example.com/announce":                  "http://example.com/scrape",
+		"http://example.com/x/announce.php":            "http://example.com/x/scrape.php",
+		"http://example.com/announce?passkey=abc":      "http://example.com/scrape?passkey=abc",
+		"http://example.com/abc/announce?passkey=a/b":  "http://example.com/abc/scrape?passkey=a/b",
+		"https://example.com:8443/announce?x=1&y=2":    "https://example.com:8443/scrape?x=1&y=2",
+		"http://example.com/a%20b/announce?passkey=ab": "http://example.com/a%20b/scrape?passkey=ab",
+	}
+
+	for announceURL, expected := range tests {
+		t.Run(announceURL, func(t *testing.T) {
+			scrapeURL, err := torrent.GetScrapeURL(announceURL)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if scrapeURL != expected {
+				t.Fatalf("expected scrape URL '%s', but got '%s'", expected, scrapeURL)
+			}
+		})
+	}
+
+	for _, announceURL := range []string{"http://example.com/a", "http://example.com/x/announce/y", "http://example.com/a?next=/announce", "http://example.com"} {
+		if _, err := torrent.GetScrapeURL(announceURL); err == nil {
+			t.Errorf("expected tracker '%s' not to support scraping", announceURL)
+		}
+	}
+}
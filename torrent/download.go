@@ -0,0 +1,436 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/MlkMahmud/hail/logging"
+)
+
+// The state shared by every source (peer connections and web seeds) the torrent's pieces are downloaded from.
+type pieceDownload struct {
+	info    *torrentInfo
+	picker  *piecePicker
+	storage *storage
+
+	mutex *sync.Mutex
+	// Whether each file has been reported as completed.
+	completedFiles []bool
+	// Closed once the data already in the download directory has been checked. See `checkExistingData`.
+	checkedCh chan struct{}
+}
+
+const (
+	// Amount of time a peer connection waits before asking the piece picker again when the peer has none of the remaining pieces.
+	peerIdleDelay = 5 * time.Second
+)
+
+/*
+Waits for the torrent's metadata and returns the state of the download.
+
+Returns false if the torrent was stopped, or if it has no download directory.
+*/
+func (tr *Torrent) waitForDownload() (*pieceDownload, bool) {
+	if tr.metadataDownloaderCtx != nil {
+		select {
+		case <-tr.ctx.Done():
+		case <-tr.metadataDownloaderCtx.Done():
+		}
+	}
+
+	tr.mutex.Lock()
+
+	if tr.ctx.Err() != nil || tr.info == nil || tr.outputDir == "" {
+		tr.mutex.Unlock()
+		return nil, false
+	}
+
+	isNew := tr.download == nil
+
+	if isNew {
+		var mutex sync.Mutex
+
+		tr.download = &pieceDownload{
+			info:    tr.info,
+			picker:  newPiecePicker(tr.info.pieces),
+			storage: newStorage(tr.outputDir, tr.info),
+
+			mutex:          &mutex,
+			completedFiles: make([]bool, len(tr.info.files)),
+			checkedCh:      make(chan struct{}),
+		}
+
+		tr.download.picker.setPriorities(piecePriorities(tr.info, tr.filePriorities))
+		tr.setStatus(StatusDownloading)
+	}
+
+	dl := tr.download
+	tr.mutex.Unlock()
+
+	if isNew {
+		tr.checkExistingData(dl)
+		close(dl.checkedCh)
+	}
+
+	select {
+	case <-tr.ctx.Done():
+		{
+			return nil, false
+		}
+
+	case <-dl.checkedCh:
+		{
+			return dl, true
+		}
+	}
+}
+
+/*
+Marks the pieces already in the download directory as completed, so they aren't downloaded again when the torrent is restarted
+and finished torrents go back to seeding.
+
+Their data counts as verified, not as downloaded.
+*/
+func (tr *Torrent) checkExistingData(dl *pieceDownload) {
+	numOfCompleted := 0
+
+	for _, piece := range dl.info.pieces {
+		if tr.ctx.Err() != nil {
+			return
+		}
+
+		// Pieces of files that don't exist yet fail to be read.
+		data, err := dl.storage.readBlock(piece, 0, piece.Length)
+
+		if err != nil || dl.info.verifyPiece(piece, data) != nil {
+			continue
+		}
+
+		tr.counters.verified.Add(int64(piece.Length))
+		dl.picker.complete(piece.Index)
+		dl.newlyCompletedFiles(piece)
+		numOfCompleted += 1
+	}
+
+	if numOfCompleted > 0 {
+		tr.logger.Info("found downloaded pieces in the download directory", "pieces", numOfCompleted)
+	}
+}
+
+// Verifies the hash of a piece downloaded from a source (a peer or a web seed), writes it to disk and marks it as completed.
+func (tr *Torrent) storePiece(dl *pieceDownload, piece Piece, data []byte, source string) error {
+	if err := tr.verifyDownloadedPiece(dl, piece, data, source); err != nil {
+		return err
+	}
+
+	return tr.saveVerifiedPiece(dl, piece, data)
+}
+
+// Verifies the hash of a piece downloaded from a source. Pieces that fail verification are counted as wasted.
+func (tr *Torrent) verifyDownloadedPiece(dl *pieceDownload, piece Piece, data []byte, source string) error {
+	start := time.Now()
+	err := dl.info.verifyPiece(piece, data)
+	tr.metrics.pieceVerified(tr.infoHash, time.Since(start), err)
+
+	if err != nil {
+		tr.counters.wasted.Add(int64(piece.Length))
+		tr.events.publish(HashFailed{EventBase: tr.newEventBase(), Index: piece.Index, Peer: source})
+	}
+
+	return err
+}
+
+func (tr *Torrent) saveVerifiedPiece(dl *pieceDownload, piece Piece, data []byte) error {
+	start := time.Now()
+	err := dl.storage.writePiece(piece, data)
+	tr.metrics.pieceWritten(time.Since(start))
+
+	if err != nil {
+		return err
+	}
+
+	tr.counters.downloaded.Add(int64(piece.Length))
+	tr.counters.verified.Add(int64(piece.Length))
+	tr.downloadMeter.add(piece.Length)
+	dl.picker.complete(piece.Index)
+	tr.broadcastHave(piece.Index)
+	tr.events.publish(PieceVerified{EventBase: tr.newEventBase(), Index: piece.Index})
+
+	for _, f := range dl.newlyCompletedFiles(piece) {
+		tr.events.publish(FileCompleted{EventBase: tr.newEventBase(), Path: f.Name})
+	}
+
+	return nil
+}
+
+// Returns the files covered by a piece that was just completed, whose pieces have all been completed. Every file is only returned once.
+func (dl *pieceDownload) newlyCompletedFiles(piece Piece) []*file {
+	dl.mutex.Lock()
+	defer dl.mutex.Unlock()
+
+	files := []*file{}
+
+	for index := range dl.info.files {
+		f := &dl.info.files[index]
+
+		if dl.completedFiles[index] || f.Length == 0 || piece.Index < f.pieceStartIndex || piece.Index > f.pieceEndIndex {
+			continue
+		}
+
+		isCompleted := true
+
+		for pieceIndex := f.pieceStartIndex; pieceIndex <= f.pieceEndIndex && isCompleted; pieceIndex++ {
+			isCompleted = dl.picker.isPieceCompleted(pieceIndex)
+		}
+
+		if isCompleted {
+			dl.completedFiles[index] = true
+			files = append(files, f)
+		}
+	}
+
+	return files
+}
+
+/*
+Starts downloading from the torrent's web seeds once the metadata is known, and reports when every wanted piece has been downloaded.
+
+The torrent goes back to downloading if skipped files are wanted again once it has finished.
+*/
+func (tr *Torrent) startPieceDownloader() {
+	dl, ok := tr.waitForDownload()
+
+	if !ok {
+		return
+	}
+
+	for _, ws := range tr.webSeeds {
+		go tr.downloadFromWebSeed(ws)
+	}
+
+	finished := false
+
+	for {
+		isDone, changedCh := dl.picker.wantedState()
+
+		if isDone != finished {
+			finished = isDone
+			status := StatusDownloading
+
+			if finished {
+				status = StatusFinished
+
+				if err := dl.storage.finalize(); err != nil {
+					tr.logger.Error("failed to finalize the torrent's files", logging.ErrorKey, err)
+				}
+
+				tr.logger.Info("finished downloading torrent", "name", dl.info.name)
+				tr.events.publish(TorrentFinished{EventBase: tr.newEventBase()})
+			}
+
+			select {
+			case <-tr.ctx.Done():
+				{
+					return
+				}
+
+			case tr.statusCh <- status:
+			}
+		}
+
+		select {
+		case <-tr.ctx.Done():
+			{
+				return
+			}
+
+		case <-changedCh:
+		}
+	}
+}
+
+/*
+Downloads pieces from a connected peer until every piece has been downloaded or the torrent is stopped.
+
+Peers that fail to send valid pieces `MaxFailedAttempts` times are disconnected.
+*/
+func (tr *Torrent) downloadFromPeer(peerConnection *PeerConnection) {
+	dl, ok := tr.waitForDownload()
+
+	if !ok {
+		return
+	}
+
+	// The hashes of v2 pieces can be requested from peers that support v2 if they aren't known yet.
+	hasPiece := func(index int) bool {
+		return peerConnection.hasPiece(index) && (peerConnection.SupportsV2 || dl.info.canVerifyPiece(index))
+	}
+
+	for {
+		tr.mutex.Lock()
+		isConnected := tr.peerConnections[peerConnection.PeerAddress] == peerConnection
+		tr.mutex.Unlock()
+
+		// The connection is closed when the torrent is paused or the peer is banned.
+		if !isConnected {
+			return
+		}
+
+		piecesChangedCh := peerConnection.piecesChanged()
+		piece, ok := dl.picker.pick(hasPiece)
+
+		if !ok {
+			select {
+			case <-tr.ctx.Done():
+				{
+					return
+				}
+
+			case <-dl.picker.completedCh:
+				{
+					return
+				}
+
+			// The peer may have just advertised pieces we want.
+			case <-piecesChangedCh:
+				{
+					continue
+				}
+
+			case <-time.After(peerIdleDelay):
+				{
+					continue
+				}
+			}
+		}
+
+		err := tr.downloadPieceFromPeer(dl, peerConnection, piece)
+
+		if err == nil {
+			continue
+		}
+
+		dl.picker.release(piece.Index)
+
+		// Peers drop our requests when they choke us, which isn't a failed attempt. We resume once we are unchoked.
+		if errors.Is(err, errPeerChoked) {
+			if err := peerConnection.waitForUnchoke(tr.ctx); err != nil {
+				return
+			}
+
+			continue
+		}
+
+		peerConnection.FailedAttempts += 1
+
+		if tr.ctx.Err() != nil {
+			return
+		}
+
+		if peerConnection.FailedAttempts >= MaxFailedAttempts {
+			peerConnection.logger.Debug("disconnecting from peer", "failedAttempts", peerConnection.FailedAttempts)
+			tr.removePeerConnection(peerConnection, fmt.Sprintf("%d failed attempts", peerConnection.FailedAttempts))
+
+			return
+		}
+	}
+}
+
+func (tr *Torrent) downloadPieceFromPeer(dl *pieceDownload, peerConnection *PeerConnection, piece Piece) error {
+	if !dl.info.canVerifyPiece(piece.Index) {
+		if err := requestPieceLayer(dl.info, peerConnection, &dl.info.files[piece.fileIndex]); err != nil {
+			return err
+		}
+	}
+
+	downloadedPiece, err := peerConnection.DownloadPiece(piece)
+
+	if err != nil {
+		return err
+	}
+
+	if err := tr.verifyDownloadedPiece(dl, piece, downloadedPiece.Data, peerConnection.PeerAddress); err != nil {
+		if dl.info.metaVersion == 2 && peerConnection.SupportsV2 {
+			reportBadBlocks(dl.info, peerConnection, piece, downloadedPiece.Data)
+		}
+
+		return err
+	}
+
+	return tr.saveVerifiedPiece(dl, piece, downloadedPiece.Data)
+}
+
+/*
+Requests the piece layer of a file from a peer, in chunks of at most 512 hashes.
+
+The layer is only stored if it matches the file's pieces root.
+*/
+func requestPieceLayer(info *torrentInfo, peerConnection *PeerConnection, f *file) error {
+	numOfPieces := f.pieceEndIndex - f.pieceStartIndex + 1
+	width := nextPowerOfTwo(numOfPieces)
+	length := min(width, maxHashRequestLength)
+	layer := make([]merkleHash, 0, width)
+
+	for index := 0; index < numOfPieces; index += length {
+		hashes, err := peerConnection.requestHashes(hashRequest{
+			piecesRoot: f.piecesRoot,
+			baseLayer:  pieceLayerIndex(info.pieceLength),
+			index:      index,
+			length:     length,
+		})
+
+		if err != nil {
+			return fmt.Errorf("failed to request piece layer of file '%s': %w", f.Name, err)
+		}
+
+		layer = append(layer, hashes...)
+	}
+
+	return info.addPieceLayer(f, layer[:numOfPieces])
+}
+
+/*
+Requests the hashes of the blocks of a piece that failed verification, to find out which 16KiB blocks the peer sent bad data for.
+
+The hashes are verified against the piece's hash, so a peer can't blame blocks it sent correctly.
+*/
+func reportBadBlocks(info *torrentInfo, peerConnection *PeerConnection, piece Piece, data []byte) {
+	_, numOfLeaves, ok := info.pieceMerkleHash(piece)
+
+	if !ok {
+		return
+	}
+
+	badBlocks := []int{0}
+
+	// The hash of a piece made of a single block is the hash of the block itself.
+	if numOfLeaves > 1 {
+		f := &info.files[piece.fileIndex]
+
+		hashes, err := peerConnection.requestHashes(hashRequest{
+			piecesRoot: f.piecesRoot,
+			index:      (piece.Index - f.pieceStartIndex) * numOfLeaves,
+			length:     numOfLeaves,
+		})
+
+		if err == nil {
+			badBlocks, err = info.findBadBlocks(piece, data, hashes)
+		}
+
+		if err != nil {
+			peerConnection.logger.Warn("failed to find the bad blocks of piece sent by peer", logging.PieceKey, piece.Index, logging.ErrorKey, err)
+			return
+		}
+	}
+
+	peerConnection.logger.Warn("peer sent bad data", logging.PieceKey, piece.Index, "blocks", badBlocks)
+}
+
+func (tr *Torrent) removePeerConnection(peerConnection *PeerConnection, reason string) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	tr.closePeerConnection(peerConnection, reason)
+}
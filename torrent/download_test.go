@@ -0,0 +1,284 @@
+package torrent_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MlkMahmud/hail/bencode"
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+const testPieceLength = 16384
+
+type testFile struct {
+	path []any
+	data []byte
+}
+
+func randomBytes(t *testing.T, length int) []byte {
+	t.Helper()
+
+	data := make([]byte, length)
+
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func pieceHashes(data []byte) string {
+	hashes := []byte{}
+
+	for offset := 0; offset < len(data); offset += testPieceLength {
+		hash := sha1.Sum(data[offset:min(offset+testPieceLength, len(data))])
+		hashes = append(hashes, hash[:]...)
+	}
+
+	return string(hashes)
+}
+
+// Writes a metainfo file for the files and returns the torrent loaded from it, set to download to a temporary directory.
+func newTestTorrentFile(t *testing.T, name string, files []testFile, metainfo map[string]any) (torrent.Torrent, string) {
+	t.Helper()
+
+	info := map[string]any{"name": name, "piece length": testPieceLength}
+	concatenated := []byte{}
+
+	if len(files) == 1 && files[0].path == nil {
+		info["length"] = len(files[0].data)
+		concatenated = files[0].data
+	} else {
+		filesList := []any{}
+
+		for _, f := range files {
+			filesList = append(filesList, map[string]any{"length": len(f.data), "path": f.path})
+			concatenated = append(concatenated, f.data...)
+		}
+
+		info["files"] = filesList
+	}
+
+	info["pieces"] = pieceHashes(concatenated)
+	metainfo["info"] = info
+
+	encoded, err := bencode.EncodeValue(metainfo)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), name+".torrent")
+
+	if err := os.WriteFile(path, []byte(encoded), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	trrnt, err := torrent.NewTorrent(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputDir := t.TempDir()
+	trrnt.SetOutputDir(outputDir)
+	t.Cleanup(trrnt.Stop)
+
+	return trrnt, outputDir
+}
+
+func assertFileContents(t *testing.T, path string, expected []byte) {
+	t.Helper()
+
+	contents, err := os.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(contents, expected) {
+		t.Errorf("contents of '%s' do not match the source (%d bytes, expected %d)", path, len(contents), len(expected))
+	}
+}
+
+/*
+Accepts a single connection on the listener and serves the data to it as a peer that has every piece.
+
+If `mangleFirstBlock` is set, it is applied to the payload of the first 'Piece' message sent.
+*/
+func serveData(listener net.Listener, data []byte, mangleFirstBlock func(payload []byte) []byte) {
+	conn, err := listener.Accept()
+
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+
+	handshake := make([]byte, 68)
+
+	if _, err := io.ReadFull(conn, handshake); err != nil {
+		return
+	}
+
+	// Respond with the info hash of the handshake, without support for any extension.
+	response := append([]byte{19}, "BitTorrent protocol"...)
+	response = append(response, make([]byte, 8)...)
+	response = append(response, handshake[28:48]...)
+	response = append(response, "-TS0001-000000000000"...)
+
+	numOfPieces := (len(data) + testPieceLength - 1) / testPieceLength
+	bitfield := make([]byte, (numOfPieces+7)/8)
+
+	for index := range numOfPieces {
+		bitfield[index/8] |= 0x80 >> (index % 8)
+	}
+
+	response = binary.BigEndian.AppendUint32(response, uint32(len(bitfield)+1))
+	response = append(response, byte(torrent.Bitfield))
+	response = append(response, bitfield...)
+
+	if _, err := conn.Write(response); err != nil {
+		return
+	}
+
+	for {
+		lengthBuffer := make([]byte, 4)
+
+		if _, err := io.ReadFull(conn, lengthBuffer); err != nil {
+			return
+		}
+
+		message := make([]byte, binary.BigEndian.Uint32(lengthBuffer))
+
+		if _, err := io.ReadFull(conn, message); err != nil {
+			return
+		}
+
+		if len(message) == 0 {
+			continue
+		}
+
+		var reply []byte
+
+		switch torrent.MessageId(message[0]) {
+		case torrent.Interested:
+			{
+				reply = []byte{byte(torrent.Unchoke)}
+			}
+
+		case torrent.Request:
+			{
+				index := binary.BigEndian.Uint32(message[1:5])
+				begin := binary.BigEndian.Uint32(message[5:9])
+				length := binary.BigEndian.Uint32(message[9:13])
+				offset := int(index)*testPieceLength + int(begin)
+
+				payload := append(bytes.Clone(message[1:9]), data[offset:offset+int(length)]...)
+
+				if mangleFirstBlock != nil {
+					payload = mangleFirstBlock(payload)
+					mangleFirstBlock = nil
+				}
+
+				reply = append([]byte{byte(torrent.PieceMessageId)}, payload...)
+			}
+
+		default:
+			{
+				continue
+			}
+		}
+
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(reply))), reply...)); err != nil {
+			return
+		}
+	}
+}
+
+func TestDownloadsFromPeer(t *testing.T) {
+	data := randomBytes(t, 3*testPieceLength+1234)
+
+	tests := []struct {
+		name             string
+		files            []testFile
+		expectedPaths    []string
+		mangleFirstBlock func(payload []byte) []byte
+	}{
+		{
+			name:          "single file",
+			files:         []testFile{{data: data}},
+			expectedPaths: []string{"torrent"},
+		},
+		{
+			name: "multiple files spanning pieces",
+			files: []testFile{
+				{path: []any{"a.bin"}, data: data[:testPieceLength+100]},
+				{path: []any{"dir", "b.bin"}, data: data[testPieceLength+100:]},
+			},
+			expectedPaths: []string{"torrent/a.bin", "torrent/dir/b.bin"},
+		},
+		{
+			name:             "after a corrupt block",
+			files:            []testFile{{data: data}},
+			expectedPaths:    []string{"torrent"},
+			mangleFirstBlock: func(payload []byte) []byte { payload[8] ^= 0xff; return payload },
+		},
+		{
+			name:             "after a 'Piece' message without a block",
+			files:            []testFile{{data: data}},
+			expectedPaths:    []string{"torrent"},
+			mangleFirstBlock: func(payload []byte) []byte { return payload[:6] },
+		},
+		{
+			name:             "after a block of another piece",
+			files:            []testFile{{data: data}},
+			expectedPaths:    []string{"torrent"},
+			mangleFirstBlock: func(payload []byte) []byte { payload[3] += 1; return payload },
+		},
+		{
+			name:             "after a block at an unaligned offset",
+			files:            []testFile{{data: data}},
+			expectedPaths:    []string{"torrent"},
+			mangleFirstBlock: func(payload []byte) []byte { payload[7] = 1; return payload },
+		},
+		{
+			name:             "after a truncated block",
+			files:            []testFile{{data: data}},
+			expectedPaths:    []string{"torrent"},
+			mangleFirstBlock: func(payload []byte) []byte { return payload[:len(payload)-1] },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer listener.Close()
+
+			go serveData(listener, data, test.mangleFirstBlock)
+
+			trrnt, outputDir := newTestTorrentFile(t, "torrent", test.files, map[string]any{"announce": "http://127.0.0.1:1/announce"})
+
+			if err := trrnt.DownloadFromPeer(listener.Addr().String(), 5*time.Second); err != nil {
+				t.Fatal(err)
+			}
+
+			for index, path := range test.expectedPaths {
+				assertFileContents(t, filepath.Join(outputDir, filepath.FromSlash(path)), test.files[index].data)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An event reported by a torrent. Use a type switch to tell events apart.
+type Event interface {
+	Base() EventBase
+}
+
+// The fields shared by every event.
+type EventBase struct {
+	// The info hash of the torrent the event is about.
+	InfoHash [sha1.Size]byte
+	Time     time.Time
+}
+
+type PeerConnected struct {
+	EventBase
+	Peer string
+}
+
+type PeerDisconnected struct {
+	EventBase
+	Peer   string
+	Reason string
+}
+
+type TrackerAnnounced struct {
+	EventBase
+	Tracker  string
+	Peers    int
+	Interval time.Duration
+}
+
+type TrackerError struct {
+	EventBase
+	Tracker string
+	Err     error
+}
+
+// Reported when the metadata of a torrent created from a magnet link has been downloaded.
+type MetadataReceived struct {
+	EventBase
+	Name string
+}
+
+type PieceVerified struct {
+	EventBase
+	Index int
+}
+
+type HashFailed struct {
+	EventBase
+	Index int
+	// The address of the peer, or the URL of the web seed, that sent the piece.
+	Peer string
+}
+
+type FileCompleted struct {
+	EventBase
+	// Path of the file, relative to the download directory.
+	Path string
+}
+
+type TorrentFinished struct {
+	EventBase
+}
+
+type StateChanged struct {
+	EventBase
+	From TorrentStatus
+	To   TorrentStatus
+}
+
+/*
+Delivers events to subscribers. It can be shared by several torrents, e.g. the torrents of a session.
+
+Every subscriber has its own bounded buffer. Events published while the buffer is full are dropped and counted,
+so slow subscribers never hold up the torrents.
+*/
+type EventBus struct {
+	mutex       *sync.Mutex
+	subscribers map[*Subscription]struct{}
+}
+
+type Subscription struct {
+	bus     *EventBus
+	events  chan Event
+	dropped atomic.Uint64
+	// Only events for which `filter` returns true are delivered. Every event is delivered if nil.
+	filter func(event Event) bool
+}
+
+// Default buffer size of subscriptions.
+const defaultEventBufferSize = 256
+
+func (e EventBase) Base() EventBase {
+	return e
+}
+
+func (s TorrentStatus) String() string {
+	switch s {
+	case StatusConnecting:
+		return "connecting"
+	case StatusDownloading:
+		return "downloading"
+	case StatusFinished:
+		return "finished"
+	case StatusSeeding:
+		return "seeding"
+	default:
+		return "unknown"
+	}
+}
+
+func NewEventBus() *EventBus {
+	var mutex sync.Mutex
+
+	return &EventBus{mutex: &mutex, subscribers: make(map[*Subscription]struct{})}
+}
+
+// Subscribes to every event published on the bus. A buffer size of 0 or less uses the default size (256 events).
+func (b *EventBus) Subscribe(bufferSize int) *Subscription {
+	return b.subscribe(bufferSize, nil)
+}
+
+func (b *EventBus) subscribe(bufferSize int, filter func(event Event) bool) *Subscription {
+	if bufferSize <= 0 {
+		bufferSize = defaultEventBufferSize
+	}
+
+	sub := &Subscription{bus: b, events: make(chan Event, bufferSize), filter: filter}
+
+	b.mutex.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mutex.Unlock()
+
+	return sub
+}
+
+// Delivers the event to every subscriber without blocking.
+func (b *EventBus) publish(event Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for sub := range b.subscribers {
+		if sub.filter != nil && !sub.filter(event) {
+			continue
+		}
+
+		select {
+		case sub.events <- event:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// Returns the channel events are delivered on. It is closed when the subscription ends.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Returns the number of events that were dropped because the subscription's buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Ends the subscription and closes its channel.
+func (s *Subscription) Unsubscribe() {
+	s.bus.mutex.Lock()
+	defer s.bus.mutex.Unlock()
+
+	if _, ok := s.bus.subscribers[s]; !ok {
+		return
+	}
+
+	delete(s.bus.subscribers, s)
+	close(s.events)
+}
+
+/*
+Makes the torrent publish its events on a bus shared with other torrents.
+
+Must be called before `Start`.
+*/
+func (t *Torrent) UseEventBus(bus *EventBus) {
+	t.events = bus
+}
+
+// Subscribes to the events of the torrent. A buffer size of 0 or less uses the default size (256 events).
+func (t *Torrent) Subscribe(bufferSize int) *Subscription {
+	return t.events.subscribe(bufferSize, func(event Event) bool {
+		return event.Base().InfoHash == t.infoHash
+	})
+}
+
+func (tr *Torrent) newEventBase() EventBase {
+	return EventBase{InfoHash: tr.infoHash, Time: time.Now()}
+}
@@ -0,0 +1,145 @@
+package torrent_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+func TestTorrentEvents(t *testing.T) {
+	files := []testFile{
+		{path: []any{"a.bin"}, data: randomBytes(t, testPieceLength+100)},
+		{path: []any{"b.bin"}, data: randomBytes(t, 2*testPieceLength)},
+	}
+
+	srcDir := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(srcDir, "events"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range files {
+		if err := os.WriteFile(filepath.Join(srcDir, "events", f.path[0].(string)), f.data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(srcDir)))
+	defer server.Close()
+
+	trrnt, _ := newTestTorrentFile(t, "events", files, map[string]any{"url-list": server.URL + "/"})
+	sub := trrnt.Subscribe(0)
+	defer sub.Unsubscribe()
+
+	trrnt.Start()
+
+	verifiedPieces := []int{}
+	completedFiles := []string{}
+	finished := 0
+	timeout := time.After(5 * time.Second)
+
+	for seeding := false; !seeding; {
+		select {
+		case event := <-sub.Events():
+			{
+				if event.Base().InfoHash != trrnt.InfoHash() {
+					t.Fatalf("expected events for info hash %x, but got %x", trrnt.InfoHash(), event.Base().InfoHash)
+				}
+
+				switch e := event.(type) {
+				case torrent.PieceVerified:
+					{
+						verifiedPieces = append(verifiedPieces, e.Index)
+					}
+
+				case torrent.FileCompleted:
+					{
+						completedFiles = append(completedFiles, e.Path)
+					}
+
+				case torrent.TorrentFinished:
+					{
+						finished += 1
+					}
+
+				case torrent.StateChanged:
+					{
+						seeding = e.To == torrent.StatusSeeding
+					}
+				}
+			}
+
+		case <-timeout:
+			{
+				t.Fatal("timed out waiting for the torrent to be seeding")
+			}
+		}
+	}
+
+	slices.Sort(verifiedPieces)
+	slices.Sort(completedFiles)
+
+	if !slices.Equal(verifiedPieces, []int{0, 1, 2, 3}) {
+		t.Fatalf("expected pieces [0 1 2 3] to be verified, but got %v", verifiedPieces)
+	}
+
+	expectedFiles := []string{filepath.Join("events", "a.bin"), filepath.Join("events", "b.bin")}
+
+	if !slices.Equal(completedFiles, expectedFiles) {
+		t.Fatalf("expected files %v to be completed, but got %v", expectedFiles, completedFiles)
+	}
+
+	if finished != 1 {
+		t.Fatalf("expected the torrent to finish once, but it finished %d times", finished)
+	}
+
+	if sub.Dropped() != 0 {
+		t.Fatalf("expected no events to be dropped, but %d were", sub.Dropped())
+	}
+}
+
+func TestEventBusDropsEventsOfSlowSubscribers(t *testing.T) {
+	data := randomBytes(t, 3*testPieceLength)
+	srcDir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(srcDir, "slow.bin"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(srcDir)))
+	defer server.Close()
+
+	bus := torrent.NewEventBus()
+	slow := bus.Subscribe(1)
+	other := bus.Subscribe(0)
+
+	trrnt, _ := newTestTorrentFile(t, "slow.bin", []testFile{{data: data}}, map[string]any{"url-list": server.URL + "/"})
+	trrnt.UseEventBus(bus)
+	trrnt.Start()
+
+	waitFor(t, "the torrent to be finished", func() bool { return trrnt.IsFinished() })
+
+	if slow.Dropped() == 0 {
+		t.Fatal("expected events to be dropped once the subscriber's buffer is full")
+	}
+
+	if other.Dropped() != 0 {
+		t.Fatalf("expected a slow subscriber not to affect other subscribers, but %d events were dropped", other.Dropped())
+	}
+
+	slow.Unsubscribe()
+
+	if _, ok := <-slow.Events(); !ok {
+		t.Fatal("expected the buffered event to be delivered before the channel is closed")
+	}
+
+	if _, ok := <-slow.Events(); ok {
+		t.Fatal("expected the channel to be closed once unsubscribed")
+	}
+}
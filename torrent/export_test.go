@@ -0,0 +1,303 @@
+package torrent
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// The result of an announcement, exposed for tests.
+type AnnounceResult struct {
+	Interval time.Duration
+	Leechers int
+	Peers    []string
+	Seeders  int
+}
+
+var ScrapeTracker = scrapeTracker
+
+// Shortens the UDP tracker timeouts for the duration of a test, returning a function that restores them.
+func SetUDPTrackerTimeouts(timeout time.Duration, connectionIdLifetime time.Duration) func() {
+	previousTimeout, previousLifetime := udpTrackerTimeout, udpConnectionIdLifetime
+	udpTrackerTimeout, udpConnectionIdLifetime = timeout, connectionIdLifetime
+
+	return func() {
+		udpTrackerTimeout, udpConnectionIdLifetime = previousTimeout, previousLifetime
+	}
+}
+
+// Shortens the time peers have to complete their handshake for the duration of a test, returning a function that restores it.
+func SetHandshakeTimeout(timeout time.Duration) func() {
+	previousTimeout := handshakeTimeout
+	handshakeTimeout = timeout
+
+	return func() {
+		handshakeTimeout = previousTimeout
+	}
+}
+
+func (t *Torrent) PeerId() [20]byte {
+	return t.peerId
+}
+
+func (t *Torrent) AnnounceToTracker(trackerUrl string) (*AnnounceResult, error) {
+	response, err := t.sendAnnounceRequest(trackerUrl, t.newAnnounceRequest(startedEvent, ""))
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := &AnnounceResult{
+		Interval: response.interval,
+		Leechers: response.leechers,
+		Seeders:  response.seeders,
+	}
+
+	for _, peer := range response.peers {
+		result.Peers = append(result.Peers, peer.String())
+	}
+
+	return result, nil
+}
+
+// Downloads the torrent from a single peer, without contacting trackers.
+func (t *Torrent) DownloadFromPeer(address string, timeout time.Duration) error {
+	go t.startPieceDownloader()
+
+	dl, ok := t.waitForDownload()
+
+	if !ok {
+		return fmt.Errorf("torrent has no metadata or output directory")
+	}
+
+	addrPort, err := netip.ParseAddrPort(address)
+
+	if err != nil {
+		return err
+	}
+
+	peerConnection := t.newPeerConnection(newPeer(addrPort.Addr(), addrPort.Port(), t.infoHash))
+
+	if err := peerConnection.InitConnection(); err != nil {
+		return err
+	}
+
+	// Waits for the peer's bitfield, so the download doesn't start idling before the peer's pieces are known.
+	for deadline := time.Now().Add(timeout); !peerConnection.hasPiece(0); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for the peer's pieces")
+		}
+	}
+
+	t.addPeerConnection(peerConnection)
+
+	select {
+	case <-dl.picker.completedCh:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out waiting for the download to complete")
+	}
+}
+
+// Announces to a tracker the way the announcer does, returning the addresses of the peers of every swarm the torrent is part of.
+func (t *Torrent) Announce(trackerUrl string) ([]string, error) {
+	response, err := t.announce(&trackerState{url: trackerUrl}, startedEvent, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	peers := []string{}
+
+	for _, peer := range response.peers {
+		peers = append(peers, peer.String())
+	}
+
+	return peers, nil
+}
+
+// Shortens the delay before retrying a failed web seed for the duration of a test, returning a function that restores it.
+func SetWebSeedRetryDelay(delay time.Duration) func() {
+	previousDelay := webSeedRetryDelay
+	webSeedRetryDelay = delay
+
+	return func() {
+		webSeedRetryDelay = previousDelay
+	}
+}
+
+// Downloads the torrent from its web seeds only, without contacting trackers or peers. Returns once the files have been finalized.
+func (t *Torrent) DownloadFromWebSeeds(timeout time.Duration) error {
+	go t.startPieceDownloader()
+
+	if _, ok := t.waitForDownload(); !ok {
+		return fmt.Errorf("torrent has no metadata or output directory")
+	}
+
+	select {
+	case <-t.statusCh:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out waiting for the download to complete")
+	}
+}
+
+// Returns the indexes of the blocks of a piece that don't match the block hashes, which must add up to the piece's hash.
+func (t *Torrent) FindBadBlocks(pieceIndex int, data []byte, hashes [][32]byte) ([]int, error) {
+	return t.info.findBadBlocks(t.info.pieces[pieceIndex], data, hashes)
+}
+
+// Returns the hashes a peer would receive in response to a 'hash request' message.
+func (t *Torrent) GetHashes(piecesRoot [32]byte, baseLayer int, index int, length int, proofLayers int) ([][32]byte, bool) {
+	return t.info.getHashes(hashRequest{piecesRoot: piecesRoot, baseLayer: baseLayer, index: index, length: length, proofLayers: proofLayers})
+}
+
+func (t *Torrent) InfoHashV2() [32]byte {
+	return t.infoHashV2
+}
+
+// Shortens the interval between checks of the seeding goals for the duration of a test, returning a function that restores it.
+func SetSeedingGoalCheckInterval(interval time.Duration) func() {
+	previousInterval := seedingGoalCheckInterval
+	seedingGoalCheckInterval = interval
+
+	return func() {
+		seedingGoalCheckInterval = previousInterval
+	}
+}
+
+// Parses a "ut_pex" message payload, returning the addresses of the added and dropped peers in the order they are handed to the torrent.
+func ParsePeerExchangeMessage(payload []byte) ([]string, []string, error) {
+	added, dropped := []string{}, []string{}
+
+	peerConnection := &PeerConnection{
+		pexState: newPeerExchangeState(),
+		onPeerExchange: func(addedPeers []Peer, droppedPeers []Peer) {
+			for _, peer := range addedPeers {
+				added = append(added, peer.String())
+			}
+
+			for _, peer := range droppedPeers {
+				dropped = append(dropped, peer.String())
+			}
+		},
+	}
+
+	err := peerConnection.handlePeerExchangeMessage(payload)
+
+	return added, dropped, err
+}
+
+// Returns the "ut_pex" messages sent to the peer at `peerAddress` as the connected peers change from one round to the next.
+func PeerExchangeMessages(peerAddress string, rounds ...[]string) []map[string]any {
+	state := newPeerExchangeState()
+	messages := []map[string]any{}
+
+	for _, round := range rounds {
+		connectedPeers := make(map[string]Peer, len(round))
+
+		for _, address := range round {
+			connectedPeers[address] = Peer{Address: netip.MustParseAddrPort(address)}
+		}
+
+		messages = append(messages, state.nextMessage(connectedPeers, peerAddress))
+	}
+
+	return messages
+}
+
+// Exposes the assembly of the metadata downloaded from peers for tests.
+type MetadataDownloader struct {
+	md *metadataDownloader
+}
+
+func NewMetadataDownloader(infoHash [20]byte) MetadataDownloader {
+	return MetadataDownloader{md: newMetadataDownloader(infoHash, [32]byte{})}
+}
+
+func (d MetadataDownloader) AddSize(size int) error {
+	return d.md.addSize(size)
+}
+
+func (d MetadataDownloader) StorePiece(size int, index int, data []byte, peerAddress string) ([]byte, []string, error) {
+	return d.md.storePiece(size, index, data, peerAddress)
+}
+
+func (d MetadataDownloader) IsDropped(peerAddress string) bool {
+	return d.md.isDropped(peerAddress)
+}
+
+// Replaces the torrent's trackers with the tiers, keeping the order of the trackers within each tier.
+func (t *Torrent) SetTrackerTiers(tiers [][]string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.trackerTiers = newTrackerTiers(tiers)
+	t.announceGroups = nil
+}
+
+/*
+Announces to every tier of the torrent as a single group the way the announcer does. Returns the URLs of the trackers of every tier in their order after the announcement.
+
+The group is kept until the tiers are replaced, so consecutive failures are counted.
+*/
+func (t *Torrent) AnnounceToTiers() [][]string {
+	t.mutex.Lock()
+
+	if t.announceGroups == nil {
+		t.announceGroups = newAnnounceGroups(t.trackerTiers, false)
+	}
+
+	group := t.announceGroups[0]
+	t.mutex.Unlock()
+
+	t.announceToGroup(group)
+
+	// The announcer hands the peers it received to the torrent, which isn't running.
+	select {
+	case <-t.incomingPeersCh:
+	default:
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	tiers := [][]string{}
+
+	for _, tier := range t.trackerTiers {
+		urls := []string{}
+
+		for _, state := range tier.trackers {
+			urls = append(urls, state.url)
+		}
+
+		tiers = append(tiers, urls)
+	}
+
+	return tiers
+}
+
+// Returns the time left before the next announcement scheduled by `AnnounceToTiers`.
+func (t *Torrent) NextAnnounceIn() time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return time.Until(t.announceGroups[0].nextAnnounce)
+}
+
+var GetScrapeURL = getScrapeURL
+
+func (t *Torrent) BanPeer(address string) {
+	t.banPeer(address)
+}
+
+// Adds connections that count towards the torrent's peers without connecting to anyone. The torrent must not be started.
+func (t *Torrent) AddPlaceholderPeerConnections(count int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for index := range count {
+		address := fmt.Sprintf("192.0.2.%d:6881", index+1)
+		t.peerConnections[address] = &PeerConnection{PeerAddress: address}
+	}
+}
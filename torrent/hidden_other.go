@@ -0,0 +1,8 @@
+//go:build !windows
+
+package torrent
+
+// Files are hidden by their name on Unix-like systems, so the hidden attribute of a file is ignored.
+func setHidden(path string) error {
+	return nil
+}
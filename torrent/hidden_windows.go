@@ -0,0 +1,20 @@
+package torrent
+
+import "syscall"
+
+// Sets the hidden attribute of a file.
+func setHidden(path string) error {
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+
+	if err != nil {
+		return err
+	}
+
+	attributes, err := syscall.GetFileAttributes(pathPtr)
+
+	if err != nil {
+		return err
+	}
+
+	return syscall.SetFileAttributes(pathPtr, attributes|syscall.FILE_ATTRIBUTE_HIDDEN)
+}
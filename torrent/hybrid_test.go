@@ -0,0 +1,319 @@
+package torrent_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/MlkMahmud/hail/bencode"
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+type hybridFile struct {
+	path        []string
+	data        []byte
+	attr        string
+	symlinkPath []any
+}
+
+/*
+Returns the info dictionary of a hybrid torrent containing the files. The v1 files list contains a padding file after every file
+that doesn't end at a piece boundary, and the v2 file tree contains the same files.
+*/
+func newHybridInfoDict(name string, files []hybridFile) (map[string]any, map[string]any) {
+	filesList := []any{}
+	fileTree := map[string]any{}
+	pieceLayers := map[string]any{}
+	concatenated := []byte{}
+
+	for index, f := range files {
+		properties := map[string]any{"length": len(f.data)}
+
+		if f.attr != "" {
+			properties["attr"] = f.attr
+		}
+
+		if f.symlinkPath != nil {
+			properties["symlink path"] = f.symlinkPath
+		}
+
+		if len(f.data) > 0 {
+			piecesRoot, layer := v2FileHashes(f.data)
+			properties["pieces root"] = string(piecesRoot[:])
+
+			if layer != nil {
+				hashes := []byte{}
+
+				for _, hash := range layer {
+					hashes = append(hashes, hash[:]...)
+				}
+
+				pieceLayers[string(piecesRoot[:])] = string(hashes)
+			}
+		}
+
+		path := []any{}
+
+		for _, segment := range f.path {
+			path = append(path, segment)
+		}
+
+		entry := map[string]any{"path": path}
+
+		for key, value := range properties {
+			if key != "pieces root" {
+				entry[key] = value
+			}
+		}
+
+		filesList = append(filesList, entry)
+		concatenated = append(concatenated, f.data...)
+
+		subtree := fileTree
+
+		for _, segment := range f.path[:len(f.path)-1] {
+			if _, ok := subtree[segment]; !ok {
+				subtree[segment] = map[string]any{}
+			}
+
+			subtree = subtree[segment].(map[string]any)
+		}
+
+		subtree[f.path[len(f.path)-1]] = map[string]any{"": properties}
+
+		if padding := (testV2PieceLength - len(f.data)%testV2PieceLength) % testV2PieceLength; padding > 0 && index < len(files)-1 {
+			filesList = append(filesList, map[string]any{"attr": "p", "length": padding, "path": []any{".pad", "0"}})
+			concatenated = append(concatenated, make([]byte, padding)...)
+		}
+	}
+
+	pieces := []byte{}
+
+	for offset := 0; offset < len(concatenated); offset += testV2PieceLength {
+		hash := sha1.Sum(concatenated[offset:min(offset+testV2PieceLength, len(concatenated))])
+		pieces = append(pieces, hash[:]...)
+	}
+
+	info := map[string]any{
+		"file tree":    fileTree,
+		"files":        filesList,
+		"meta version": 2,
+		"name":         name,
+		"piece length": testV2PieceLength,
+		"pieces":       string(pieces),
+	}
+
+	return info, pieceLayers
+}
+
+func writeMetainfo(t *testing.T, metainfo map[string]any) string {
+	t.Helper()
+
+	encoded, err := bencode.EncodeValue(metainfo)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "hybrid.torrent")
+
+	if err := os.WriteFile(path, []byte(encoded), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestHybridWebSeedDownload(t *testing.T) {
+	files := []hybridFile{
+		{path: []string{"a.bin"}, data: randomBytes(t, 2*testV2PieceLength+1000)},
+		{path: []string{"bin", "run.sh"}, data: randomBytes(t, 100), attr: "x"},
+		{path: []string{"empty"}, data: []byte{}},
+		{path: []string{"link"}, data: []byte{}, attr: "l", symlinkPath: []any{"bin", "run.sh"}},
+	}
+
+	srcDir := t.TempDir()
+
+	for _, f := range files[:2] {
+		path := filepath.Join(append([]string{srcDir, "hybrid"}, f.path...)...)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, f.data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(srcDir)))
+	defer server.Close()
+
+	info, pieceLayers := newHybridInfoDict("hybrid", files)
+	path := writeMetainfo(t, map[string]any{"info": info, "piece layers": pieceLayers, "url-list": server.URL + "/"})
+
+	trrnt, err := torrent.NewTorrent(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputDir := t.TempDir()
+	trrnt.SetOutputDir(outputDir)
+	t.Cleanup(trrnt.Stop)
+
+	encodedInfo, _ := bencode.EncodeValue(info)
+	infoHash := trrnt.InfoHash()
+
+	if infoHash != sha1.Sum([]byte(encodedInfo)) || trrnt.InfoHashV2() != sha256.Sum256([]byte(encodedInfo)) {
+		t.Errorf("expected hybrid torrent to have both a v1 and a v2 info hash, but got %x and %x", infoHash, trrnt.InfoHashV2())
+	}
+
+	if err := trrnt.DownloadFromWebSeeds(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	assertFileContents(t, filepath.Join(outputDir, "hybrid", "a.bin"), files[0].data)
+	assertFileContents(t, filepath.Join(outputDir, "hybrid", "bin", "run.sh"), files[1].data)
+	assertFileContents(t, filepath.Join(outputDir, "hybrid", "empty"), []byte{})
+
+	if _, err := os.Stat(filepath.Join(outputDir, "hybrid", ".pad")); !os.IsNotExist(err) {
+		t.Error("expected padding files not to be written to disk")
+	}
+
+	if stat, err := os.Stat(filepath.Join(outputDir, "hybrid", "bin", "run.sh")); err != nil || stat.Mode().Perm()&0o100 == 0 {
+		t.Errorf("expected 'run.sh' to be executable, but got %v (%v)", stat.Mode(), err)
+	}
+
+	target, err := os.Readlink(filepath.Join(outputDir, "hybrid", "link"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if target != filepath.Join("bin", "run.sh") {
+		t.Errorf("expected symbolic link to point to 'bin/run.sh', but got '%s'", target)
+	}
+}
+
+func TestHybridRejectsMismatchedFileTree(t *testing.T) {
+	files := []hybridFile{
+		{path: []string{"a.bin"}, data: randomBytes(t, testV2PieceLength+10)},
+		{path: []string{"b.bin"}, data: randomBytes(t, 10)},
+	}
+
+	info, pieceLayers := newHybridInfoDict("hybrid", files)
+	info["file tree"].(map[string]any)["b.bin"].(map[string]any)[""].(map[string]any)["length"] = 11
+
+	path := writeMetainfo(t, map[string]any{"announce": "http://127.0.0.1:1/announce", "info": info, "piece layers": pieceLayers})
+
+	if _, err := torrent.NewTorrent(path); err == nil {
+		t.Error("expected file tree that doesn't match the files list to be rejected")
+	}
+}
+
+func TestRejectsPathTraversal(t *testing.T) {
+	pieces := string(make([]byte, 20))
+
+	tests := map[string]map[string]any{
+		"file path with '..'": {
+			"files":        []any{map[string]any{"length": 1, "path": []any{"..", "..", "escaped"}}},
+			"name":         "torrent",
+			"piece length": testPieceLength,
+			"pieces":       pieces,
+		},
+		"file path with a separator": {
+			"files":        []any{map[string]any{"length": 1, "path": []any{"../escaped"}}},
+			"name":         "torrent",
+			"piece length": testPieceLength,
+			"pieces":       pieces,
+		},
+		"empty file path": {
+			"files":        []any{map[string]any{"length": 1, "path": []any{}}},
+			"name":         "torrent",
+			"piece length": testPieceLength,
+			"pieces":       pieces,
+		},
+		"name of a single-file torrent": {
+			"length":       1,
+			"name":         "..",
+			"piece length": testPieceLength,
+			"pieces":       pieces,
+		},
+		"name of a multi-file torrent": {
+			"files":        []any{map[string]any{"length": 1, "path": []any{"file"}}},
+			"name":         "/tmp",
+			"piece length": testPieceLength,
+			"pieces":       pieces,
+		},
+		"name of a v2 torrent": {
+			"file tree":    map[string]any{"file": map[string]any{"": map[string]any{"length": 0}}},
+			"meta version": 2,
+			"name":         "..",
+			"piece length": testV2PieceLength,
+		},
+	}
+
+	for name, info := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := writeMetainfo(t, map[string]any{"announce": "http://127.0.0.1:1/announce", "info": info})
+
+			if _, err := torrent.NewTorrent(path); err == nil {
+				t.Error("expected metainfo with a path outside of the download directory to be rejected")
+			}
+		})
+	}
+}
+
+func TestHybridAnnouncesToBothSwarms(t *testing.T) {
+	files := []hybridFile{{path: []string{"a.bin"}, data: randomBytes(t, 100)}}
+	info, pieceLayers := newHybridInfoDict("a.bin", files)
+	delete(info, "files")
+	info["length"] = len(files[0].data)
+
+	infoHashes := [][]byte{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		infoHash := []byte(r.URL.Query().Get("info_hash"))
+		infoHashes = append(infoHashes, infoHash)
+
+		// Every swarm has a single peer, whose port is the number of the announcement.
+		peers := string([]byte{127, 0, 0, 1, 0, byte(len(infoHashes))})
+		response, _ := bencode.EncodeValue(map[string]any{"interval": 60, "peers": peers})
+		w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	path := writeMetainfo(t, map[string]any{"announce": server.URL, "info": info, "piece layers": pieceLayers})
+	trrnt, err := torrent.NewTorrent(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(trrnt.Stop)
+
+	peers, err := trrnt.Announce(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infoHash := trrnt.InfoHash()
+	infoHashV2 := trrnt.InfoHashV2()
+
+	if len(infoHashes) != 2 || !bytes.Equal(infoHashes[0], infoHash[:]) || !bytes.Equal(infoHashes[1], infoHashV2[:20]) {
+		t.Errorf("expected announcements for the v1 and the truncated v2 info hashes, but got %x", infoHashes)
+	}
+
+	if !slices.Equal(peers, []string{"127.0.0.1:1", "127.0.0.1:2"}) {
+		t.Errorf("expected the peers of both swarms, but got %v", peers)
+	}
+}
@@ -0,0 +1,200 @@
+package torrent
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+Limits the number of peer connections of several torrents, e.g. the torrents of a session.
+
+A nil limiter doesn't limit anything.
+*/
+type ConnectionLimiter struct {
+	mutex *sync.Mutex
+	max   int
+	count int
+}
+
+/*
+A token bucket limiting the rate at which bytes are transferred over the peer connections that share it.
+
+The bucket holds at most one second worth of bytes. A nil limiter, or a limiter with a rate of 0, doesn't limit anything.
+*/
+type RateLimiter struct {
+	mutex *sync.Mutex
+	// Bytes per second.
+	rate       int
+	tokens     float64
+	lastRefill time.Time
+}
+
+// A connection whose reads and writes are throttled by rate limiters.
+type rateLimitedConn struct {
+	net.Conn
+	download *RateLimiter
+	upload   *RateLimiter
+}
+
+// A reader, e.g. the body of an HTTP response, whose reads are throttled by a rate limiter.
+type rateLimitedReader struct {
+	reader  io.Reader
+	limiter *RateLimiter
+}
+
+func NewConnectionLimiter(max int) *ConnectionLimiter {
+	var mutex sync.Mutex
+
+	return &ConnectionLimiter{mutex: &mutex, max: max}
+}
+
+// Reserves a connection slot, returning false if every slot is taken.
+func (cl *ConnectionLimiter) tryAcquire() bool {
+	if cl == nil {
+		return true
+	}
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	if cl.count >= cl.max {
+		return false
+	}
+
+	cl.count += 1
+
+	return true
+}
+
+func (cl *ConnectionLimiter) release() {
+	if cl == nil {
+		return
+	}
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	cl.count = max(cl.count-1, 0)
+}
+
+// Returns the number of connection slots in use.
+func (cl *ConnectionLimiter) NumOfConnections() int {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	return cl.count
+}
+
+func (cl *ConnectionLimiter) Max() int {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	return cl.max
+}
+
+func (cl *ConnectionLimiter) SetMax(max int) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	cl.max = max
+}
+
+func NewRateLimiter(bytesPerSecond int) *RateLimiter {
+	var mutex sync.Mutex
+
+	return &RateLimiter{mutex: &mutex, rate: bytesPerSecond, tokens: float64(bytesPerSecond), lastRefill: time.Now()}
+}
+
+// Returns the rate in bytes per second, 0 if unlimited.
+func (rl *RateLimiter) Rate() int {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	return rl.rate
+}
+
+// Sets the rate in bytes per second. A rate of 0 removes the limit.
+func (rl *RateLimiter) SetRate(bytesPerSecond int) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	rl.rate = bytesPerSecond
+	rl.tokens = min(rl.tokens, float64(bytesPerSecond))
+}
+
+// Blocks until `n` bytes can be transferred.
+func (rl *RateLimiter) wait(n int) {
+	if rl == nil {
+		return
+	}
+
+	for n > 0 {
+		rl.mutex.Lock()
+
+		if rl.rate <= 0 {
+			rl.mutex.Unlock()
+			return
+		}
+
+		now := time.Now()
+		rl.tokens = min(rl.tokens+now.Sub(rl.lastRefill).Seconds()*float64(rl.rate), float64(rl.rate))
+		rl.lastRefill = now
+
+		// Transfers larger than the bucket are split into chunks of at most one second worth of bytes.
+		chunk := min(n, rl.rate)
+
+		if rl.tokens >= float64(chunk) {
+			rl.tokens -= float64(chunk)
+			rl.mutex.Unlock()
+			n -= chunk
+
+			continue
+		}
+
+		delay := time.Duration((float64(chunk) - rl.tokens) / float64(rl.rate) * float64(time.Second))
+		rl.mutex.Unlock()
+
+		time.Sleep(delay)
+	}
+}
+
+// Wraps the connection so its reads and writes are throttled by the limiters. The connection is returned as is if neither is set.
+func newRateLimitedConn(conn net.Conn, download *RateLimiter, upload *RateLimiter) net.Conn {
+	if download == nil && upload == nil {
+		return conn
+	}
+
+	return &rateLimitedConn{Conn: conn, download: download, upload: upload}
+}
+
+// Bytes are only accounted for once they have been read, so the rate is limited by delaying the next read.
+func (c *rateLimitedConn) Read(buffer []byte) (int, error) {
+	n, err := c.Conn.Read(buffer)
+	c.download.wait(n)
+
+	return n, err
+}
+
+func (c *rateLimitedConn) Write(buffer []byte) (int, error) {
+	c.upload.wait(len(buffer))
+
+	return c.Conn.Write(buffer)
+}
+
+// Wraps the reader so its reads are throttled by the limiter. The reader is returned as is if the limiter isn't set.
+func newRateLimitedReader(reader io.Reader, limiter *RateLimiter) io.Reader {
+	if limiter == nil {
+		return reader
+	}
+
+	return &rateLimitedReader{reader: reader, limiter: limiter}
+}
+
+func (r *rateLimitedReader) Read(buffer []byte) (int, error) {
+	n, err := r.reader.Read(buffer)
+	r.limiter.wait(n)
+
+	return n, err
+}
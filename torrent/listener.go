@@ -0,0 +1,102 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/MlkMahmud/hail/logging"
+)
+
+// A connection that replays the bytes that were read from it before it was handed over.
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+const (
+	// The beginning of a handshake: the protocol string, the reserved bytes and the info hash.
+	handshakeInfoHashEnd = pstrLen + 29
+)
+
+// Amount of time a peer that connects to us has to complete the handshake.
+var handshakeTimeout = 10 * time.Second
+
+func (c *replayConn) Read(buffer []byte) (int, error) {
+	return c.reader.Read(buffer)
+}
+
+/*
+Reads the beginning of the handshake of an incoming connection to find out which torrent the peer wants.
+
+Returns a connection that replays the bytes that were read, so the whole handshake can be read by the torrent
+the connection is handed to with `HandleIncomingConnection`. The connection is closed if the handshake can't be read.
+
+The deadline of the connection is kept until the torrent has completed the handshake, so peers can't hold on to a connection
+by stalling in the middle of it.
+*/
+func ReadHandshakeInfoHash(conn net.Conn) ([sha1.Size]byte, net.Conn, error) {
+	var infoHash [sha1.Size]byte
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	buffer := make([]byte, handshakeInfoHashEnd)
+
+	if _, err := io.ReadFull(conn, buffer); err != nil {
+		conn.Close()
+		return infoHash, nil, fmt.Errorf("failed to receive handshake: %w", err)
+	}
+
+	if buffer[0] != byte(pstrLen) || string(buffer[1:pstrLen+1]) != pstr {
+		conn.Close()
+		return infoHash, nil, ErrInvalidHandshake
+	}
+
+	copy(infoHash[:], buffer[pstrLen+9:])
+
+	return infoHash, &replayConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(buffer), conn)}, nil
+}
+
+/*
+Completes the handshake of a connection initiated by a peer and adds the peer to the torrent's connections.
+
+The connection is closed if the peer is banned, if the torrent is paused, or if there are no connection slots left.
+*/
+func (t *Torrent) HandleIncomingConnection(conn net.Conn) {
+	address, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	peer := newPeer(address.Addr(), address.Port(), t.infoHash)
+
+	t.mutex.Lock()
+	isBanned := t.isBanned(peer)
+	hasCapacity := len(t.peerConnections) < t.maxPeerConnections && !t.paused
+	t.mutex.Unlock()
+
+	if isBanned || !hasCapacity || !t.connectionLimiter.tryAcquire() {
+		conn.Close()
+		return
+	}
+
+	peerConnection := t.newPeerConnection(peer)
+
+	if err := peerConnection.AcceptConnection(conn); err != nil {
+		peerConnection.logger.Debug("failed to accept connection from peer", logging.ErrorKey, err)
+		t.metrics.HandshakeFailed(err)
+		peerConnection.Close()
+		t.connectionLimiter.release()
+
+		return
+	}
+
+	peerConnection.logger.Debug("accepted connection from peer")
+	t.addPeerConnection(peerConnection)
+}
@@ -1,15 +1,18 @@
 package torrent
 
 import (
-	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base32"
 	"encoding/hex"
 	"fmt"
 	"net/url"
 	"strings"
+)
 
-	"github.com/MlkMahmud/hail/utils"
+const (
+	infoHashV2URNPrefix = "urn:btmh:"
+	sha256MultihashCode = 0x12
 )
 
 func parseInfoHashParameter(xtParameter string) ([sha1.Size]byte, error) {
@@ -51,6 +54,31 @@ func parseInfoHashParameter(xtParameter string) ([sha1.Size]byte, error) {
 	return infoHash, nil
 }
 
+/*
+Parses a v2 info hash parameter (BEP 52), a hex-encoded multihash:
+
+	urn:btmh:1220<64 hex characters>
+
+where 0x12 identifies the SHA-256 hash function and 0x20 is the length of the hash.
+*/
+func parseInfoHashV2Parameter(xtParameter string) ([sha256.Size]byte, error) {
+	var infoHash [sha256.Size]byte
+
+	multihash, err := hex.DecodeString(strings.TrimPrefix(xtParameter, infoHashV2URNPrefix))
+
+	if err != nil {
+		return infoHash, fmt.Errorf("failed to decode hex encoded multihash: %w", err)
+	}
+
+	if len(multihash) != 2+sha256.Size || multihash[0] != sha256MultihashCode || multihash[1] != sha256.Size {
+		return infoHash, fmt.Errorf("v2 info hash must be a SHA-256 multihash")
+	}
+
+	copy(infoHash[:], multihash[2:])
+
+	return infoHash, nil
+}
+
 func parseMagnetURL(magnetURL *url.URL) (Torrent, error) {
 	var torrent Torrent
 
@@ -64,40 +92,52 @@ func parseMagnetURL(magnetURL *url.URL) (Torrent, error) {
 		return torrent, err
 	}
 
-	if infoHashParam, ok := params["xt"]; !ok || len(infoHashParam) != 1 {
-		return torrent, fmt.Errorf("magnet URL must include an 'xt' (info hash) parameter")
-	}
+	var infoHash [sha1.Size]byte
+	var infoHashV2 [sha256.Size]byte
+	var hasInfoHash, hasInfoHashV2 bool
+
+	// Hybrid torrents (BEP 52) are identified by both a v1 and a v2 info hash.
+	for _, xtParameter := range params["xt"] {
+		if strings.HasPrefix(xtParameter, infoHashV2URNPrefix) && !hasInfoHashV2 {
+			if infoHashV2, err = parseInfoHashV2Parameter(xtParameter); err != nil {
+				return torrent, err
+			}
 
-	if trackerParam, ok := params["tr"]; !ok || len(trackerParam) == 0 {
-		return torrent, fmt.Errorf("magnet URL must include a 'tr' (list of trackers) parameter")
+			hasInfoHashV2 = true
+		} else if !hasInfoHash {
+			if infoHash, err = parseInfoHashParameter(xtParameter); err != nil {
+				return torrent, err
+			}
+
+			hasInfoHash = true
+		}
 	}
 
-	infoHash, err := parseInfoHashParameter(params["xt"][0])
+	if !hasInfoHash && !hasInfoHashV2 {
+		return torrent, fmt.Errorf("magnet URL must include an 'xt' (info hash) parameter")
+	}
 
-	if err != nil {
-		return torrent, err
+	// The v2 info hash is truncated to 20 bytes on the wire, unless the torrent also has a v1 info hash.
+	if !hasInfoHash {
+		infoHash = [sha1.Size]byte(infoHashV2[:sha1.Size])
 	}
 
-	trackers := utils.NewSet()
+	// Every tracker of a magnet link is placed in its own tier.
+	trackerTiers := [][]string{}
 
 	for _, tr := range params["tr"] {
-		trackers.Add(tr)
+		trackerTiers = append(trackerTiers, []string{tr})
 	}
 
-	ctx, cancelFunc := context.WithCancel(context.Background())
+	torrent.init(infoHash, nil, nil, trackerTiers)
+	torrent.infoHashV2 = infoHashV2
 
-	torrent.ctx = ctx
-	torrent.cancelFunc = cancelFunc
-
-	torrent.infoHash = infoHash
-	torrent.incomingPeersCh = make(chan []Peer, 1)
-	torrent.maxPeerConnections = 10
-	torrent.metadataPeersCh = make(chan PeerConnection, 10)
-	torrent.peerConnections = map[string]PeerConnection{}
-	torrent.peers = make(map[string]Peer)
-	torrent.failingPeers = make(map[string]Peer)
-	torrent.statusCh = make(chan torrentStatus, 1)
-	torrent.trackers = *trackers
+	// BEP 19: web seeds are given in the "ws" parameters.
+	for _, ws := range params["ws"] {
+		if isSupportedWebSeedURL(ws) {
+			torrent.webSeeds = append(torrent.webSeeds, newWebSeed(urlListWebSeed, ws))
+		}
+	}
 
 	return torrent, nil
 }
@@ -0,0 +1,346 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"sync"
+)
+
+/*
+BitTorrent v2 (BEP 52) hashes every file with a merkle tree of SHA-256 hashes.
+
+The leaves of the tree are the hashes of the file's 16KiB blocks, and the tree is padded to a power of two with zero hashes.
+The layer of the tree where every node covers a whole piece is the "piece layer": it is stored in the metainfo file
+(outside the info dictionary) for files larger than one piece, or requested from peers with 'hash request' messages.
+*/
+
+type merkleHash = [sha256.Size]byte
+
+// A 'hash request', 'hashes' or 'hash reject' message. The hashes are only set for 'hashes' messages.
+type hashRequest struct {
+	piecesRoot merkleHash
+	// Layer of the tree the hashes are taken from, the leaves being layer 0.
+	baseLayer int
+	index     int
+	length    int
+	// Number of ancestor layers for which the uncle hashes are included in the response.
+	proofLayers int
+	hashes      []merkleHash
+}
+
+// The validated piece layers of the torrent's files, keyed by pieces root.
+type pieceLayerStore struct {
+	mutex  *sync.Mutex
+	layers map[merkleHash][]merkleHash
+}
+
+const (
+	hashRequestSize = 48
+	// Maximum number of hashes that can be requested in a single 'hash request' message.
+	maxHashRequestLength = 512
+)
+
+func newPieceLayerStore() *pieceLayerStore {
+	var mutex sync.Mutex
+
+	return &pieceLayerStore{mutex: &mutex, layers: make(map[merkleHash][]merkleHash)}
+}
+
+func (pls *pieceLayerStore) get(piecesRoot merkleHash) ([]merkleHash, bool) {
+	pls.mutex.Lock()
+	defer pls.mutex.Unlock()
+
+	layer, ok := pls.layers[piecesRoot]
+
+	return layer, ok
+}
+
+func (pls *pieceLayerStore) set(piecesRoot merkleHash, layer []merkleHash) {
+	pls.mutex.Lock()
+	defer pls.mutex.Unlock()
+
+	pls.layers[piecesRoot] = layer
+}
+
+func hashPair(left merkleHash, right merkleHash) merkleHash {
+	return sha256.Sum256(append(left[:], right[:]...))
+}
+
+func nextPowerOfTwo(n int) int {
+	if n <= 1 {
+		return 1
+	}
+
+	return 1 << bits.Len(uint(n-1))
+}
+
+func numOfBlocks(length int) int {
+	return (length + BlockSize - 1) / BlockSize
+}
+
+// Returns the SHA-256 hashes of the 16KiB blocks of the data. The last block may be shorter.
+func blockHashes(data []byte) []merkleHash {
+	hashes := make([]merkleHash, 0, numOfBlocks(len(data)))
+
+	for offset := 0; offset < len(data); offset += BlockSize {
+		hashes = append(hashes, sha256.Sum256(data[offset:min(offset+BlockSize, len(data))]))
+	}
+
+	return hashes
+}
+
+// Returns the root of a tree of `numOfLeaves` zero hashes.
+func paddingHash(numOfLeaves int) merkleHash {
+	var hash merkleHash
+
+	for width := numOfLeaves; width > 1; width /= 2 {
+		hash = hashPair(hash, hash)
+	}
+
+	return hash
+}
+
+/*
+Returns every layer of the tree built on top of `base`, from `base` itself to the root.
+
+The base is padded to `width` nodes (a power of two) with `pad`, the hash of an empty subtree at the base's layer.
+*/
+func merkleLayers(base []merkleHash, width int, pad merkleHash) [][]merkleHash {
+	nodes := make([]merkleHash, width)
+	copy(nodes, base)
+
+	for index := len(base); index < width; index++ {
+		nodes[index] = pad
+	}
+
+	layers := [][]merkleHash{nodes}
+
+	for len(nodes) > 1 {
+		parents := make([]merkleHash, len(nodes)/2)
+
+		for index := range parents {
+			parents[index] = hashPair(nodes[2*index], nodes[2*index+1])
+		}
+
+		layers = append(layers, parents)
+		nodes = parents
+	}
+
+	return layers
+}
+
+func merkleRoot(base []merkleHash, width int, pad merkleHash) merkleHash {
+	layers := merkleLayers(base, width, pad)
+
+	return layers[len(layers)-1][0]
+}
+
+// Returns the layer of the tree where every node covers a piece of `pieceLength` bytes.
+func pieceLayerIndex(pieceLength int) int {
+	return bits.Len(uint(pieceLength/BlockSize)) - 1
+}
+
+/*
+Verifies a piece layer against the file's pieces root and stores it.
+
+The piece layer contains one hash per piece of the file, and is padded with the hash of an empty piece to compute the root.
+*/
+func (info *torrentInfo) addPieceLayer(f *file, layer []merkleHash) error {
+	expectedLength := (f.Length + info.pieceLength - 1) / info.pieceLength
+
+	if len(layer) != expectedLength {
+		return fmt.Errorf("expected piece layer of file '%s' to contain %d hashes, but got %d", f.Name, expectedLength, len(layer))
+	}
+
+	pad := paddingHash(info.pieceLength / BlockSize)
+
+	if root := merkleRoot(layer, nextPowerOfTwo(len(layer)), pad); root != f.piecesRoot {
+		return fmt.Errorf("piece layer of file '%s' does not match its pieces root", f.Name)
+	}
+
+	info.pieceLayers.set(f.piecesRoot, layer)
+
+	return nil
+}
+
+/*
+Returns the hash a v2 piece must match, and the number of leaves of the subtree the hash is the root of.
+
+Files that fit in a single piece don't have a piece layer: the piece must match the file's pieces root.
+Returns false if the piece layer of the file hasn't been received yet.
+*/
+func (info *torrentInfo) pieceMerkleHash(piece Piece) (merkleHash, int, bool) {
+	f := &info.files[piece.fileIndex]
+
+	if f.Length <= info.pieceLength {
+		return f.piecesRoot, nextPowerOfTwo(numOfBlocks(f.Length)), true
+	}
+
+	layer, ok := info.pieceLayers.get(f.piecesRoot)
+
+	if !ok {
+		return merkleHash{}, 0, false
+	}
+
+	return layer[piece.Index-f.pieceStartIndex], info.pieceLength / BlockSize, true
+}
+
+/*
+Reports whether the hash of a piece is known, i.e. whether the piece can be verified once downloaded.
+
+The pieces of v1 and hybrid torrents can always be verified with their SHA-1 hash.
+*/
+func (info *torrentInfo) canVerifyPiece(index int) bool {
+	if info.metaVersion != 2 || info.hybrid {
+		return true
+	}
+
+	_, _, ok := info.pieceMerkleHash(info.pieces[index])
+
+	return ok
+}
+
+// Returns the part of a piece's data covered by its file's merkle tree. The last piece of a file of a hybrid torrent ends with padding, which isn't.
+func (info *torrentInfo) pieceFileData(piece Piece, data []byte) []byte {
+	f := &info.files[piece.fileIndex]
+
+	return data[:min(len(data), f.Offset+f.Length-piece.Index*info.pieceLength)]
+}
+
+/*
+Verifies a downloaded piece against its SHA-1 hash (v1), the hash of its file's merkle tree (v2), or both (hybrid).
+
+The merkle tree hash of a hybrid piece is only checked once the piece layer of its file is known.
+*/
+func (info *torrentInfo) verifyPiece(piece Piece, data []byte) error {
+	if info.metaVersion != 2 || info.hybrid {
+		downloadedPiece := DownloadedPiece{Data: data, Piece: piece}
+
+		if err := downloadedPiece.CheckHashIntegrity(); err != nil || info.metaVersion != 2 {
+			return err
+		}
+	}
+
+	expectedHash, numOfLeaves, ok := info.pieceMerkleHash(piece)
+
+	if !ok && info.hybrid {
+		return nil
+	}
+
+	if !ok {
+		return fmt.Errorf("hash of piece %d is unknown", piece.Index)
+	}
+
+	if root := merkleRoot(blockHashes(info.pieceFileData(piece, data)), numOfLeaves, merkleHash{}); root != expectedHash {
+		return fmt.Errorf("merkle root '%x' of downloaded piece at index '%d' does not match expected '%x'", root, piece.Index, expectedHash)
+	}
+
+	return nil
+}
+
+/*
+Returns the indexes (within the piece) of the blocks of the data that don't match their hashes.
+
+The block hashes are sent by a peer, so they are only trusted if they add up to the piece's hash.
+*/
+func (info *torrentInfo) findBadBlocks(piece Piece, data []byte, hashes []merkleHash) ([]int, error) {
+	expectedHash, numOfLeaves, ok := info.pieceMerkleHash(piece)
+
+	if !ok {
+		return nil, fmt.Errorf("hash of piece %d is unknown", piece.Index)
+	}
+
+	if len(hashes) != numOfLeaves || merkleRoot(hashes, numOfLeaves, merkleHash{}) != expectedHash {
+		return nil, fmt.Errorf("block hashes of piece %d do not match the piece's hash", piece.Index)
+	}
+
+	badBlocks := []int{}
+
+	for index, hash := range blockHashes(info.pieceFileData(piece, data)) {
+		if hash != hashes[index] {
+			badBlocks = append(badBlocks, index)
+		}
+	}
+
+	return badBlocks, nil
+}
+
+/*
+Returns the hashes requested by a peer, followed by the uncle hashes of the requested layers' ancestors.
+
+Only the hashes of the piece layer and the layers above it can be served, since the block hashes aren't stored.
+*/
+func (info *torrentInfo) getHashes(req hashRequest) ([]merkleHash, bool) {
+	pieceLayer := pieceLayerIndex(info.pieceLength)
+
+	if req.baseLayer < pieceLayer || req.length < 2 || req.length > maxHashRequestLength || req.length&(req.length-1) != 0 || req.index%req.length != 0 {
+		return nil, false
+	}
+
+	layer, ok := info.pieceLayers.get(req.piecesRoot)
+
+	if !ok {
+		return nil, false
+	}
+
+	layers := merkleLayers(layer, nextPowerOfTwo(len(layer)), paddingHash(info.pieceLength/BlockSize))
+	base := req.baseLayer - pieceLayer
+
+	if base >= len(layers) || req.index+req.length > len(layers[base]) {
+		return nil, false
+	}
+
+	hashes := append([]merkleHash{}, layers[base][req.index:req.index+req.length]...)
+	// The uncles start at the layer of the root of the requested hashes.
+	subtreeLayer := base + bits.Len(uint(req.length)) - 1
+	position := req.index / req.length
+
+	for layerIndex := subtreeLayer; layerIndex < len(layers)-1 && layerIndex < subtreeLayer+req.proofLayers; layerIndex++ {
+		hashes = append(hashes, layers[layerIndex][position^1])
+		position /= 2
+	}
+
+	return hashes, true
+}
+
+func encodeHashRequest(req hashRequest) []byte {
+	payload := bytes.Clone(req.piecesRoot[:])
+	payload = binary.BigEndian.AppendUint32(payload, uint32(req.baseLayer))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(req.index))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(req.length))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(req.proofLayers))
+
+	for _, hash := range req.hashes {
+		payload = append(payload, hash[:]...)
+	}
+
+	return payload
+}
+
+/*
+Decodes the payload of a 'hash request', 'hashes' or 'hash reject' message:
+
+	<pieces root (32 bytes)><base layer><index><length><proof layers>[<hashes (32 bytes each)>]
+*/
+func decodeHashRequest(payload []byte) (hashRequest, error) {
+	var req hashRequest
+
+	if len(payload) < hashRequestSize || (len(payload)-hashRequestSize)%sha256.Size != 0 {
+		return req, fmt.Errorf("hash message has an invalid length of %d bytes", len(payload))
+	}
+
+	copy(req.piecesRoot[:], payload)
+	req.baseLayer = int(binary.BigEndian.Uint32(payload[32:]))
+	req.index = int(binary.BigEndian.Uint32(payload[36:]))
+	req.length = int(binary.BigEndian.Uint32(payload[40:]))
+	req.proofLayers = int(binary.BigEndian.Uint32(payload[44:]))
+
+	for offset := hashRequestSize; offset < len(payload); offset += sha256.Size {
+		req.hashes = append(req.hashes, merkleHash(payload[offset:offset+sha256.Size]))
+	}
+
+	return req, nil
+}
@@ -0,0 +1,283 @@
+package torrent_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MlkMahmud/hail/bencode"
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+const testV2PieceLength = 2 * torrent.BlockSize
+
+func hashNodes(nodes [][32]byte, width int, pad [32]byte) [32]byte {
+	padded := append([][32]byte{}, nodes...)
+
+	for len(padded) < width {
+		padded = append(padded, pad)
+	}
+
+	for len(padded) > 1 {
+		parents := [][32]byte{}
+
+		for index := 0; index < len(padded); index += 2 {
+			parents = append(parents, sha256.Sum256(append(padded[index][:], padded[index+1][:]...)))
+		}
+
+		padded = parents
+	}
+
+	return padded[0]
+}
+
+func testBlockHashes(data []byte) [][32]byte {
+	hashes := [][32]byte{}
+
+	for offset := 0; offset < len(data); offset += torrent.BlockSize {
+		hashes = append(hashes, sha256.Sum256(data[offset:min(offset+torrent.BlockSize, len(data))]))
+	}
+
+	return hashes
+}
+
+func powerOfTwo(n int) int {
+	width := 1
+
+	for width < n {
+		width *= 2
+	}
+
+	return width
+}
+
+// Returns the pieces root and piece layer of a file, computed independently of the package under test.
+func v2FileHashes(data []byte) ([32]byte, [][32]byte) {
+	leavesPerPiece := testV2PieceLength / torrent.BlockSize
+	blocks := testBlockHashes(data)
+
+	if len(data) <= testV2PieceLength {
+		return hashNodes(blocks, powerOfTwo(len(blocks)), [32]byte{}), nil
+	}
+
+	layer := [][32]byte{}
+
+	for index := 0; index < len(blocks); index += leavesPerPiece {
+		layer = append(layer, hashNodes(blocks[index:min(index+leavesPerPiece, len(blocks))], leavesPerPiece, [32]byte{}))
+	}
+
+	emptyPiece := hashNodes(nil, leavesPerPiece, [32]byte{})
+
+	return hashNodes(layer, powerOfTwo(len(layer)), emptyPiece), layer
+}
+
+// Writes a v2 metainfo file with a file tree containing the files and returns the torrent loaded from it.
+func newV2Torrent(t *testing.T, name string, files map[string][]byte, metainfo map[string]any) (torrent.Torrent, string, []byte) {
+	t.Helper()
+
+	fileTree := map[string]any{}
+	pieceLayers := map[string]any{}
+
+	for fileName, data := range files {
+		piecesRoot, layer := v2FileHashes(data)
+		fileTree[fileName] = map[string]any{"": map[string]any{"length": len(data), "pieces root": string(piecesRoot[:])}}
+
+		if layer != nil {
+			concatenated := []byte{}
+
+			for _, hash := range layer {
+				concatenated = append(concatenated, hash[:]...)
+			}
+
+			pieceLayers[string(piecesRoot[:])] = string(concatenated)
+		}
+	}
+
+	info := map[string]any{"file tree": fileTree, "meta version": 2, "name": name, "piece length": testV2PieceLength}
+	metainfo["info"] = info
+	metainfo["piece layers"] = pieceLayers
+
+	encodedInfo, err := bencode.EncodeValue(info)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := bencode.EncodeValue(metainfo)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), name+".torrent")
+
+	if err := os.WriteFile(path, []byte(encoded), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	trrnt, err := torrent.NewTorrent(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputDir := t.TempDir()
+	trrnt.SetOutputDir(outputDir)
+	t.Cleanup(trrnt.Stop)
+
+	return trrnt, outputDir, []byte(encodedInfo)
+}
+
+func TestV2InfoHash(t *testing.T) {
+	trrnt, _, encodedInfo := newV2Torrent(t, "v2", map[string][]byte{"a.bin": randomBytes(t, 100)}, map[string]any{"announce": "http://127.0.0.1:1/announce"})
+
+	expectedInfoHash := sha256.Sum256(encodedInfo)
+	infoHash := trrnt.InfoHash()
+
+	if trrnt.InfoHashV2() != expectedInfoHash {
+		t.Errorf("expected v2 info hash to be %x, but got %x", expectedInfoHash, trrnt.InfoHashV2())
+	}
+
+	if string(infoHash[:]) != string(expectedInfoHash[:20]) {
+		t.Errorf("expected info hash to be the truncated v2 info hash, but got %x", infoHash)
+	}
+}
+
+func TestV2MetainfoRejectsInvalidPieceLayers(t *testing.T) {
+	data := randomBytes(t, 3*testV2PieceLength)
+	piecesRoot, _ := v2FileHashes(data)
+
+	info := map[string]any{
+		"file tree":    map[string]any{"a.bin": map[string]any{"": map[string]any{"length": len(data), "pieces root": string(piecesRoot[:])}}},
+		"meta version": 2,
+		"name":         "v2",
+		"piece length": testV2PieceLength,
+	}
+
+	encoded, _ := bencode.EncodeValue(map[string]any{
+		"announce":     "http://127.0.0.1:1/announce",
+		"info":         info,
+		"piece layers": map[string]any{string(piecesRoot[:]): string(make([]byte, 3*sha256.Size))},
+	})
+
+	path := filepath.Join(t.TempDir(), "v2.torrent")
+
+	if err := os.WriteFile(path, []byte(encoded), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := torrent.NewTorrent(path); err == nil {
+		t.Error("expected piece layer that doesn't match the pieces root to be rejected")
+	}
+}
+
+func TestV2WebSeedDownload(t *testing.T) {
+	files := map[string][]byte{
+		"a.bin": randomBytes(t, 3*testV2PieceLength+1000),
+		"b.bin": randomBytes(t, 100),
+	}
+
+	srcDir := t.TempDir()
+
+	for fileName, data := range files {
+		if err := os.MkdirAll(filepath.Join(srcDir, "v2"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(srcDir, "v2", fileName), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(srcDir)))
+	defer server.Close()
+
+	trrnt, outputDir, _ := newV2Torrent(t, "v2", files, map[string]any{"url-list": server.URL + "/"})
+
+	if err := trrnt.DownloadFromWebSeeds(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	for fileName, data := range files {
+		assertFileContents(t, filepath.Join(outputDir, "v2", fileName), data)
+	}
+}
+
+func TestV2FindBadBlocks(t *testing.T) {
+	data := randomBytes(t, 3*testV2PieceLength)
+	trrnt, _, _ := newV2Torrent(t, "v2", map[string][]byte{"a.bin": data}, map[string]any{"announce": "http://127.0.0.1:1/announce"})
+
+	piece := append([]byte{}, data[testV2PieceLength:2*testV2PieceLength]...)
+	hashes := testBlockHashes(piece)
+	piece[torrent.BlockSize+10] ^= 0xFF
+
+	badBlocks, err := trrnt.FindBadBlocks(1, piece, hashes)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(badBlocks) != 1 || badBlocks[0] != 1 {
+		t.Errorf("expected block 1 to be reported, but got %v", badBlocks)
+	}
+
+	// Hashes that don't add up to the piece's hash can't be used to blame blocks.
+	if _, err := trrnt.FindBadBlocks(1, piece, testBlockHashes(piece)); err == nil {
+		t.Error("expected forged block hashes to be rejected")
+	}
+}
+
+func TestV2ServesPieceLayerHashes(t *testing.T) {
+	data := randomBytes(t, 5*testV2PieceLength)
+	piecesRoot, layer := v2FileHashes(data)
+	trrnt, _, _ := newV2Torrent(t, "v2", map[string][]byte{"a.bin": data}, map[string]any{"announce": "http://127.0.0.1:1/announce"})
+
+	// The piece layer is layer 1 of the tree, since pieces are made of 2 blocks.
+	hashes, ok := trrnt.GetHashes(piecesRoot, 1, 0, 2, 2)
+
+	if !ok {
+		t.Fatal("expected hash request to be served")
+	}
+
+	if len(hashes) != 4 || hashes[0] != layer[0] || hashes[1] != layer[1] {
+		t.Fatalf("unexpected hashes: %x", hashes)
+	}
+
+	// The requested hashes and their uncles add up to the pieces root.
+	node := hashNodes(hashes[:2], 2, [32]byte{})
+	node = sha256.Sum256(append(node[:], hashes[2][:]...))
+	node = sha256.Sum256(append(node[:], hashes[3][:]...))
+
+	if node != piecesRoot {
+		t.Errorf("expected proof to add up to the pieces root %x, but got %x", piecesRoot, node)
+	}
+
+	if _, ok := trrnt.GetHashes(piecesRoot, 0, 0, 2, 0); ok {
+		t.Error("expected request for block hashes to be rejected")
+	}
+}
+
+func TestV2Magnet(t *testing.T) {
+	infoHashV2 := sha256.Sum256([]byte("hail"))
+
+	trrnt, err := torrent.NewTorrent("magnet:?xt=urn:btmh:1220" + hex.EncodeToString(infoHashV2[:]))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infoHash := trrnt.InfoHash()
+
+	if trrnt.InfoHashV2() != infoHashV2 || string(infoHash[:]) != string(infoHashV2[:20]) {
+		t.Errorf("unexpected info hashes %x and %x", infoHash, trrnt.InfoHashV2())
+	}
+
+	if _, err := torrent.NewTorrent("magnet:?xt=urn:btmh:1114" + hex.EncodeToString(infoHashV2[:20])); err == nil {
+		t.Error("expected multihash that isn't SHA-256 to be rejected")
+	}
+}
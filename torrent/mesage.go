@@ -11,7 +11,8 @@ type Message struct {
 type MessageId int
 
 const (
-	Metadata Extension = "ut_metadata"
+	Metadata     Extension = "ut_metadata"
+	PeerExchange Extension = "ut_pex"
 )
 
 const (
@@ -30,5 +31,10 @@ const (
 	Request
 	PieceMessageId
 	Cancel
+	Port
 	ExtensionMessageId = 20
+	// BitTorrent v2 (BEP 52) messages used to exchange the hashes of the files' merkle trees.
+	HashRequest MessageId = 21
+	Hashes      MessageId = 22
+	HashReject  MessageId = 23
 )
@@ -0,0 +1,320 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/MlkMahmud/hail/logging"
+)
+
+/*
+Tracks the pieces of the torrent's metadata (the bencoded info dictionary) downloaded from peers.
+
+The metadata is split into 16KiB pieces which are requested from multiple peers concurrently.
+Once every piece has been received, the assembled metadata is verified against the torrent's info hash.
+
+Peers may advertise different sizes for the metadata, so the pieces are assembled separately for every advertised size.
+A peer advertising a wrong size only wastes the pieces downloaded for that size.
+*/
+type metadataDownloader struct {
+	infoHash [sha1.Size]byte
+	// The SHA-256 info hash of v2 torrents. If set, the metadata is verified against it instead of `infoHash`.
+	infoHashV2 [sha256.Size]byte
+	mutex      sync.Mutex
+
+	completed bool
+	// The metadata being assembled, keyed by the size advertised by the peers it is downloaded from.
+	candidates map[int]*metadataCandidate
+	// Number of invalid pieces, and of failed verifications of the metadata, each peer contributed to.
+	failures map[string]int
+}
+
+type metadataCandidate struct {
+	// Address of the peer each piece was received from.
+	contributors map[int]string
+	pieces       [][]byte
+	// The time at which each in-flight piece was requested.
+	requestedAt map[int]time.Time
+	size        int
+
+	/*
+		The pieces of the last attempt that failed verification, and the peers they were received from.
+		They are compared with the verified metadata to find the peers that sent bad pieces.
+	*/
+	rejectedContributors map[int]string
+	rejectedPieces       [][]byte
+}
+
+const (
+	// Upper bound on the size of the info dictionary we are willing to download.
+	maxMetadataSize = 16 * 1024 * 1024
+	// Number of 'reject' messages after which we stop requesting metadata from a peer.
+	maxMetadataRejects = 3
+	// Number of failures after which we stop requesting metadata from a peer. See `metadataDownloader.failures`.
+	maxMetadataFailures = 3
+)
+
+func newMetadataDownloader(infoHash [sha1.Size]byte, infoHashV2 [sha256.Size]byte) *metadataDownloader {
+	return &metadataDownloader{
+		candidates: make(map[int]*metadataCandidate),
+		failures:   make(map[string]int),
+		infoHash:   infoHash,
+		infoHashV2: infoHashV2,
+	}
+}
+
+func (md *metadataDownloader) matchesInfoHash(metadata []byte) bool {
+	if md.infoHashV2 != ([sha256.Size]byte{}) {
+		return sha256.Sum256(metadata) == md.infoHashV2
+	}
+
+	return sha1.Sum(metadata) == md.infoHash
+}
+
+// Reports whether the peer has sent bad metadata too many times to keep downloading from it.
+func (md *metadataDownloader) isDropped(peerAddress string) bool {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	return md.failures[peerAddress] >= maxMetadataFailures
+}
+
+func (md *metadataDownloader) isCompleted() bool {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	return md.completed
+}
+
+// Returns the index of the next piece of the metadata of the given size to request, or false if all its pieces are either downloaded or being downloaded.
+func (md *metadataDownloader) nextPiece(size int) (int, bool) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	candidate, ok := md.candidates[size]
+
+	if !ok {
+		return 0, false
+	}
+
+	for index, piece := range candidate.pieces {
+		if piece != nil {
+			continue
+		}
+
+		// Pieces that have been in flight for too long are requested again from another peer.
+		if requestedAt, ok := candidate.requestedAt[index]; ok && time.Since(requestedAt) < metadataRequestTimeout {
+			continue
+		}
+
+		candidate.requestedAt[index] = time.Now()
+
+		return index, true
+	}
+
+	return 0, false
+}
+
+func (md *metadataDownloader) releasePiece(size int, index int) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	if candidate, ok := md.candidates[size]; ok {
+		delete(candidate.requestedAt, index)
+	}
+}
+
+// Registers the size of the metadata advertised by a peer, so its pieces can be requested.
+func (md *metadataDownloader) addSize(size int) error {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	if size <= 0 || size > maxMetadataSize {
+		return fmt.Errorf("metadata size %d is invalid", size)
+	}
+
+	if _, ok := md.candidates[size]; ok {
+		return nil
+	}
+
+	md.candidates[size] = &metadataCandidate{
+		contributors: make(map[int]string),
+		pieces:       make([][]byte, int(math.Ceil(float64(size)/float64(BlockSize)))),
+		requestedAt:  make(map[int]time.Time),
+		size:         size,
+	}
+
+	return nil
+}
+
+/*
+Stores a downloaded piece of the metadata of the given size. Once all its pieces have been downloaded, the metadata is assembled and verified.
+
+Returns the assembled metadata if it matches the info hash, along with the addresses of the peers that sent bad pieces in a previous
+attempt so they can be banned. If it doesn't match, all the pieces are discarded and downloaded again: it is not known yet which
+of them are bad, so a failure is counted for every peer that sent one of them. The peer is returned to be banned if it sent all of them.
+*/
+func (md *metadataDownloader) storePiece(size int, index int, data []byte, peerAddress string) ([]byte, []string, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	if md.completed {
+		return nil, nil, nil
+	}
+
+	candidate, ok := md.candidates[size]
+
+	if !ok {
+		return nil, nil, fmt.Errorf("metadata size %d is unknown", size)
+	}
+
+	delete(candidate.requestedAt, index)
+	numOfPieces := len(candidate.pieces)
+
+	if index < 0 || index >= numOfPieces {
+		md.failures[peerAddress] += 1
+		return nil, nil, fmt.Errorf("metadata piece index %d is out of range", index)
+	}
+
+	// Every piece except the last one MUST be 16KiB.
+	expectedLength := BlockSize
+
+	if index == numOfPieces-1 {
+		expectedLength = size - (BlockSize * (numOfPieces - 1))
+	}
+
+	if len(data) != expectedLength {
+		md.failures[peerAddress] += 1
+		return nil, nil, fmt.Errorf("expected metadata piece %d to have length %d, but received %d", index, expectedLength, len(data))
+	}
+
+	candidate.pieces[index] = data
+	candidate.contributors[index] = peerAddress
+
+	for _, piece := range candidate.pieces {
+		if piece == nil {
+			return nil, nil, nil
+		}
+	}
+
+	metadata := bytes.Join(candidate.pieces, nil)
+
+	if !md.matchesInfoHash(metadata) {
+		contributors := make(map[string]struct{})
+
+		for _, address := range candidate.contributors {
+			contributors[address] = struct{}{}
+		}
+
+		for address := range contributors {
+			md.failures[address] += 1
+		}
+
+		candidate.rejectedContributors = candidate.contributors
+		candidate.rejectedPieces = candidate.pieces
+		candidate.contributors = make(map[int]string)
+		candidate.pieces = make([][]byte, numOfPieces)
+
+		// A peer that sent every piece is the one that sent the bad ones.
+		if len(contributors) == 1 {
+			return nil, []string{peerAddress}, fmt.Errorf("assembled metadata does not match the info hash")
+		}
+
+		return nil, nil, fmt.Errorf("assembled metadata does not match the info hash")
+	}
+
+	md.completed = true
+	invalidPeers := []string{}
+	seen := make(map[string]struct{})
+
+	for index, piece := range candidate.rejectedPieces {
+		address, ok := candidate.rejectedContributors[index]
+
+		if !ok || bytes.Equal(piece, candidate.pieces[index]) {
+			continue
+		}
+
+		if _, ok := seen[address]; !ok {
+			seen[address] = struct{}{}
+			invalidPeers = append(invalidPeers, address)
+		}
+	}
+
+	return metadata, invalidPeers, nil
+}
+
+/*
+Requests pieces of the metadata from a single peer until the metadata has been downloaded or the peer stops cooperating.
+
+Pieces are claimed from the shared `metadataDownloader`, so several peers can be downloading different pieces at the same time.
+Peers are dropped once they have sent bad metadata `maxMetadataFailures` times.
+*/
+func (tr *Torrent) downloadMetadataFromPeer(md *metadataDownloader, peerConnection *PeerConnection, completedCh chan<- []byte) {
+	size := peerConnection.metadataSize
+
+	if err := md.addSize(size); err != nil {
+		peerConnection.logger.Debug("cannot download metadata from peer", logging.ErrorKey, err)
+		return
+	}
+
+	numOfRejects := 0
+
+	for tr.metadataDownloaderCtx.Err() == nil && !md.isCompleted() && !md.isDropped(peerConnection.PeerAddress) {
+		pieceIndex, ok := md.nextPiece(size)
+
+		if !ok {
+			// The remaining pieces are being downloaded from other peers, they may be released if those peers fail.
+			select {
+			case <-tr.metadataDownloaderCtx.Done():
+				return
+			case <-time.After(time.Second):
+				continue
+			}
+		}
+
+		piece, err := peerConnection.downloadMetadataPiece(pieceIndex)
+
+		if errors.Is(err, errMetadataPieceRejected) {
+			md.releasePiece(size, pieceIndex)
+			numOfRejects += 1
+
+			if numOfRejects >= maxMetadataRejects {
+				return
+			}
+
+			continue
+		}
+
+		if err != nil {
+			md.releasePiece(size, pieceIndex)
+			peerConnection.logger.Debug("failed to download metadata piece from peer", logging.PieceKey, pieceIndex, logging.ErrorKey, err)
+			return
+		}
+
+		metadata, invalidPeers, err := md.storePiece(size, pieceIndex, piece, peerConnection.PeerAddress)
+
+		for _, address := range invalidPeers {
+			tr.banPeer(address)
+		}
+
+		if err != nil {
+			peerConnection.logger.Warn("failed to store metadata piece from peer", logging.PieceKey, pieceIndex, logging.ErrorKey, err)
+			continue
+		}
+
+		if metadata != nil {
+			select {
+			case completedCh <- metadata:
+			case <-tr.metadataDownloaderCtx.Done():
+			}
+
+			return
+		}
+	}
+}
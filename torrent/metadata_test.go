@@ -0,0 +1,216 @@
+package torrent_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"reflect"
+	"testing"
+
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+type metadataPiece struct {
+	peer string
+	// Offset added to the actual size of the metadata, as advertised by the peer.
+	sizeOffset int
+	index      int
+	corrupt    bool
+}
+
+func TestMetadataDownloader(t *testing.T) {
+	metadata := randomBytes(t, 2*torrent.BlockSize+100)
+
+	tests := []struct {
+		name string
+		// The pieces received from peers, in order.
+		pieces []metadataPiece
+		// Number of times the assembled metadata is expected to fail verification.
+		expectedFailures int
+		expectedBanned   []string
+	}{
+		{
+			name:           "pieces from several peers",
+			pieces:         []metadataPiece{{peer: "a", index: 1}, {peer: "b", index: 0}, {peer: "a", index: 2}},
+			expectedBanned: []string{},
+		},
+		{
+			name: "peer advertising a wrong size first",
+			pieces: []metadataPiece{
+				{peer: "liar", sizeOffset: 1, index: 0},
+				{peer: "liar", sizeOffset: 1, index: 1},
+				{peer: "liar", sizeOffset: 1, index: 2},
+				{peer: "a", index: 0},
+				{peer: "b", index: 1},
+				{peer: "a", index: 2},
+			},
+			expectedFailures: 1,
+			expectedBanned:   []string{},
+		},
+		{
+			name: "bad piece re-fetched from another peer",
+			pieces: []metadataPiece{
+				{peer: "bad", index: 0, corrupt: true},
+				{peer: "a", index: 1},
+				{peer: "bad", index: 2},
+				{peer: "a", index: 0},
+				{peer: "a", index: 1},
+				{peer: "bad", index: 2},
+			},
+			expectedFailures: 1,
+			expectedBanned:   []string{"bad"},
+		},
+		{
+			name: "wrong size and bad pieces",
+			pieces: []metadataPiece{
+				{peer: "liar", sizeOffset: -1, index: 0},
+				{peer: "bad", index: 0},
+				{peer: "liar", sizeOffset: -1, index: 1},
+				{peer: "bad", index: 1, corrupt: true},
+				{peer: "a", index: 2, corrupt: true},
+				{peer: "liar", sizeOffset: -1, index: 2},
+				{peer: "b", index: 0},
+				{peer: "b", index: 1},
+				{peer: "b", index: 2},
+			},
+			expectedFailures: 2,
+			expectedBanned:   []string{"bad", "a"},
+		},
+		{
+			name: "hash failures without proof",
+			pieces: []metadataPiece{
+				{peer: "a", index: 0, corrupt: true},
+				{peer: "a", index: 1},
+				{peer: "a", index: 2},
+				{peer: "b", index: 0, corrupt: true},
+				{peer: "b", index: 1},
+				{peer: "b", index: 2},
+				{peer: "c", index: 0},
+				{peer: "c", index: 1},
+				{peer: "c", index: 2},
+			},
+			expectedFailures: 2,
+			// Only the pieces of the last failed attempt are compared with the verified metadata.
+			expectedBanned: []string{"b"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			md := torrent.NewMetadataDownloader(sha1.Sum(metadata))
+			numOfFailures := 0
+			var downloaded []byte
+			var banned []string
+
+			for _, piece := range test.pieces {
+				size := len(metadata) + piece.sizeOffset
+				// The metadata advertised with a wrong size is padded or truncated.
+				data := append(bytes.Clone(metadata), make([]byte, max(piece.sizeOffset, 0))...)[:size]
+				data = data[piece.index*torrent.BlockSize : min((piece.index+1)*torrent.BlockSize, size)]
+
+				if piece.corrupt {
+					data = bytes.Clone(data)
+					data[0] ^= 0xff
+				}
+
+				if err := md.AddSize(size); err != nil {
+					t.Fatal(err)
+				}
+
+				result, invalidPeers, err := md.StorePiece(size, piece.index, data, piece.peer)
+
+				if err != nil {
+					numOfFailures += 1
+				}
+
+				if result != nil {
+					downloaded, banned = result, invalidPeers
+				}
+			}
+
+			if !bytes.Equal(downloaded, metadata) {
+				t.Fatal("expected metadata to be downloaded")
+			}
+
+			if numOfFailures != test.expectedFailures {
+				t.Errorf("expected %d verification failures, but got %d", test.expectedFailures, numOfFailures)
+			}
+
+			if !reflect.DeepEqual(banned, test.expectedBanned) {
+				t.Errorf("expected %v to be banned, but got %v", test.expectedBanned, banned)
+			}
+		})
+	}
+}
+
+func TestMetadataDownloaderRejectsInvalidPieces(t *testing.T) {
+	md := torrent.NewMetadataDownloader([20]byte{})
+
+	for _, size := range []int{0, -1, 16*1024*1024 + 1} {
+		if err := md.AddSize(size); err == nil {
+			t.Errorf("expected size %d to be rejected", size)
+		}
+	}
+
+	if err := md.AddSize(torrent.BlockSize + 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, piece := range map[string]struct {
+		size  int
+		index int
+		data  []byte
+	}{
+		"unknown size":       {size: torrent.BlockSize, index: 0, data: make([]byte, torrent.BlockSize)},
+		"index out of range": {size: torrent.BlockSize + 1, index: 2, data: make([]byte, 1)},
+		"short piece":        {size: torrent.BlockSize + 1, index: 0, data: make([]byte, 100)},
+		"long last piece":    {size: torrent.BlockSize + 1, index: 1, data: make([]byte, 2)},
+	} {
+		if _, _, err := md.StorePiece(piece.size, piece.index, piece.data, "a"); err == nil {
+			t.Errorf("%s: expected piece to be rejected", name)
+		}
+	}
+}
+
+func TestMetadataDownloaderDropsFailingPeers(t *testing.T) {
+	metadata := randomBytes(t, torrent.BlockSize+100)
+	corrupt := bytes.Clone(metadata)
+	corrupt[0] ^= 0xff
+
+	size := len(metadata)
+	md := torrent.NewMetadataDownloader(sha1.Sum(metadata))
+
+	if err := md.AddSize(size); err != nil {
+		t.Fatal(err)
+	}
+
+	// A peer that sent every piece of metadata that doesn't match the info hash is proven to be bad.
+	for attempt := range 3 {
+		md.StorePiece(size, 0, corrupt[:torrent.BlockSize], "bad")
+		_, invalidPeers, err := md.StorePiece(size, 1, corrupt[torrent.BlockSize:], "bad")
+
+		if err == nil || !reflect.DeepEqual(invalidPeers, []string{"bad"}) {
+			t.Fatalf("expected the peer to be reported as invalid, but got %v (%v)", invalidPeers, err)
+		}
+
+		if dropped := md.IsDropped("bad"); dropped != (attempt == 2) {
+			t.Fatalf("expected the peer to be dropped after 3 failures, but got dropped: %v after %d", dropped, attempt+1)
+		}
+	}
+
+	// Pieces with a wrong length only count as failures of the peer that sent them.
+	for range 3 {
+		if _, _, err := md.StorePiece(size, 1, make([]byte, 1), "short"); err == nil {
+			t.Fatal("expected piece with a wrong length to be rejected")
+		}
+	}
+
+	if !md.IsDropped("short") || md.IsDropped("good") {
+		t.Fatal("expected only the peer that sent pieces with a wrong length to be dropped")
+	}
+
+	md.StorePiece(size, 0, metadata[:torrent.BlockSize], "good")
+
+	if result, _, err := md.StorePiece(size, 1, metadata[torrent.BlockSize:], "good"); err != nil || !bytes.Equal(result, metadata) {
+		t.Fatalf("expected metadata to be downloaded from the remaining peer, but got '%v'", err)
+	}
+}
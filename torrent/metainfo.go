@@ -1,26 +1,34 @@
 package torrent
 
 import (
-	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
+	"math/rand"
+	"net"
 	"path/filepath"
 	"reflect"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/MlkMahmud/hail/bencode"
-	"github.com/MlkMahmud/hail/utils"
 )
 
-func parseAnnounceList(list any) (*utils.Set, error) {
-	trackers := utils.NewSet()
+/*
+Parses the "announce-list" property (BEP 12), a list of tiers where each tier is a list of tracker URLs.
 
+The order of the tiers is preserved, while the trackers within each tier are shuffled.
+*/
+func parseAnnounceList(list any) ([][]string, error) {
 	announceList, ok := list.([]any)
 
 	if !ok {
 		return nil, fmt.Errorf("\"announce-list\" property should be a list, but received '%T'", announceList)
 	}
 
+	tiers := [][]string{}
+
 	for listIndex, tier := range announceList {
 		tierList, ok := tier.([]any)
 
@@ -28,6 +36,8 @@ func parseAnnounceList(list any) (*utils.Set, error) {
 			return nil, fmt.Errorf("announce list contains an invalid entry at index %d", listIndex)
 		}
 
+		trackers := []string{}
+
 		for tierIndex, url := range tierList {
 			urlStr, ok := url.(string)
 
@@ -35,15 +45,125 @@ func parseAnnounceList(list any) (*utils.Set, error) {
 				return nil, fmt.Errorf("announce list entry at index %d contains an invalid entry at index %d", listIndex, tierIndex)
 			}
 
-			if strings.HasPrefix(urlStr, "http://") || strings.HasPrefix(urlStr, "https://") || strings.HasPrefix(urlStr, "udp://") {
-				trackers.Add(urlStr)
+			if isSupportedTrackerURL(urlStr) && !slices.Contains(trackers, urlStr) {
+				trackers = append(trackers, urlStr)
+			}
+		}
+
+		if len(trackers) == 0 {
+			continue
+		}
+
+		rand.Shuffle(len(trackers), func(i, j int) {
+			trackers[i], trackers[j] = trackers[j], trackers[i]
+		})
+
+		tiers = append(tiers, trackers)
+	}
+
+	return tiers, nil
+}
+
+func isSupportedTrackerURL(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") || strings.HasPrefix(url, "udp://")
+}
+
+/*
+Parses the "nodes" property of a trackerless torrent, a list of DHT nodes close to the torrent's info hash.
+
+	nodes = [["<host>", <port>], ["<host>", <port>], ...]
+*/
+func parseNodesList(list any) ([]string, error) {
+	nodesList, ok := list.([]any)
+
+	if !ok {
+		return nil, fmt.Errorf("\"nodes\" property should be a list, but received '%T'", list)
+	}
+
+	nodes := []string{}
+
+	for index, entry := range nodesList {
+		pair, ok := entry.([]any)
+
+		if !ok || len(pair) != 2 {
+			return nil, fmt.Errorf("nodes list contains an invalid entry at index %d", index)
+		}
+
+		host, hostOk := pair[0].(string)
+		port, portOk := pair[1].(int)
+
+		if !hostOk || !portOk {
+			return nil, fmt.Errorf("nodes list contains an invalid entry at index %d", index)
+		}
+
+		nodes = append(nodes, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+
+	return nodes, nil
+}
+
+/*
+Parses the "attr" property of a file (BEP 47), a string in which every character sets an attribute:
+
+	p: padding file, x: executable, h: hidden, l: symbolic link
+
+The target of a symbolic link is given by the "symlink path" property, a list of path segments relative to the torrent's root directory.
+Unknown attributes are ignored. Returns true for padding files.
+*/
+func parseFileAttributes(properties map[string]any, length int) (fileAttributes, bool, error) {
+	var attributes fileAttributes
+
+	attr, ok := properties["attr"].(string)
+
+	if !ok {
+		return attributes, false, nil
+	}
+
+	attributes.executable = strings.Contains(attr, "x")
+	attributes.hidden = strings.Contains(attr, "h")
+
+	if strings.Contains(attr, "l") {
+		segments, ok := properties["symlink path"].([]any)
+
+		if !ok || len(segments) == 0 {
+			return attributes, false, fmt.Errorf("symbolic link is missing the 'symlink path' property")
+		}
+
+		pathList := make([]string, len(segments))
+
+		for index, segment := range segments {
+			name, ok := segment.(string)
+
+			if !ok || !isValidPathSegment(name) {
+				return attributes, false, fmt.Errorf("'symlink path' property contains an invalid entry at index %d", index)
 			}
+
+			pathList[index] = name
+		}
+
+		if length != 0 {
+			return attributes, false, fmt.Errorf("symbolic link must not contain any data")
 		}
+
+		attributes.symlinkPath = filepath.Join(pathList...)
 	}
 
-	return trackers, nil
+	return attributes, strings.Contains(attr, "p"), nil
+}
+
+// Reports whether a path segment of a file can be safely joined to the download directory.
+func isValidPathSegment(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
 }
 
+/*
+Parses the "files" property of a multi-file torrent.
+
+The pieces of a multi-file torrent are computed over the concatenation of every file, in the order they are listed,
+so a single piece can contain data from several files. Each file's offset is the position of its first byte in that concatenation.
+
+Padding files (BEP 47) are left out of the torrent's files, so the bytes they cover are never written to disk.
+*/
 func parseFilesList(infoDict map[string]any, tr Torrent) (*torrentInfo, error) {
 	filesList, ok := infoDict["files"].([]any)
 
@@ -52,18 +172,17 @@ func parseFilesList(infoDict map[string]any, tr Torrent) (*torrentInfo, error) {
 	}
 
 	numOfFiles := len(filesList)
-	files := make([]file, numOfFiles)
+	files := make([]file, 0, numOfFiles)
 
 	pieceLength := infoDict["piece length"].(int)
-	pieces := infoDict["pieces"].(string)
-	piecesArr := []Piece{}
+	totalLength := 0
 
-	fileOffset := 0
-	piecesIndex := 0
+	if pieceLength <= 0 {
+		return nil, fmt.Errorf("'piece length' property must be a positive integer")
+	}
 
 	for i := range numOfFiles {
 		entry, ok := filesList[i].(map[string]any)
-		isLastFile := i == (numOfFiles - 1)
 
 		if !ok {
 			return nil, fmt.Errorf("files list contains an invalid entry at index '%d'", i)
@@ -80,56 +199,66 @@ func parseFilesList(infoDict map[string]any, tr Torrent) (*torrentInfo, error) {
 		paths := entry["path"].([]any)
 		pathList := make([]string, len(paths))
 
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("files list entry at index '%d' contains an empty 'path' property", i)
+		}
+
+		// Segments such as ".." would place the file outside of the download directory.
 		for index, entry := range paths {
-			if _, ok := entry.(string); !ok {
+			name, ok := entry.(string)
+
+			if !ok || !isValidPathSegment(name) {
 				return nil, fmt.Errorf("files list entry at index '%d' contains an invalid 'path' property", i)
 			}
 
-			pathList[index] = entry.(string)
+			pathList[index] = name
 		}
 
 		fileLength := entry["length"].(int)
-		path := filepath.Join(pathList...)
-
-		pieceStartIndex := piecesIndex / sha1.Size
-		pieceEndIndex := pieceStartIndex + (fileLength / pieceLength)
-
-		result, err := parsePiecesHashes(fileLength, pieceLength, pieceStartIndex, pieces[piecesIndex:])
+		attributes, isPadding, err := parseFileAttributes(entry, fileLength)
 
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse files list entry at index '%d': %w", i, err)
+			return nil, fmt.Errorf("files list entry at index '%d' contains invalid attributes: %w", i, err)
 		}
 
-		files[i] = file{
-			torrent:         &tr,
-			Length:          fileLength,
-			Name:            filepath.Join(infoDict["name"].(string), path),
-			Offset:          fileOffset,
-			pieceEndIndex:   pieceEndIndex,
-			pieceStartIndex: pieceStartIndex,
-		}
-		/*
-			If the offset for the next file is not '0' it means the final piece for this file was truncated.
-			Given this assertion, we can copy all the parsed pieces except the last piece, seeing as it will be copied
-			as the first piece for the next file, unless the current file is the last file in the list.
-		*/
-		if result.nextFileOffset != 0 && !isLastFile {
-			piecesArr = append(piecesArr, result.pieces[:len(result.pieces)-1]...)
-		} else {
-			piecesArr = append(piecesArr, result.pieces...)
+		// Padding files are never written to disk, but their bytes are part of the pieces.
+		if !isPadding {
+			files = append(files, file{
+				torrent:         &tr,
+				Length:          fileLength,
+				Name:            filepath.Join(infoDict["name"].(string), filepath.Join(pathList...)),
+				Offset:          totalLength,
+				attributes:      attributes,
+				pieceEndIndex:   (totalLength + max(fileLength-1, 0)) / pieceLength,
+				pieceStartIndex: totalLength / pieceLength,
+			})
 		}
 
-		fileOffset = result.nextFileOffset
-		piecesIndex += result.nextPieceStartIndex
+		totalLength += fileLength
+	}
+
+	result, err := parsePiecesHashes(totalLength, pieceLength, 0, infoDict["pieces"].(string))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse pieces hashes: %w", err)
 	}
 
 	return &torrentInfo{
-		files:  files,
-		pieces: piecesArr,
+		files:       files,
+		isMultiFile: true,
+		length:      totalLength,
+		name:        infoDict["name"].(string),
+		pieceLength: pieceLength,
+		pieceLayers: newPieceLayerStore(),
+		pieces:      result.pieces,
 	}, nil
 }
 
 func parseInfoDict(infoDict map[string]any, tr Torrent) (*torrentInfo, error) {
+	if _, hasPieces := infoDict["pieces"]; !hasPieces && infoDict["meta version"] == 2 {
+		return parseInfoDictV2(infoDict, tr)
+	}
+
 	for key, value := range map[string]any{"name": "", "piece length": 0, "pieces": ""} {
 		if _, exists := infoDict[key]; !exists {
 			return nil, fmt.Errorf("metainfo 'info' dictionary is missing required property '%s'", key)
@@ -143,12 +272,36 @@ func parseInfoDict(infoDict map[string]any, tr Torrent) (*torrentInfo, error) {
 		}
 	}
 
+	if name := infoDict["name"].(string); !isValidPathSegment(name) {
+		return nil, fmt.Errorf("'name' property of metainfo 'info' dictionary is not a valid file name: '%s'", name)
+	}
+
+	var info *torrentInfo
+	var err error
+
 	if _, ok := infoDict["files"]; ok {
-		info, err := parseFilesList(infoDict, tr)
+		info, err = parseFilesList(infoDict, tr)
+	} else {
+		info, err = parseSingleFile(infoDict, tr)
+	}
 
-		return info, err
+	if err != nil {
+		return nil, err
 	}
 
+	info.private = isPrivateInfoDict(infoDict)
+
+	// Hybrid torrents (BEP 52) describe their files with both a v1 files list and a v2 file tree.
+	if _, ok := infoDict["file tree"]; ok && infoDict["meta version"] == 2 {
+		if err := addHybridFileTree(info, infoDict); err != nil {
+			return nil, fmt.Errorf("failed to parse file tree of hybrid torrent: %w", err)
+		}
+	}
+
+	return info, nil
+}
+
+func parseSingleFile(infoDict map[string]any, tr Torrent) (*torrentInfo, error) {
 	if _, ok := infoDict["length"]; !ok {
 		return nil, fmt.Errorf("metainfo 'info' dictionary must contain a 'files' or 'length' property")
 	}
@@ -161,6 +314,10 @@ func parseInfoDict(infoDict map[string]any, tr Torrent) (*torrentInfo, error) {
 
 	pieceLength := infoDict["piece length"].(int)
 	pieceOffset := 0
+
+	if pieceLength <= 0 {
+		return nil, fmt.Errorf("'piece length' property must be a positive integer")
+	}
 	piecesHashes := infoDict["pieces"].(string)
 
 	result, err := parsePiecesHashes(fileLength, pieceLength, pieceOffset, piecesHashes)
@@ -169,21 +326,299 @@ func parseInfoDict(infoDict map[string]any, tr Torrent) (*torrentInfo, error) {
 		return nil, fmt.Errorf("failed to parse pieces hashes: %w", err)
 	}
 
+	// The attributes of the file of a single-file torrent are set in the info dictionary.
+	attributes, _, err := parseFileAttributes(infoDict, fileLength)
+
+	if err != nil {
+		return nil, fmt.Errorf("metainfo 'info' dictionary contains invalid attributes: %w", err)
+	}
+
 	files := []file{{
 		torrent:         &tr,
 		Length:          fileLength,
 		Name:            infoDict["name"].(string),
 		Offset:          0,
-		pieceEndIndex:   fileLength / pieceLength,
+		attributes:      attributes,
+		pieceEndIndex:   max(fileLength-1, 0) / pieceLength,
 		pieceStartIndex: 0,
 	}}
 
 	return &torrentInfo{
-		files:  files,
-		pieces: result.pieces,
+		files:       files,
+		length:      fileLength,
+		name:        infoDict["name"].(string),
+		pieceLength: pieceLength,
+		pieceLayers: newPieceLayerStore(),
+		pieces:      result.pieces,
 	}, nil
 }
 
+/*
+Adds the pieces roots of the v2 file tree of a hybrid torrent to the files parsed from its v1 "files" list.
+
+Both describe the same files: the v1 files list uses padding files so that every file starts at a piece boundary,
+which makes each v1 piece cover the data of a single file, just like the v2 pieces. Hybrid pieces are verified against both their SHA-1 hash
+and the merkle tree of their file.
+*/
+func addHybridFileTree(info *torrentInfo, infoDict map[string]any) error {
+	pieceLength := info.pieceLength
+
+	if pieceLength < BlockSize || pieceLength&(pieceLength-1) != 0 {
+		return fmt.Errorf("'piece length' property must be a power of two of at least %d", BlockSize)
+	}
+
+	fileTree, ok := infoDict["file tree"].(map[string]any)
+
+	if !ok {
+		return fmt.Errorf("\"file tree\" property should be a dictionary, but received '%T'", infoDict["file tree"])
+	}
+
+	entries, err := parseFileTree(fileTree, nil)
+
+	if err != nil {
+		return err
+	}
+
+	entriesByName := make(map[string]fileTreeEntry, len(entries))
+
+	for _, entry := range entries {
+		entriesByName[fileTreeEntryName(info, entry)] = entry
+	}
+
+	if len(entries) != len(info.files) {
+		return fmt.Errorf("file tree contains %d files, but the files list contains %d", len(entries), len(info.files))
+	}
+
+	for index := range info.files {
+		f := &info.files[index]
+		entry, ok := entriesByName[f.Name]
+
+		if !ok || entry.length != f.Length {
+			return fmt.Errorf("file '%s' does not match the file tree", f.Name)
+		}
+
+		if f.Length == 0 {
+			continue
+		}
+
+		if f.Offset%pieceLength != 0 {
+			return fmt.Errorf("file '%s' does not start at a piece boundary", f.Name)
+		}
+
+		f.piecesRoot = entry.piecesRoot
+
+		for pieceIndex := f.pieceStartIndex; pieceIndex <= f.pieceEndIndex; pieceIndex++ {
+			info.pieces[pieceIndex].fileIndex = index
+		}
+	}
+
+	info.hybrid = true
+	info.metaVersion = 2
+
+	return nil
+}
+
+// Returns the path of a file of the file tree, relative to the download directory.
+func fileTreeEntryName(info *torrentInfo, entry fileTreeEntry) string {
+	if info.isMultiFile {
+		return filepath.Join(info.name, filepath.Join(entry.path...))
+	}
+
+	return filepath.Join(entry.path...)
+}
+
+/*
+Parses the info dictionary of a BitTorrent v2 torrent (BEP 52).
+
+The files are described by the "file tree" property, a nested dictionary in which every file is a dictionary
+with an empty key:
+
+	{"dir": {"file.txt": {"": {"length": 1024, "pieces root": <32 bytes>}}}}
+
+Unlike v1 torrents, the pieces of v2 torrents never span several files: every file starts at a piece boundary.
+*/
+func parseInfoDictV2(infoDict map[string]any, tr Torrent) (*torrentInfo, error) {
+	name, ok := infoDict["name"].(string)
+
+	if !ok {
+		return nil, fmt.Errorf("metainfo 'info' dictionary is missing required property 'name'")
+	}
+
+	if !isValidPathSegment(name) {
+		return nil, fmt.Errorf("'name' property of metainfo 'info' dictionary is not a valid file name: '%s'", name)
+	}
+
+	pieceLength, ok := infoDict["piece length"].(int)
+
+	// The piece length of v2 torrents must be a power of two of at least 16KiB.
+	if !ok || pieceLength < BlockSize || pieceLength&(pieceLength-1) != 0 {
+		return nil, fmt.Errorf("'piece length' property must be a power of two of at least %d", BlockSize)
+	}
+
+	fileTree, ok := infoDict["file tree"].(map[string]any)
+
+	if !ok {
+		return nil, fmt.Errorf("metainfo 'info' dictionary is missing required property 'file tree'")
+	}
+
+	entries, err := parseFileTree(fileTree, nil)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse file tree: %w", err)
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("file tree does not contain any files")
+	}
+
+	info := &torrentInfo{
+		// A torrent with a single file at the root of the file tree is a single-file torrent.
+		isMultiFile: len(entries) > 1 || len(entries[0].path) > 1,
+		metaVersion: 2,
+		name:        name,
+		pieceLength: pieceLength,
+		pieceLayers: newPieceLayerStore(),
+		private:     isPrivateInfoDict(infoDict),
+	}
+
+	offset := 0
+
+	for index, entry := range entries {
+		f := file{
+			torrent:         &tr,
+			Length:          entry.length,
+			Name:            fileTreeEntryName(info, entry),
+			Offset:          offset,
+			attributes:      entry.attributes,
+			pieceEndIndex:   (offset + max(entry.length-1, 0)) / pieceLength,
+			pieceStartIndex: offset / pieceLength,
+			piecesRoot:      entry.piecesRoot,
+		}
+
+		for pieceOffset := 0; pieceOffset < entry.length; pieceOffset += pieceLength {
+			info.pieces = append(info.pieces, Piece{
+				Index:     len(info.pieces),
+				Length:    min(pieceLength, entry.length-pieceOffset),
+				fileIndex: index,
+			})
+		}
+
+		info.files = append(info.files, f)
+		info.length += entry.length
+		// The next file starts at the next piece boundary.
+		offset += (entry.length + pieceLength - 1) / pieceLength * pieceLength
+	}
+
+	return info, nil
+}
+
+type fileTreeEntry struct {
+	attributes fileAttributes
+	length     int
+	path       []string
+	piecesRoot merkleHash
+}
+
+// Returns the files of a file tree, in the order of their paths.
+func parseFileTree(tree map[string]any, path []string) ([]fileTreeEntry, error) {
+	if len(path) > 0 {
+		if properties, ok := tree[""].(map[string]any); ok {
+			length, ok := properties["length"].(int)
+
+			if !ok || length < 0 {
+				return nil, fmt.Errorf("file '%s' has an invalid 'length' property", strings.Join(path, "/"))
+			}
+
+			attributes, _, err := parseFileAttributes(properties, length)
+
+			if err != nil {
+				return nil, fmt.Errorf("file '%s' has invalid attributes: %w", strings.Join(path, "/"), err)
+			}
+
+			entry := fileTreeEntry{attributes: attributes, length: length, path: path}
+
+			// Empty files don't have a pieces root.
+			if length > 0 {
+				piecesRoot, ok := properties["pieces root"].(string)
+
+				if !ok || len(piecesRoot) != sha256.Size {
+					return nil, fmt.Errorf("file '%s' has an invalid 'pieces root' property", strings.Join(path, "/"))
+				}
+
+				entry.piecesRoot = merkleHash([]byte(piecesRoot))
+			}
+
+			return []fileTreeEntry{entry}, nil
+		}
+	}
+
+	names := make([]string, 0, len(tree))
+
+	for name := range tree {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+	entries := []fileTreeEntry{}
+
+	for _, name := range names {
+		subtree, ok := tree[name].(map[string]any)
+
+		if !ok || !isValidPathSegment(name) {
+			return nil, fmt.Errorf("file tree contains an invalid entry '%s'", name)
+		}
+
+		subEntries, err := parseFileTree(subtree, append(slices.Clone(path), name))
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, subEntries...)
+	}
+
+	return entries, nil
+}
+
+/*
+Parses the "piece layers" property of a v2 metainfo file: a dictionary mapping the pieces root of every file larger than
+one piece to the concatenated hashes of its piece layer.
+*/
+func parsePieceLayers(info *torrentInfo, value any) error {
+	pieceLayers, ok := value.(map[string]any)
+
+	// Torrents whose files all fit in a single piece don't need piece layers.
+	if !ok && value != nil {
+		return fmt.Errorf("\"piece layers\" property should be a dictionary, but received '%T'", value)
+	}
+
+	for index := range info.files {
+		f := &info.files[index]
+
+		if f.Length <= info.pieceLength {
+			continue
+		}
+
+		hashes, ok := pieceLayers[string(f.piecesRoot[:])].(string)
+
+		if !ok || len(hashes)%sha256.Size != 0 {
+			return fmt.Errorf("piece layer of file '%s' is missing or invalid", f.Name)
+		}
+
+		layer := make([]merkleHash, len(hashes)/sha256.Size)
+
+		for hashIndex := range layer {
+			layer[hashIndex] = merkleHash([]byte(hashes[hashIndex*sha256.Size : (hashIndex+1)*sha256.Size]))
+		}
+
+		if err := info.addPieceLayer(f, layer); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func parseMetaInfo(data []byte) (Torrent, error) {
 	var torrent Torrent
 
@@ -199,7 +634,16 @@ func parseMetaInfo(data []byte) (Torrent, error) {
 		return torrent, fmt.Errorf("expected metainfo to be a bencoded dictionary, but received '%T'", metainfo)
 	}
 
-	for key, value := range map[string]any{"announce": "string", "info": make(map[string]any)} {
+	requiredProperties := map[string]any{"announce": "string", "info": make(map[string]any)}
+
+	// Trackerless torrents include a list of DHT nodes or web seeds instead of a tracker URL.
+	for _, key := range []string{"nodes", "url-list", "httpseeds"} {
+		if _, ok := metainfo[key]; ok {
+			delete(requiredProperties, "announce")
+		}
+	}
+
+	for key, value := range requiredProperties {
 		if _, exists := metainfo[key]; !exists {
 			return torrent, fmt.Errorf("metainfo dictionary is missing required property '%s'", key)
 		}
@@ -213,12 +657,13 @@ func parseMetaInfo(data []byte) (Torrent, error) {
 	}
 
 	var announceListErr error
-	trackers := utils.NewSet()
+	trackerTiers := [][]string{}
 
+	// BEP 12: if the "announce-list" key is present, the client must ignore the "announce" key.
 	if announceList, ok := metainfo["announce-list"]; ok {
-		trackers, announceListErr = parseAnnounceList(announceList)
-	} else {
-		trackers.Add(metainfo["announce"].(string))
+		trackerTiers, announceListErr = parseAnnounceList(announceList)
+	} else if announce, ok := metainfo["announce"].(string); ok {
+		trackerTiers = append(trackerTiers, []string{announce})
 	}
 
 	if announceListErr != nil {
@@ -237,22 +682,43 @@ func parseMetaInfo(data []byte) (Torrent, error) {
 		return torrent, fmt.Errorf("failed to encode metainfo 'info' dictionary")
 	}
 
-	ctx, cancelFunc := context.WithCancel(context.Background())
+	if torrentInfo.metaVersion == 2 {
+		if err := parsePieceLayers(torrentInfo, metainfo["piece layers"]); err != nil {
+			return torrent, fmt.Errorf("failed to parse piece layers: %w", err)
+		}
 
-	torrent.ctx = ctx
-	torrent.cancelFunc = cancelFunc
+		// The info hash of v2 torrents is the SHA-256 hash of the info dictionary, truncated to 20 bytes on the wire.
+		// Hybrid torrents are identified by their v1 info hash, and also join the swarm of their truncated v2 info hash.
+		infoHashV2 := sha256.Sum256([]byte(bencodedValue))
+		infoHash := [sha1.Size]byte(infoHashV2[:sha1.Size])
 
-	torrent.info = torrentInfo
-	torrent.infoHash = sha1.Sum([]byte(bencodedValue))
+		if torrentInfo.hybrid {
+			infoHash = sha1.Sum([]byte(bencodedValue))
+		}
+
+		torrent.init(infoHash, torrentInfo, []byte(bencodedValue), trackerTiers)
+		torrent.infoHashV2 = infoHashV2
+	} else {
+		torrent.init(sha1.Sum([]byte(bencodedValue)), torrentInfo, []byte(bencodedValue), trackerTiers)
+	}
+
+	if nodesList, ok := metainfo["nodes"]; ok {
+		nodes, err := parseNodesList(nodesList)
+
+		if err != nil {
+			return torrent, fmt.Errorf("failed to parse nodes list: %w", err)
+		}
+
+		torrent.dhtNodes = nodes
+	}
+
+	webSeeds, err := parseWebSeeds(metainfo)
+
+	if err != nil {
+		return torrent, fmt.Errorf("failed to parse web seeds: %w", err)
+	}
 
-	torrent.incomingPeersCh = make(chan []Peer, 1)
-	torrent.maxPeerConnections = 10
-	torrent.metadataPeersCh = make(chan PeerConnection, 10)
-	torrent.peerConnections = map[string]PeerConnection{}
-	torrent.peers = make(map[string]Peer)
-	torrent.failingPeers = make(map[string]Peer)
-	torrent.statusCh = make(chan torrentStatus, 1)
-	torrent.trackers = *trackers
+	torrent.webSeeds = webSeeds
 
 	return torrent, nil
 }
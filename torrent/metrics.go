@@ -0,0 +1,165 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/MlkMahmud/hail/metrics"
+)
+
+/*
+The metrics recorded by torrents as they run: failed handshakes, tracker announcements, piece verification and disk writes.
+
+A single set of metrics is usually shared by every torrent of a session, see `UseMetrics`. Nothing is recorded by a nil `*Metrics`.
+*/
+type Metrics struct {
+	handshakeFailures *metrics.Counter
+	announceDuration  *metrics.Histogram
+	announceFailures  *metrics.Counter
+	hashFailures      *metrics.Counter
+	verifyDuration    *metrics.Histogram
+	diskWriteDuration *metrics.Histogram
+}
+
+// The reasons handshakes fail for, used as the "reason" label of the handshake failures.
+const (
+	handshakeReasonTimeout         = "timeout"
+	handshakeReasonRefused         = "refused"
+	handshakeReasonUnreachable     = "unreachable"
+	handshakeReasonClosed          = "closed"
+	handshakeReasonProtocol        = "protocol"
+	handshakeReasonUnknownInfoHash = "unknown_info_hash"
+	handshakeReasonOther           = "other"
+)
+
+// Registers the metrics of torrents with a registry.
+func NewMetrics(registry *metrics.Registry) *Metrics {
+	return &Metrics{
+		handshakeFailures: registry.NewCounter(
+			"hail_peer_handshake_failures_total",
+			"Number of connections to and from peers that failed before the handshake completed, by reason.",
+			"reason",
+		),
+		announceDuration: registry.NewHistogram(
+			"hail_tracker_announce_duration_seconds",
+			"Time taken by tracker announcements, successful or not, by tracker host.",
+			metrics.DurationBuckets,
+			"tracker",
+		),
+		announceFailures: registry.NewCounter(
+			"hail_tracker_announce_failures_total",
+			"Number of failed tracker announcements, by tracker host.",
+			"tracker",
+		),
+		hashFailures: registry.NewCounter(
+			"hail_piece_hash_failures_total",
+			"Number of downloaded pieces that failed hash verification, by torrent.",
+			"info_hash",
+		),
+		verifyDuration: registry.NewHistogram(
+			"hail_piece_verification_duration_seconds",
+			"Time taken to verify the hash of downloaded pieces.",
+			metrics.DurationBuckets,
+		),
+		diskWriteDuration: registry.NewHistogram(
+			"hail_disk_write_duration_seconds",
+			"Time taken to write verified pieces to disk.",
+			metrics.DurationBuckets,
+		),
+	}
+}
+
+/*
+Records the metrics of the torrent with `metrics`. Nothing is recorded if it isn't set.
+
+Must be called before the torrent is started.
+*/
+func (t *Torrent) UseMetrics(metrics *Metrics) {
+	t.metrics = metrics
+}
+
+// Records a connection to or from a peer that failed before its handshake completed.
+func (m *Metrics) HandshakeFailed(err error) {
+	if m == nil {
+		return
+	}
+
+	m.handshakeFailures.Inc(handshakeFailureReason(err))
+}
+
+func (m *Metrics) announced(trackerUrl string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	tracker := trackerLabel(trackerUrl)
+	m.announceDuration.Observe(duration.Seconds(), tracker)
+
+	if err != nil {
+		m.announceFailures.Inc(tracker)
+	}
+}
+
+/*
+Returns the "tracker" label of an announce URL: its scheme and host, e.g. "udp://tracker.example.com:6969".
+
+The path and query are left out, since the announce URLs of private trackers contain the user's passkey.
+*/
+func trackerLabel(trackerUrl string) string {
+	u, err := url.Parse(trackerUrl)
+
+	if err != nil || u.Host == "" {
+		return "invalid"
+	}
+
+	return u.Scheme + "://" + u.Host
+}
+
+func (m *Metrics) pieceVerified(infoHash [sha1.Size]byte, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	m.verifyDuration.Observe(duration.Seconds())
+
+	if err != nil {
+		m.hashFailures.Inc(hex.EncodeToString(infoHash[:]))
+	}
+}
+
+func (m *Metrics) pieceWritten(duration time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.diskWriteDuration.Observe(duration.Seconds())
+}
+
+// Returns the reason a handshake failed, from the error it failed with.
+func handshakeFailureReason(err error) string {
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, ErrUnknownInfoHash):
+		return handshakeReasonUnknownInfoHash
+	case errors.Is(err, ErrInvalidHandshake):
+		return handshakeReasonProtocol
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return handshakeReasonTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return handshakeReasonRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return handshakeReasonUnreachable
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET), errors.Is(err, net.ErrClosed):
+		return handshakeReasonClosed
+	default:
+		return handshakeReasonOther
+	}
+}
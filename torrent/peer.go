@@ -2,15 +2,69 @@ package torrent
 
 import (
 	"crypto/sha1"
+	"encoding/binary"
 	"fmt"
+	"net/netip"
 )
 
 type Peer struct {
-	InfoHash  [sha1.Size]byte
-	IpAddress string
-	Port      uint16
+	Address  netip.AddrPort
+	InfoHash [sha1.Size]byte
 }
 
+const (
+	compactPeerSize  = 6
+	compactPeer6Size = 18
+)
+
+// Creates a peer from an IP address and port. IPv4-mapped IPv6 addresses are converted to IPv4 addresses.
+func newPeer(addr netip.Addr, port uint16, infoHash [sha1.Size]byte) Peer {
+	return Peer{Address: netip.AddrPortFrom(addr.Unmap(), port), InfoHash: infoHash}
+}
+
+// Returns the "host:port" address of the peer. IPv6 addresses are enclosed in brackets, e.g. "[2001:db8::1]:6881".
 func (p Peer) String() string {
-	return fmt.Sprintf("%s:%d", p.IpAddress, p.Port)
+	return p.Address.String()
+}
+
+/*
+Returns the compact representation of the peer (the IP address followed by the port in network byte order).
+
+The second return value reports whether the peer has an IPv4 address, which is encoded in 6 bytes; IPv6 addresses are encoded in 18 bytes.
+*/
+func (p Peer) compact() ([]byte, bool) {
+	if !p.Address.IsValid() {
+		return nil, false
+	}
+
+	addr := p.Address.Addr()
+	buffer, _ := addr.MarshalBinary()
+	buffer = binary.BigEndian.AppendUint16(buffer, p.Address.Port())
+
+	return buffer, addr.Is4()
+}
+
+// Parses a string of peers in the compact format, where each peer is represented by its IP address followed by its port.
+func parseCompactPeers(peers string, peerSize int, infoHash [sha1.Size]byte) ([]Peer, error) {
+	peersStringLen := len(peers)
+
+	if peersStringLen%peerSize != 0 {
+		return nil, fmt.Errorf("peers value must be a multiple of '%d' bytes", peerSize)
+	}
+
+	ipAddressSize := peerSize - 2
+	peersArr := make([]Peer, 0, peersStringLen/peerSize)
+
+	for i := 0; i < peersStringLen; i += peerSize {
+		addr, ok := netip.AddrFromSlice([]byte(peers[i : i+ipAddressSize]))
+
+		if !ok {
+			return nil, fmt.Errorf("peers value contains an invalid IP address at offset %d", i)
+		}
+
+		port := binary.BigEndian.Uint16([]byte(peers[i+ipAddressSize : i+peerSize]))
+		peersArr = append(peersArr, newPeer(addr, port, infoHash))
+	}
+
+	return peersArr, nil
 }
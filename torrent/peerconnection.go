@@ -2,15 +2,21 @@ package torrent
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"log/slog"
 	"math"
 	"net"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/MlkMahmud/hail/bencode"
+	"github.com/MlkMahmud/hail/logging"
 	"github.com/MlkMahmud/hail/utils"
 )
 
@@ -27,13 +33,110 @@ type PeerConnection struct {
 	PeerAddress        string
 	PeerId             string
 	PeerExtensions     map[Extension]uint8
+	SupportsDHT        bool
 	SupportsExtensions bool
-	Unchoked           bool
+	// Set if the peer supports BitTorrent v2 (BEP 52) and can send the hashes of the torrent's merkle trees.
+	SupportsV2 bool
+	// Set while the peer lets us request blocks. See `chokeState`.
+	Unchoked bool
+
+	peer        Peer
+	localPeerId [20]byte
+	// Set if the connection was initiated by the peer, in which case the peer's port is not the one it accepts connections on.
+	incoming bool
+	// Set if the connection was created before the torrent's metadata was known, in which case `availablePieces` grows with the messages of the peer.
+	numOfPiecesUnknown bool
+
+	dhtPort   uint16
+	onDHTPort func(address string)
+
+	getMetadata func() []byte
+	getHashes   func(req hashRequest) ([]merkleHash, bool)
+
+	getBlock        func(pieceIndex int, begin int, length int) ([]byte, bool)
+	completedPieces func() []bool
+	onUpload        func(n int)
+	// Set once we unchoked the peer, which may then request blocks from us.
+	unchokedPeer bool
+	// Set once we sent an 'Interested' message to the peer.
+	amInterested bool
+	// Set while the peer is interested in our pieces.
+	peerInterested bool
+	// Number of 'Request' messages sent to the peer that haven't been answered yet.
+	pendingRequests int
+	// Number of 'hash request' and "ut_metadata" requests sent to the peer that haven't been answered yet.
+	pendingHashRequests     int
+	pendingMetadataRequests int
+	// Measure the rates at which blocks are received from and sent to the peer.
+	downloadMeter *rateMeter
+	uploadMeter   *rateMeter
+
+	// Info hashes accepted from peers that initiate the connection.
+	acceptedInfoHashes [][sha1.Size]byte
+
+	downloadLimiter *RateLimiter
+	uploadLimiter   *RateLimiter
+	// The size of the info dictionary, as advertised in the peer's extension handshake.
+	metadataSize int
+
+	extensionHandshakeCh chan struct{}
+	// Closed when the peer chokes or unchokes us, then replaced.
+	chokeChangedCh chan struct{}
+	// Closed when the peer advertises pieces with a 'Have' or 'Bitfield' message, then replaced.
+	piecesChangedCh chan struct{}
+	// Closed once the connection has been closed and the message reader has returned.
+	closedCh chan struct{}
+	// Responses to our pending requests, forwarded by the message reader. See `readMessages`.
+	messagesCh chan Message
+	mutex      *sync.Mutex
+	writeMutex *sync.Mutex
+
+	disablePeerExchange bool
+	onPeerExchange      func(added []Peer, dropped []Peer)
+	pexState            *peerExchangeState
+
+	logger *slog.Logger
 }
 
 type PeerConnectionConfig struct {
 	Peer        Peer
 	NumOfPieces int
+	// Our peer Id, sent in the handshake. A random Id is used if not set.
+	PeerId [20]byte
+
+	// Prevents the connection from advertising or handling the "ut_pex" extension (e.g for private torrents).
+	DisablePeerExchange bool
+	// Called with the peers received in "ut_pex" messages from the remote peer.
+	OnPeerExchange func(added []Peer, dropped []Peer)
+
+	// UDP port of our DHT node. If set, DHT support is advertised in the handshake and the port is sent to peers that support the DHT.
+	DHTPort uint16
+	// Called with the "host:port" address of the peer's DHT node when it sends a 'Port' message.
+	OnDHTPort func(address string)
+
+	// Returns the bencoded info dictionary served to peers that request it with "ut_metadata" messages, or nil if it isn't known yet.
+	GetMetadata func() []byte
+	// Returns the hashes requested by the peer in a 'hash request' message. If set, BitTorrent v2 support is advertised in the handshake.
+	GetHashes func(req hashRequest) ([]merkleHash, bool)
+	/*
+		Info hashes the peer may identify the torrent with when it initiates the connection, in addition to the peer's info hash.
+		Peers of the v2 swarm of a hybrid torrent use its truncated v2 info hash, which we then use in our own handshake.
+	*/
+	AcceptedInfoHashes [][sha1.Size]byte
+
+	// Limit the rate at which data is received from and sent to the peer. The limiters are usually shared with other connections.
+	DownloadLimiter *RateLimiter
+	UploadLimiter   *RateLimiter
+
+	// Returns a block of a piece we have, requested by the peer in a 'Request' message. If set, peers that are interested are unchoked.
+	GetBlock func(pieceIndex int, begin int, length int) ([]byte, bool)
+	// Returns the pieces we have, advertised to the peer in a 'Bitfield' message once the handshake is complete.
+	CompletedPieces func() []bool
+	// Called with the size of every block sent to the peer.
+	OnUpload func(n int)
+
+	// Logger of the connection. Its records are tagged with the peer's address. Defaults to the "peer" component of `slog.Default()`.
+	Logger *slog.Logger
 }
 
 type ReadWriteMutex struct {
@@ -50,18 +153,109 @@ const (
 	pstr                = "BitTorrent protocol"
 	pstrLen             = len(pstr)
 
-	metadataExtensionId = 1
+	// Reserved bits used to advertise support for protocol extensions in the handshake.
+	dhtReservedByteIndex       = 7
+	dhtReservedBit             = 0x01
+	extensionReservedByteIndex = 5
+	extensionReservedBit       = 0x10
+	v2ReservedByteIndex        = 7
+	v2ReservedBit              = 0x10
+
+	extensionHandshakeId = 0
+)
+
+const (
+	// Peers are expected to send a keep-alive message at least once every two minutes.
+	peerIdleTimeout    = 3 * time.Minute
+	messagesBufferSize = 32
+	/*
+		Well-behaved peers never send larger messages: the largest are 'Piece' messages with a block of at most `maxRequestLength` bytes,
+		"ut_metadata" messages with a piece of 16KiB and the 'Bitfield' of torrents with `maxNumOfPieces` pieces.
+	*/
+	maxMessageLength = 1 << 20
 )
 
 const (
 	MaxFailedAttempts = 3
+	// Requests for larger blocks are ignored.
+	maxRequestLength = 8 * BlockSize
+	// Upper bound of the number of pieces tracked for peers of torrents whose metadata is unknown.
+	maxNumOfPieces = 1 << 20
+
+	blockRequestTimeout    = 5 * time.Second
+	metadataRequestTimeout = 10 * time.Second
+	hashRequestTimeout     = 10 * time.Second
+	unchokeTimeout         = 5 * time.Second
+)
+
+// The Ids we advertise in our extension handshake. Peers use these Ids when sending us extension messages.
+var localExtensionIds = map[Extension]uint8{
+	Metadata:     1,
+	PeerExchange: 2,
+}
+
+var (
+	errMetadataPieceRejected = errors.New("peer does not have the piece of metadata that was requested")
+	// Returned when the peer chokes us while we wait for blocks: it drops our pending requests, which isn't a failure of the peer.
+	errPeerChoked = errors.New("peer choked us")
+)
+
+var (
+	// Returned when a peer's handshake isn't a valid BitTorrent handshake.
+	ErrInvalidHandshake = errors.New("connection does not use the BitTorrent protocol")
+	// Returned when a peer's handshake is for a torrent we don't have.
+	ErrUnknownInfoHash = errors.New("peer wants a torrent we don't have")
 )
 
 func NewPeerConnection(config PeerConnectionConfig) *PeerConnection {
+	var mutex sync.Mutex
+	var writeMutex sync.Mutex
+
+	logger := config.Logger
+
+	if logger == nil {
+		logger = logging.Component(nil, logging.ComponentPeer)
+	}
+
 	return &PeerConnection{
-		availablePieces: make([]bool, config.NumOfPieces),
-		InfoHash:        config.Peer.InfoHash,
-		PeerAddress:     fmt.Sprintf("%s:%d", config.Peer.IpAddress, config.Peer.Port),
+		availablePieces:    make([]bool, config.NumOfPieces),
+		numOfPiecesUnknown: config.NumOfPieces == 0,
+		InfoHash:           config.Peer.InfoHash,
+		PeerAddress:        config.Peer.String(),
+
+		peer:        config.Peer,
+		localPeerId: config.PeerId,
+
+		dhtPort:   config.DHTPort,
+		onDHTPort: config.OnDHTPort,
+
+		getMetadata: config.GetMetadata,
+		getHashes:   config.GetHashes,
+
+		getBlock:        config.GetBlock,
+		completedPieces: config.CompletedPieces,
+		onUpload:        config.OnUpload,
+
+		acceptedInfoHashes: config.AcceptedInfoHashes,
+
+		downloadLimiter: config.DownloadLimiter,
+		uploadLimiter:   config.UploadLimiter,
+		downloadMeter:   newRateMeter(),
+		uploadMeter:     newRateMeter(),
+
+		extensionHandshakeCh: make(chan struct{}),
+		chokeChangedCh:       make(chan struct{}),
+		piecesChangedCh:      make(chan struct{}),
+		closedCh:             make(chan struct{}),
+		messagesCh:           make(chan Message, messagesBufferSize),
+		mutex:                &mutex,
+		writeMutex:           &writeMutex,
+
+		disablePeerExchange: config.DisablePeerExchange,
+		onPeerExchange:      config.OnPeerExchange,
+		pexState:            newPeerExchangeState(),
+
+		logger: logger.With(logging.PeerKey, config.Peer.String()),
 	}
 }
 
@@ -87,19 +281,43 @@ func generateBlockRequestPayload(block Block) []byte {
 	return messageBuffer
 }
 
+/*
+Completes the base handshake on a connection we initiated: we send our handshake first, then wait for the peer's.
+
+On incoming connections the order is reversed, see `AcceptConnection`.
+*/
 func (p *PeerConnection) completeBaseHandshake() error {
-	peerId := []byte(utils.GenerateRandomString(20, ""))
+	if err := p.sendBaseHandshakeMessage(); err != nil {
+		return err
+	}
+
+	return p.receiveBaseHandshakeMessage()
+}
+
+func (p *PeerConnection) sendBaseHandshakeMessage() error {
+	peerId := p.localPeerId[:]
+
+	if p.localPeerId == ([20]byte{}) {
+		peerId = []byte(utils.GenerateRandomString(20, ""))
+	}
+
 	messageBuffer := make([]byte, handshakeMessageLen)
 	messageBuffer[0] = byte(pstrLen)
 
-	index := 1
-	index += copy(messageBuffer[index:], []byte(pstr))
-	index += copy(messageBuffer[index:], make([]byte, 5))
+	reserved := make([]byte, 8)
+	reserved[extensionReservedByteIndex] |= extensionReservedBit
 
-	messageBuffer[index] = byte(16)
-	index += 1
+	if p.dhtPort != 0 {
+		reserved[dhtReservedByteIndex] |= dhtReservedBit
+	}
 
-	index += copy(messageBuffer[index:], make([]byte, 2))
+	if p.getHashes != nil {
+		reserved[v2ReservedByteIndex] |= v2ReservedBit
+	}
+
+	index := 1
+	index += copy(messageBuffer[index:], []byte(pstr))
+	index += copy(messageBuffer[index:], reserved)
 	index += copy(messageBuffer[index:], p.InfoHash[:])
 	index += copy(messageBuffer[index:], peerId[:])
 
@@ -107,6 +325,10 @@ func (p *PeerConnection) completeBaseHandshake() error {
 		return fmt.Errorf("failed to send base handshake message: %w", err)
 	}
 
+	return nil
+}
+
+func (p *PeerConnection) receiveBaseHandshakeMessage() error {
 	responseBuffer := make([]byte, handshakeMessageLen)
 
 	if _, err := utils.ConnReadFull(p.Conn, responseBuffer, 0); err != nil {
@@ -120,22 +342,40 @@ func (p *PeerConnection) completeBaseHandshake() error {
 	}
 
 	if receivedPstrLen := responseBuffer[0]; receivedPstrLen != byte(pstrLen) {
-		return fmt.Errorf("expected handshake protocol string length to be '%d', but got '%v'", pstrLen, receivedPstrLen)
+		return fmt.Errorf("%w: expected handshake protocol string length to be '%d', but got '%v'", ErrInvalidHandshake, pstrLen, receivedPstrLen)
 	}
 
 	if receivedPstr := responseBuffer[1 : pstrLen+1]; string(receivedPstr) != pstr {
-		return fmt.Errorf("expected protocol string to equal '%s', but got '%s'", pstr, receivedPstr)
+		return fmt.Errorf("%w: expected protocol string to equal '%s', but got '%s'", ErrInvalidHandshake, pstr, receivedPstr)
+	}
+
+	receivedInfoHash := [sha1.Size]byte(responseBuffer[28:48])
+
+	if p.incoming && slices.Contains(p.acceptedInfoHashes, receivedInfoHash) {
+		p.InfoHash = receivedInfoHash
 	}
 
-	if receivedInfoHash := responseBuffer[28:48]; !bytes.Equal(receivedInfoHash, p.InfoHash[:]) {
-		return fmt.Errorf("received info hash %v does not match expected info hash %v", receivedInfoHash, p.InfoHash)
+	if !bytes.Equal(receivedInfoHash[:], p.InfoHash[:]) {
+		return fmt.Errorf("%w: received info hash %v does not match expected info hash %v", ErrUnknownInfoHash, receivedInfoHash, p.InfoHash)
 	}
 
+	receivedReserved := responseBuffer[pstrLen+1 : pstrLen+9]
+
 	//The bit selected for the extension protocol is bit 20th from the right (counting starts at 0). So (reserved_byte[5] & 0x10) is the expression to use for checking if the client supports extended messaging.
-	if reservedByteIndex := 25; bytes.Equal(responseBuffer[reservedByteIndex:reservedByteIndex+1], []byte{byte(0x10)}) {
+	if receivedReserved[extensionReservedByteIndex]&extensionReservedBit != 0 {
 		p.SupportsExtensions = true
 	}
 
+	// Peers that support the DHT set the last bit of the reserved bytes.
+	if receivedReserved[dhtReservedByteIndex]&dhtReservedBit != 0 {
+		p.SupportsDHT = true
+	}
+
+	// BEP 52: peers that support BitTorrent v2 set the fourth bit of the last reserved byte.
+	if receivedReserved[v2ReservedByteIndex]&v2ReservedBit != 0 {
+		p.SupportsV2 = true
+	}
+
 	peerIdStartIndex := 48
 	p.PeerId = string(responseBuffer[peerIdStartIndex:])
 
@@ -151,11 +391,18 @@ func (p *PeerConnection) completeExtensionHandshake() error {
 		return err
 	}
 
-	if err := p.receiveExtensionHandshakeMessage(); err != nil {
-		return err
-	}
+	// The peer's extension handshake is parsed by the message reader as soon as it arrives.
+	select {
+	case <-p.extensionHandshakeCh:
+		{
+			return nil
+		}
 
-	return nil
+	case <-time.After(5 * time.Second):
+		{
+			return fmt.Errorf("failed to receive extension handshake message: timed out")
+		}
+	}
 }
 
 func (p *PeerConnection) downloadBlock(block Block, resultsQueue chan<- BlockRequestResult, mutex *ReadWriteMutex) {
@@ -167,24 +414,45 @@ func (p *PeerConnection) downloadBlock(block Block, resultsQueue chan<- BlockReq
 	for i := 0; i < retries; i++ {
 		payload := generateBlockRequestPayload(block)
 
+		// The request is counted before it is sent, so the message reader forwards the response however fast it arrives.
+		p.mutex.Lock()
+		p.pendingRequests += 1
+		p.mutex.Unlock()
+
 		mutex.writer.Lock()
 		err := p.sendMessage(Request, payload)
 		mutex.writer.Unlock()
 
-		if err != nil {
-			mainError = fmt.Errorf("failed to send 'Request' message to peer: %w", err)
-			continue
+		var message *Message
+
+		if err == nil {
+			mutex.reader.Lock()
+			message, err = p.receivePieceMessage()
+			mutex.reader.Unlock()
+		} else {
+			err = fmt.Errorf("failed to send 'Request' message to peer: %w", err)
 		}
 
-		mutex.reader.Lock()
-		message, err := p.receiveMessage(PieceMessageId)
-		mutex.reader.Unlock()
+		p.mutex.Lock()
+		p.pendingRequests -= 1
+		p.mutex.Unlock()
+
+		if errors.Is(err, errPeerChoked) {
+			mainError = err
+			break
+		}
 
 		if err != nil {
 			mainError = fmt.Errorf("failed to receive 'Piece' message from peer: %w", err)
 			continue
 		}
 
+		// The payload starts with the index of the piece and the offset of the block.
+		if len(message.Payload) < 8 {
+			mainError = fmt.Errorf("expected 'Piece' payload to contain at least 8 bytes, but got '%d'", len(message.Payload))
+			continue
+		}
+
 		index := 0
 
 		blockPieceIndex := binary.BigEndian.Uint32(message.Payload[index:])
@@ -194,6 +462,7 @@ func (p *PeerConnection) downloadBlock(block Block, resultsQueue chan<- BlockReq
 		index += 4
 
 		blockData := message.Payload[index:]
+		p.downloadMeter.add(len(blockData))
 
 		downloadedBlock = Block{
 			Begin:      int(blockPieceOffset),
@@ -212,6 +481,9 @@ func (p *PeerConnection) downloadBlock(block Block, resultsQueue chan<- BlockReq
 }
 
 func (p *PeerConnection) hasPiece(pieceIndex int) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
 	if pieceIndex < 0 || pieceIndex >= len(p.availablePieces) {
 		return false
 	}
@@ -219,60 +491,64 @@ func (p *PeerConnection) hasPiece(pieceIndex int) bool {
 	return p.availablePieces[pieceIndex]
 }
 
-func (p *PeerConnection) downloadMetadata() ([]byte, error) {
-	buffer := []byte{}
-	hasDownloadedAllPieces := false
-	index := 0
-
-	for hasDownloadedAllPieces != true {
-		metadataPiece, err := p.downloadMetadataPiece(index)
+/*
+Requests a piece of the torrent's metadata from the peer and waits for the response.
 
-		if err != nil {
-			return nil, err
-		}
-
-		buffer = append(buffer, metadataPiece...)
-		index += 1
-
-		//  If it is not the last piece of the metadata, it MUST be 16kiB (BlockSize).
-		// todo: get metadata size from extension handshake request.
-		if len(metadataPiece) != BlockSize {
-			hasDownloadedAllPieces = true
-			break
-		}
-	}
+Returns `errMetadataPieceRejected` if the peer responds with a 'reject' message.
+*/
+func (p *PeerConnection) downloadMetadataPiece(pieceIndex int) ([]byte, error) {
+	p.mutex.Lock()
+	p.pendingMetadataRequests += 1
+	p.mutex.Unlock()
 
-	return buffer, nil
-}
+	defer func() {
+		p.mutex.Lock()
+		p.pendingMetadataRequests -= 1
+		p.mutex.Unlock()
+	}()
 
-func (p *PeerConnection) downloadMetadataPiece(pieceIndex int) ([]byte, error) {
 	if err := p.sendMetadataRequestMessage(pieceIndex); err != nil {
 		return nil, err
 	}
 
-	piece, err := p.receiveMetadataMessage()
+	deadline := time.Now().Add(metadataRequestTimeout)
 
-	if err != nil {
-		return nil, err
-	}
+	for {
+		message, err := p.waitForMessage(ExtensionMessageId, time.Until(deadline))
 
-	return piece, nil
-}
+		if err != nil {
+			return nil, fmt.Errorf("failed to receive metadata message: %w", err)
+		}
 
-func (p *PeerConnection) parseBitFieldMessage() error {
-	message, err := p.receiveMessage(Bitfield)
+		receivedPieceIndex, piece, err := p.parseMetadataMessage(message)
 
-	if err != nil {
-		return fmt.Errorf("failed to receive 'Bitfield' message from peer: %w", err)
+		if err != nil {
+			return nil, err
+		}
+
+		// Responses to earlier requests that timed out may still arrive.
+		if receivedPieceIndex != pieceIndex {
+			continue
+		}
+
+		return piece, nil
 	}
+}
+
+func (p *PeerConnection) parseBitFieldMessage(message Message) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 
 	numOfPieces := len(p.availablePieces)
-	expectedBitFieldLength := int(math.Ceil(float64(numOfPieces) / byteSize))
 
-	if numOfPieces == 0 {
-		return nil
+	// The number of pieces is unknown until the metadata of torrents created from magnet links has been downloaded.
+	if p.numOfPiecesUnknown {
+		numOfPieces = len(message.Payload) * byteSize
+		p.availablePieces = make([]bool, numOfPieces)
 	}
 
+	expectedBitFieldLength := int(math.Ceil(float64(numOfPieces) / byteSize))
+
 	if receivedBitfieldLength := len(message.Payload); receivedBitfieldLength != expectedBitFieldLength {
 		return fmt.Errorf("expected 'Bitfield' payload to contain '%d' bytes, but got '%d'", expectedBitFieldLength, receivedBitfieldLength)
 	}
@@ -288,16 +564,26 @@ func (p *PeerConnection) parseBitFieldMessage() error {
 		p.availablePieces[index] = isBitSet
 	}
 
+	p.notifyPiecesChanged()
+
 	return nil
 }
 
-func (p *PeerConnection) receiveExtensionHandshakeMessage() error {
-	message, err := p.receiveMessage(ExtensionMessageId)
+// Returns a channel that is closed when the peer advertises pieces.
+func (p *PeerConnection) piecesChanged() <-chan struct{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 
-	if err != nil {
-		return fmt.Errorf("failed to receive extension handshake message %w", err)
-	}
+	return p.piecesChangedCh
+}
 
+// Must be called with the connection's mutex held.
+func (p *PeerConnection) notifyPiecesChanged() {
+	close(p.piecesChangedCh)
+	p.piecesChangedCh = make(chan struct{})
+}
+
+func (p *PeerConnection) parseExtensionHandshakeMessage(message Message) error {
 	// Ignore the first byte of the payload which contains the extension message ID.
 	decodedPayload, _, err := bencode.DecodeValue(message.Payload[1:])
 
@@ -318,7 +604,7 @@ func (p *PeerConnection) receiveExtensionHandshakeMessage() error {
 		return fmt.Errorf("expected decoded payload to include an \"m\" key which maps to a dictionary of supported extensions, but got %v", extensionsMap)
 	}
 
-	for _, ext := range []Extension{Metadata} {
+	for _, ext := range []Extension{Metadata, PeerExchange} {
 		value, ok := extensionsMap[string(ext)]
 
 		if !ok {
@@ -340,113 +626,675 @@ func (p *PeerConnection) receiveExtensionHandshakeMessage() error {
 
 	p.PeerExtensions = extensions
 
+	if metadataSize, ok := dict["metadata_size"].(int); ok && metadataSize > 0 {
+		p.metadataSize = metadataSize
+	}
+
 	return nil
 }
 
-func (p *PeerConnection) receiveMessage(messageId MessageId) (*Message, error) {
+/*
+Reads messages from the peer until the connection is closed.
+
+Messages that are not tied to a request of ours (e.g 'Have', 'Choke', 'Request' or "ut_pex") are handled as soon as they arrive.
+Responses are forwarded to the `messagesCh` channel only while a request is waiting for them, and dropped otherwise,
+so the reader never blocks on a consumer that has gone away (e.g once we are only seeding to the peer).
+*/
+func (p *PeerConnection) readMessages() {
+	defer close(p.closedCh)
+	defer close(p.messagesCh)
+
 	messageLengthBuffer := make([]byte, 4)
 
-	if _, err := utils.ConnReadFull(p.Conn, messageLengthBuffer, 0); err != nil {
-		return nil, err
+	for {
+		if _, err := utils.ConnReadFull(p.Conn, messageLengthBuffer, peerIdleTimeout); err != nil {
+			return
+		}
+
+		messageLength := binary.BigEndian.Uint32(messageLengthBuffer)
+
+		// keep-alive
+		if messageLength == 0 {
+			continue
+		}
+
+		// The length is read before the message, so peers could otherwise make us allocate up to 4GiB.
+		if messageLength > maxMessageLength {
+			p.logger.Debug("disconnecting from peer: message is too large", "length", messageLength)
+			p.Close()
+
+			return
+		}
+
+		messageBuffer := make([]byte, messageLength)
+
+		if _, err := utils.ConnReadFull(p.Conn, messageBuffer, 0); err != nil {
+			return
+		}
+
+		message := Message{Id: MessageId(messageBuffer[0]), Payload: messageBuffer[1:]}
+
+		if handled := p.handleMessage(message); handled {
+			continue
+		}
+
+		if !p.isAwaited(message) {
+			p.logger.Debug("dropping unrequested message from peer", "messageId", int(message.Id))
+			continue
+		}
+
+		select {
+		case p.messagesCh <- message:
+		default:
+			{
+				p.logger.Debug("dropping message from peer: too many responses are waiting to be consumed", "messageId", int(message.Id))
+			}
+		}
 	}
+}
+
+// Reports whether a message is the response to one of our pending requests.
+func (p *PeerConnection) isAwaited(message Message) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	switch message.Id {
+	case PieceMessageId:
+		return p.pendingRequests > 0
+	case Hashes, HashReject:
+		return p.pendingHashRequests > 0
+	case ExtensionMessageId:
+		return p.pendingMetadataRequests > 0 && len(message.Payload) > 0 && message.Payload[0] == localExtensionIds[Metadata]
+	default:
+		return false
+	}
+}
 
-	messageLength := binary.BigEndian.Uint32(messageLengthBuffer)
-	messageBuffer := make([]byte, messageLength)
+// Returns whether the peer lets us request blocks, along with a channel that is closed when that changes.
+func (p *PeerConnection) chokeState() (bool, <-chan struct{}) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 
-	if _, err := utils.ConnReadFull(p.Conn, messageBuffer, 0); err != nil {
-		return nil, err
+	return p.Unchoked, p.chokeChangedCh
+}
+
+func (p *PeerConnection) setUnchoked(unchoked bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.Unchoked == unchoked {
+		return
 	}
 
-	receivedMessageId := MessageId(messageBuffer[0])
+	p.Unchoked = unchoked
+	close(p.chokeChangedCh)
+	p.chokeChangedCh = make(chan struct{})
+}
+
+/*
+Waits until the peer unchokes us.
+
+Returns an error if the context is done first, or if the connection is closed.
+*/
+func (p *PeerConnection) waitForUnchoke(ctx context.Context) error {
+	for {
+		unchoked, changedCh := p.chokeState()
+
+		if unchoked {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			{
+				return fmt.Errorf("failed to receive 'Unchoke' message from peer: %w", ctx.Err())
+			}
+
+		case <-p.closedCh:
+			{
+				return fmt.Errorf("connection to peer %s was closed", p.PeerAddress)
+			}
 
-	if receivedMessageId != messageId {
-		return nil, fmt.Errorf("expected received message Id to be %d, but got %d", messageId, receivedMessageId)
+		case <-changedCh:
+		}
 	}
+}
+
+// Handles messages that can be received at any point during the lifetime of the connection. Returns false if the message was not handled.
+func (p *PeerConnection) handleMessage(message Message) bool {
+	switch message.Id {
+	case Choke:
+		{
+			p.setUnchoked(false)
+			return true
+		}
+
+	case Unchoke:
+		{
+			p.setUnchoked(true)
+			return true
+		}
+
+	case Have:
+		{
+			if len(message.Payload) != 4 {
+				return true
+			}
+
+			pieceIndex := int(binary.BigEndian.Uint32(message.Payload))
+
+			p.mutex.Lock()
+			// The number of pieces is unknown until the metadata of torrents created from magnet links has been downloaded.
+			if p.numOfPiecesUnknown && pieceIndex >= len(p.availablePieces) && pieceIndex < maxNumOfPieces {
+				p.availablePieces = append(p.availablePieces, make([]bool, pieceIndex+1-len(p.availablePieces))...)
+			}
+
+			if pieceIndex < len(p.availablePieces) {
+				p.availablePieces[pieceIndex] = true
+				p.notifyPiecesChanged()
+			}
+			p.mutex.Unlock()
+
+			return true
+		}
+
+	case Bitfield:
+		{
+			if err := p.parseBitFieldMessage(message); err != nil {
+				p.logger.Debug("failed to parse 'Bitfield' message from peer", logging.ErrorKey, err)
+			}
+
+			return true
+		}
+
+	case Port:
+		{
+			if len(message.Payload) != 2 || p.onDHTPort == nil {
+				return true
+			}
+
+			host, _, err := net.SplitHostPort(p.PeerAddress)
+
+			if err != nil {
+				return true
+			}
+
+			port := binary.BigEndian.Uint16(message.Payload)
+			p.onDHTPort(net.JoinHostPort(host, strconv.Itoa(int(port))))
 
-	return &Message{Id: receivedMessageId, Payload: messageBuffer[1:]}, nil
+			return true
+		}
+
+	case HashRequest:
+		{
+			p.handleHashRequestMessage(message.Payload)
+			return true
+		}
+
+	case Interested:
+		{
+			p.handleInterestedMessage()
+			return true
+		}
+
+	case NotInterested:
+		{
+			p.mutex.Lock()
+			p.peerInterested = false
+			p.mutex.Unlock()
+
+			return true
+		}
+
+	case Request:
+		{
+			p.handleRequestMessage(message.Payload)
+			return true
+		}
+
+	// Blocks are sent as soon as they are requested, so there's nothing to cancel.
+	case Cancel:
+		{
+			return true
+		}
+
+	case ExtensionMessageId:
+		{
+			if len(message.Payload) == 0 {
+				return true
+			}
+
+			switch extensionId := message.Payload[0]; {
+			case extensionId == extensionHandshakeId:
+				{
+					if err := p.parseExtensionHandshakeMessage(message); err != nil {
+						p.logger.Debug("failed to parse extension handshake message from peer", logging.ErrorKey, err)
+						return true
+					}
+
+					// Peers may send more than one extension handshake during the lifetime of the connection.
+					select {
+					case <-p.extensionHandshakeCh:
+					default:
+						close(p.extensionHandshakeCh)
+					}
+
+					return true
+				}
+
+			case extensionId == localExtensionIds[Metadata]:
+				{
+					// Only requests are handled here, responses to our own requests are consumed by `receiveMetadataMessage`.
+					return p.handleMetadataRequestMessage(message.Payload[1:])
+				}
+
+			case extensionId == localExtensionIds[PeerExchange]:
+				{
+					if err := p.handlePeerExchangeMessage(message.Payload[1:]); err != nil {
+						p.logger.Debug("failed to parse 'ut_pex' message from peer", logging.ErrorKey, err)
+					}
+
+					return true
+				}
+			}
+
+			return false
+		}
+
+	default:
+		{
+			return false
+		}
+	}
 }
 
-func (p *PeerConnection) receiveMetadataMessage() ([]byte, error) {
-	message, err := p.receiveMessage(ExtensionMessageId)
+/*
+Handles "ut_metadata" messages sent by the peer. Returns false if the message is not a request.
+
+Requests are answered with a 'data' message containing the requested 16KiB piece of the info dictionary,
+or with a 'reject' message if the piece is invalid or we don't have the metadata yet.
+*/
+func (p *PeerConnection) handleMetadataRequestMessage(payload []byte) bool {
+	decodedValue, _, err := bencode.DecodeValue(payload)
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to receive metadata message: %w", err)
+		return false
 	}
 
+	dict, ok := decodedValue.(map[string]any)
+
+	if !ok || dict["msg_type"] != int(ExtensionRequestMessageId) {
+		return false
+	}
+
+	pieceIndex, ok := dict["piece"].(int)
+
+	if !ok {
+		return true
+	}
+
+	if err := p.sendMetadataPiece(pieceIndex); err != nil {
+		p.logger.Debug("failed to respond to metadata request from peer", logging.ErrorKey, err)
+	}
+
+	return true
+}
+
+// Unchokes a peer that is interested in our pieces. Every interested peer is unchoked: the number of peers is bounded by the connection limits.
+func (p *PeerConnection) handleInterestedMessage() {
+	p.mutex.Lock()
+	alreadyUnchoked := p.unchokedPeer
+	p.unchokedPeer = p.getBlock != nil
+	p.peerInterested = true
+	p.mutex.Unlock()
+
+	if alreadyUnchoked || p.getBlock == nil {
+		return
+	}
+
+	if err := p.sendMessage(Unchoke, nil); err != nil {
+		p.logger.Debug("failed to send 'Unchoke' message to peer", logging.ErrorKey, err)
+	}
+}
+
+// Answers a 'Request' message from an unchoked peer with a 'Piece' message containing the requested block.
+func (p *PeerConnection) handleRequestMessage(payload []byte) {
+	p.mutex.Lock()
+	unchokedPeer := p.unchokedPeer
+	p.mutex.Unlock()
+
+	if !unchokedPeer || len(payload) != 12 {
+		return
+	}
+
+	pieceIndex := int(binary.BigEndian.Uint32(payload))
+	begin := int(binary.BigEndian.Uint32(payload[4:]))
+	length := int(binary.BigEndian.Uint32(payload[8:]))
+
+	if length <= 0 || length > maxRequestLength {
+		return
+	}
+
+	data, ok := p.getBlock(pieceIndex, begin, length)
+
+	if !ok {
+		return
+	}
+
+	messagePayload := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(messagePayload, uint32(pieceIndex))
+	binary.BigEndian.PutUint32(messagePayload[4:], uint32(begin))
+	copy(messagePayload[8:], data)
+
+	if err := p.sendMessage(PieceMessageId, messagePayload); err != nil {
+		p.logger.Debug("failed to send 'Piece' message to peer", logging.ErrorKey, err)
+		return
+	}
+
+	p.uploadMeter.add(len(data))
+
+	if p.onUpload != nil {
+		p.onUpload(len(data))
+	}
+}
+
+// Advertises the pieces we have with a 'Bitfield' message. Nothing is sent if we don't have any piece.
+func (p *PeerConnection) sendBitfieldMessage() error {
+	if p.completedPieces == nil {
+		return nil
+	}
+
+	completedPieces := p.completedPieces()
+
+	if !slices.Contains(completedPieces, true) {
+		return nil
+	}
+
+	bitfield := make([]byte, (len(completedPieces)+byteSize-1)/byteSize)
+
+	for index, completed := range completedPieces {
+		if completed {
+			bitfield[index/byteSize] |= 1 << (7 - index%byteSize)
+		}
+	}
+
+	if err := p.sendMessage(Bitfield, bitfield); err != nil {
+		return fmt.Errorf("failed to send 'Bitfield' message: %w", err)
+	}
+
+	return nil
+}
+
+// Tells the peer we have a piece we just downloaded.
+func (p *PeerConnection) sendHaveMessage(pieceIndex int) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(pieceIndex))
+
+	return p.sendMessage(Have, payload)
+}
+
+// Answers a 'hash request' message with a 'hashes' message, or with a 'hash reject' message if we don't have the hashes.
+func (p *PeerConnection) handleHashRequestMessage(payload []byte) {
+	req, err := decodeHashRequest(payload)
+
+	if err != nil || len(req.hashes) != 0 {
+		return
+	}
+
+	var hashes []merkleHash
+	ok := false
+
+	if p.getHashes != nil {
+		hashes, ok = p.getHashes(req)
+	}
+
+	if !ok {
+		if err := p.sendMessage(HashReject, encodeHashRequest(req)); err != nil {
+			p.logger.Debug("failed to send 'hash reject' message to peer", logging.ErrorKey, err)
+		}
+
+		return
+	}
+
+	req.hashes = hashes
+
+	if err := p.sendMessage(Hashes, encodeHashRequest(req)); err != nil {
+		p.logger.Debug("failed to send 'hashes' message to peer", logging.ErrorKey, err)
+	}
+}
+
+/*
+Requests hashes of a file's merkle tree from the peer and waits for the response.
+
+The hashes are returned as sent by the peer: it is up to the caller to verify them against a trusted hash.
+*/
+func (p *PeerConnection) requestHashes(req hashRequest) ([]merkleHash, error) {
+	p.mutex.Lock()
+	p.pendingHashRequests += 1
+	p.mutex.Unlock()
+
+	defer func() {
+		p.mutex.Lock()
+		p.pendingHashRequests -= 1
+		p.mutex.Unlock()
+	}()
+
+	if err := p.sendMessage(HashRequest, encodeHashRequest(req)); err != nil {
+		return nil, fmt.Errorf("failed to send 'hash request' message to peer: %w", err)
+	}
+
+	timer := time.NewTimer(hashRequestTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case message, ok := <-p.messagesCh:
+			{
+				if !ok {
+					return nil, fmt.Errorf("connection to peer %s was closed", p.PeerAddress)
+				}
+
+				if message.Id != Hashes && message.Id != HashReject {
+					continue
+				}
+
+				res, err := decodeHashRequest(message.Payload)
+
+				// Responses to earlier requests that timed out may still arrive.
+				if err != nil || res.piecesRoot != req.piecesRoot || res.baseLayer != req.baseLayer || res.index != req.index || res.length != req.length {
+					continue
+				}
+
+				if message.Id == HashReject {
+					return nil, fmt.Errorf("peer %s rejected the hash request", p.PeerAddress)
+				}
+
+				if len(res.hashes) < req.length {
+					return nil, fmt.Errorf("expected peer %s to send %d hashes, but received %d", p.PeerAddress, req.length, len(res.hashes))
+				}
+
+				return res.hashes[:req.length], nil
+			}
+
+		case <-timer.C:
+			{
+				return nil, fmt.Errorf("timed out waiting for hashes from peer %s", p.PeerAddress)
+			}
+		}
+	}
+}
+
+func (p *PeerConnection) metadata() []byte {
+	if p.getMetadata == nil {
+		return nil
+	}
+
+	return p.getMetadata()
+}
+
+/*
+Waits for a 'Piece' message answering one of our 'Request' messages.
+
+Returns `errPeerChoked` if the peer chokes us in the meantime. Other responses still in the channel (e.g to requests that timed out) are discarded.
+*/
+func (p *PeerConnection) receivePieceMessage() (*Message, error) {
+	timer := time.NewTimer(blockRequestTimeout)
+	defer timer.Stop()
+
+	for {
+		unchoked, changedCh := p.chokeState()
+
+		if !unchoked {
+			return nil, errPeerChoked
+		}
+
+		select {
+		case message, ok := <-p.messagesCh:
+			{
+				if !ok {
+					return nil, fmt.Errorf("connection to peer %s was closed", p.PeerAddress)
+				}
+
+				if message.Id == PieceMessageId {
+					return &message, nil
+				}
+			}
+
+		case <-changedCh:
+
+		case <-timer.C:
+			{
+				return nil, fmt.Errorf("timed out waiting for 'Piece' message")
+			}
+		}
+	}
+}
+
+// Waits for a message with the given Id, discarding any other message received in the meantime.
+func (p *PeerConnection) waitForMessage(messageId MessageId, timeout time.Duration) (*Message, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case message, ok := <-p.messagesCh:
+			{
+				if !ok {
+					return nil, fmt.Errorf("connection to peer %s was closed", p.PeerAddress)
+				}
+
+				if message.Id == messageId {
+					return &message, nil
+				}
+			}
+
+		case <-timer.C:
+			{
+				return nil, fmt.Errorf("timed out waiting for message with Id %d", messageId)
+			}
+		}
+	}
+}
+
+/*
+Parses a "ut_metadata" 'data' or 'reject' message sent in response to one of our requests.
+
+A 'data' message contains a bencoded dictionary followed by the piece of metadata:
+
+	{'msg_type': 1, 'piece': 0, 'total_size': 3425}
+
+where "total_size" is the size of the entire info dictionary (not the size of the piece).
+*/
+func (p *PeerConnection) parseMetadataMessage(message *Message) (int, []byte, error) {
 	if len(message.Payload) == 0 {
-		return nil, fmt.Errorf("metadata response payload is empty")
+		return 0, nil, fmt.Errorf("metadata response payload is empty")
 	}
 
-	if receivedId := int(message.Payload[0]); receivedId != metadataExtensionId {
-		return nil, fmt.Errorf("expected metadata extension Id to be %d, but received %d", metadataExtensionId, receivedId)
+	if receivedId := message.Payload[0]; receivedId != localExtensionIds[Metadata] {
+		return 0, nil, fmt.Errorf("expected metadata extension Id to be %d, but received %d", localExtensionIds[Metadata], receivedId)
 	}
 
 	decoded, nextCharIndex, err := bencode.DecodeValue(message.Payload[1:])
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode metadata response payload: %w", err)
+		return 0, nil, fmt.Errorf("failed to decode metadata response payload: %w", err)
 	}
 
 	dict, ok := decoded.(map[string]any)
 
 	if !ok {
-		return nil, fmt.Errorf("expected decoded metadata response to be a dictionary, but received %v", dict)
+		return 0, nil, fmt.Errorf("expected decoded metadata response to be a dictionary, but received %v", dict)
+	}
+
+	pieceIndex, ok := dict["piece"].(int)
+
+	if !ok {
+		return 0, nil, fmt.Errorf("expected \"piece\" key to be an integer, but received %v", dict["piece"])
 	}
 
 	if dict["msg_type"] == int(ExtensionRejectMessageId) {
-		return nil, fmt.Errorf("peer does not have the piece of metadata that was requested")
+		return pieceIndex, nil, errMetadataPieceRejected
 	}
 
 	if dict["msg_type"] != int(ExtensionDataMessageId) {
-		return nil, fmt.Errorf("expected \"msg_type\" key to have value %d, but got %v", int(ExtensionDataMessageId), dict["msg_type"])
+		return 0, nil, fmt.Errorf("expected \"msg_type\" key to have value %d, but got %v", int(ExtensionDataMessageId), dict["msg_type"])
 	}
 
-	pieceIndex, ok := dict["piece"].(int)
+	totalSize, ok := dict["total_size"].(int)
 
 	if !ok {
-		return nil, fmt.Errorf("expected \"piece\" key to be an integer, but received %v", pieceIndex)
+		return 0, nil, fmt.Errorf("expected \"total_size\" key to be an integer, but received %v", dict["total_size"])
 	}
 
-	pieceSize, ok := dict["total_size"].(int)
-
-	if !ok {
-		return nil, fmt.Errorf("expected \"total_size\" key to be an integer, but received %v", pieceSize)
+	if p.metadataSize != 0 && totalSize != p.metadataSize {
+		return 0, nil, fmt.Errorf("expected \"total_size\" to be %d (as advertised in the extension handshake), but received %d", p.metadataSize, totalSize)
 	}
 
 	metadataPieceStartIndex := nextCharIndex + 1 // add one to account for the first byte (the extension message Id)
-	metadataPiece := message.Payload[metadataPieceStartIndex:]
-
-	if receivedPieceSize := len(metadataPiece); receivedPieceSize != pieceSize {
-		return nil, fmt.Errorf("expected metadata piece to have length %d, but received %d", pieceSize, receivedPieceSize)
-	}
 
-	return metadataPiece, nil
+	return pieceIndex, message.Payload[metadataPieceStartIndex:], nil
 }
 
+// Tells the peer we want its pieces, once, and waits for it to unchoke us.
 func (p *PeerConnection) sendInterestAndAwaitUnchokeMessage() error {
-	if p.Unchoked {
-		return nil
-	}
+	p.mutex.Lock()
+	amInterested := p.amInterested
+	p.mutex.Unlock()
 
-	if err := p.sendMessage(Interested, nil); err != nil {
-		return fmt.Errorf("failed to send 'Interested' message to peer: %w", err)
-	}
+	if !amInterested {
+		if err := p.sendMessage(Interested, nil); err != nil {
+			return fmt.Errorf("failed to send 'Interested' message to peer: %w", err)
+		}
 
-	if _, err := p.receiveMessage(Unchoke); err != nil {
-		return fmt.Errorf("failed to receive 'Unchoke' message from peer: %w", err)
+		p.mutex.Lock()
+		p.amInterested = true
+		p.mutex.Unlock()
 	}
 
-	p.Unchoked = true
+	ctx, cancel := context.WithTimeout(context.Background(), unchokeTimeout)
+	defer cancel()
 
-	return nil
+	return p.waitForUnchoke(ctx)
 }
 
 func (p *PeerConnection) sendExtensionHandshakeMessage() error {
-	bencodedString, err := bencode.EncodeValue(map[string]any{
-		"m": map[string]any{
-			"ut_metadata": metadataExtensionId,
-		},
-	})
+	extensions := map[string]any{
+		string(Metadata): int(localExtensionIds[Metadata]),
+	}
+
+	if !p.disablePeerExchange {
+		extensions[string(PeerExchange)] = int(localExtensionIds[PeerExchange])
+	}
+
+	handshake := map[string]any{
+		"m": extensions,
+	}
+
+	if metadata := p.metadata(); metadata != nil {
+		handshake["metadata_size"] = len(metadata)
+	}
+
+	bencodedString, err := bencode.EncodeValue(handshake)
 
 	if err != nil {
 		return fmt.Errorf("failed to generate extension handshake payload: %w", err)
@@ -486,6 +1334,9 @@ func (p *PeerConnection) sendMessage(messageId MessageId, payload []byte) error
 	messageBuffer[index] = byte(messageId)
 	copy(messageBuffer[index+1:], payload)
 
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+
 	if _, err := utils.ConnWriteFull(p.Conn, messageBuffer, 0); err != nil {
 		return err
 	}
@@ -493,6 +1344,50 @@ func (p *PeerConnection) sendMessage(messageId MessageId, payload []byte) error
 	return nil
 }
 
+func (p *PeerConnection) sendMetadataPiece(pieceIndex int) error {
+	if !p.supportsExtension(Metadata) {
+		return nil
+	}
+
+	metadata := p.metadata()
+	metadataSize := len(metadata)
+	pieceStartIndex := pieceIndex * BlockSize
+
+	response := map[string]any{
+		"msg_type": int(ExtensionRejectMessageId),
+		"piece":    pieceIndex,
+	}
+
+	var metadataPiece []byte
+
+	if metadata != nil && pieceIndex >= 0 && pieceStartIndex < metadataSize {
+		response["msg_type"] = int(ExtensionDataMessageId)
+		response["total_size"] = metadataSize
+		metadataPiece = metadata[pieceStartIndex:min(pieceStartIndex+BlockSize, metadataSize)]
+	}
+
+	bencodedString, err := bencode.EncodeValue(response)
+
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata extension response payload: %w", err)
+	}
+
+	messagePayloadBuffer := make([]byte, 1+len(bencodedString)+len(metadataPiece))
+
+	index := 0
+	messagePayloadBuffer[index] = byte(p.PeerExtensions[Metadata])
+	index += 1
+
+	index += copy(messagePayloadBuffer[index:], []byte(bencodedString))
+	copy(messagePayloadBuffer[index:], metadataPiece)
+
+	if err := p.sendMessage(ExtensionMessageId, messagePayloadBuffer); err != nil {
+		return fmt.Errorf("failed to send metadata extension response: %w", err)
+	}
+
+	return nil
+}
+
 func (p *PeerConnection) sendMetadataRequestMessage(pieceIndex int) error {
 	bencodedString, err := bencode.EncodeValue(map[string]any{
 		"msg_type": int(ExtensionRequestMessageId),
@@ -519,6 +1414,22 @@ func (p *PeerConnection) sendMetadataRequestMessage(pieceIndex int) error {
 	return nil
 }
 
+// Sends the UDP port of our DHT node to peers that support the DHT.
+func (p *PeerConnection) sendPortMessage() error {
+	if p.dhtPort == 0 || !p.SupportsDHT {
+		return nil
+	}
+
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, p.dhtPort)
+
+	if err := p.sendMessage(Port, payload); err != nil {
+		return fmt.Errorf("failed to send 'Port' message: %w", err)
+	}
+
+	return nil
+}
+
 func (p *PeerConnection) supportsExtension(ext Extension) bool {
 	_, ok := p.PeerExtensions[ext]
 
@@ -552,14 +1463,18 @@ func (p *PeerConnection) DownloadPiece(piece Piece) (*DownloadedPiece, error) {
 	downloadedBlocks := make([]Block, numOfBlocks)
 	maxBatchSize := 5
 	mutex := ReadWriteMutex{}
-	resultsQueue := make(chan BlockRequestResult)
+	// Buffered so the requests of a batch can return their result once we have given up on the piece.
+	resultsQueue := make(chan BlockRequestResult, maxBatchSize)
 
 	for numOfBlocksDownloaded < numOfBlocks {
 		pendingBlocks := blocks[numOfBlocksDownloaded:]
 		numOfPendingBlocks := len(pendingBlocks)
 		currentBatchSize := min(numOfPendingBlocks, maxBatchSize)
+		// Indexes of the blocks of the batch that haven't been received yet.
+		requestedBlocks := map[int]bool{}
 
 		for i := 0; i < currentBatchSize; i++ {
+			requestedBlocks[numOfBlocksDownloaded+i] = true
 			go p.downloadBlock(pendingBlocks[i], resultsQueue, &mutex)
 		}
 
@@ -570,13 +1485,22 @@ func (p *PeerConnection) DownloadPiece(piece Piece) (*DownloadedPiece, error) {
 				return nil, fmt.Errorf("failed to download piece at index %d: %w", piece.Index, result.err)
 			}
 
+			/*
+				The responses to the requests of a batch can arrive in any order, so a block only has to match one of the requests of the batch.
+				Anything else (e.g a block of another piece, or a block we already have) would leave a requested block missing.
+			*/
 			downloadedBlock := result.block
 			downloadedBlockIndex := downloadedBlock.Begin / BlockSize
 
-			if downloadedBlockIndex >= numOfBlocks {
-				return nil, fmt.Errorf("downloaded block offset %d is invalid", downloadedBlock.Begin)
+			if downloadedBlock.PieceIndex != piece.Index || downloadedBlock.Begin%BlockSize != 0 || !requestedBlocks[downloadedBlockIndex] {
+				return nil, fmt.Errorf("received block at offset %d of piece %d, which was not requested", downloadedBlock.Begin, downloadedBlock.PieceIndex)
+			}
+
+			if expectedLength := blocks[downloadedBlockIndex].Length; downloadedBlock.Length != expectedLength {
+				return nil, fmt.Errorf("expected block at offset %d to contain '%d' bytes, but got '%d'", downloadedBlock.Begin, expectedLength, downloadedBlock.Length)
 			}
 
+			delete(requestedBlocks, downloadedBlockIndex)
 			downloadedBlocks[downloadedBlockIndex] = downloadedBlock
 			numOfBlocksDownloaded += 1
 		}
@@ -600,20 +1524,55 @@ func (p *PeerConnection) InitConnection() error {
 		return fmt.Errorf("failed to initialized peer connection: %w", err)
 	}
 
-	p.Conn = conn
+	p.Conn = newRateLimitedConn(conn, p.downloadLimiter, p.uploadLimiter)
 
 	if err := p.completeBaseHandshake(); err != nil {
 		return err
 	}
 
-	if err := p.parseBitFieldMessage(); err != nil {
-		fmt.Printf("failed to receive 'Bitfield' message from peer: %v", err)
-		return nil
+	return p.startSession()
+}
+
+/*
+Initializes a connection initiated by the peer.
+
+The peer sends its handshake first. Ours is only sent once we have verified that the peer wants the same torrent.
+*/
+func (p *PeerConnection) AcceptConnection(conn net.Conn) error {
+	p.Conn = newRateLimitedConn(conn, p.downloadLimiter, p.uploadLimiter)
+	p.incoming = true
+
+	if err := p.receiveBaseHandshakeMessage(); err != nil {
+		return err
+	}
+
+	if err := p.sendBaseHandshakeMessage(); err != nil {
+		return err
+	}
+
+	// Clears the deadline set while the handshake was read, see `ReadHandshakeInfoHash`.
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+
+	return p.startSession()
+}
+
+// Starts reading messages from the peer and completes the steps that follow the base handshake.
+func (p *PeerConnection) startSession() error {
+	go p.readMessages()
+
+	if err := p.sendBitfieldMessage(); err != nil {
+		return err
 	}
 
 	if err := p.completeExtensionHandshake(); err != nil {
 		return err
 	}
 
+	if err := p.sendPortMessage(); err != nil {
+		return err
+	}
+
 	return nil
 }
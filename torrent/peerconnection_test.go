@@ -0,0 +1,604 @@
+package torrent_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/MlkMahmud/hail/bencode"
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+/*
+Accepts the connection of a peer connection created from the config, as a peer responding with a handshake with the reserved bytes.
+Returns the connection once the handshakes have been exchanged, along with the reserved bytes of the peer connection's handshake.
+*/
+func acceptPeerConnection(t *testing.T, config torrent.PeerConnectionConfig, reserved []byte) (net.Conn, []byte) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	config.Peer = torrent.Peer{Address: netip.MustParseAddrPort(listener.Addr().String()), InfoHash: [20]byte{1}}
+	peerConnection := torrent.NewPeerConnection(config)
+	initializedCh := make(chan struct{})
+
+	go func() {
+		defer close(initializedCh)
+		peerConnection.InitConnection()
+	}()
+
+	// Cleanups run in reverse order: closing our end first lets a pending `InitConnection` return.
+	t.Cleanup(func() {
+		<-initializedCh
+		peerConnection.Close()
+	})
+
+	conn, err := listener.Accept()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	handshake := make([]byte, 68)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := io.ReadFull(conn, handshake); err != nil {
+		t.Fatal(err)
+	}
+
+	response := append([]byte{19}, "BitTorrent protocol"...)
+	response = append(response, reserved...)
+	response = append(response, config.Peer.InfoHash[:]...)
+	response = append(response, "-TS0001-000000000000"...)
+
+	if _, err := conn.Write(response); err != nil {
+		t.Fatal(err)
+	}
+
+	return conn, handshake[20:28]
+}
+
+// Reads the next message sent by the peer, skipping keep-alives.
+func readPeerMessage(t *testing.T, conn net.Conn) (torrent.MessageId, []byte) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for {
+		lengthBuffer := make([]byte, 4)
+
+		if _, err := io.ReadFull(conn, lengthBuffer); err != nil {
+			t.Fatal(err)
+		}
+
+		length := binary.BigEndian.Uint32(lengthBuffer)
+
+		if length == 0 {
+			continue
+		}
+
+		message := make([]byte, length)
+
+		if _, err := io.ReadFull(conn, message); err != nil {
+			t.Fatal(err)
+		}
+
+		return torrent.MessageId(message[0]), message[1:]
+	}
+}
+
+func writePeerMessage(t *testing.T, conn net.Conn, id torrent.MessageId, payload []byte) {
+	t.Helper()
+
+	message := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	message = append(message, byte(id))
+
+	if _, err := conn.Write(append(message, payload...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendsDHTPort(t *testing.T) {
+	tests := []struct {
+		name            string
+		dhtPort         uint16
+		peerSupportsDHT bool
+	}{
+		{name: "to peers that support the DHT", dhtPort: 6881, peerSupportsDHT: true},
+		{name: "not to peers that don't support the DHT", dhtPort: 6881, peerSupportsDHT: false},
+		{name: "not without a DHT node", dhtPort: 0, peerSupportsDHT: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reserved := make([]byte, 8)
+
+			if test.peerSupportsDHT {
+				reserved[7] |= 0x01
+			}
+
+			conn, receivedReserved := acceptPeerConnection(t, torrent.PeerConnectionConfig{DHTPort: test.dhtPort}, reserved)
+
+			if advertised := receivedReserved[7]&0x01 != 0; advertised != (test.dhtPort != 0) {
+				t.Fatalf("expected DHT support to be advertised: %v, but got %v", test.dhtPort != 0, advertised)
+			}
+
+			if !test.peerSupportsDHT || test.dhtPort == 0 {
+				conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+
+				if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+					t.Fatalf("expected no 'Port' message, but got '%v'", err)
+				}
+
+				return
+			}
+
+			if id, payload := readPeerMessage(t, conn); id != torrent.Port || !bytes.Equal(payload, []byte{0x1a, 0xe1}) {
+				t.Fatalf("expected 'Port' message with port %d, but got message %d with payload %v", test.dhtPort, id, payload)
+			}
+		})
+	}
+}
+
+func TestReceivesDHTPort(t *testing.T) {
+	addressCh := make(chan string, 2)
+
+	conn, _ := acceptPeerConnection(t, torrent.PeerConnectionConfig{OnDHTPort: func(address string) { addressCh <- address }}, make([]byte, 8))
+
+	// Messages with an invalid payload are ignored.
+	writePeerMessage(t, conn, torrent.Port, []byte{0x1a, 0xe1, 0x00})
+	writePeerMessage(t, conn, torrent.Port, []byte{0x1a, 0xe2})
+
+	select {
+	case address := <-addressCh:
+		{
+			if address != "127.0.0.1:6882" {
+				t.Fatalf("expected the address of the peer's DHT node to be '127.0.0.1:6882', but got '%s'", address)
+			}
+		}
+
+	case <-time.After(5 * time.Second):
+		{
+			t.Fatal("timed out waiting for the 'Port' message to be handled")
+		}
+	}
+}
+
+func TestDisconnectsPeersSendingLargeMessages(t *testing.T) {
+	conn, _ := acceptPeerConnection(t, torrent.PeerConnectionConfig{}, make([]byte, 8))
+
+	// Only the length of the message is sent: the connection is closed without waiting for the rest.
+	if _, err := conn.Write(binary.BigEndian.AppendUint32(nil, 1<<20+1)); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for {
+		if _, err := conn.Read(make([]byte, 1024)); err != nil {
+			if !errors.Is(err, io.EOF) {
+				t.Fatalf("expected the connection to be closed, but got '%v'", err)
+			}
+
+			return
+		}
+	}
+}
+
+func TestServesMetadataToPeers(t *testing.T) {
+	const peerMetadataId = 3
+
+	metadata := make([]byte, 2*torrent.BlockSize+100)
+
+	for index := range metadata {
+		metadata[index] = byte(index % 251)
+	}
+
+	tests := []struct {
+		name         string
+		metadata     []byte
+		piece        int
+		expectedData []byte
+	}{
+		{name: "first piece", metadata: metadata, piece: 0, expectedData: metadata[:torrent.BlockSize]},
+		{name: "last piece", metadata: metadata, piece: 2, expectedData: metadata[2*torrent.BlockSize:]},
+		{name: "piece out of range", metadata: metadata, piece: 3},
+		{name: "negative piece", metadata: metadata, piece: -1},
+		{name: "unknown metadata", metadata: nil, piece: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reserved := make([]byte, 8)
+			reserved[5] |= 0x10
+
+			conn, _ := acceptPeerConnection(t, torrent.PeerConnectionConfig{GetMetadata: func() []byte { return test.metadata }}, reserved)
+
+			handshake, err := bencode.EncodeValue(map[string]any{"m": map[string]any{"ut_metadata": peerMetadataId}})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			writePeerMessage(t, conn, torrent.ExtensionMessageId, append([]byte{0}, handshake...))
+
+			id, payload := readPeerMessage(t, conn)
+
+			if id != torrent.ExtensionMessageId || payload[0] != 0 {
+				t.Fatalf("expected extension handshake, but got message %d", id)
+			}
+
+			decodedHandshake, _, err := bencode.DecodeValue(payload[1:])
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if size, ok := decodedHandshake.(map[string]any)["metadata_size"]; (test.metadata != nil) != ok || (ok && size != len(test.metadata)) {
+				t.Fatalf("expected the extension handshake to advertise the size of the metadata, but got %v", decodedHandshake)
+			}
+
+			request, err := bencode.EncodeValue(map[string]any{"msg_type": int(torrent.ExtensionRequestMessageId), "piece": test.piece})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The peer's requests are sent with the Id we advertised for "ut_metadata".
+			writePeerMessage(t, conn, torrent.ExtensionMessageId, append([]byte{1}, request...))
+
+			if id, payload = readPeerMessage(t, conn); id != torrent.ExtensionMessageId || payload[0] != peerMetadataId {
+				t.Fatalf("expected 'ut_metadata' message, but got message %d", id)
+			}
+
+			decodedResponse, length, err := bencode.DecodeValue(payload[1:])
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response := decodedResponse.(map[string]any)
+			data := payload[1+length:]
+
+			if test.expectedData == nil {
+				if response["msg_type"] != int(torrent.ExtensionRejectMessageId) || response["piece"] != test.piece || len(data) != 0 {
+					t.Fatalf("expected the request to be rejected, but got %v", response)
+				}
+
+				return
+			}
+
+			if response["msg_type"] != int(torrent.ExtensionDataMessageId) || response["piece"] != test.piece || response["total_size"] != len(test.metadata) {
+				t.Fatalf("expected 'data' message for piece %d, but got %v", test.piece, response)
+			}
+
+			if !bytes.Equal(data, test.expectedData) {
+				t.Fatalf("expected %d bytes of metadata, but got %d", len(test.expectedData), len(data))
+			}
+		})
+	}
+}
+
+func TestAcceptsPeerConnections(t *testing.T) {
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		t.Run(host, func(t *testing.T) {
+			listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+
+			if err != nil {
+				t.Skipf("can't listen on '%s': %v", host, err)
+			}
+
+			defer listener.Close()
+
+			infoHash := [20]byte{1}
+			addressCh := make(chan string, 1)
+
+			go func() {
+				conn, err := listener.Accept()
+
+				if err != nil {
+					return
+				}
+
+				address := netip.MustParseAddrPort(conn.RemoteAddr().String())
+				peerConnection := torrent.NewPeerConnection(torrent.PeerConnectionConfig{
+					Peer:      torrent.Peer{Address: address, InfoHash: infoHash},
+					OnDHTPort: func(address string) { addressCh <- address },
+				})
+
+				if err := peerConnection.AcceptConnection(conn); err != nil {
+					conn.Close()
+					return
+				}
+
+				t.Cleanup(peerConnection.Close)
+			}()
+
+			conn, err := net.Dial("tcp", listener.Addr().String())
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer conn.Close()
+
+			handshake := append([]byte{19}, "BitTorrent protocol"...)
+			handshake = append(handshake, make([]byte, 8)...)
+			handshake = append(handshake, infoHash[:]...)
+			handshake = append(handshake, "-TS0001-000000000000"...)
+
+			if _, err := conn.Write(handshake); err != nil {
+				t.Fatal(err)
+			}
+
+			response := make([]byte, len(handshake))
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+			if _, err := io.ReadFull(conn, response); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(response[:20], handshake[:20]) || !bytes.Equal(response[28:48], infoHash[:]) {
+				t.Fatalf("expected a handshake for the info hash, but got %v", response[:48])
+			}
+
+			// The address of the peer's DHT node is derived from the address of the connection.
+			writePeerMessage(t, conn, torrent.Port, []byte{0x1a, 0xe2})
+
+			select {
+			case address := <-addressCh:
+				{
+					if expected := net.JoinHostPort(host, "6882"); address != expected {
+						t.Fatalf("expected the address of the peer's DHT node to be '%s', but got '%s'", expected, address)
+					}
+				}
+
+			case <-time.After(5 * time.Second):
+				{
+					t.Fatal("timed out waiting for the 'Port' message to be handled")
+				}
+			}
+		})
+	}
+}
+
+// Connects to a torrent as a peer without extensions and completes the base handshake.
+func connectToTorrent(t *testing.T, trrnt *torrent.Torrent) net.Conn {
+	t.Helper()
+
+	conn, err := dialTorrent(t, trrnt)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+// Connects to a torrent as a peer without extensions, returning an error if the torrent doesn't complete the handshake.
+func dialTorrent(t *testing.T, trrnt *torrent.Torrent) (net.Conn, error) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			trrnt.HandleIncomingConnection(conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	infoHash := trrnt.InfoHash()
+	handshake := append([]byte{19}, "BitTorrent protocol"...)
+	handshake = append(handshake, make([]byte, 8)...)
+	handshake = append(handshake, infoHash[:]...)
+	handshake = append(handshake, "-TS0001-000000000000"...)
+
+	if _, err := conn.Write(handshake); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	if _, err := io.ReadFull(conn, make([]byte, len(handshake))); err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func blockRequest(pieceIndex int, begin int, length int) []byte {
+	request := binary.BigEndian.AppendUint32(nil, uint32(pieceIndex))
+	request = binary.BigEndian.AppendUint32(request, uint32(begin))
+
+	return binary.BigEndian.AppendUint32(request, uint32(length))
+}
+
+func TestSeedingSurvivesUnrequestedMessages(t *testing.T) {
+	data := randomBytes(t, 2*testPieceLength)
+	trrnt := newSeedingTorrent(t, data, nil)
+	conn := connectToTorrent(t, trrnt)
+
+	if id, _ := readPeerMessage(t, conn); id != torrent.Bitfield {
+		t.Fatalf("expected 'Bitfield' message, but got message %d", id)
+	}
+
+	// Far more messages than the connection buffers, none of which answers a request of ours.
+	for range 100 {
+		writePeerMessage(t, conn, torrent.Choke, nil)
+		writePeerMessage(t, conn, torrent.Unchoke, nil)
+		writePeerMessage(t, conn, torrent.PieceMessageId, blockRequest(0, 0, 0))
+		writePeerMessage(t, conn, torrent.Hashes, make([]byte, 48))
+		writePeerMessage(t, conn, torrent.ExtensionMessageId, []byte{42})
+	}
+
+	writePeerMessage(t, conn, torrent.Interested, nil)
+
+	if id, _ := readPeerMessage(t, conn); id != torrent.Unchoke {
+		t.Fatalf("expected 'Unchoke' message, but got message %d", id)
+	}
+
+	writePeerMessage(t, conn, torrent.Request, blockRequest(1, 0, 100))
+
+	if id, payload := readPeerMessage(t, conn); id != torrent.PieceMessageId || !bytes.Equal(payload[8:], data[testPieceLength:testPieceLength+100]) {
+		t.Fatalf("expected the requested block, but got message %d", id)
+	}
+}
+
+func TestDownloadResumesAfterPeerChokes(t *testing.T) {
+	data := randomBytes(t, 3*testPieceLength)
+	trrnt, _ := newTestTorrentFile(t, "choke.bin", []testFile{{data: data}}, map[string]any{"announce": "http://127.0.0.1:1/announce"})
+
+	trrnt.Start()
+	defer trrnt.Stop()
+
+	conn := connectToTorrent(t, &trrnt)
+
+	writePeerMessage(t, conn, torrent.Bitfield, []byte{0b11100000})
+
+	if id, _ := readPeerMessage(t, conn); id != torrent.Interested {
+		t.Fatalf("expected 'Interested' message, but got message %d", id)
+	}
+
+	writePeerMessage(t, conn, torrent.Unchoke, nil)
+	numOfChokes := 0
+	var unchokeTimer *time.Timer
+
+	/*
+		Choke the torrent as many times as it tolerates failed attempts, dropping its pending requests like real peers do,
+		and unchoke it shortly after every time.
+	*/
+	for !trrnt.IsFinished() {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		id, payload := readPeerMessage(t, conn)
+
+		if id != torrent.Request {
+			continue
+		}
+
+		// Requests sent while the torrent is choked are dropped.
+		if unchokeTimer != nil && unchokeTimer.Stop() {
+			unchokeTimer.Reset(100 * time.Millisecond)
+			continue
+		}
+
+		if numOfChokes < torrent.MaxFailedAttempts {
+			numOfChokes += 1
+			writePeerMessage(t, conn, torrent.Choke, nil)
+
+			unchokeTimer = time.AfterFunc(100*time.Millisecond, func() {
+				conn.Write([]byte{0, 0, 0, 1, byte(torrent.Unchoke)})
+			})
+
+			continue
+		}
+
+		pieceIndex := int(binary.BigEndian.Uint32(payload))
+		begin := int(binary.BigEndian.Uint32(payload[4:]))
+		length := int(binary.BigEndian.Uint32(payload[8:]))
+		offset := pieceIndex*testPieceLength + begin
+
+		writePeerMessage(t, conn, torrent.PieceMessageId, append(payload[:8], data[offset:offset+length]...))
+	}
+
+	if stats := trrnt.Stats(); stats.ConnectedPeers != 1 {
+		t.Fatalf("expected the peer that choked us to stay connected, but got %d connected peers", stats.ConnectedPeers)
+	}
+}
+
+func TestBannedPeerCannotReconnect(t *testing.T) {
+	trrnt := newSeedingTorrent(t, randomBytes(t, testPieceLength), nil)
+	conn := connectToTorrent(t, trrnt)
+
+	trrnt.BanPeer(conn.LocalAddr().String())
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Fatalf("expected the connection of the banned peer to be closed, but got '%v'", err)
+	}
+
+	// The peer connects again from another port.
+	if _, err := dialTorrent(t, trrnt); err == nil {
+		t.Fatal("expected the banned peer not to be able to reconnect")
+	}
+}
+
+func TestKeepsHandshakeDeadlineOfIncomingConnections(t *testing.T) {
+	defer torrent.SetHandshakeTimeout(100 * time.Millisecond)()
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	infoHash := [20]byte{1}
+	handshake := append([]byte{19}, "BitTorrent protocol"...)
+	handshake = append(handshake, make([]byte, 8)...)
+	handshake = append(handshake, infoHash[:]...)
+
+	// The peer stalls once it has sent the beginning of its handshake.
+	go remote.Write(handshake)
+
+	receivedInfoHash, conn, err := torrent.ReadHandshakeInfoHash(local)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if receivedInfoHash != infoHash {
+		t.Fatalf("expected info hash %x, but got %x", infoHash, receivedInfoHash)
+	}
+
+	// The bytes that were read are replayed, then reading the rest of the handshake times out.
+	if _, err := io.ReadFull(conn, make([]byte, len(handshake))); err != nil {
+		t.Fatal(err)
+	}
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		{
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("expected reading the rest of the handshake to time out, but got '%v'", err)
+			}
+		}
+
+	case <-time.After(5 * time.Second):
+		{
+			t.Fatal("expected the handshake deadline to be kept once the info hash has been read")
+		}
+	}
+}
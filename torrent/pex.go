@@ -0,0 +1,326 @@
+package torrent
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/MlkMahmud/hail/bencode"
+	"github.com/MlkMahmud/hail/logging"
+)
+
+type peerExchangeState struct {
+	// peers included in the previous "ut_pex" messages sent to the peer, keyed by address.
+	sent map[string]Peer
+	// set once the first (full) "ut_pex" message has been sent to the peer.
+	initialized bool
+
+	lastReceivedAt time.Time
+}
+
+const (
+	// BEP 11: peers should not send more than one "ut_pex" message per minute.
+	pexInterval = time.Minute
+	// Messages received well before the interval has elapsed are ignored.
+	pexMinReceiveInterval = 45 * time.Second
+	// BEP 11: a single message must not contain more than 50 added and 50 dropped peers.
+	pexMaxPeers = 50
+
+	// The peer accepts incoming connections.
+	pexFlagReachable = 0x10
+)
+
+func newPeerExchangeState() *peerExchangeState {
+	return &peerExchangeState{
+		sent: make(map[string]Peer),
+	}
+}
+
+/*
+Parses a "ut_pex" message and forwards the peers it contains to the connection's `onPeerExchange` handler.
+Added peers that accept incoming connections (according to their flags) are forwarded first, so they are the first to be connected to.
+
+The message is a bencoded dictionary with the following keys (all optional):
+
+	added      compact IPv4 peers (6 bytes each)
+	added.f    one byte of flags for each peer in "added"
+	dropped    compact IPv4 peers (6 bytes each)
+	added6     compact IPv6 peers (18 bytes each)
+	added6.f   one byte of flags for each peer in "added6"
+	dropped6   compact IPv6 peers (18 bytes each)
+*/
+func (p *PeerConnection) handlePeerExchangeMessage(payload []byte) error {
+	if p.disablePeerExchange || p.onPeerExchange == nil {
+		return nil
+	}
+
+	now := time.Now()
+
+	if !p.pexState.lastReceivedAt.IsZero() && now.Sub(p.pexState.lastReceivedAt) < pexMinReceiveInterval {
+		return fmt.Errorf("peer sent more than one 'ut_pex' message within %v", pexMinReceiveInterval)
+	}
+
+	p.pexState.lastReceivedAt = now
+
+	decodedValue, _, err := bencode.DecodeValue(payload)
+
+	if err != nil {
+		return fmt.Errorf("failed to decode 'ut_pex' message: %w", err)
+	}
+
+	dict, ok := decodedValue.(map[string]any)
+
+	if !ok {
+		return fmt.Errorf("expected 'ut_pex' message to be a dictionary, but received '%T'", decodedValue)
+	}
+
+	reachable := []Peer{}
+	added := []Peer{}
+	dropped := []Peer{}
+
+	for _, entry := range []struct {
+		key      string
+		peerSize int
+		list     *[]Peer
+	}{
+		{"added", compactPeerSize, &added},
+		{"added6", compactPeer6Size, &added},
+		{"dropped", compactPeerSize, &dropped},
+		{"dropped6", compactPeer6Size, &dropped},
+	} {
+		value, exists := dict[entry.key]
+
+		if !exists {
+			continue
+		}
+
+		compactPeers, ok := value.(string)
+
+		if !ok {
+			return fmt.Errorf("expected '%s' property to be a string, but received '%T'", entry.key, value)
+		}
+
+		peers, err := parseCompactPeers(compactPeers, entry.peerSize, p.InfoHash)
+
+		if err != nil {
+			return fmt.Errorf("failed to parse '%s' property: %w", entry.key, err)
+		}
+
+		flags, ok := dict[entry.key+".f"].(string)
+
+		if !ok {
+			*entry.list = append(*entry.list, peers...)
+			continue
+		}
+
+		if len(flags) != len(peers) {
+			return fmt.Errorf("expected '%s.f' property to contain %d flags, but received %d", entry.key, len(peers), len(flags))
+		}
+
+		for index, peer := range peers {
+			if flags[index]&pexFlagReachable != 0 {
+				reachable = append(reachable, peer)
+			} else {
+				*entry.list = append(*entry.list, peer)
+			}
+		}
+	}
+
+	added = append(reachable, added...)
+
+	if len(added) > pexMaxPeers {
+		added = added[:pexMaxPeers]
+	}
+
+	if len(dropped) > pexMaxPeers {
+		dropped = dropped[:pexMaxPeers]
+	}
+
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil
+	}
+
+	p.onPeerExchange(added, dropped)
+
+	return nil
+}
+
+// Sends a "ut_pex" message with the changes to the set of connected peers since the previous message, see `nextMessage`.
+func (p *PeerConnection) sendPeerExchangeMessage(connectedPeers map[string]Peer) error {
+	if p.disablePeerExchange || !p.supportsExtension(PeerExchange) {
+		return nil
+	}
+
+	message := p.pexState.nextMessage(connectedPeers, p.PeerAddress)
+
+	if message == nil {
+		return nil
+	}
+
+	bencodedString, err := bencode.EncodeValue(message)
+
+	if err != nil {
+		return fmt.Errorf("failed to encode 'ut_pex' message payload: %w", err)
+	}
+
+	messagePayloadBuffer := make([]byte, len(bencodedString)+1)
+	messagePayloadBuffer[0] = p.PeerExtensions[PeerExchange]
+	copy(messagePayloadBuffer[1:], []byte(bencodedString))
+
+	if err := p.sendMessage(ExtensionMessageId, messagePayloadBuffer); err != nil {
+		return fmt.Errorf("failed to send 'ut_pex' message: %w", err)
+	}
+
+	return nil
+}
+
+/*
+Returns the "ut_pex" message with the changes to the set of connected peers since the previous message, or nil if nothing changed.
+The peer the message is sent to (`peerAddress`) is never included.
+
+The first message contains the full set of connected peers (up to the size limit).
+Peers that did not fit in a message are included in the next one.
+*/
+func (s *peerExchangeState) nextMessage(connectedPeers map[string]Peer, peerAddress string) map[string]any {
+	var added, added6, addedFlags, added6Flags, dropped, dropped6 []byte
+	numOfAddedPeers := 0
+	numOfDroppedPeers := 0
+
+	for address, peer := range connectedPeers {
+		if numOfAddedPeers >= pexMaxPeers {
+			break
+		}
+
+		if _, ok := s.sent[address]; ok || address == peerAddress {
+			continue
+		}
+
+		compactPeer, isIPv4 := peer.compact()
+
+		if compactPeer == nil {
+			continue
+		}
+
+		if isIPv4 {
+			added = append(added, compactPeer...)
+			addedFlags = append(addedFlags, pexFlagReachable)
+		} else {
+			added6 = append(added6, compactPeer...)
+			added6Flags = append(added6Flags, pexFlagReachable)
+		}
+
+		s.sent[address] = peer
+		numOfAddedPeers += 1
+	}
+
+	for address, peer := range s.sent {
+		if numOfDroppedPeers >= pexMaxPeers {
+			break
+		}
+
+		if _, ok := connectedPeers[address]; ok {
+			continue
+		}
+
+		compactPeer, isIPv4 := peer.compact()
+
+		if isIPv4 {
+			dropped = append(dropped, compactPeer...)
+		} else {
+			dropped6 = append(dropped6, compactPeer...)
+		}
+
+		delete(s.sent, address)
+		numOfDroppedPeers += 1
+	}
+
+	if s.initialized && numOfAddedPeers == 0 && numOfDroppedPeers == 0 {
+		return nil
+	}
+
+	s.initialized = true
+
+	return map[string]any{
+		"added":    string(added),
+		"added.f":  string(addedFlags),
+		"added6":   string(added6),
+		"added6.f": string(added6Flags),
+		"dropped":  string(dropped),
+		"dropped6": string(dropped6),
+	}
+}
+
+/*
+Adds the peers received from PEX messages to the torrent's peer list and forgets peers that were dropped by the swarm.
+
+It is called from the peer's reader goroutine, so the added peers are handed off in the background instead of waiting for the
+torrent to finish connecting to the peers it received before.
+*/
+func (tr *Torrent) handlePeerExchange(added []Peer, dropped []Peer) {
+	if tr.IsPrivate() {
+		return
+	}
+
+	tr.mutex.Lock()
+
+	for _, peer := range dropped {
+		delete(tr.peers, peer.String())
+	}
+
+	tr.mutex.Unlock()
+
+	if len(added) == 0 {
+		return
+	}
+
+	go func() {
+		select {
+		case <-tr.ctx.Done():
+		case tr.incomingPeersCh <- added:
+		}
+	}()
+}
+
+// Periodically sends our connected peers to every peer that supports the "ut_pex" extension.
+func (tr *Torrent) startPeerExchange() {
+	ticker := time.NewTicker(pexInterval)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-tr.ctx.Done():
+			{
+				return
+			}
+
+		case <-ticker.C:
+			{
+				if tr.IsPrivate() {
+					continue
+				}
+
+				tr.mutex.Lock()
+
+				connectedPeers := make(map[string]Peer, len(tr.peerConnections))
+				peerConnections := make([]*PeerConnection, 0, len(tr.peerConnections))
+
+				for address, peerConnection := range tr.peerConnections {
+					// Other peers can't connect to the ephemeral port of an incoming connection.
+					if !peerConnection.incoming {
+						connectedPeers[address] = peerConnection.peer
+					}
+
+					peerConnections = append(peerConnections, peerConnection)
+				}
+
+				tr.mutex.Unlock()
+
+				for _, peerConnection := range peerConnections {
+					if err := peerConnection.sendPeerExchangeMessage(connectedPeers); err != nil {
+						peerConnection.logger.Debug("failed to send 'ut_pex' message to peer", logging.ErrorKey, err)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package torrent_test
+
+import (
+	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/MlkMahmud/hail/bencode"
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+func encodePeerExchangeMessage(t *testing.T, message map[string]any) []byte {
+	t.Helper()
+
+	bencodedString, err := bencode.EncodeValue(message)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []byte(bencodedString)
+}
+
+func TestParsePeerExchangeMessage(t *testing.T) {
+	manyPeers := []string{}
+
+	for port := range 60 {
+		manyPeers = append(manyPeers, netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), uint16(port+1)).String())
+	}
+
+	tests := []struct {
+		name            string
+		message         map[string]any
+		expectedAdded   []string
+		expectedDropped []string
+	}{
+		{
+			name:            "added and dropped IPv4 peers",
+			message:         map[string]any{"added": compactPeers("1.2.3.4:6881", "5.6.7.8:51413"), "dropped": compactPeers("9.9.9.9:80")},
+			expectedAdded:   []string{"1.2.3.4:6881", "5.6.7.8:51413"},
+			expectedDropped: []string{"9.9.9.9:80"},
+		},
+		{
+			name:            "added and dropped IPv6 peers",
+			message:         map[string]any{"added6": compactPeers("[2001:db8::1]:6881"), "dropped6": compactPeers("[2001:db8::2]:6882")},
+			expectedAdded:   []string{"[2001:db8::1]:6881"},
+			expectedDropped: []string{"[2001:db8::2]:6882"},
+		},
+		{
+			name: "reachable peers first",
+			message: map[string]any{
+				"added":    compactPeers("1.1.1.1:1", "2.2.2.2:2"),
+				"added.f":  "\x00\x10",
+				"added6":   compactPeers("[::3]:3", "[::4]:4"),
+				"added6.f": "\x12\x02",
+			},
+			expectedAdded:   []string{"2.2.2.2:2", "[::3]:3", "1.1.1.1:1", "[::4]:4"},
+			expectedDropped: []string{},
+		},
+		{
+			name:            "IPv4-mapped IPv6 peers",
+			message:         map[string]any{"added6": compactPeers("[::ffff:1.2.3.4]:6881")},
+			expectedAdded:   []string{"1.2.3.4:6881"},
+			expectedDropped: []string{},
+		},
+		{
+			name:            "at most 50 added peers",
+			message:         map[string]any{"added": compactPeers(manyPeers...)},
+			expectedAdded:   manyPeers[:50],
+			expectedDropped: []string{},
+		},
+		{
+			name:            "empty message",
+			message:         map[string]any{},
+			expectedAdded:   []string{},
+			expectedDropped: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			added, dropped, err := torrent.ParsePeerExchangeMessage(encodePeerExchangeMessage(t, test.message))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(added, test.expectedAdded) {
+				t.Errorf("expected added peers %v, but got %v", test.expectedAdded, added)
+			}
+
+			if !reflect.DeepEqual(dropped, test.expectedDropped) {
+				t.Errorf("expected dropped peers %v, but got %v", test.expectedDropped, dropped)
+			}
+		})
+	}
+}
+
+func TestParseInvalidPeerExchangeMessage(t *testing.T) {
+	tests := map[string]string{
+		"not a dictionary":      "li1ee",
+		"truncated":             "d5:added",
+		"added is not a string": "d5:addedi1ee",
+		"partial IPv4 peer":     string(encodePeerExchangeMessage(t, map[string]any{"added": "\x01\x02\x03\x04\x05"})),
+		"partial IPv6 peer":     string(encodePeerExchangeMessage(t, map[string]any{"added6": compactPeers("1.2.3.4:5")})),
+		"missing flags":         string(encodePeerExchangeMessage(t, map[string]any{"added": compactPeers("1.2.3.4:5", "1.2.3.4:6"), "added.f": "\x10"})),
+	}
+
+	for name, payload := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, _, err := torrent.ParsePeerExchangeMessage([]byte(payload)); err == nil {
+				t.Fatal("expected message to be rejected")
+			}
+		})
+	}
+}
+
+func TestPeerExchangeMessages(t *testing.T) {
+	const peerAddress = "7.7.7.7:7"
+
+	messages := torrent.PeerExchangeMessages(
+		peerAddress,
+		[]string{},
+		[]string{"1.1.1.1:1", "[2001:db8::1]:2", peerAddress},
+		[]string{"1.1.1.1:1", "[2001:db8::1]:2", peerAddress},
+		[]string{"[2001:db8::1]:2", "3.3.3.3:3"},
+		[]string{},
+	)
+
+	tests := []struct {
+		expectedAdded   []string
+		expectedDropped []string
+	}{
+		// The first message is sent even if there are no peers.
+		{expectedAdded: []string{}, expectedDropped: []string{}},
+		// The peer the message is sent to is never included.
+		{expectedAdded: []string{"1.1.1.1:1", "[2001:db8::1]:2"}, expectedDropped: []string{}},
+		// Nothing is sent if nothing changed.
+		{},
+		{expectedAdded: []string{"3.3.3.3:3"}, expectedDropped: []string{"1.1.1.1:1"}},
+		{expectedAdded: []string{}, expectedDropped: []string{"3.3.3.3:3", "[2001:db8::1]:2"}},
+	}
+
+	for index, test := range tests {
+		message := messages[index]
+
+		if test.expectedAdded == nil {
+			if message != nil {
+				t.Errorf("round %d: expected no message, but got %v", index, message)
+			}
+
+			continue
+		}
+
+		for key, peerSize := range map[string]int{"added": 6, "added6": 18} {
+			if flags := message[key+".f"].(string); flags != strings.Repeat("\x10", len(message[key].(string))/peerSize) {
+				t.Errorf("round %d: expected every peer of '%s' to be flagged as reachable, but got %q", index, key, flags)
+			}
+		}
+
+		// Sent messages are parsed back, since the order of peers within a message isn't specified.
+		added, dropped, err := torrent.ParsePeerExchangeMessage(encodePeerExchangeMessage(t, message))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		slices.Sort(added)
+		slices.Sort(dropped)
+
+		if !reflect.DeepEqual(added, test.expectedAdded) || !reflect.DeepEqual(dropped, test.expectedDropped) {
+			t.Errorf("round %d: expected added %v and dropped %v, but got added %v and dropped %v", index, test.expectedAdded, test.expectedDropped, added, dropped)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package torrent
+
+import (
+	"sync"
+)
+
+type pieceState int
+
+const (
+	pendingPiece pieceState = iota
+	inProgressPiece
+	completedPiece
+)
+
+/*
+Decides which piece each source (a peer connection or a web seed) downloads next.
+
+A piece is assigned to a single source at a time. Pieces that fail to download or to pass hash verification
+are released and handed to the next source that has them.
+
+Pieces are picked by priority (see `FilePriority`), then in order. Skipped pieces are never picked.
+*/
+type piecePicker struct {
+	mutex *sync.Mutex
+
+	pieces         []Piece
+	states         []pieceState
+	priorities     []FilePriority
+	numOfCompleted int
+	// Number of pieces that aren't skipped and haven't been completed.
+	numOfWanted int
+	// Closed once every piece has been completed.
+	completedCh chan struct{}
+	// Closed, and replaced, whenever the wanted pieces become all completed or stop being so. See `wantedState`.
+	wantedChangedCh chan struct{}
+}
+
+func newPiecePicker(pieces []Piece) *piecePicker {
+	var mutex sync.Mutex
+
+	pp := &piecePicker{
+		mutex: &mutex,
+
+		pieces:          pieces,
+		states:          make([]pieceState, len(pieces)),
+		priorities:      make([]FilePriority, len(pieces)),
+		numOfWanted:     len(pieces),
+		completedCh:     make(chan struct{}),
+		wantedChangedCh: make(chan struct{}),
+	}
+
+	if len(pieces) == 0 {
+		close(pp.completedCh)
+	}
+
+	return pp
+}
+
+// Assigns the first pending piece of the highest priority the source has to the caller. Returns false if there's no such piece.
+func (pp *piecePicker) pick(hasPiece func(index int) bool) (Piece, bool) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	picked := -1
+
+	for index, state := range pp.states {
+		if state != pendingPiece || pp.priorities[index] == PrioritySkip {
+			continue
+		}
+
+		if picked != -1 && pp.priorities[index] <= pp.priorities[picked] {
+			continue
+		}
+
+		if !hasPiece(index) {
+			continue
+		}
+
+		picked = index
+
+		if pp.priorities[index] == PriorityHigh {
+			break
+		}
+	}
+
+	if picked == -1 {
+		return Piece{}, false
+	}
+
+	pp.states[picked] = inProgressPiece
+
+	return pp.pieces[picked], true
+}
+
+/*
+Sets the priority of every piece.
+
+Pieces being downloaded when they are skipped are still completed. The wanted state changes if pieces that weren't completed are skipped or wanted again.
+*/
+func (pp *piecePicker) setPriorities(priorities []FilePriority) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	wasDone := pp.numOfWanted == 0
+	pp.priorities = priorities
+	pp.numOfWanted = 0
+
+	for index, state := range pp.states {
+		if state != completedPiece && priorities[index] != PrioritySkip {
+			pp.numOfWanted += 1
+		}
+	}
+
+	if wasDone != (pp.numOfWanted == 0) {
+		close(pp.wantedChangedCh)
+		pp.wantedChangedCh = make(chan struct{})
+	}
+}
+
+// Reports whether every piece that isn't skipped has been completed, and returns a channel that is closed when that changes.
+func (pp *piecePicker) wantedState() (bool, <-chan struct{}) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	return pp.numOfWanted == 0, pp.wantedChangedCh
+}
+
+// Returns the number of bytes of the pieces that aren't skipped and haven't been completed.
+func (pp *piecePicker) bytesLeft() int64 {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	left := int64(0)
+
+	for index, state := range pp.states {
+		if state != completedPiece && pp.priorities[index] != PrioritySkip {
+			left += int64(pp.pieces[index].Length)
+		}
+	}
+
+	return left
+}
+
+// Makes a piece that failed to download available to other sources.
+func (pp *piecePicker) release(index int) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	if pp.states[index] != inProgressPiece {
+		return
+	}
+
+	pp.states[index] = pendingPiece
+}
+
+// Marks a piece that passed hash verification and was written to disk as completed.
+func (pp *piecePicker) complete(index int) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	if pp.states[index] == completedPiece {
+		return
+	}
+
+	pp.states[index] = completedPiece
+	pp.numOfCompleted += 1
+
+	if pp.priorities[index] != PrioritySkip {
+		pp.numOfWanted -= 1
+
+		if pp.numOfWanted == 0 {
+			close(pp.wantedChangedCh)
+			pp.wantedChangedCh = make(chan struct{})
+		}
+	}
+
+	if pp.numOfCompleted == len(pp.pieces) {
+		close(pp.completedCh)
+	}
+}
+
+func (pp *piecePicker) isCompleted() bool {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	return pp.numOfCompleted == len(pp.pieces)
+}
+
+func (pp *piecePicker) isPieceCompleted(index int) bool {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	return index >= 0 && index < len(pp.states) && pp.states[index] == completedPiece
+}
+
+// Returns whether each piece has been completed, in piece order.
+func (pp *piecePicker) completedPieces() []bool {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	completed := make([]bool, len(pp.states))
+
+	for index, state := range pp.states {
+		completed[index] = state == completedPiece
+	}
+
+	return completed
+}
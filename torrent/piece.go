@@ -26,6 +26,9 @@ type Piece struct {
 	Index  int
 	Hash   [sha1.Size]byte
 	Length int
+
+	// Index of the file the piece belongs to. Only set for v2 and hybrid torrents, whose pieces never span several files.
+	fileIndex int
 }
 
 type piecesParserResult struct {
@@ -0,0 +1,115 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+The priority of a file decides in which order the pieces of the torrent are downloaded.
+
+The pieces of high priority files are downloaded before the pieces of normal priority files. Skipped files aren't downloaded,
+except for the pieces they share with files that are, so they may still be created on disk with some of their data.
+*/
+type FilePriority int
+
+const (
+	PrioritySkip   FilePriority = -1
+	PriorityNormal FilePriority = 0
+	PriorityHigh   FilePriority = 1
+)
+
+var ErrMetadataUnknown = errors.New("the torrent's metadata isn't known yet")
+
+func (p FilePriority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "unknown"
+	}
+}
+
+// Parses the name of a priority, as returned by `FilePriority.String`.
+func ParseFilePriority(name string) (FilePriority, error) {
+	for _, priority := range []FilePriority{PrioritySkip, PriorityNormal, PriorityHigh} {
+		if priority.String() == name {
+			return priority, nil
+		}
+	}
+
+	return PriorityNormal, fmt.Errorf("unknown file priority '%s'", name)
+}
+
+/*
+Returns the priority of every piece: the highest priority of the files the piece belongs to.
+
+Pieces that only belong to skipped files (or to empty files) are skipped.
+*/
+func piecePriorities(info *torrentInfo, filePriorities []FilePriority) []FilePriority {
+	priorities := make([]FilePriority, len(info.pieces))
+
+	for index := range priorities {
+		priorities[index] = PrioritySkip
+	}
+
+	for index := range info.files {
+		f := &info.files[index]
+
+		if f.Length == 0 {
+			continue
+		}
+
+		for pieceIndex := f.pieceStartIndex; pieceIndex <= f.pieceEndIndex; pieceIndex++ {
+			priorities[pieceIndex] = max(priorities[pieceIndex], filePriorities[index])
+		}
+	}
+
+	return priorities
+}
+
+// Returns the priority of every file, in the order of the torrent's files. Returns `ErrMetadataUnknown` if the torrent's metadata isn't known yet.
+func (t *Torrent) FilePriorities() ([]FilePriority, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.info == nil {
+		return nil, ErrMetadataUnknown
+	}
+
+	return append([]FilePriority{}, t.filePriorities...), nil
+}
+
+/*
+Sets the priority of the file at the index, in the order of the torrent's files. Returns `ErrMetadataUnknown` if the torrent's metadata isn't known yet.
+
+A finished torrent goes back to downloading if a skipped file that wasn't downloaded is wanted again.
+*/
+func (t *Torrent) SetFilePriority(index int, priority FilePriority) error {
+	if priority < PrioritySkip || priority > PriorityHigh {
+		return fmt.Errorf("invalid file priority %d", priority)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.info == nil {
+		return ErrMetadataUnknown
+	}
+
+	if index < 0 || index >= len(t.info.files) {
+		return fmt.Errorf("file index %d is out of range, the torrent has %d files", index, len(t.info.files))
+	}
+
+	t.filePriorities[index] = priority
+
+	if t.download != nil {
+		t.download.picker.setPriorities(piecePriorities(t.info, t.filePriorities))
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package torrent_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+func TestFilePriorities(t *testing.T) {
+	files := []testFile{
+		{path: []any{"a.bin"}, data: randomBytes(t, 2*testPieceLength)},
+		{path: []any{"b.bin"}, data: randomBytes(t, 2*testPieceLength)},
+		{path: []any{"c.bin"}, data: randomBytes(t, testPieceLength)},
+	}
+
+	srcDir := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(srcDir, "priorities"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range files {
+		if err := os.WriteFile(filepath.Join(srcDir, "priorities", f.path[0].(string)), f.data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(srcDir)))
+	defer server.Close()
+
+	trrnt, outputDir := newTestTorrentFile(t, "priorities", files, map[string]any{"url-list": server.URL + "/"})
+
+	if err := trrnt.SetFilePriority(3, torrent.PriorityHigh); err == nil {
+		t.Fatal("expected setting the priority of a file that doesn't exist to fail")
+	}
+
+	if err := trrnt.SetFilePriority(1, torrent.PrioritySkip); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := trrnt.SetFilePriority(2, torrent.PriorityHigh); err != nil {
+		t.Fatal(err)
+	}
+
+	sub := trrnt.Subscribe(0)
+	defer sub.Unsubscribe()
+
+	trrnt.Start()
+
+	firstPiece := -1
+	timeout := time.After(5 * time.Second)
+
+	for firstPiece == -1 {
+		select {
+		case event := <-sub.Events():
+			{
+				if e, ok := event.(torrent.PieceVerified); ok {
+					firstPiece = e.Index
+				}
+			}
+
+		case <-timeout:
+			{
+				t.Fatal("timed out waiting for the first piece")
+			}
+		}
+	}
+
+	if firstPiece != 4 {
+		t.Fatalf("expected the piece of the high priority file to be downloaded first, but piece %d was", firstPiece)
+	}
+
+	waitFor(t, "the torrent to be seeding", trrnt.IsSeeding)
+
+	stats := trrnt.Stats()
+
+	if stats.Files[0].BytesCompleted != len(files[0].data) || stats.Files[1].BytesCompleted != 0 || stats.Files[2].BytesCompleted != len(files[2].data) {
+		t.Fatalf("expected every file but the skipped one to be downloaded, but got %+v", stats.Files)
+	}
+
+	if stats.Files[1].Priority != torrent.PrioritySkip || stats.ETA != 0 {
+		t.Fatalf("expected the skipped file to be reported and the download to be complete, but got %+v", stats)
+	}
+
+	if err := trrnt.SetFilePriority(1, torrent.PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the skipped file to be downloaded", func() bool {
+		stats := trrnt.Stats()
+		return stats.Status == torrent.StatusSeeding && stats.Files[1].BytesCompleted == len(files[1].data)
+	})
+
+	for _, f := range files {
+		assertFileContents(t, filepath.Join(outputDir, "priorities", f.path[0].(string)), f.data)
+	}
+}
+
+func TestFilePrioritiesRequireMetadata(t *testing.T) {
+	trrnt, err := torrent.NewTorrent("magnet:?xt=urn:btih:c9e15763f722f23e98a29decdfae341b98d53056")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := trrnt.SetFilePriority(0, torrent.PrioritySkip); !errors.Is(err, torrent.ErrMetadataUnknown) {
+		t.Fatalf("expected error '%v', but got '%v'", torrent.ErrMetadataUnknown, err)
+	}
+
+	if _, err := torrent.ParseFilePriority("urgent"); err == nil {
+		t.Fatal("expected unknown priorities to be rejected")
+	}
+}
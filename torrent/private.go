@@ -0,0 +1,26 @@
+package torrent
+
+import "errors"
+
+var ErrPrivateTorrent = errors.New("private torrents only use the trackers listed in their metainfo")
+
+// BEP 27: a torrent is private if the info dictionary contains the key-value pair "private=1".
+func isPrivateInfoDict(infoDict map[string]any) bool {
+	private, ok := infoDict["private"].(int)
+
+	return ok && private == 1
+}
+
+/*
+Reports whether the torrent is private (BEP 27).
+
+Private torrents only get peers from the trackers listed in their metainfo: the DHT and peer exchange are disabled,
+and extra trackers are refused. The metadata of torrents created from magnet links is unknown until it has been downloaded,
+so they are reported as public until then.
+*/
+func (t *Torrent) IsPrivate() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.info != nil && t.info.private
+}
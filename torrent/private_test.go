@@ -0,0 +1,77 @@
+package torrent_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MlkMahmud/hail/bencode"
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+func newTorrentFile(t *testing.T, private bool) torrent.Torrent {
+	t.Helper()
+
+	info := map[string]any{"length": 1, "name": "file", "piece length": 16384, "pieces": string(make([]byte, 20))}
+
+	if private {
+		info["private"] = 1
+	}
+
+	metainfo, err := bencode.EncodeValue(map[string]any{"announce": "http://127.0.0.1:1/announce", "info": info})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "file.torrent")
+
+	if err := os.WriteFile(path, []byte(metainfo), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	trrnt, err := torrent.NewTorrent(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return trrnt
+}
+
+func TestPrivateTorrentRefusesExtraTrackers(t *testing.T) {
+	trrnt := newTorrentFile(t, true)
+
+	if !trrnt.IsPrivate() {
+		t.Fatal("expected torrent to be private")
+	}
+
+	if err := trrnt.AddTrackers([]string{"udp://127.0.0.1:2"}); !errors.Is(err, torrent.ErrPrivateTorrent) {
+		t.Errorf("expected extra trackers to be refused, but got %v", err)
+	}
+
+	if results := trrnt.Scrape(); len(results) != 1 || results[0].Tracker != "http://127.0.0.1:1/announce" {
+		t.Errorf("expected only the metainfo tracker to be scraped, but got %+v", results)
+	}
+}
+
+func TestPublicTorrentAcceptsExtraTrackers(t *testing.T) {
+	trrnt := newTorrentFile(t, false)
+
+	if trrnt.IsPrivate() {
+		t.Fatal("expected torrent to be public")
+	}
+
+	if err := trrnt.AddTrackers([]string{"udp://127.0.0.1:2", "http://127.0.0.1:1/announce"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if results := trrnt.Scrape(); len(results) != 2 {
+		t.Errorf("expected the metainfo tracker and 1 extra tracker to be scraped, but got %+v", results)
+	}
+
+	if err := trrnt.AddTrackers([]string{"wss://127.0.0.1:3"}); err == nil {
+		t.Error("expected unsupported tracker URL to be refused")
+	}
+}
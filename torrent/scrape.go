@@ -0,0 +1,275 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/MlkMahmud/hail/bencode"
+)
+
+// The swarm statistics reported by a tracker for a single torrent.
+type ScrapeResult struct {
+	// Number of peers that have completed the download ("downloaded" key of the scrape response).
+	Completed int
+	// Set if the tracker could not be scraped, in which case the other fields are zero.
+	Error    error
+	Leechers int
+	Seeders  int
+	Tracker  string
+}
+
+const udpScrapeResponseSize = 20
+
+/*
+Derives the scrape URL of an HTTP tracker from its announce URL.
+
+By convention, if the last path segment of the announce URL starts with "announce", the scrape URL is obtained by
+replacing "announce" with "scrape", e.g. "http://example.com/x/announce.php" becomes "http://example.com/x/scrape.php".
+Trackers whose announce URL doesn't follow this convention do not support scraping.
+*/
+func getScrapeURL(announceURL string) (string, error) {
+	u, err := url.Parse(announceURL)
+
+	if err != nil {
+		return "", fmt.Errorf("failed to parse tracker URL: %w", err)
+	}
+
+	// The query may contain slashes too, e.g. "?passkey=a/b".
+	index := strings.LastIndex(u.Path, "/")
+
+	if index == -1 || !strings.HasPrefix(u.Path[index+1:], "announce") {
+		return "", fmt.Errorf("tracker '%s' does not support scraping", announceURL)
+	}
+
+	u.Path = u.Path[:index+1] + "scrape" + strings.TrimPrefix(u.Path[index+1:], "announce")
+	u.RawPath = ""
+
+	return u.String(), nil
+}
+
+/*
+Parses the response of an HTTP scrape request:
+
+	d5:filesd20:<info hash>d8:completei<seeders>e10:downloadedi<completed>e10:incompletei<leechers>eeee
+*/
+func parseHTTPScrapeResponse(res []byte) (map[[sha1.Size]byte]ScrapeResult, error) {
+	decodedResponse, _, err := bencode.DecodeValue(res)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode scrape response: %w", err)
+	}
+
+	dict, ok := decodedResponse.(map[string]any)
+
+	if !ok {
+		return nil, fmt.Errorf("decoded response type \"%T\" is invalid", decodedResponse)
+	}
+
+	if failureMsg, ok := dict["failure reason"].(string); ok {
+		return nil, fmt.Errorf("failed to scrape tracker: %s", failureMsg)
+	}
+
+	files, ok := dict["files"].(map[string]any)
+
+	if !ok {
+		return nil, fmt.Errorf("decoded response does not include a valid \"files\" key")
+	}
+
+	results := make(map[[sha1.Size]byte]ScrapeResult)
+
+	for key, value := range files {
+		stats, ok := value.(map[string]any)
+
+		if !ok || len(key) != sha1.Size {
+			return nil, fmt.Errorf("files dictionary contains an invalid entry")
+		}
+
+		result := ScrapeResult{}
+		result.Completed, _ = stats["downloaded"].(int)
+		result.Leechers, _ = stats["incomplete"].(int)
+		result.Seeders, _ = stats["complete"].(int)
+
+		results[[sha1.Size]byte([]byte(key))] = result
+	}
+
+	return results, nil
+}
+
+func sendHTTPScrapeRequest(trackerURL string, infoHash [sha1.Size]byte) (ScrapeResult, error) {
+	scrapeURL, err := getScrapeURL(trackerURL)
+
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+
+	params := url.Values{}
+	params.Add("info_hash", string(infoHash[:]))
+
+	separator := "?"
+
+	if strings.Contains(scrapeURL, "?") {
+		separator = "&"
+	}
+
+	res, err := trackerHTTPClient.Get(scrapeURL + separator + params.Encode())
+
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return ScrapeResult{}, fmt.Errorf("received NON-OK HTTP status code \"%d\"", res.StatusCode)
+	}
+
+	body, err := io.ReadAll(res.Body)
+
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+
+	results, err := parseHTTPScrapeResponse(body)
+
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+
+	result, ok := results[infoHash]
+
+	if !ok {
+		return ScrapeResult{}, fmt.Errorf("tracker did not return statistics for the torrent")
+	}
+
+	return result, nil
+}
+
+/*
+Parses the response of a UDP scrape request:
+
+	Offset  Size            Name            Value
+	0       32-bit integer  action          2 // scrape
+	4       32-bit integer  transaction_id
+	8       32-bit integer  seeders
+	12      32-bit integer  completed
+	16      32-bit integer  leechers
+	20
+*/
+func parseUDPScrapeResponse(response []byte) (ScrapeResult, error) {
+	if receivedSize := len(response); receivedSize < udpScrapeResponseSize {
+		return ScrapeResult{}, fmt.Errorf("'scrape' response should contain at least %d bytes, but received %d", udpScrapeResponseSize, receivedSize)
+	}
+
+	return ScrapeResult{
+		Completed: int(binary.BigEndian.Uint32(response[12:])),
+		Leechers:  int(binary.BigEndian.Uint32(response[16:])),
+		Seeders:   int(binary.BigEndian.Uint32(response[8:])),
+	}, nil
+}
+
+/*
+Sends a scrape request to a UDP tracker.
+
+Scrape request:
+
+	Offset  Size            Name            Value
+	0       64-bit integer  connection_id
+	8       32-bit integer  action          2 // scrape
+	12      32-bit integer  transaction_id
+	16      20-byte string  info_hash
+	36
+*/
+func sendUDPScrapeRequest(trackerUrl string, infoHash [sha1.Size]byte) (ScrapeResult, error) {
+	conn, err := dialUDPTracker(trackerUrl)
+
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+
+	defer conn.Close()
+
+	response, err := conn.send(scrapeActionId, infoHash[:])
+
+	if err != nil {
+		return ScrapeResult{}, fmt.Errorf("'scrape' request failed: %w", err)
+	}
+
+	return parseUDPScrapeResponse(response)
+}
+
+// Asks a tracker for the swarm statistics of a torrent.
+func scrapeTracker(trackerUrl string, infoHash [sha1.Size]byte) (ScrapeResult, error) {
+	parsedURL, err := url.Parse(trackerUrl)
+
+	if err != nil {
+		return ScrapeResult{}, fmt.Errorf("failed to parse tracker URL: %w", err)
+	}
+
+	switch parsedURL.Scheme {
+	case "http", "https":
+		{
+			return sendHTTPScrapeRequest(trackerUrl, infoHash)
+		}
+
+	case "udp":
+		{
+			return sendUDPScrapeRequest(trackerUrl, infoHash)
+		}
+
+	default:
+		{
+			return ScrapeResult{}, fmt.Errorf("tracker URL protocol must be one of 'HTTP' or 'UDP'")
+		}
+	}
+}
+
+// Asks every tracker of the torrent for the number of seeders, leechers and completed downloads in the swarm.
+func (t *Torrent) Scrape() []ScrapeResult {
+	trackerUrls := []string{}
+	private := t.IsPrivate()
+
+	t.mutex.Lock()
+
+	for _, tier := range t.trackerTiers {
+		for _, state := range tier.trackers {
+			if state.extra && private {
+				continue
+			}
+
+			trackerUrls = append(trackerUrls, state.url)
+		}
+	}
+
+	t.mutex.Unlock()
+
+	results := make([]ScrapeResult, len(trackerUrls))
+
+	var wg sync.WaitGroup
+
+	for index, trackerUrl := range trackerUrls {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			result, err := scrapeTracker(trackerUrl, t.infoHash)
+
+			if err != nil {
+				result = ScrapeResult{Error: err}
+			}
+
+			result.Tracker = trackerUrl
+			results[index] = result
+		}()
+	}
+
+	wg.Wait()
+
+	return results
+}
@@ -0,0 +1,172 @@
+package torrent
+
+import (
+	"fmt"
+	"time"
+)
+
+// The cumulative transfer statistics of a torrent over all its runs, which are meant to be saved when it is stopped.
+type TransferHistory struct {
+	Downloaded  int64         `json:"downloaded"`
+	Uploaded    int64         `json:"uploaded"`
+	SeedingTime time.Duration `json:"seedingTime"`
+}
+
+// The conditions under which a finished torrent stops seeding. A goal is disabled if it is 0.
+type SeedingGoals struct {
+	// Share ratio: the number of bytes uploaded divided by the number of bytes downloaded, over all the runs of the torrent.
+	Ratio float64
+	// Total amount of time spent seeding, over all the runs of the torrent.
+	SeedTime time.Duration
+	// Amount of time spent seeding without uploading anything.
+	IdleTime time.Duration
+}
+
+// Interval between checks of the seeding goals.
+var seedingGoalCheckInterval = time.Second
+
+// Reports whether every piece that isn't skipped has been downloaded. The mutex must be held.
+func (tr *Torrent) isComplete() bool {
+	return tr.status == StatusFinished || tr.status == StatusSeeding
+}
+
+// Moves the torrent to a new status, keeping track of the time spent seeding. The mutex must be held.
+func (tr *Torrent) setStatus(status TorrentStatus) {
+	now := time.Now()
+
+	if tr.status == StatusSeeding && status != StatusSeeding {
+		tr.history.SeedingTime += now.Sub(tr.seedingSince)
+		tr.seedingSince = time.Time{}
+	}
+
+	if status == StatusSeeding && tr.status != StatusSeeding {
+		tr.seedingSince = now
+	}
+
+	if status != tr.status {
+		tr.events.publish(StateChanged{EventBase: tr.newEventBase(), From: tr.status, To: status})
+	}
+
+	tr.status = status
+}
+
+// Returns the transfer history, including the current run. The mutex must be held.
+func (tr *Torrent) transferHistory(now time.Time) TransferHistory {
+	history := tr.history
+	history.Downloaded += tr.counters.downloaded.Load()
+	history.Uploaded += tr.counters.uploaded.Load()
+
+	if tr.status == StatusSeeding {
+		history.SeedingTime += now.Sub(tr.seedingSince)
+	}
+
+	return history
+}
+
+/*
+Sets the transfer history of the previous runs of the torrent, which counts towards its seeding goals.
+
+Must be called before `Start`.
+*/
+func (t *Torrent) SetTransferHistory(history TransferHistory) {
+	t.history = history
+}
+
+// Returns the transfer history of the torrent, including the current run.
+func (t *Torrent) TransferHistory() TransferHistory {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.transferHistory(time.Now())
+}
+
+// Sets the conditions under which the torrent stops seeding. The torrent is paused once any of them is met.
+func (t *Torrent) SetSeedingGoals(goals SeedingGoals) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.seedingGoals = goals
+}
+
+/*
+Reports whether the torrent reached one of its seeding goals.
+
+The goals are only checked once: a torrent that reached a goal and is resumed seeds until it is paused again.
+*/
+func (t *Torrent) HasReachedSeedingGoal() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.seedingGoalReached
+}
+
+// Returns a description of the seeding goal the torrent reached, or an empty string if none was reached. The mutex must be held.
+func (tr *Torrent) reachedSeedingGoal(now time.Time) string {
+	goals := tr.seedingGoals
+	history := tr.transferHistory(now)
+
+	if goals.Ratio > 0 {
+		downloaded := history.Downloaded
+
+		// Torrents that were already complete when they were added haven't downloaded anything.
+		if downloaded == 0 {
+			downloaded = int64(tr.info.length)
+		}
+
+		if ratio := float64(history.Uploaded) / float64(max(downloaded, 1)); ratio >= goals.Ratio {
+			return fmt.Sprintf("share ratio of %.2f", ratio)
+		}
+	}
+
+	if goals.SeedTime > 0 && history.SeedingTime >= goals.SeedTime {
+		return fmt.Sprintf("seeding time of %s", goals.SeedTime)
+	}
+
+	idleSince := tr.seedingSince
+
+	if tr.lastUpload.After(idleSince) {
+		idleSince = tr.lastUpload
+	}
+
+	if goals.IdleTime > 0 && now.Sub(idleSince) >= goals.IdleTime {
+		return fmt.Sprintf("no upload for %s", goals.IdleTime)
+	}
+
+	return ""
+}
+
+// Pauses the torrent once it reaches one of its seeding goals, checked every `interval`.
+func (tr *Torrent) startSeedingGoalMonitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-tr.ctx.Done():
+			{
+				return
+			}
+
+		case <-ticker.C:
+			{
+				tr.mutex.Lock()
+
+				if tr.status != StatusSeeding || tr.seedingGoalReached {
+					tr.mutex.Unlock()
+					continue
+				}
+
+				goal := tr.reachedSeedingGoal(time.Now())
+				tr.seedingGoalReached = goal != ""
+				tr.mutex.Unlock()
+
+				if goal != "" {
+					tr.logger.Info("torrent reached its seeding goal, pausing", "goal", goal)
+					tr.Pause()
+
+					return
+				}
+			}
+		}
+	}
+}
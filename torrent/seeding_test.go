@@ -0,0 +1,195 @@
+package torrent_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+// Starts a torrent that downloads its data from a web seed, and waits until it seeds.
+func newSeedingTorrent(t *testing.T, data []byte, configure func(trrnt *torrent.Torrent)) *torrent.Torrent {
+	t.Helper()
+
+	srcDir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(srcDir, "seed.bin"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(srcDir)))
+	t.Cleanup(server.Close)
+
+	trrnt, _ := newTestTorrentFile(t, "seed.bin", []testFile{{data: data}}, map[string]any{"url-list": server.URL + "/"})
+
+	if configure != nil {
+		configure(&trrnt)
+	}
+
+	trrnt.Start()
+
+	waitFor(t, "the torrent to be finished", func() bool { return trrnt.IsFinished() })
+
+	return &trrnt
+}
+
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServesPiecesToPeers(t *testing.T) {
+	data := randomBytes(t, 2*testPieceLength+500)
+	trrnt := newSeedingTorrent(t, data, nil)
+
+	if !trrnt.IsSeeding() {
+		t.Fatal("expected finished torrent to be seeding")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			trrnt.HandleIncomingConnection(conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	infoHash := trrnt.InfoHash()
+	handshake := append([]byte{19}, "BitTorrent protocol"...)
+	handshake = append(handshake, make([]byte, 8)...)
+	handshake = append(handshake, infoHash[:]...)
+	handshake = append(handshake, "-TS0001-000000000000"...)
+
+	if _, err := conn.Write(handshake); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(conn, make([]byte, len(handshake))); err != nil {
+		t.Fatal(err)
+	}
+
+	if id, payload := readPeerMessage(t, conn); id != torrent.Bitfield || !bytes.Equal(payload, []byte{0b11100000}) {
+		t.Fatalf("expected 'Bitfield' message advertising every piece, but got message %d with payload %08b", id, payload)
+	}
+
+	writePeerMessage(t, conn, torrent.Interested, nil)
+
+	if id, _ := readPeerMessage(t, conn); id != torrent.Unchoke {
+		t.Fatalf("expected 'Unchoke' message, but got message %d", id)
+	}
+
+	request := binary.BigEndian.AppendUint32(nil, 1)
+	request = binary.BigEndian.AppendUint32(request, 100)
+	request = binary.BigEndian.AppendUint32(request, 1000)
+	writePeerMessage(t, conn, torrent.Request, request)
+
+	id, payload := readPeerMessage(t, conn)
+
+	if id != torrent.PieceMessageId || !bytes.Equal(payload[:8], request[:8]) {
+		t.Fatalf("expected 'Piece' message for block 100 of piece 1, but got message %d with header %v", id, payload[:min(len(payload), 8)])
+	}
+
+	if expected := data[testPieceLength+100 : testPieceLength+1100]; !bytes.Equal(payload[8:], expected) {
+		t.Fatal("block sent to the peer does not match the torrent's data")
+	}
+
+	waitFor(t, "the upload to be recorded", func() bool { return trrnt.TransferHistory().Uploaded == 1000 })
+}
+
+func TestSeedingGoals(t *testing.T) {
+	defer torrent.SetSeedingGoalCheckInterval(10 * time.Millisecond)()
+
+	data := randomBytes(t, testPieceLength+500)
+
+	tests := []struct {
+		name    string
+		history torrent.TransferHistory
+		goals   torrent.SeedingGoals
+	}{
+		{name: "ratio", history: torrent.TransferHistory{Uploaded: int64(2 * len(data))}, goals: torrent.SeedingGoals{Ratio: 1.5}},
+		{name: "seed time", history: torrent.TransferHistory{SeedingTime: time.Hour}, goals: torrent.SeedingGoals{SeedTime: time.Hour}},
+		{name: "idle time", goals: torrent.SeedingGoals{IdleTime: 50 * time.Millisecond}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trrnt := newSeedingTorrent(t, data, func(trrnt *torrent.Torrent) {
+				trrnt.SetTransferHistory(test.history)
+				trrnt.SetSeedingGoals(test.goals)
+			})
+
+			waitFor(t, "the seeding goal to be reached", func() bool { return trrnt.HasReachedSeedingGoal() && trrnt.IsPaused() })
+
+			if trrnt.IsSeeding() {
+				t.Fatal("expected torrent that reached its seeding goal to stop seeding")
+			}
+
+			history := trrnt.TransferHistory()
+
+			if history.Downloaded != test.history.Downloaded+int64(len(data)) || history.SeedingTime < test.history.SeedingTime {
+				t.Fatalf("expected the transfer history to include the previous runs, but got %+v", history)
+			}
+		})
+	}
+
+	t.Run("not reached", func(t *testing.T) {
+		trrnt := newSeedingTorrent(t, data, func(trrnt *torrent.Torrent) {
+			trrnt.SetSeedingGoals(torrent.SeedingGoals{Ratio: 1, SeedTime: time.Hour, IdleTime: time.Hour})
+		})
+
+		time.Sleep(100 * time.Millisecond)
+
+		if trrnt.HasReachedSeedingGoal() || !trrnt.IsSeeding() {
+			t.Fatal("expected torrent to keep seeding until it reaches a goal")
+		}
+	})
+}
+
+func TestSeedsExistingDataAfterRestart(t *testing.T) {
+	data := randomBytes(t, 2*testPieceLength+500)
+	outputDir := t.TempDir()
+
+	newSeedingTorrent(t, data, func(trrnt *torrent.Torrent) { trrnt.SetOutputDir(outputDir) }).Stop()
+
+	// The restarted torrent has no source to download from: every piece must be found in the download directory.
+	restarted, _ := newTestTorrentFile(t, "seed.bin", []testFile{{data: data}}, map[string]any{"announce": "http://127.0.0.1:1/announce"})
+	restarted.SetOutputDir(outputDir)
+	restarted.Start()
+
+	waitFor(t, "the restarted torrent to be seeding", restarted.IsSeeding)
+
+	if stats := restarted.Stats(); stats.Downloaded != 0 || stats.PiecesCompleted != stats.NumOfPieces {
+		t.Fatalf("expected every piece to be found without being downloaded, but got %d bytes downloaded and %d/%d pieces", stats.Downloaded, stats.PiecesCompleted, stats.NumOfPieces)
+	}
+}
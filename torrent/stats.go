@@ -0,0 +1,333 @@
+package torrent
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A snapshot of the activity of a torrent, see `Torrent.Stats`.
+type Stats struct {
+	Status TorrentStatus
+
+	// Number of bytes of verified pieces downloaded, and of blocks uploaded, since the torrent was created.
+	Downloaded int64
+	Uploaded   int64
+	// Number of bytes of pieces that were discarded because they failed hash verification.
+	Wasted int64
+	// Transfer rates in bytes per second, smoothed over the last few seconds.
+	DownloadRate float64
+	UploadRate   float64
+	// Estimated time until the download of the files that aren't skipped completes. Zero once it is complete, and `UnknownETA` if nothing is being downloaded or the torrent's size isn't known yet.
+	ETA time.Duration
+
+	PiecesCompleted int
+	// Zero until the torrent's metadata is known.
+	NumOfPieces int
+
+	ConnectedPeers int
+	// Number of peers we know of, connected or not.
+	KnownPeers int
+	// Number of peers we failed to connect to.
+	FailingPeers int
+
+	Peers    []PeerStats
+	Trackers []TrackerStats
+	// Empty until the torrent's metadata is known.
+	Files []FileStats
+}
+
+// A snapshot of the activity of a connected peer.
+type PeerStats struct {
+	Address string
+	// Name and version of the peer's client, derived from its peer Id. Empty if the client is unknown.
+	Client string
+	// Transfer rates in bytes per second, smoothed over the last few seconds.
+	DownloadRate float64
+	UploadRate   float64
+
+	// Set while we don't let the peer request blocks.
+	AmChoking bool
+	// Set once we told the peer we want its pieces.
+	AmInterested bool
+	// Set until the peer lets us request blocks.
+	PeerChoking bool
+	// Set while the peer wants our pieces.
+	PeerInterested bool
+
+	// Number of block requests sent to the peer that it hasn't answered yet.
+	OutstandingRequests int
+	// Number of pieces the peer has.
+	PiecesAvailable int
+}
+
+// The progress of one of the torrent's files.
+type FileStats struct {
+	// Path of the file, relative to the download directory.
+	Path   string
+	Length int
+	// Number of bytes of the file covered by verified pieces.
+	BytesCompleted int
+	Priority       FilePriority
+}
+
+// The status of one of the torrent's trackers.
+type TrackerStats struct {
+	URL string
+	// Index of the tracker's tier in the announce list.
+	Tier int
+
+	// Zero until the tracker has been announced to.
+	LastAnnounce time.Time
+	// Time of the next regular announcement of the tracker's announce group. Zero until the torrent has started.
+	NextAnnounce time.Time
+	// Error of the most recent announcement, empty if it succeeded.
+	LastError string
+
+	// Numbers of seeders and leechers reported in the tracker's most recent response.
+	Seeders  int
+	Leechers int
+}
+
+// Measures a transfer rate, smoothed with an exponential moving average.
+type rateMeter struct {
+	mutex *sync.Mutex
+	// Rate in bytes per second as of `lastSample`.
+	rate float64
+	// Number of bytes transferred since `lastSample`.
+	pending    int64
+	lastSample time.Time
+}
+
+// Reported as the ETA of torrents whose download isn't progressing.
+const UnknownETA time.Duration = -1
+
+// Period over which transfer rates are smoothed.
+const rateSmoothingPeriod = 5 * time.Second
+
+// Names of the clients identified by the first two characters of Azureus-style peer Ids.
+var clientNames = map[string]string{
+	"AZ": "Vuze",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"HL": "hail",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "rTorrent",
+	"qB": "qBittorrent",
+	"TR": "Transmission",
+	"UT": "µTorrent",
+	"WW": "WebTorrent",
+}
+
+func newRateMeter() *rateMeter {
+	var mutex sync.Mutex
+
+	return &rateMeter{mutex: &mutex, lastSample: time.Now()}
+}
+
+func (m *rateMeter) add(n int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.pending += int64(n)
+}
+
+// Returns the rate in bytes per second. The bytes added since the previous sample weigh according to the time elapsed since then.
+func (m *rateMeter) sample(now time.Time) float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	elapsed := now.Sub(m.lastSample).Seconds()
+
+	if elapsed <= 0 {
+		return m.rate
+	}
+
+	weight := 1 - math.Exp(-elapsed/rateSmoothingPeriod.Seconds())
+	m.rate += weight * (float64(m.pending)/elapsed - m.rate)
+	m.pending = 0
+	m.lastSample = now
+
+	return m.rate
+}
+
+/*
+Returns the name and version of the client that generated a peer Id, e.g "qBittorrent 4.6.2" for "-qB4620-...".
+
+Only Azureus-style peer Ids are recognized. Returns an empty string for other peer Ids.
+*/
+func clientName(peerId string) string {
+	if len(peerId) < 8 || peerId[0] != '-' || peerId[7] != '-' {
+		return ""
+	}
+
+	name, ok := clientNames[peerId[1:3]]
+
+	if !ok {
+		name = peerId[1:3]
+	}
+
+	version := strings.Split(strings.TrimRight(peerId[3:7], "0"), "")
+
+	if len(version) == 0 {
+		version = []string{"0"}
+	}
+
+	return name + " " + strings.Join(version, ".")
+}
+
+func (p *PeerConnection) stats(now time.Time) PeerStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	piecesAvailable := 0
+
+	for _, available := range p.availablePieces {
+		if available {
+			piecesAvailable += 1
+		}
+	}
+
+	return PeerStats{
+		Address:             p.PeerAddress,
+		Client:              clientName(p.PeerId),
+		DownloadRate:        p.downloadMeter.sample(now),
+		UploadRate:          p.uploadMeter.sample(now),
+		AmChoking:           !p.unchokedPeer,
+		AmInterested:        p.amInterested,
+		PeerChoking:         !p.Unchoked,
+		PeerInterested:      p.peerInterested,
+		OutstandingRequests: p.pendingRequests,
+		PiecesAvailable:     piecesAvailable,
+	}
+}
+
+// Returns a snapshot of the torrent's activity: transfer totals and rates, progress, and the status of its peers and trackers.
+func (t *Torrent) Stats() Stats {
+	now := time.Now()
+
+	t.mutex.Lock()
+
+	stats := Stats{
+		Status:         t.status,
+		Downloaded:     t.counters.downloaded.Load(),
+		Uploaded:       t.counters.uploaded.Load(),
+		Wasted:         t.counters.wasted.Load(),
+		DownloadRate:   t.downloadMeter.sample(now),
+		UploadRate:     t.uploadMeter.sample(now),
+		ETA:            UnknownETA,
+		ConnectedPeers: len(t.peerConnections),
+		KnownPeers:     len(t.peerConnections),
+		FailingPeers:   len(t.failingPeers),
+		Peers:          []PeerStats{},
+		Trackers:       []TrackerStats{},
+		Files:          []FileStats{},
+	}
+
+	for address := range t.peers {
+		if _, ok := t.peerConnections[address]; !ok {
+			stats.KnownPeers += 1
+		}
+	}
+
+	peerConnections := make([]*PeerConnection, 0, len(t.peerConnections))
+
+	for _, peerConnection := range t.peerConnections {
+		peerConnections = append(peerConnections, peerConnection)
+	}
+
+	// The next announcement of every tracker is the one of its announce group.
+	nextAnnounces := map[*trackerTier]time.Time{}
+
+	for _, group := range t.announceGroups {
+		for _, tier := range group.tiers {
+			nextAnnounces[tier] = group.nextAnnounce
+		}
+	}
+
+	for index, tier := range t.trackerTiers {
+		for _, state := range tier.trackers {
+			trackerStats := TrackerStats{
+				URL:          state.url,
+				Tier:         index,
+				LastAnnounce: state.lastAnnounce,
+				NextAnnounce: nextAnnounces[tier],
+				Seeders:      state.seeders,
+				Leechers:     state.leechers,
+			}
+
+			if state.lastError != nil {
+				trackerStats.LastError = state.lastError.Error()
+			}
+
+			stats.Trackers = append(stats.Trackers, trackerStats)
+		}
+	}
+
+	info, dl := t.info, t.download
+	filePriorities := append([]FilePriority{}, t.filePriorities...)
+
+	t.mutex.Unlock()
+
+	for _, peerConnection := range peerConnections {
+		stats.Peers = append(stats.Peers, peerConnection.stats(now))
+	}
+
+	if info == nil {
+		return stats
+	}
+
+	stats.NumOfPieces = len(info.pieces)
+	completedPieces := make([]bool, len(info.pieces))
+
+	if dl != nil {
+		completedPieces = dl.picker.completedPieces()
+	}
+
+	for _, completed := range completedPieces {
+		if completed {
+			stats.PiecesCompleted += 1
+		}
+	}
+
+	for index := range info.files {
+		f := &info.files[index]
+		fileStats := FileStats{Path: f.Name, Length: f.Length, Priority: filePriorities[index]}
+
+		for pieceIndex := f.pieceStartIndex; f.Length > 0 && pieceIndex <= f.pieceEndIndex; pieceIndex++ {
+			if !completedPieces[pieceIndex] {
+				continue
+			}
+
+			pieceStart := pieceIndex * info.pieceLength
+			pieceEnd := pieceStart + info.pieces[pieceIndex].Length
+			fileStats.BytesCompleted += min(pieceEnd, f.Offset+f.Length) - max(pieceStart, f.Offset)
+		}
+
+		stats.Files = append(stats.Files, fileStats)
+	}
+
+	left := max(int64(info.length)-t.counters.verified.Load(), 0)
+
+	// Skipped files aren't downloaded.
+	if dl != nil {
+		left = dl.picker.bytesLeft()
+	}
+
+	switch {
+	case left == 0:
+		{
+			stats.ETA = 0
+		}
+
+	case stats.DownloadRate > 0:
+		{
+			stats.ETA = time.Duration(float64(left) / stats.DownloadRate * float64(time.Second))
+		}
+	}
+
+	return stats
+}
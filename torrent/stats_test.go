@@ -0,0 +1,124 @@
+package torrent_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+func TestStats(t *testing.T) {
+	data := randomBytes(t, 3*testPieceLength)
+	srcDir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(srcDir, "stats.bin"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(srcDir)))
+	defer server.Close()
+
+	trrnt, _ := newTestTorrentFile(t, "stats.bin", []testFile{{data: data}}, map[string]any{
+		"announce": "http://127.0.0.1:1/announce",
+		"url-list": server.URL + "/",
+	})
+
+	if stats := trrnt.Stats(); stats.NumOfPieces != 3 || stats.PiecesCompleted != 0 || stats.ETA != torrent.UnknownETA {
+		t.Fatalf("expected 0 of 3 pieces and an unknown ETA before the torrent starts, but got %+v", stats)
+	}
+
+	trrnt.Start()
+
+	waitFor(t, "the torrent to be seeding", trrnt.IsSeeding)
+	waitFor(t, "the tracker to fail", func() bool {
+		trackers := trrnt.Stats().Trackers
+		return len(trackers) == 1 && trackers[0].LastError != ""
+	})
+
+	stats := trrnt.Stats()
+
+	if stats.Status != torrent.StatusSeeding || stats.PiecesCompleted != 3 || stats.Downloaded != int64(len(data)) || stats.ETA != 0 {
+		t.Fatalf("expected every piece to be downloaded, but got %+v", stats)
+	}
+
+	if len(stats.Files) != 1 || stats.Files[0].Path != "stats.bin" || stats.Files[0].BytesCompleted != len(data) {
+		t.Fatalf("expected the file to be completed, but got %+v", stats.Files)
+	}
+
+	if stats.DownloadRate <= 0 {
+		t.Fatalf("expected a positive download rate right after downloading, but got %f", stats.DownloadRate)
+	}
+
+	if tracker := stats.Trackers[0]; tracker.URL != "http://127.0.0.1:1/announce" || tracker.LastAnnounce.IsZero() || tracker.NextAnnounce.Before(tracker.LastAnnounce) {
+		t.Fatalf("expected the status of the failing tracker, but got %+v", tracker)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			trrnt.HandleIncomingConnection(conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	infoHash := trrnt.InfoHash()
+	handshake := append([]byte{19}, "BitTorrent protocol"...)
+	handshake = append(handshake, make([]byte, 8)...)
+	handshake = append(handshake, infoHash[:]...)
+	handshake = append(handshake, "-qB4620-000000000000"...)
+
+	if _, err := conn.Write(handshake); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(conn, make([]byte, len(handshake))); err != nil {
+		t.Fatal(err)
+	}
+
+	readPeerMessage(t, conn)
+	writePeerMessage(t, conn, torrent.Interested, nil)
+
+	if id, _ := readPeerMessage(t, conn); id != torrent.Unchoke {
+		t.Fatalf("expected 'Unchoke' message, but got message %d", id)
+	}
+
+	request := binary.BigEndian.AppendUint32(nil, 0)
+	request = binary.BigEndian.AppendUint32(request, 0)
+	request = binary.BigEndian.AppendUint32(request, 1000)
+	writePeerMessage(t, conn, torrent.Request, request)
+	readPeerMessage(t, conn)
+
+	waitFor(t, "the upload to be recorded", func() bool { return trrnt.Stats().Uploaded == 1000 })
+
+	stats = trrnt.Stats()
+
+	if stats.ConnectedPeers != 1 || len(stats.Peers) != 1 {
+		t.Fatalf("expected a single connected peer, but got %+v", stats)
+	}
+
+	peer := stats.Peers[0]
+
+	if peer.Client != "qBittorrent 4.6.2" || !peer.PeerInterested || peer.AmChoking || peer.UploadRate <= 0 {
+		t.Fatalf("expected an interested and unchoked qBittorrent peer we upload to, but got %+v", peer)
+	}
+}
@@ -0,0 +1,244 @@
+package torrent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Writes verified pieces to the torrent's files in the download directory.
+type storage struct {
+	dir   string
+	info  *torrentInfo
+	mutex *sync.Mutex
+}
+
+// A section of a file covered by a byte range of the torrent's data.
+type fileSection struct {
+	file *file
+	// Offset of the section within the file.
+	offset int
+	length int
+}
+
+func newStorage(dir string, info *torrentInfo) *storage {
+	var mutex sync.Mutex
+
+	return &storage{dir: dir, info: info, mutex: &mutex}
+}
+
+// Returns the sections of the files covered by `length` bytes starting at `offset` in the torrent's data, in order.
+func (info *torrentInfo) fileSections(offset int, length int) []fileSection {
+	sections := []fileSection{}
+	end := offset + length
+
+	for index := range info.files {
+		f := &info.files[index]
+		fileEnd := f.Offset + f.Length
+
+		if fileEnd <= offset || f.Offset >= end || f.Length == 0 {
+			continue
+		}
+
+		sectionStart := max(offset, f.Offset)
+		sectionEnd := min(end, fileEnd)
+
+		sections = append(sections, fileSection{file: f, offset: sectionStart - f.Offset, length: sectionEnd - sectionStart})
+	}
+
+	return sections
+}
+
+// Returns the files covered by a piece, along with the section of each file.
+func (info *torrentInfo) pieceSections(piece Piece) []fileSection {
+	return info.fileSections(piece.Index*info.pieceLength, piece.Length)
+}
+
+func (s *storage) writePiece(piece Piece, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pieceOffset := piece.Index * s.info.pieceLength
+
+	for _, section := range s.info.pieceSections(piece) {
+		path := filepath.Join(s.dir, section.file.Name)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return fmt.Errorf("failed to create directory for file '%s': %w", section.file.Name, err)
+		}
+
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0o666)
+
+		if err != nil {
+			return fmt.Errorf("failed to open file '%s': %w", section.file.Name, err)
+		}
+
+		// The data of padding files sits between the sections and is skipped.
+		start := section.file.Offset + section.offset - pieceOffset
+		_, err = f.WriteAt(data[start:start+section.length], int64(section.offset))
+		closeErr := f.Close()
+
+		if err == nil {
+			err = closeErr
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to write piece %d to file '%s': %w", piece.Index, section.file.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Reads `length` bytes of a piece starting at `begin`. The data of padding files is read as zeros.
+func (s *storage) readBlock(piece Piece, begin int, length int) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data := make([]byte, length)
+	blockOffset := piece.Index*s.info.pieceLength + begin
+
+	for _, section := range s.info.fileSections(blockOffset, length) {
+		f, err := os.Open(filepath.Join(s.dir, section.file.Name))
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file '%s': %w", section.file.Name, err)
+		}
+
+		start := section.file.Offset + section.offset - blockOffset
+		_, err = f.ReadAt(data[start:start+section.length], int64(section.offset))
+		f.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read piece %d from file '%s': %w", piece.Index, section.file.Name, err)
+		}
+	}
+
+	return data, nil
+}
+
+/*
+Creates the files that don't contain any data (empty files and symbolic links) and applies the attributes of the torrent's files (BEP 47).
+
+Called once every piece has been written.
+*/
+func (s *storage) finalize() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// The targets of symbolic links are relative to the torrent's root directory.
+	rootDir := s.dir
+
+	if s.info.isMultiFile {
+		rootDir = filepath.Join(s.dir, s.info.name)
+	}
+
+	for index := range s.info.files {
+		f := &s.info.files[index]
+		path := filepath.Join(s.dir, f.Name)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return fmt.Errorf("failed to create directory for file '%s': %w", f.Name, err)
+		}
+
+		if f.attributes.symlinkPath != "" {
+			target, err := filepath.Rel(filepath.Dir(path), filepath.Join(rootDir, f.attributes.symlinkPath))
+
+			if err == nil {
+				os.Remove(path)
+				err = os.Symlink(target, path)
+			}
+
+			if err != nil {
+				return fmt.Errorf("failed to create symbolic link '%s': %w", f.Name, err)
+			}
+
+			continue
+		}
+
+		if f.Length == 0 {
+			emptyFile, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0o666)
+
+			if err != nil {
+				return fmt.Errorf("failed to create file '%s': %w", f.Name, err)
+			}
+
+			emptyFile.Close()
+		}
+
+		if f.attributes.executable {
+			info, err := os.Stat(path)
+
+			if err == nil {
+				// Files are made executable by whoever can read them.
+				mode := info.Mode().Perm()
+				err = os.Chmod(path, mode|(mode&0o444)>>2)
+			}
+
+			if err != nil {
+				return fmt.Errorf("failed to make file '%s' executable: %w", f.Name, err)
+			}
+		}
+
+		if f.attributes.hidden {
+			if err := setHidden(path); err != nil {
+				return fmt.Errorf("failed to hide file '%s': %w", f.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+Deletes the torrent's files from the download directory, along with the directories that are left empty.
+
+Does nothing if the torrent has no download directory or if its metadata is unknown.
+*/
+func (t *Torrent) DeleteData() error {
+	t.mutex.Lock()
+	info, dir, dl := t.info, t.outputDir, t.download
+	t.mutex.Unlock()
+
+	if info == nil || dir == "" {
+		return nil
+	}
+
+	// Waits for pieces that are being written.
+	if dl != nil {
+		dl.storage.mutex.Lock()
+		defer dl.storage.mutex.Unlock()
+	}
+
+	dirs := []string{}
+
+	for _, f := range info.files {
+		path := filepath.Join(dir, f.Name)
+
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete file '%s': %w", f.Name, err)
+		}
+
+		for parent := filepath.Dir(f.Name); parent != "."; parent = filepath.Dir(parent) {
+			dirs = append(dirs, parent)
+		}
+	}
+
+	// Nested directories are removed before their parents. Directories that contain other files are kept.
+	slices.SortFunc(dirs, func(a string, b string) int {
+		if len(a) != len(b) {
+			return len(b) - len(a)
+		}
+
+		return strings.Compare(a, b)
+	})
+
+	for _, parent := range slices.Compact(dirs) {
+		os.Remove(filepath.Join(dir, parent))
+	}
+
+	return nil
+}
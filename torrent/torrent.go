@@ -1,53 +1,102 @@
 package torrent
 
 import (
-	"bytes"
 	"context"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"log/slog"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
-	"os/signal"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/MlkMahmud/hail/bencode"
+	"github.com/MlkMahmud/hail/dht"
+	"github.com/MlkMahmud/hail/logging"
 	"github.com/MlkMahmud/hail/utils"
 )
 
+// The attributes of a file (BEP 47), applied once the torrent has been downloaded.
+type fileAttributes struct {
+	executable bool
+	hidden     bool
+	// Target of a symbolic link, relative to the torrent's root directory. Empty for regular files.
+	symlinkPath string
+}
+
 type file struct {
 	torrent *Torrent
 
 	Length int
-	Name   string
+	// Path of the file, relative to the download directory. The path of files in multi-file torrents starts with the torrent's name.
+	Name string
+	// Position of the file's first byte in the torrent's data (the concatenation of every file, including padding files).
 	Offset int
 
+	attributes fileAttributes
+
 	pieceEndIndex   int
 	pieceStartIndex int
+	// The root of the file's merkle tree (BitTorrent v2).
+	piecesRoot merkleHash
 }
 
 type torrentInfo struct {
-	files  []file
-	length int
-	name   string
-	pieces []Piece
+	files []file
+	// Set for multi-file torrents, whose files are stored in a directory named after the torrent.
+	isMultiFile bool
+	length      int
+	// Set for hybrid torrents (BEP 52), whose pieces have both a SHA-1 hash and a merkle tree hash.
+	hybrid bool
+	// 2 for BitTorrent v2 and hybrid torrents (BEP 52), whose pieces are verified with the merkle trees of their files.
+	metaVersion int
+	name        string
+	pieceLength int
+	pieceLayers *pieceLayerStore
+	pieces      []Piece
+	private     bool
 }
 
-type torrentStatus int
+type TorrentStatus int
+
+const (
+	// Port advertised to trackers and DHT nodes, unless set with `SetListenPort`.
+	defaultListenPort = 6881
+	// Maximum number of peer connections of a torrent, unless set with `SetMaxPeerConnections`.
+	defaultMaxPeerConnections = 10
 
+	dhtAnnounceInterval = 5 * time.Minute
+
+	peerIdPrefix = "-HL0001-"
+)
+
+/*
+A torrent is connecting until its metadata is known, then downloading until every piece has been downloaded.
+Once finished, it is seeding while it runs and finished while it is paused or stopped.
+*/
 const (
-	connecting torrentStatus = iota
-	downloading
-	finished
-	seeding
+	StatusConnecting TorrentStatus = iota
+	StatusDownloading
+	StatusFinished
+	StatusSeeding
 )
 
 type Torrent struct {
-	info     *torrentInfo
+	info *torrentInfo
+	// The info hash sent to trackers, DHT nodes and peers. For v2 torrents, this is the SHA-256 info hash truncated to 20 bytes.
+	// Hybrid torrents use their SHA-1 info hash.
 	infoHash [sha1.Size]byte
+	// The SHA-256 hash of the info dictionary of v2 and hybrid torrents, zero for v1 torrents.
+	infoHashV2 [sha256.Size]byte
+	// The bencoded info dictionary, served to peers that request it.
+	metadata []byte
 
 	ctx        context.Context
 	cancelFunc context.CancelFunc
@@ -55,20 +104,126 @@ type Torrent struct {
 	metadataDownloaderCtx      context.Context
 	metadataDownloadCancelFunc context.CancelFunc
 
-	bannedPeers        utils.Set
+	// Peers are banned by IP address, since the port of incoming connections changes every time they connect.
+	bannedPeers        map[netip.Addr]struct{}
 	bannedPeersCh      chan string
 	failingPeers       map[string]Peer
 	incomingPeersCh    chan []Peer
 	maxPeerConnections int
-	metadataPeersCh    chan PeerConnection
-	peerConnections    map[string]PeerConnection
+	metadataPeersCh    chan *PeerConnection
+	peerConnections    map[string]*PeerConnection
 	peers              map[string]Peer
 
-	failingTrackers utils.Set
-	trackers        utils.Set
+	mutex *sync.Mutex
+
+	// Announce to every tier of the announce list instead of stopping at the first tracker that responds.
+	announceToAllTiers bool
+	trackerTiers       []*trackerTier
+
+	counters *transferCounters
+	// Measure the transfer rates reported in the torrent's stats.
+	downloadMeter *rateMeter
+	uploadMeter   *rateMeter
+	// Our peer Id, sent to trackers and peers for the lifetime of the torrent.
+	peerId [20]byte
+	// Random value sent to trackers so they can identify us if our IP address changes.
+	trackerKey uint32
+	// Port advertised to trackers and DHT nodes, on which peers can connect to us.
+	listenPort uint16
+
+	// Limit the connections and bandwidth shared with other torrents. Nothing is limited if they aren't set.
+	connectionLimiter *ConnectionLimiter
+	downloadLimiter   *RateLimiter
+	uploadLimiter     *RateLimiter
+
+	dht *dht.DHT
+	// "host:port" addresses of DHT nodes included in the metainfo file.
+	dhtNodes []string
+
+	// Directory the torrent's files are downloaded to. Pieces are only downloaded if it is set.
+	outputDir string
+	// Set once the metadata is known and the download has started.
+	download *pieceDownload
+	webSeeds []*webSeed
+	// The priority of every file, set once the metadata is known. See `SetFilePriority`.
+	filePriorities []FilePriority
+
+	status   TorrentStatus
+	statusCh chan TorrentStatus
+	// The bus the torrent publishes its events on, see `UseEventBus`.
+	events *EventBus
+	// Nothing is recorded if nil, see `UseMetrics`.
+	metrics *Metrics
+	// Loggers of the torrent and of its peer connections, trackers and web seeds, see `SetLogger`.
+	logger        *slog.Logger
+	peerLogger    *slog.Logger
+	trackerLogger *slog.Logger
+	webSeedLogger *slog.Logger
+
+	// Transfer history of the previous runs of the torrent, plus the time spent seeding in this run before the last pause.
+	history TransferHistory
+	// Time the torrent started seeding, zero while it isn't seeding.
+	seedingSince time.Time
+	lastUpload   time.Time
+	seedingGoals SeedingGoals
+	// Set once a seeding goal has been reached.
+	seedingGoalReached bool
+
+	// Set while the torrent is paused. `resumedCh` is closed when it is resumed.
+	paused    bool
+	resumedCh chan struct{}
+	// The announce groups of the torrent's trackers, set once the announcer has started.
+	announceGroups []*announceGroup
+}
+
+/*
+Generates a peer Id using the Azureus-style convention: the client Id and version
+enclosed in dashes, followed by random characters.
+*/
+func GeneratePeerId() [20]byte {
+	var peerId [20]byte
+	prefix := copy(peerId[:], peerIdPrefix)
+	copy(peerId[prefix:], utils.GenerateRandomString(len(peerId)-prefix, ""))
 
-	status   torrentStatus
-	statusCh chan torrentStatus
+	return peerId
+}
+
+// Initializes the torrent's context, channels and peer state.
+func (tr *Torrent) init(infoHash [sha1.Size]byte, info *torrentInfo, metadata []byte, trackerTiers [][]string) {
+	var mutex sync.Mutex
+
+	tr.ctx, tr.cancelFunc = context.WithCancel(context.Background())
+
+	tr.info = info
+	tr.infoHash = infoHash
+	tr.metadata = metadata
+
+	tr.bannedPeers = make(map[netip.Addr]struct{})
+	tr.bannedPeersCh = make(chan string, 1)
+	tr.incomingPeersCh = make(chan []Peer, 1)
+	tr.maxPeerConnections = defaultMaxPeerConnections
+	tr.metadataPeersCh = make(chan *PeerConnection, 10)
+	tr.peerConnections = make(map[string]*PeerConnection)
+	tr.peers = make(map[string]Peer)
+	tr.failingPeers = make(map[string]Peer)
+	tr.mutex = &mutex
+	tr.statusCh = make(chan TorrentStatus, 1)
+	tr.events = NewEventBus()
+	tr.setLogger(slog.Default())
+	tr.trackerTiers = newTrackerTiers(trackerTiers)
+
+	tr.counters = &transferCounters{}
+	tr.downloadMeter = newRateMeter()
+	tr.uploadMeter = newRateMeter()
+	tr.peerId = GeneratePeerId()
+	tr.trackerKey = rand.Uint32()
+	tr.listenPort = defaultListenPort
+
+	if info == nil {
+		tr.metadataDownloaderCtx, tr.metadataDownloadCancelFunc = context.WithCancel(tr.ctx)
+	} else {
+		tr.filePriorities = make([]FilePriority, len(info.files))
+	}
 }
 
 func NewTorrent(src string) (Torrent, error) {
@@ -143,12 +298,60 @@ func (tr *Torrent) handleBannedPeers() {
 			}
 		case bannedPeerAddress := <-tr.bannedPeersCh:
 			{
-				tr.bannedPeers.Add(bannedPeerAddress)
+				tr.banPeer(bannedPeerAddress)
 			}
 		}
 	}
 }
 
+// Closes the connections to the peer and prevents any future connections from or to its IP address.
+func (tr *Torrent) banPeer(address string) {
+	addrPort, err := netip.ParseAddrPort(address)
+
+	if err != nil {
+		tr.logger.Warn("cannot ban peer with an invalid address", logging.PeerKey, address, logging.ErrorKey, err)
+		return
+	}
+
+	addr := addrPort.Addr().Unmap()
+
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	tr.logger.Info("banning peer", logging.PeerKey, address)
+	tr.bannedPeers[addr] = struct{}{}
+
+	for peerAddress, peer := range tr.peers {
+		if peer.Address.Addr() == addr {
+			delete(tr.peers, peerAddress)
+		}
+	}
+
+	for _, peerConnection := range tr.peerConnections {
+		if peerConnection.peer.Address.Addr() == addr {
+			tr.closePeerConnection(peerConnection, "peer was banned")
+		}
+	}
+}
+
+// Reports whether the peer's IP address is banned. Must be called with the torrent's mutex held.
+func (tr *Torrent) isBanned(peer Peer) bool {
+	_, ok := tr.bannedPeers[peer.Address.Addr()]
+
+	return ok
+}
+
+// Closes a registered peer connection and frees its connection slot. Must be called with the torrent's mutex held.
+func (tr *Torrent) closePeerConnection(peerConnection *PeerConnection, reason string) {
+	peerConnection.Close()
+
+	if tr.peerConnections[peerConnection.PeerAddress] == peerConnection {
+		delete(tr.peerConnections, peerConnection.PeerAddress)
+		tr.connectionLimiter.release()
+		tr.events.publish(PeerDisconnected{EventBase: tr.newEventBase(), Peer: peerConnection.PeerAddress, Reason: reason})
+	}
+}
+
 func (tr *Torrent) handleIncomingPeers() {
 	for {
 		// todo: handle failed peers
@@ -156,36 +359,60 @@ func (tr *Torrent) handleIncomingPeers() {
 		case peers := <-tr.incomingPeersCh:
 			{
 				for _, peer := range peers {
-					if len(tr.peerConnections) >= tr.maxPeerConnections {
+					tr.mutex.Lock()
+					numOfPeerConnections := len(tr.peerConnections)
+					_, isConnected := tr.peerConnections[peer.String()]
+					isBanned := tr.isBanned(peer)
+					// Peers received while the torrent is paused are connected to once it is resumed.
+					isPaused := tr.paused
+
+					if numOfPeerConnections >= tr.maxPeerConnections || isPaused {
 						tr.peers[peer.String()] = peer
-						break
 					}
 
-					if _, ok := tr.peerConnections[peer.String()]; ok {
-						fmt.Println("peer already exists in connection pool")
+					tr.mutex.Unlock()
+
+					if isPaused {
 						continue
 					}
 
-					peerConnection := NewPeerConnection(PeerConnectionConfig{Peer: peer})
+					if numOfPeerConnections >= tr.maxPeerConnections {
+						break
+					}
 
-					if err := peerConnection.InitConnection(); err != nil {
-						fmt.Printf("failed to connect to peer: %s: %v\n", peer, err)
-						tr.failingPeers[peer.String()] = peer
+					if isBanned {
 						continue
 					}
 
-					fmt.Printf("connected to peer: %s\n", peer)
-					tr.peerConnections[peer.String()] = *peerConnection
-
-					if !peerConnection.supportsExtension(Metadata) || tr.metadataDownloaderCtx == nil {
+					if isConnected {
+						tr.logger.Debug("peer already exists in connection pool", logging.PeerKey, peer.String())
 						continue
 					}
 
-					select {
-					case <-tr.metadataDownloaderCtx.Done():
+					// The connection limit is shared with the other torrents of the session.
+					if !tr.connectionLimiter.tryAcquire() {
+						tr.mutex.Lock()
+						tr.peers[peer.String()] = peer
+						tr.mutex.Unlock()
+
+						break
+					}
+
+					peerConnection := tr.newPeerConnection(peer)
+
+					if err := peerConnection.InitConnection(); err != nil {
+						tr.peerLogger.Debug("failed to connect to peer", logging.PeerKey, peer.String(), logging.ErrorKey, err)
+						tr.metrics.HandshakeFailed(err)
+						tr.mutex.Lock()
+						tr.failingPeers[peer.String()] = peer
+						tr.mutex.Unlock()
+						peerConnection.Close()
+						tr.connectionLimiter.release()
 						continue
-					case tr.metadataPeersCh <- *peerConnection:
 					}
+
+					tr.peerLogger.Debug("connected to peer", logging.PeerKey, peer.String())
+					tr.addPeerConnection(peerConnection)
 				}
 			}
 
@@ -197,6 +424,71 @@ func (tr *Torrent) handleIncomingPeers() {
 	}
 }
 
+func (tr *Torrent) newPeerConnection(peer Peer) *PeerConnection {
+	numOfPieces := 0
+
+	tr.mutex.Lock()
+
+	if tr.info != nil {
+		numOfPieces = len(tr.info.pieces)
+	}
+
+	tr.mutex.Unlock()
+
+	return NewPeerConnection(PeerConnectionConfig{
+		Peer:                peer,
+		NumOfPieces:         numOfPieces,
+		PeerId:              tr.peerId,
+		DisablePeerExchange: tr.IsPrivate(),
+		OnPeerExchange:      tr.handlePeerExchange,
+		DHTPort:             tr.dhtPort(),
+		OnDHTPort:           tr.handleDHTPort,
+		GetMetadata:         tr.getMetadata,
+		GetHashes:           tr.getHashesFunc(),
+		AcceptedInfoHashes:  tr.SwarmInfoHashes(),
+		DownloadLimiter:     tr.downloadLimiter,
+		UploadLimiter:       tr.uploadLimiter,
+		GetBlock:            tr.getBlock,
+		CompletedPieces:     tr.completedPieces,
+		OnUpload:            tr.recordUpload,
+		Logger:              tr.peerLogger,
+	})
+}
+
+/*
+Registers an established connection, which holds a slot of the connection limiter, and hands it to the metadata downloader if we still need the metadata.
+
+Once the metadata is known, the peer is asked for the pieces we are missing.
+The connection is closed if the torrent was paused or stopped, or if we connected to the peer in the meantime.
+*/
+func (tr *Torrent) addPeerConnection(peerConnection *PeerConnection) {
+	tr.mutex.Lock()
+
+	if _, isConnected := tr.peerConnections[peerConnection.PeerAddress]; isConnected || tr.paused || tr.ctx.Err() != nil {
+		tr.mutex.Unlock()
+		peerConnection.Close()
+		tr.connectionLimiter.release()
+
+		return
+	}
+
+	tr.peerConnections[peerConnection.PeerAddress] = peerConnection
+	tr.mutex.Unlock()
+
+	tr.events.publish(PeerConnected{EventBase: tr.newEventBase(), Peer: peerConnection.PeerAddress})
+
+	go tr.downloadFromPeer(peerConnection)
+
+	if !peerConnection.supportsExtension(Metadata) || peerConnection.metadataSize == 0 || tr.metadataDownloaderCtx == nil {
+		return
+	}
+
+	select {
+	case <-tr.metadataDownloaderCtx.Done():
+	case tr.metadataPeersCh <- peerConnection:
+	}
+}
+
 func (tr *Torrent) handleStatusUpdate() {
 	for {
 		select {
@@ -207,55 +499,79 @@ func (tr *Torrent) handleStatusUpdate() {
 
 		case status := <-tr.statusCh:
 			{
-				tr.status = status
+				tr.mutex.Lock()
+
+				// Finished torrents keep running to seed, unless they are paused.
+				if status == StatusFinished && !tr.paused {
+					status = StatusSeeding
+				}
+
+				tr.setStatus(status)
+				tr.mutex.Unlock()
 			}
 		}
 	}
 }
 
-func (tr *Torrent) startAnnouncer() {
-	// todo: make this function run in a interval
-	// todo: handle failed trackers
-	const announceInterval = 3 * time.Second
-	ticker := time.NewTicker(announceInterval)
+/*
+Periodically looks up peers for the torrent in the DHT and announces that we are downloading it.
 
-	defer ticker.Stop()
+The nodes listed in the metainfo file are added to the DHT's routing table before the first lookup.
+*/
+func (tr *Torrent) startDHTAnnouncer() {
+	for _, address := range tr.dhtNodes {
+		tr.dht.AddNode(address)
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-tr.ctx.Done():
 			{
-				// todo: notify trackers that we're stopping?
 				return
 			}
 
-		case <-ticker.C:
+		case <-timer.C:
 			{
-				var wg sync.WaitGroup
+				timer.Reset(dhtAnnounceInterval)
 
-				maxConcurrency := 5
-				sem := utils.NewSemaphore(maxConcurrency)
+				// Private torrents must only get peers from their trackers.
+				if tr.IsPrivate() {
+					continue
+				}
 
-				for trackerUrl := range tr.trackers.Entries() {
-					wg.Add(1)
-					sem.Acquire()
+				if !tr.waitUntilResumed() {
+					return
+				}
 
-					go func() {
-						defer sem.Release()
-						defer wg.Done()
+				if tr.dht.NumOfNodes() == 0 {
+					if err := tr.dht.Bootstrap(tr.ctx); err != nil {
+						tr.logger.Warn("failed to bootstrap the DHT", logging.ErrorKey, err)
+						continue
+					}
+				}
 
-						peers, err := tr.sendAnnounceRequest(trackerUrl)
+				for _, infoHash := range tr.SwarmInfoHashes() {
+					addresses, err := tr.dht.Announce(tr.ctx, infoHash, tr.listenPort)
 
-						if err != nil {
-							fmt.Println(err.Error())
-							return
-						}
+					if err != nil {
+						tr.logger.Warn("failed to get peers from the DHT", logging.ErrorKey, err)
+						continue
+					}
 
-						tr.incomingPeersCh <- peers
-					}()
-				}
+					peers := make([]Peer, len(addresses))
 
-				wg.Wait()
+					for index, address := range addresses {
+						peers[index] = newPeer(address.Addr(), address.Port(), infoHash)
+					}
+
+					select {
+					case <-tr.ctx.Done():
+					case tr.incomingPeersCh <- peers:
+					}
+				}
 			}
 		}
 	}
@@ -264,105 +580,448 @@ func (tr *Torrent) startAnnouncer() {
 /*
 Downloads the torrent's metadata (info) if it hasn't been downloaded yet.
 
-This function listens for peer connections on the `metadataPeersCh` channel and attempts to download
-the torrent's metadata from each peer connection. If the metadata is successfully downloaded and verified
-against the torrent's info hash, the metadata is decoded and stored in the torrent's `info` field.
-
-On success, the function cancels the metadata downloader context, signalling the goroutine responsible
-for sending peer connections to the `metadataPeersCh` channel to stop sending further connections.
-
-For example:
-
- 1. A peer connection is received via the `metadataPeersCh` channel.
+This function listens for peer connections on the `metadataPeersCh` channel and starts downloading pieces
+of the metadata from each of them concurrently (BEP 9). Only peers that advertised the size of the metadata
+in their extension handshake are used.
 
- 2. The function requests the metadata from the peer using the `downloadMetadata` method.
+Once all the pieces have been downloaded and the assembled metadata matches the torrent's info hash, it is decoded
+and stored in the torrent's `info` field, and the metadata downloader context is canceled to signal the goroutine
+responsible for sending peer connections to the `metadataPeersCh` channel to stop sending further connections.
 
- 3. If the metadata matches the torrent's info hash, it is decoded and stored.
-
- 4. The metadata downloader context is canceled to stop further metadata requests and signal other goroutines.
-
-If the metadata download fails or the hash does not match, the function continues to process other peer connections.
+When the assembled metadata does not match the info hash, the download starts over. Peers that keep sending bad metadata
+are dropped, or banned once they are proven to have sent bad pieces. The download fails once no peers are left to download
+from, and resumes when new peers connect.
 */
 func (tr *Torrent) startMetadataDownloader() {
-	if tr.info != nil {
+	if tr.metadataDownloaderCtx == nil {
 		return
 	}
 
-	ctx, cancelFunc := context.WithCancel(context.Background())
-	tr.metadataDownloaderCtx = ctx
-	tr.metadataDownloadCancelFunc = cancelFunc
+	completedCh := make(chan []byte)
+	md := newMetadataDownloader(tr.infoHash, tr.infoHashV2)
+	// Number of peers the metadata is being downloaded from.
+	numOfPeers := 0
+	peerDoneCh := make(chan struct{})
 
 	for {
 		select {
 		case <-tr.ctx.Done():
 			{
+				tr.metadataDownloadCancelFunc()
 				return
 			}
+
 		case peerConnection := <-tr.metadataPeersCh:
 			{
-				// request peer connection. If successful cancel the metadata downloader context and signal to downloader that i can start.
-				// todo: add debug logs
-				metadata, err := peerConnection.downloadMetadata()
-
-				if err != nil {
-					break
+				if md.isDropped(peerConnection.PeerAddress) {
+					continue
 				}
 
-				if metadataHash := sha1.Sum(metadata); !bytes.Equal(tr.infoHash[:], metadataHash[:]) {
-					// todo: blacklist peer?
-					break
+				numOfPeers += 1
+
+				go func() {
+					tr.downloadMetadataFromPeer(md, peerConnection, completedCh)
+
+					select {
+					case <-tr.metadataDownloaderCtx.Done():
+					case peerDoneCh <- struct{}{}:
+					}
+				}()
+			}
+
+		case <-peerDoneCh:
+			{
+				numOfPeers -= 1
+
+				if numOfPeers == 0 {
+					tr.logger.Warn("failed to download metadata: no peers left to download it from, waiting for new peers")
 				}
+			}
 
+		case metadata := <-completedCh:
+			{
 				decodedValue, _, err := bencode.DecodeValue(metadata)
 
 				if err != nil {
-					break
+					tr.logger.Warn("failed to decode metadata", logging.ErrorKey, err)
+					continue
 				}
 
 				metadataDict, ok := decodedValue.(map[string]any)
 
 				if !ok {
-					break
+					tr.logger.Warn(fmt.Sprintf("expected metadata to be a dictionary, but received '%T'", decodedValue))
+					continue
 				}
 
 				info, err := parseInfoDict(metadataDict, *tr)
 
 				if err != nil {
-					break
+					tr.logger.Warn("failed to parse metadata", logging.ErrorKey, err)
+					continue
 				}
 
+				tr.mutex.Lock()
 				tr.info = info
+				tr.metadata = metadata
+				tr.filePriorities = make([]FilePriority, len(info.files))
+				tr.mutex.Unlock()
+
+				tr.events.publish(MetadataReceived{EventBase: tr.newEventBase(), Name: info.name})
+
 				tr.metadataDownloadCancelFunc()
+
+				return
 			}
 		}
 	}
 }
 
+// Returns the bencoded info dictionary, or nil if the metadata is still being downloaded.
+func (tr *Torrent) getMetadata() []byte {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	return tr.metadata
+}
+
+// Returns the function serving the hashes of the torrent's merkle trees to peers, or nil if the torrent isn't a v2 torrent.
+func (tr *Torrent) getHashesFunc() func(req hashRequest) ([]merkleHash, bool) {
+	if tr.infoHashV2 == ([sha256.Size]byte{}) {
+		return nil
+	}
+
+	return func(req hashRequest) ([]merkleHash, bool) {
+		tr.mutex.Lock()
+		info := tr.info
+		tr.mutex.Unlock()
+
+		if info == nil || info.metaVersion != 2 {
+			return nil, false
+		}
+
+		return info.getHashes(req)
+	}
+}
+
+// Returns the UDP port of the DHT node used by the torrent, or 0 if the torrent does not use the DHT.
+func (tr *Torrent) dhtPort() uint16 {
+	if tr.dht == nil || tr.IsPrivate() {
+		return 0
+	}
+
+	addr, ok := tr.dht.Addr().(*net.UDPAddr)
+
+	if !ok {
+		return 0
+	}
+
+	return uint16(addr.Port)
+}
+
+/*
+Pings the DHT node advertised by a peer in a 'Port' message.
+
+If the node responds, it is added to the routing table. This is how most clients join the DHT without relying on public bootstrap nodes.
+*/
+func (tr *Torrent) handleDHTPort(address string) {
+	if tr.dht == nil || tr.IsPrivate() {
+		return
+	}
+
+	tr.dht.AddNode(address)
+}
+
+func (t *Torrent) InfoHash() [sha1.Size]byte {
+	return t.infoHash
+}
+
+/*
+Returns the info hashes of the swarms the torrent is part of, starting with its main info hash. Peers may use any of them in their handshake.
+
+Hybrid torrents (BEP 52) are part of both the v1 swarm and the v2 swarm, which is identified by the v2 info hash truncated to 20 bytes.
+*/
+func (t *Torrent) SwarmInfoHashes() [][sha1.Size]byte {
+	infoHashes := [][sha1.Size]byte{t.infoHash}
+
+	if t.infoHashV2 == ([sha256.Size]byte{}) {
+		return infoHashes
+	}
+
+	if truncatedInfoHash := [sha1.Size]byte(t.infoHashV2[:sha1.Size]); truncatedInfoHash != t.infoHash {
+		infoHashes = append(infoHashes, truncatedInfoHash)
+	}
+
+	return infoHashes
+}
+
+// Returns the torrent's name, or an empty string if the metadata of a torrent created from a magnet link hasn't been downloaded yet.
+func (t *Torrent) Name() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.info == nil {
+		return ""
+	}
+
+	return t.info.name
+}
+
+/*
+Adds trackers that are not listed in the torrent's metainfo, e.g the trackers of a magnet link for the same torrent.
+Every tracker is placed in its own tier, after the torrent's own tiers.
+
+Extra trackers are refused for private torrents. If the metadata of a torrent created from a magnet link turns out to be private
+once downloaded, the extra trackers stop being announced to.
+
+Must be called before `Start`.
+*/
+func (t *Torrent) AddTrackers(trackerUrls []string) error {
+	if t.IsPrivate() {
+		return ErrPrivateTorrent
+	}
+
+	known := make(map[string]bool)
+
+	for _, tier := range t.trackerTiers {
+		for _, state := range tier.trackers {
+			known[state.url] = true
+		}
+	}
+
+	for _, trackerUrl := range trackerUrls {
+		if known[trackerUrl] {
+			continue
+		}
+
+		if !isSupportedTrackerURL(trackerUrl) {
+			return fmt.Errorf("tracker URL '%s' is not supported", trackerUrl)
+		}
+
+		known[trackerUrl] = true
+		t.trackerTiers = append(t.trackerTiers, &trackerTier{trackers: []*trackerState{{url: trackerUrl, extra: true}}})
+	}
+
+	return nil
+}
+
+/*
+Announces to one tracker in every tier of the announce list, instead of only the first tier with a responding tracker.
+
+Must be called before `Start`.
+*/
+func (t *Torrent) SetAnnounceToAllTiers(enabled bool) {
+	t.announceToAllTiers = enabled
+}
+
+// Sets the directory the torrent's files are downloaded to. Nothing is downloaded if it isn't set. Must be called before `Start`.
+func (t *Torrent) SetOutputDir(dir string) {
+	t.outputDir = dir
+}
+
+func (t *Torrent) OutputDir() string {
+	return t.outputDir
+}
+
+// Uses the DHT node to find peers for the torrent, in addition to the torrent's trackers. Must be called before `Start`.
+func (t *Torrent) UseDHT(node *dht.DHT) {
+	t.dht = node
+}
+
+// Sets the peer Id sent to trackers and peers, e.g. to share it between the torrents of a session. Must be called before `Start`.
+func (t *Torrent) SetPeerId(peerId [20]byte) {
+	t.peerId = peerId
+}
+
+// Sets the port advertised to trackers and DHT nodes, on which incoming connections are accepted. Must be called before `Start`.
+func (t *Torrent) SetListenPort(port uint16) {
+	t.listenPort = port
+}
+
+/*
+Sets the logger of the torrent. Records are tagged with the torrent's info hash and with the component that logged them:
+"torrent", "peer", "tracker" or "webseed" (see `logging.NewLogger` for per-component levels). Defaults to `slog.Default()`.
+
+Must be called before `Start`.
+*/
+func (t *Torrent) SetLogger(logger *slog.Logger) {
+	t.setLogger(logger)
+}
+
+func (tr *Torrent) setLogger(logger *slog.Logger) {
+	logger = logger.With(logging.InfoHashKey, hex.EncodeToString(tr.infoHash[:]))
+
+	tr.logger = logging.Component(logger, logging.ComponentTorrent)
+	tr.peerLogger = logging.Component(logger, logging.ComponentPeer)
+	tr.trackerLogger = logging.Component(logger, logging.ComponentTracker)
+	tr.webSeedLogger = logging.Component(logger, logging.ComponentWebSeed)
+}
+
+// Sets the maximum number of peers the torrent is connected to at the same time.
+func (t *Torrent) SetMaxPeerConnections(max int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.maxPeerConnections = max
+}
+
+// Limits the number of peer connections of the torrent along with the other torrents sharing the limiter. Must be called before `Start`.
+func (t *Torrent) UseConnectionLimiter(limiter *ConnectionLimiter) {
+	t.connectionLimiter = limiter
+}
+
+// Limits the rate at which data is exchanged with peers. Either limiter may be nil. Must be called before `Start`.
+func (t *Torrent) UseRateLimiters(download *RateLimiter, upload *RateLimiter) {
+	t.downloadLimiter = download
+	t.uploadLimiter = upload
+}
+
+/*
+Starts looking for peers and downloading the torrent. The torrent runs in the background until `Stop` is called.
+
+Incoming connections aren't accepted by the torrent itself: they are handed to it with `HandleIncomingConnection`, usually by a session
+that listens for the connections of all its torrents.
+*/
 func (t *Torrent) Start() {
 	go t.startAnnouncer()
+	go t.startPeerExchange()
+
+	if t.dht != nil {
+		go t.startDHTAnnouncer()
+	}
+
 	go t.handleIncomingPeers()
 	go t.handleStatusUpdate()
 	go t.handleBannedPeers()
 	go t.startMetadataDownloader()
+	go t.startPieceDownloader()
+	go t.startSeedingGoalMonitor(seedingGoalCheckInterval)
+}
 
-	// todo: move this signal handler to a higher-level (session)
-	signalsCh := make(chan os.Signal, 1)
-	signal.Notify(signalsCh, syscall.SIGINT, syscall.SIGTERM)
+/*
+Pauses the torrent: its peer connections are closed, its trackers are told that we stopped, and nothing is downloaded until `Resume` is called.
 
-	<-signalsCh
-	fmt.Println("shutting down...")
-	t.Stop()
-	fmt.Println("successfully closed all peer connections.")
-	close(signalsCh)
+The pieces that have been downloaded are kept, and the peers we were connected to are connected to again when the torrent is resumed.
+*/
+func (t *Torrent) Pause() {
+	t.mutex.Lock()
+
+	if t.paused || t.ctx.Err() != nil {
+		t.mutex.Unlock()
+		return
+	}
+
+	t.paused = true
+	t.resumedCh = make(chan struct{})
+
+	if t.status == StatusSeeding {
+		t.setStatus(StatusFinished)
+	}
+
+	for address, peerConnection := range t.peerConnections {
+		t.peers[address] = peerConnection.peer
+		t.closePeerConnection(peerConnection, "torrent was paused")
+	}
+
+	t.mutex.Unlock()
+
+	t.announceStopped()
 }
 
-// Cancels all active goroutines and gracefully shuts down all active peer connections
+// Resumes a paused torrent. Trackers are announced to immediately.
+func (t *Torrent) Resume() {
+	t.mutex.Lock()
+
+	if !t.paused {
+		t.mutex.Unlock()
+		return
+	}
+
+	t.paused = false
+	close(t.resumedCh)
+
+	if t.status == StatusFinished {
+		t.setStatus(StatusSeeding)
+	}
+
+	for _, group := range t.announceGroups {
+		group.nextAnnounce = time.Time{}
+	}
+
+	peers := make([]Peer, 0, len(t.peers))
+
+	for address, peer := range t.peers {
+		peers = append(peers, peer)
+		delete(t.peers, address)
+	}
+
+	t.mutex.Unlock()
+
+	go func() {
+		select {
+		case <-t.ctx.Done():
+		case t.incomingPeersCh <- peers:
+		}
+	}()
+}
+
+func (t *Torrent) IsPaused() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.paused
+}
+
+// Reports whether every piece of the torrent has been downloaded, except for the pieces of skipped files.
+func (t *Torrent) IsFinished() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.isComplete()
+}
+
+// Reports whether the torrent is uploading to peers after downloading every piece.
+func (t *Torrent) IsSeeding() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.status == StatusSeeding
+}
+
+// Returns the number of bytes of the pieces downloaded from peers and web seeds since the torrent was started.
+func (t *Torrent) BytesDownloaded() int64 {
+	return t.counters.downloaded.Load()
+}
+
+// Blocks while the torrent is paused. Returns false if the torrent was stopped.
+func (tr *Torrent) waitUntilResumed() bool {
+	tr.mutex.Lock()
+	paused, resumedCh := tr.paused, tr.resumedCh
+	tr.mutex.Unlock()
+
+	if paused {
+		select {
+		case <-tr.ctx.Done():
+		case <-resumedCh:
+		}
+	}
+
+	return tr.ctx.Err() == nil
+}
+
+// Notifies trackers that we are stopping, cancels all active goroutines and gracefully shuts down all active peer connections
 func (t *Torrent) Stop() {
+	t.announceStopped()
 	t.cancelFunc()
 
-	for _, connection := range t.peerConnections {
-		connection.Close()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.status == StatusSeeding {
+		t.setStatus(StatusFinished)
 	}
 
-	// todo: close channels?
+	for _, connection := range t.peerConnections {
+		t.closePeerConnection(connection, "torrent was stopped")
+	}
 }
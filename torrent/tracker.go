@@ -1,29 +1,76 @@
 package torrent
 
 import (
-	"encoding/binary"
+	"crypto/sha1"
 	"fmt"
 	"io"
-	"math"
-	"math/rand"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"reflect"
 	"strconv"
 	"time"
 
 	"github.com/MlkMahmud/hail/bencode"
-	"github.com/MlkMahmud/hail/utils"
+	"github.com/MlkMahmud/hail/logging"
 )
 
 type UDPTrackerActionId int
 
+type trackerEvent int
+
+type announceRequest struct {
+	downloaded int64
+	event      trackerEvent
+	// Whether there are other trackers in the tier to fall through to if the tracker doesn't respond.
+	hasAlternatives bool
+	// The info hash of the swarm we announce to. Hybrid torrents are announced with both of their info hashes.
+	infoHash  [sha1.Size]byte
+	left      int64
+	trackerId string
+	uploaded  int64
+}
+
+type announceResponse struct {
+	interval    time.Duration
+	leechers    int
+	minInterval time.Duration
+	peers       []Peer
+	seeders     int
+	trackerId   string
+}
+
 const (
 	connectActionId UDPTrackerActionId = iota
 	announceActionId
+	scrapeActionId
+	errorActionId
 )
 
+var trackerHTTPClient = &http.Client{Timeout: 15 * time.Second}
+
+// The values of the events match those used by the UDP tracker protocol.
+const (
+	noneEvent trackerEvent = iota
+	completedEvent
+	startedEvent
+	stoppedEvent
+)
+
+func (e trackerEvent) String() string {
+	switch e {
+	case completedEvent:
+		return "completed"
+	case startedEvent:
+		return "started"
+	case stoppedEvent:
+		return "stopped"
+	default:
+		return ""
+	}
+}
+
 /*
 The tracker can send one of two kinds of response, as a [w:Bencode BEncoded] dictionary. If the tracker was able to process the client request it sends a BEncoded dictionary that has two keys:
 
@@ -45,7 +92,7 @@ The compact extension tells the tracker to send the peers key as a single string
 
 The second kind of response is a BEncoded dictionary with a failure reason key. It means that the tracker was unable to process the request. The value of the failure reason is a human readable text that contains the cause of the error. If this key is present, no other key needs to be present.
 */
-func (t *Torrent) parseHTTPAnnounceResponse(res []byte) ([]Peer, error) {
+func (t *Torrent) parseHTTPAnnounceResponse(trackerURL string, res []byte, infoHash [sha1.Size]byte) (*announceResponse, error) {
 	decodedResponse, _, err := bencode.DecodeValue(res)
 
 	if err != nil {
@@ -63,40 +110,73 @@ func (t *Torrent) parseHTTPAnnounceResponse(res []byte) ([]Peer, error) {
 	}
 
 	if warningMsg, ok := dict["warning message"].(string); ok {
-		fmt.Println(warningMsg)
+		t.trackerLogger.Warn("tracker sent a warning", logging.TrackerKey, trackerURL, "message", warningMsg)
 	}
 
 	peers, exists := dict["peers"]
+	peers6, peers6Exists := dict["peers6"]
 
-	if !exists {
+	if !exists && !peers6Exists {
 		return nil, fmt.Errorf("decoded response does not include a \"peers\" key")
 	}
 
-	switch peersValue := peers.(type) {
-	case string:
-		{
-			peersStringLen := len(peersValue)
-			peerSize := 6
+	response := &announceResponse{}
 
-			if peersStringLen%peerSize != 0 {
-				return nil, fmt.Errorf("peers value must be a multiple of '%d' bytes", peerSize)
-			}
+	if interval, ok := dict["interval"].(int); ok && interval > 0 {
+		response.interval = time.Duration(interval) * time.Second
+	}
+
+	if minInterval, ok := dict["min interval"].(int); ok && minInterval > 0 {
+		response.minInterval = time.Duration(minInterval) * time.Second
+	}
 
-			numOfPeers := peersStringLen / peerSize
-			peersArr := make([]Peer, numOfPeers)
+	// If the tracker sends a "tracker id", it must be sent back on subsequent announcements.
+	if trackerId, ok := dict["tracker id"].(string); ok {
+		response.trackerId = trackerId
+	}
 
-			for i, j := 0, 0; i < peersStringLen; i += peerSize {
-				IpAddress := fmt.Sprintf("%d.%d.%d.%d", byte(peersValue[i]), byte(peersValue[i+1]), byte(peersValue[i+2]), byte(peersValue[i+3]))
-				Port := binary.BigEndian.Uint16([]byte(peersValue[i+4 : i+6]))
-				peersArr[j] = Peer{IpAddress: IpAddress, Port: Port, InfoHash: t.infoHash}
-				j++
-			}
+	response.seeders, _ = dict["complete"].(int)
+	response.leechers, _ = dict["incomplete"].(int)
 
-			return peersArr, nil
+	if exists {
+		peersArr, err := t.parseHTTPAnnounceResponsePeers(peers, infoHash)
+
+		if err != nil {
+			return nil, err
+		}
+
+		response.peers = peersArr
+	}
+
+	// BEP 7: IPv6 peers are returned in the "peers6" key, in the compact format (18 bytes per peer).
+	if peers6Exists {
+		compactPeers, ok := peers6.(string)
+
+		if !ok {
+			return nil, fmt.Errorf("decoded value of \"peers6\" is invalid. expected a string, but received %T", peers6)
+		}
+
+		peers6Arr, err := parseCompactPeers(compactPeers, compactPeer6Size, infoHash)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse \"peers6\" value: %w", err)
+		}
+
+		response.peers = append(response.peers, peers6Arr...)
+	}
+
+	return response, nil
+}
+
+func (t *Torrent) parseHTTPAnnounceResponsePeers(peers any, infoHash [sha1.Size]byte) ([]Peer, error) {
+	switch peersValue := peers.(type) {
+	case string:
+		{
+			return parseCompactPeers(peersValue, compactPeerSize, infoHash)
 		}
 	case []any:
 		{
-			peersArr := make([]Peer, len(peersValue))
+			peersArr := make([]Peer, 0, len(peersValue))
 
 			for index, peer := range peersValue {
 				peerDict, ok := peer.(map[string]any)
@@ -118,11 +198,14 @@ func (t *Torrent) parseHTTPAnnounceResponse(res []byte) ([]Peer, error) {
 					}
 				}
 
-				peersArr[index] = Peer{
-					InfoHash:  t.infoHash,
-					IpAddress: peerDict["ip"].(string),
-					Port:      uint16(peerDict["port"].(int)),
+				// The "ip" property may also be a DNS name, which we don't resolve.
+				addr, err := netip.ParseAddr(peerDict["ip"].(string))
+
+				if err != nil {
+					continue
 				}
+
+				peersArr = append(peersArr, newPeer(addr, uint16(peerDict["port"].(int)), infoHash))
 			}
 
 			return peersArr, nil
@@ -136,307 +219,115 @@ func (t *Torrent) parseHTTPAnnounceResponse(res []byte) ([]Peer, error) {
 }
 
 /*
-IPv4 announce response:
-
-	Offset      Size            Name            Value
-	0           32-bit integer  action          1 // announce
-	4           32-bit integer  transaction_id
-	8           32-bit integer  interval
-	12          32-bit integer  leechers
-	16          32-bit integer  seeders
-	20 + 6 * n  32-bit integer  IP address
-	24 + 6 * n  16-bit integer  TCP port
-	20 + 6 * N
+Returns the first public IPv4 and IPv6 addresses assigned to the host's network interfaces.
+
+Either address is invalid (the zero value) if the host doesn't have a public address in that family.
 */
-func (tr *Torrent) parseUDPAnnounceResponse(response []byte, action uint32, transactionId uint32) ([]Peer, error) {
-	minSize := 20
-	peerSize := 6
+func getPublicAddresses() (netip.Addr, netip.Addr) {
+	var ipv4, ipv6 netip.Addr
 
-	if receivedSize := len(response); receivedSize < minSize {
-		return nil, fmt.Errorf("'announce' response should contain at least %d bytes", minSize)
-	}
+	interfaceAddrs, err := net.InterfaceAddrs()
 
-	if receivedAction := binary.BigEndian.Uint32(response); receivedAction != action {
-		return nil, fmt.Errorf("received action value '%d' does not match expected value '%d'", receivedAction, action)
+	if err != nil {
+		return ipv4, ipv6
 	}
 
-	if receivedTransactionId := binary.BigEndian.Uint32(response[4:]); receivedTransactionId != transactionId {
-		return nil, fmt.Errorf("received transaction_id '%d' does not match expected value '%d'", receivedTransactionId, transactionId)
-	}
+	for _, interfaceAddr := range interfaceAddrs {
+		prefix, err := netip.ParsePrefix(interfaceAddr.String())
 
-	peersBuffer := response[minSize : minSize+1]
-	peersBufferSize := len(peersBuffer)
+		if err != nil {
+			continue
+		}
 
-	if peersBufferSize%peerSize != 0 {
-		return nil, fmt.Errorf("peers list must be a multiple of '%d'", peerSize)
-	}
+		addr := prefix.Addr().Unmap()
+
+		if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+			continue
+		}
 
-	numOfPeers := peersBufferSize / peerSize
-	peersArr := make([]Peer, numOfPeers)
+		if addr.Is4() && !ipv4.IsValid() {
+			ipv4 = addr
+		}
 
-	for i, j := 0, 0; i < peersBufferSize; i += peerSize {
-		ipAddress := fmt.Sprintf("%d.%d.%d.%d", peersBuffer[i], peersBuffer[i+1], peersBuffer[i+2], peersBuffer[i+3])
-		port := binary.BigEndian.Uint16(peersBuffer[i+4:])
-		peersArr[j] = Peer{InfoHash: tr.infoHash, IpAddress: ipAddress, Port: port}
-		j++
+		if addr.Is6() && !ipv6.IsValid() {
+			ipv6 = addr
+		}
 	}
 
-	return peersArr, nil
+	return ipv4, ipv6
 }
 
-func (tr *Torrent) sendHTTPAnnounceRequest(trackerURL string) ([]Peer, error) {
+func (tr *Torrent) sendHTTPAnnounceRequest(trackerURL string, announceReq announceRequest) (*announceResponse, error) {
 	params := url.Values{}
-	// set length to a random value if the length of the torrent file is not known yet
-	length := 999
 
-	if tr.info != nil {
-		length = tr.info.length
-	}
-
-	params.Add("info_hash", string(tr.infoHash[:]))
-	params.Add("peer_id", utils.GenerateRandomString(20, ""))
-	params.Add("port", "6881")
-	params.Add("downloaded", "0")
-	params.Add("uploaded", "0")
-	params.Add("left", strconv.Itoa(length))
+	params.Add("info_hash", string(announceReq.infoHash[:]))
+	params.Add("peer_id", string(tr.peerId[:]))
+	params.Add("port", strconv.Itoa(int(tr.listenPort)))
+	params.Add("downloaded", strconv.FormatInt(announceReq.downloaded, 10))
+	params.Add("uploaded", strconv.FormatInt(announceReq.uploaded, 10))
+	params.Add("left", strconv.FormatInt(announceReq.left, 10))
 	params.Add("compact", "1")
+	params.Add("key", fmt.Sprintf("%08x", tr.trackerKey))
 
-	querystring := params.Encode()
-
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s?%s", trackerURL, querystring), nil)
+	// BEP 7: the tracker only sees the address the request was sent from, so we tell it about our addresses in the other family.
+	ipv4, ipv6 := getPublicAddresses()
 
-	if err != nil {
-		return nil, err
+	if ipv4.IsValid() {
+		params.Add("ipv4", ipv4.String())
 	}
 
-	res, err := http.DefaultClient.Do(req)
-
-	if err != nil {
-		return nil, err
+	if ipv6.IsValid() {
+		params.Add("ipv6", ipv6.String())
 	}
 
-	defer res.Body.Close()
-	var trackerResponse []byte
-
-	if res.StatusCode == http.StatusOK {
-		trackerResponse, err = io.ReadAll(res.Body)
-
-		if err != nil {
-			return nil, err
-		}
+	if announceReq.event != noneEvent {
+		params.Add("event", announceReq.event.String())
 	}
 
-	peers, err := tr.parseHTTPAnnounceResponse(trackerResponse)
-
-	if err != nil {
-		return nil, err
+	if announceReq.trackerId != "" {
+		params.Add("trackerid", announceReq.trackerId)
 	}
 
-	return peers, nil
-}
-
-/*
-Sends an announce request to a UDP tracker.
-
-Announce Request
-
-	Choose a random transaction ID.
-	Fill the announce request structure.
-	Send the packet.
-	IPv4 announce request:
-
-	Offset  Size    Name    Value
-	0       64-bit integer  connection_id
-	8       32-bit integer  action          1 // announce
-	12      32-bit integer  transaction_id
-	16      20-byte string  info_hash
-	36      20-byte string  peer_id
-	56      64-bit integer  downloaded
-	64      64-bit integer  left
-	72      64-bit integer  uploaded
-	80      32-bit integer  event           0 // 0: none; 1: completed; 2: started; 3: stopped
-	84      32-bit integer  IP address      0 // default
-	88      32-bit integer  key
-	92      32-bit integer  num_want        -1 // default
-	96      16-bit integer  port
-	98
-*/
-func (tr *Torrent) sendUDPAnnounceRequest(trackerUrl string) ([]Peer, error) {
-	parsedUrl, err := url.Parse(trackerUrl)
+	announceURL, err := url.Parse(trackerURL)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse tracker URL: %w", err)
 	}
 
-	if scheme := parsedUrl.Scheme; scheme != "udp" {
-		return nil, fmt.Errorf("tracker scheme must be 'UDP' got '%s'", scheme)
+	// The announce URLs of private trackers usually have a query of their own, e.g. "?passkey=<passkey>".
+	if announceURL.RawQuery != "" {
+		announceURL.RawQuery += "&" + params.Encode()
+	} else {
+		announceURL.RawQuery = params.Encode()
 	}
 
-	addr, err := net.ResolveUDPAddr("udp", parsedUrl.Host)
+	req, err := http.NewRequest("GET", announceURL.String(), nil)
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to resolve tracker URL: %w", err)
+		return nil, err
 	}
 
-	conn, err := net.DialTimeout("udp", addr.String(), 5*time.Second)
+	res, err := trackerHTTPClient.Do(req)
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to initiate connection with tracker: %w", err)
+		return nil, err
 	}
 
-	defer conn.Close()
-
-	transactionId := rand.Uint32()
+	defer res.Body.Close()
+	var trackerResponse []byte
 
-	connectionId, err := sendUDPConnectRequest(conn, transactionId)
+	if res.StatusCode == http.StatusOK {
+		trackerResponse, err = io.ReadAll(res.Body)
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to get list of peers: %w", err)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	action := uint32(announceActionId)
-	peerId := utils.GenerateRandomString(20, "")
-	port := uint16(6881)
-	reqBuffer := make([]byte, 98)
-	attempts := 0
-	index := 0
-
-	binary.BigEndian.PutUint64(reqBuffer, connectionId)
-	index += 8
-
-	binary.BigEndian.PutUint32(reqBuffer[index:], action)
-	index += 4
-
-	binary.BigEndian.PutUint32(reqBuffer[index:], transactionId)
-	index += 4
-
-	index += copy(reqBuffer[index:], tr.infoHash[:])
-	index += copy(reqBuffer[index:], []byte(peerId))
-
-	binary.BigEndian.PutUint64(reqBuffer[index:], 0)
-	index += 8
-
-	binary.BigEndian.PutUint64(reqBuffer[index:], 0)
-	index += 8
-
-	binary.BigEndian.PutUint64(reqBuffer[index:], 0)
-	index += 8
-
-	binary.BigEndian.PutUint32(reqBuffer[index:], 0)
-	index += 4
-
-	binary.BigEndian.PutUint32(reqBuffer[index:], 0)
-	index += 4
-
-	binary.BigEndian.PutUint32(reqBuffer[index:], 0)
-	index += 4
-
-	numWant := -1
-	binary.BigEndian.PutUint32(reqBuffer[index:], uint32(numWant))
-	index += 4
-
-	binary.BigEndian.PutUint16(reqBuffer[index:], port)
-
-	response, err := utils.Retry(utils.RetryOptions[[]Peer]{
-		Delay: 3 * time.Second,
-		Operation: func() ([]Peer, error) {
-			defer func() {
-				attempts += 1
-			}()
-
-			if _, err := utils.ConnWriteFull(conn, reqBuffer, 0); err != nil {
-				return nil, fmt.Errorf("failed to send 'announce' request to tracker: %w", err)
-			}
-
-			timeout := time.Duration(15 * (int(math.Pow(2, float64(attempts)))))
-
-			if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
-				return nil, fmt.Errorf("failed to received 'announce' response from tracker: %w", err)
-			}
-
-			resBuffer, err := io.ReadAll(conn)
-
-			if err != nil {
-				return nil, fmt.Errorf("failed to receive 'announce' response from tracker: %w", err)
-			}
-
-			peers, err := tr.parseUDPAnnounceResponse(resBuffer, action, transactionId)
-
-			return peers, err
-		},
-		MaxAttempts: 3,
-	})
-
-	return response, err
-}
-
-/*
-Sends a connect request to a UDP tracker.
-
-Connect request:
-
-	Offset  Size            Name            Value
-	0       64-bit integer  protocol_id     0x41727101980 // magic constant
-	8       32-bit integer  action          0 // connect
-	12      32-bit integer  transaction_id
-	16
-*/
-func sendUDPConnectRequest(conn net.Conn, transactionId uint32) (uint64, error) {
-	action := uint32(connectActionId)
-	connectRequestSize := 16
-	reqBuffer := make([]byte, connectRequestSize)
-	resBuffer := make([]byte, connectRequestSize)
-
-	index := 0
-
-	binary.BigEndian.PutUint64(reqBuffer[index:], 0x41727101980)
-	index += 8
-
-	binary.BigEndian.PutUint32(reqBuffer[index:], action)
-	index += 4
-
-	binary.BigEndian.PutUint32(reqBuffer[index:], transactionId)
-
-	attempts := 0
-
-	connectionId, err := utils.Retry(utils.RetryOptions[uint64]{
-		Delay: 3 * time.Second,
-		Operation: func() (uint64, error) {
-			defer func() {
-				attempts += 1
-			}()
-
-			if _, err := utils.ConnWriteFull(conn, reqBuffer, 5*time.Second); err != nil {
-				return 0, fmt.Errorf("failed to send 'connect' message request to tracker: %w", err)
-			}
-
-			/*
-				If a response is not received after 15 * 2 ^ n seconds,
-				the client should retransmit the request, where n starts at 0 and is increased up to 8 (3840 seconds) after every retransmission.
-			*/
-			timeout := time.Duration(15 * (int(math.Pow(2, float64(attempts)))))
-
-			if _, err := utils.ConnReadFull(conn, resBuffer, timeout); err != nil {
-				return 0, fmt.Errorf("failed to receive 'connect' message response from tracker: %w", err)
-			}
-
-			if receivedAction := binary.BigEndian.Uint32(resBuffer); receivedAction != action {
-				return 0, fmt.Errorf("received action value '%d' does not match expected value '%d'", receivedAction, action)
-			}
-
-			if receivedTransactionId := binary.BigEndian.Uint32(resBuffer[4:]); receivedTransactionId != transactionId {
-				return 0, fmt.Errorf("received transaction_id '%d' does not match expected value '%d'", receivedTransactionId, transactionId)
-			}
-
-			return binary.BigEndian.Uint64(resBuffer[8:]), nil
-		},
-		MaxAttempts: 4,
-	})
-
-	return connectionId, err
+	return tr.parseHTTPAnnounceResponse(trackerURL, trackerResponse, announceReq.infoHash)
 }
 
-func (tr *Torrent) sendAnnounceRequest(trackerUrl string) ([]Peer, error) {
+func (tr *Torrent) sendAnnounceRequest(trackerUrl string, announceReq announceRequest) (*announceResponse, error) {
 	parsedURL, err := url.Parse(trackerUrl)
 
 	if err != nil {
@@ -446,24 +337,12 @@ func (tr *Torrent) sendAnnounceRequest(trackerUrl string) ([]Peer, error) {
 	switch parsedURL.Scheme {
 	case "http", "https":
 		{
-			peers, err := tr.sendHTTPAnnounceRequest(trackerUrl)
-
-			if err != nil {
-				return nil, err
-			}
-
-			return peers, nil
+			return tr.sendHTTPAnnounceRequest(trackerUrl, announceReq)
 		}
 
 	case "udp":
 		{
-			peers, err := tr.sendUDPAnnounceRequest(trackerUrl)
-
-			if err != nil {
-				return nil, err
-			}
-
-			return peers, nil
+			return tr.sendUDPAnnounceRequest(trackerUrl, announceReq)
 		}
 
 	default:
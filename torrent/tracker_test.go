@@ -0,0 +1,121 @@
+package torrent_test
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/MlkMahmud/hail/bencode"
+)
+
+// Returns the compact representation of peers, e.g. "1.2.3.4:5" or "[::1]:5".
+func compactPeers(addresses ...string) string {
+	buffer := []byte{}
+
+	for _, address := range addresses {
+		addrPort := netip.MustParseAddrPort(address)
+		buffer = append(buffer, addrPort.Addr().AsSlice()...)
+		buffer = binary.BigEndian.AppendUint16(buffer, addrPort.Port())
+	}
+
+	return string(buffer)
+}
+
+// Starts an HTTP tracker that responds to every announcement with the response, and returns its announce URL.
+func newHTTPTracker(t *testing.T, response map[string]any) string {
+	t.Helper()
+
+	encoded, err := bencode.EncodeValue(response)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(encoded))
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server.URL + "/announce"
+}
+
+func TestHTTPAnnounceResponsePeers(t *testing.T) {
+	tests := []struct {
+		name     string
+		response map[string]any
+		expected []string
+	}{
+		{
+			name:     "compact IPv4 peers",
+			response: map[string]any{"peers": compactPeers("10.0.0.1:6881", "10.0.0.2:51413")},
+			expected: []string{"10.0.0.1:6881", "10.0.0.2:51413"},
+		},
+		{
+			name:     "compact IPv6 peers only",
+			response: map[string]any{"peers6": compactPeers("[2001:db8::1]:6881", "[2001:db8::2]:6882")},
+			expected: []string{"[2001:db8::1]:6881", "[2001:db8::2]:6882"},
+		},
+		{
+			name:     "IPv4 and IPv6 peers",
+			response: map[string]any{"peers": compactPeers("10.0.0.1:6881"), "peers6": compactPeers("[2001:db8::1]:6881")},
+			expected: []string{"10.0.0.1:6881", "[2001:db8::1]:6881"},
+		},
+		{
+			name:     "IPv4-mapped IPv6 peers",
+			response: map[string]any{"peers": "", "peers6": compactPeers("[::ffff:10.0.0.1]:6881")},
+			expected: []string{"10.0.0.1:6881"},
+		},
+		{
+			name: "dictionary peers",
+			response: map[string]any{"peers": []any{
+				map[string]any{"ip": "10.0.0.1", "port": 6881},
+				map[string]any{"ip": "2001:db8::1", "port": 6882},
+				map[string]any{"ip": "tracker.example.com", "port": 6883},
+			}},
+			expected: []string{"10.0.0.1:6881", "[2001:db8::1]:6882"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trrnt := newTestTorrent(t)
+
+			result, err := trrnt.AnnounceToTracker(newHTTPTracker(t, test.response))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(result.Peers, test.expected) {
+				t.Fatalf("expected peers %v, but got %v", test.expected, result.Peers)
+			}
+		})
+	}
+}
+
+func TestInvalidHTTPAnnounceResponsePeers(t *testing.T) {
+	tests := map[string]map[string]any{
+		"no peers":                 {"interval": 1800},
+		"partial IPv6 peer":        {"peers6": compactPeers("[2001:db8::1]:6881")[:17]},
+		"IPv4 peers in peers6":     {"peers6": compactPeers("10.0.0.1:6881", "10.0.0.2:6881")},
+		"peers6 is not a string":   {"peers6": []any{}},
+		"peer without a port":      {"peers": []any{map[string]any{"ip": "10.0.0.1"}}},
+		"peers is not a string":    {"peers": 1},
+		"partial IPv4 peer":        {"peers": compactPeers("10.0.0.1:6881")[:5]},
+		"IPv6 peers in IPv4 peers": {"peers": compactPeers("[2001:db8::1]:6881", "[2001:db8::2]:6881")[:22]},
+	}
+
+	for name, response := range tests {
+		t.Run(name, func(t *testing.T) {
+			trrnt := newTestTorrent(t)
+
+			if _, err := trrnt.AnnounceToTracker(newHTTPTracker(t, response)); err == nil {
+				t.Fatal("expected the response to be rejected")
+			}
+		})
+	}
+}
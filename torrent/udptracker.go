@@ -0,0 +1,415 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// A connection to a UDP tracker (BEP 15).
+type udpTrackerConnection struct {
+	conn net.Conn
+	// If set, requests fail once it has passed, no matter how many times they were retransmitted.
+	deadline time.Time
+	// The "host:port" address of the tracker, used to look up its cached connection id.
+	host               string
+	maxRetransmissions int
+}
+
+// An error returned by a UDP tracker in an 'error' (action 3) response.
+type udpTrackerError struct {
+	message string
+}
+
+type udpConnectionId struct {
+	id         uint64
+	obtainedAt time.Time
+}
+
+// Connection ids of the UDP trackers we are connected to, keyed by the tracker's "host:port" address.
+type udpConnectionIdCache struct {
+	entries map[string]udpConnectionId
+	mutex   sync.Mutex
+}
+
+const (
+	udpProtocolId = 0x41727101980
+
+	udpConnectRequestSize   = 16
+	udpConnectResponseSize  = 16
+	udpAnnounceRequestSize  = 98
+	udpAnnounceResponseSize = 20
+	udpRequestHeaderSize    = 16
+	udpResponseHeaderSize   = 8
+
+	// Large enough to hold any UDP datagram.
+	maxUDPPacketSize = 65507
+)
+
+var (
+	// A connection id can be used for one minute after it was received.
+	udpConnectionIdLifetime = time.Minute
+	/*
+		If a response is not received after 15 * 2 ^ n seconds, the request is retransmitted, where n starts at 0.
+		BEP 15 allows n to go up to 8 (3840 seconds), but we give up earlier so an unresponsive tracker doesn't hold up its tier.
+		If there are other trackers in the tier to fall through to, we give up after 15 + 30 seconds in total.
+	*/
+	udpTrackerTimeout                       = 15 * time.Second
+	maxUDPTrackerRetransmissions            = 2
+	maxUDPTrackerFallthroughRetransmissions = 1
+	udpConnectionIds                        = &udpConnectionIdCache{entries: make(map[string]udpConnectionId)}
+	errUDPTrackerResponseTimedOut           = errors.New("timed out waiting for a response from tracker")
+)
+
+func (e *udpTrackerError) Error() string {
+	return fmt.Sprintf("tracker returned an error: %s", e.message)
+}
+
+func (c *udpConnectionIdCache) get(host string) (uint64, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[host]
+
+	if !ok || time.Since(entry.obtainedAt) >= udpConnectionIdLifetime {
+		delete(c.entries, host)
+		return 0, false
+	}
+
+	return entry.id, true
+}
+
+func (c *udpConnectionIdCache) set(host string, id uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries[host] = udpConnectionId{id: id, obtainedAt: time.Now()}
+}
+
+func (c *udpConnectionIdCache) delete(host string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.entries, host)
+}
+
+func dialUDPTracker(trackerUrl string) (*udpTrackerConnection, error) {
+	parsedUrl, err := url.Parse(trackerUrl)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tracker URL: %w", err)
+	}
+
+	if scheme := parsedUrl.Scheme; scheme != "udp" {
+		return nil, fmt.Errorf("tracker scheme must be 'UDP' got '%s'", scheme)
+	}
+
+	conn, err := net.DialTimeout("udp", parsedUrl.Host, 5*time.Second)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to initiate connection with tracker: %w", err)
+	}
+
+	return &udpTrackerConnection{conn: conn, host: parsedUrl.Host, maxRetransmissions: maxUDPTrackerRetransmissions}, nil
+}
+
+/*
+Limits the number of times requests are retransmitted, and the time spent waiting for every response of the connection
+(e.g. to both the 'connect' and 'announce' requests) to the time a single request takes to time out.
+*/
+func (c *udpTrackerConnection) limitRetransmissions(maxRetransmissions int) {
+	c.maxRetransmissions = maxRetransmissions
+	c.deadline = time.Now().Add(udpTrackerTimeout * time.Duration(1<<(maxRetransmissions+1)-1))
+}
+
+func (c *udpTrackerConnection) Close() error {
+	return c.conn.Close()
+}
+
+// Reports whether the tracker is reached over IPv4, in which case peers are returned in the 6 byte compact format.
+func (c *udpTrackerConnection) isIPv4() bool {
+	addr, ok := c.conn.RemoteAddr().(*net.UDPAddr)
+
+	return ok && addr.IP.To4() != nil
+}
+
+/*
+Sends a request to the tracker and waits for the response with the same transaction id.
+
+Every read returns a single datagram. Datagrams with a different transaction id (e.g. late responses to
+a previous request) are ignored. If no response is received in time, the request is retransmitted,
+after `beforeRetransmit` (if set) has had a chance to update it. An 'error' response is returned as a `*udpTrackerError`.
+*/
+func (c *udpTrackerConnection) roundTrip(request []byte, action UDPTrackerActionId, transactionId uint32, beforeRetransmit func(request []byte) error) ([]byte, error) {
+	buffer := make([]byte, maxUDPPacketSize)
+
+	for attempt := 0; attempt <= c.maxRetransmissions; attempt++ {
+		if attempt > 0 && beforeRetransmit != nil {
+			if err := beforeRetransmit(request); err != nil {
+				return nil, err
+			}
+		}
+
+		readDeadline := time.Now().Add(udpTrackerTimeout * time.Duration(1<<attempt))
+
+		if !c.deadline.IsZero() && c.deadline.Before(readDeadline) {
+			readDeadline = c.deadline
+		}
+
+		if !readDeadline.After(time.Now()) {
+			break
+		}
+
+		if _, err := c.conn.Write(request); err != nil {
+			return nil, fmt.Errorf("failed to send request to tracker: %w", err)
+		}
+
+		if err := c.conn.SetReadDeadline(readDeadline); err != nil {
+			return nil, err
+		}
+
+		for {
+			bytesRead, err := c.conn.Read(buffer)
+
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				break
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("failed to receive response from tracker: %w", err)
+			}
+
+			if bytesRead < udpResponseHeaderSize || binary.BigEndian.Uint32(buffer[4:]) != transactionId {
+				continue
+			}
+
+			response := append([]byte{}, buffer[:bytesRead]...)
+			receivedAction := UDPTrackerActionId(binary.BigEndian.Uint32(response))
+
+			if receivedAction == errorActionId {
+				return nil, &udpTrackerError{message: string(response[udpResponseHeaderSize:])}
+			}
+
+			if receivedAction != action {
+				return nil, fmt.Errorf("received action value '%d' does not match expected value '%d'", receivedAction, action)
+			}
+
+			return response, nil
+		}
+	}
+
+	return nil, errUDPTrackerResponseTimedOut
+}
+
+/*
+Returns a connection id for the tracker, reusing the cached one if it hasn't expired.
+
+Connect request:
+
+	Offset  Size            Name            Value
+	0       64-bit integer  protocol_id     0x41727101980 // magic constant
+	8       32-bit integer  action          0 // connect
+	12      32-bit integer  transaction_id
+	16
+
+Connect response:
+
+	Offset  Size            Name            Value
+	0       32-bit integer  action          0 // connect
+	4       32-bit integer  transaction_id
+	8       64-bit integer  connection_id
+	16
+*/
+func (c *udpTrackerConnection) connect() (uint64, error) {
+	if connectionId, ok := udpConnectionIds.get(c.host); ok {
+		return connectionId, nil
+	}
+
+	transactionId := rand.Uint32()
+	request := make([]byte, udpConnectRequestSize)
+
+	binary.BigEndian.PutUint64(request, udpProtocolId)
+	binary.BigEndian.PutUint32(request[8:], uint32(connectActionId))
+	binary.BigEndian.PutUint32(request[12:], transactionId)
+
+	response, err := c.roundTrip(request, connectActionId, transactionId, nil)
+
+	if err != nil {
+		return 0, fmt.Errorf("'connect' request failed: %w", err)
+	}
+
+	if receivedSize := len(response); receivedSize < udpConnectResponseSize {
+		return 0, fmt.Errorf("'connect' response should contain %d bytes, but received %d", udpConnectResponseSize, receivedSize)
+	}
+
+	connectionId := binary.BigEndian.Uint64(response[8:])
+	udpConnectionIds.set(c.host, connectionId)
+
+	return connectionId, nil
+}
+
+/*
+Sends an 'announce' or 'scrape' request, whose body follows the common header:
+
+	Offset  Size            Name            Value
+	0       64-bit integer  connection_id
+	8       32-bit integer  action
+	12      32-bit integer  transaction_id
+	16
+
+The connection id of retransmitted requests is renewed once it has expired, since retransmissions can outlast its lifetime.
+The cached connection id is discarded if the tracker responds with an error, since it may have expired on the tracker's side.
+*/
+func (c *udpTrackerConnection) send(action UDPTrackerActionId, body []byte) ([]byte, error) {
+	connectionId, err := c.connect()
+
+	if err != nil {
+		return nil, err
+	}
+
+	transactionId := rand.Uint32()
+	request := make([]byte, udpRequestHeaderSize+len(body))
+
+	binary.BigEndian.PutUint64(request, connectionId)
+	binary.BigEndian.PutUint32(request[8:], uint32(action))
+	binary.BigEndian.PutUint32(request[12:], transactionId)
+	copy(request[udpRequestHeaderSize:], body)
+
+	response, err := c.roundTrip(request, action, transactionId, func(request []byte) error {
+		connectionId, err := c.connect()
+
+		if err != nil {
+			return err
+		}
+
+		binary.BigEndian.PutUint64(request, connectionId)
+
+		return nil
+	})
+
+	if trackerErr := (*udpTrackerError)(nil); errors.As(err, &trackerErr) {
+		udpConnectionIds.delete(c.host)
+	}
+
+	return response, err
+}
+
+/*
+IPv4 announce response:
+
+	Offset      Size            Name            Value
+	0           32-bit integer  action          1 // announce
+	4           32-bit integer  transaction_id
+	8           32-bit integer  interval
+	12          32-bit integer  leechers
+	16          32-bit integer  seeders
+	20 + 6 * n  32-bit integer  IP address
+	24 + 6 * n  16-bit integer  TCP port
+	20 + 6 * N
+
+IPv6 announce responses have the same layout, with 16 byte IP addresses.
+*/
+func (tr *Torrent) parseUDPAnnounceResponse(response []byte, peerSize int, infoHash [sha1.Size]byte) (*announceResponse, error) {
+	if receivedSize := len(response); receivedSize < udpAnnounceResponseSize {
+		return nil, fmt.Errorf("'announce' response should contain at least %d bytes", udpAnnounceResponseSize)
+	}
+
+	peers, err := parseCompactPeers(string(response[udpAnnounceResponseSize:]), peerSize, infoHash)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse peers list: %w", err)
+	}
+
+	return &announceResponse{
+		interval: time.Duration(binary.BigEndian.Uint32(response[8:])) * time.Second,
+		leechers: int(binary.BigEndian.Uint32(response[12:])),
+		peers:    peers,
+		seeders:  int(binary.BigEndian.Uint32(response[16:])),
+	}, nil
+}
+
+/*
+Sends an announce request to a UDP tracker.
+
+IPv4 announce request:
+
+	Offset  Size            Name            Value
+	0       64-bit integer  connection_id
+	8       32-bit integer  action          1 // announce
+	12      32-bit integer  transaction_id
+	16      20-byte string  info_hash
+	36      20-byte string  peer_id
+	56      64-bit integer  downloaded
+	64      64-bit integer  left
+	72      64-bit integer  uploaded
+	80      32-bit integer  event           0 // 0: none; 1: completed; 2: started; 3: stopped
+	84      32-bit integer  IP address      0 // default
+	88      32-bit integer  key
+	92      32-bit integer  num_want        -1 // default
+	96      16-bit integer  port
+	98
+*/
+func (tr *Torrent) sendUDPAnnounceRequest(trackerUrl string, announceReq announceRequest) (*announceResponse, error) {
+	conn, err := dialUDPTracker(trackerUrl)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	if announceReq.hasAlternatives {
+		conn.limitRetransmissions(maxUDPTrackerFallthroughRetransmissions)
+	}
+
+	body := make([]byte, udpAnnounceRequestSize-udpRequestHeaderSize)
+	index := 0
+
+	index += copy(body[index:], announceReq.infoHash[:])
+	index += copy(body[index:], tr.peerId[:])
+
+	binary.BigEndian.PutUint64(body[index:], uint64(announceReq.downloaded))
+	index += 8
+
+	binary.BigEndian.PutUint64(body[index:], uint64(announceReq.left))
+	index += 8
+
+	binary.BigEndian.PutUint64(body[index:], uint64(announceReq.uploaded))
+	index += 8
+
+	binary.BigEndian.PutUint32(body[index:], uint32(announceReq.event))
+	index += 4
+
+	// Let the tracker use the address the request was sent from.
+	binary.BigEndian.PutUint32(body[index:], 0)
+	index += 4
+
+	binary.BigEndian.PutUint32(body[index:], tr.trackerKey)
+	index += 4
+
+	numWant := int32(-1)
+	binary.BigEndian.PutUint32(body[index:], uint32(numWant))
+	index += 4
+
+	binary.BigEndian.PutUint16(body[index:], tr.listenPort)
+
+	response, err := conn.send(announceActionId, body)
+
+	if err != nil {
+		return nil, fmt.Errorf("'announce' request failed: %w", err)
+	}
+
+	peerSize := compactPeer6Size
+
+	if conn.isIPv4() {
+		peerSize = compactPeerSize
+	}
+
+	return tr.parseUDPAnnounceResponse(response, peerSize, announceReq.infoHash)
+}
@@ -0,0 +1,339 @@
+package torrent_test
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+const testMagnetLink = "magnet:?xt=urn:btih:c9e15763f722f23e98a29decdfae341b98d53056&dn=hail"
+
+type fakeUDPTrackerConfig struct {
+	// Number of announce requests to ignore before responding, used to test retransmissions.
+	dropAnnouncements int
+	// If set, every announce request is answered with an error response containing the message.
+	errorMessage string
+}
+
+// An in-process UDP tracker (BEP 15) that records the requests it receives.
+type fakeUDPTracker struct {
+	config fakeUDPTrackerConfig
+	conn   *net.UDPConn
+
+	mutex sync.Mutex
+	// Number of requests of each action received.
+	requests      map[uint32]int
+	announceEvent uint32
+	announceKeys  []uint32
+	peerId        []byte
+}
+
+func newFakeUDPTracker(t *testing.T, config fakeUDPTrackerConfig) *fakeUDPTracker {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := &fakeUDPTracker{config: config, conn: conn, requests: make(map[uint32]int)}
+	t.Cleanup(func() { conn.Close() })
+
+	go tracker.serve()
+
+	return tracker
+}
+
+func (ft *fakeUDPTracker) url() string {
+	return fmt.Sprintf("udp://%s/announce", ft.conn.LocalAddr())
+}
+
+func (ft *fakeUDPTracker) count(action uint32) int {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+
+	return ft.requests[action]
+}
+
+// Returns the peer_id, event and keys sent in the announce requests received so far.
+func (ft *fakeUDPTracker) announcements() (string, uint32, []uint32) {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+
+	return string(ft.peerId), ft.announceEvent, append([]uint32{}, ft.announceKeys...)
+}
+
+func (ft *fakeUDPTracker) serve() {
+	const connectionId = 0xC0FFEE
+	buffer := make([]byte, 2048)
+
+	for {
+		bytesRead, addr, err := ft.conn.ReadFromUDP(buffer)
+
+		if err != nil {
+			return
+		}
+
+		request := buffer[:bytesRead]
+
+		if bytesRead < 16 {
+			continue
+		}
+
+		action := binary.BigEndian.Uint32(request[8:])
+		transactionId := binary.BigEndian.Uint32(request[12:])
+		response := binary.BigEndian.AppendUint32(nil, action)
+		response = binary.BigEndian.AppendUint32(response, transactionId)
+
+		ft.mutex.Lock()
+		ft.requests[action] += 1
+
+		switch action {
+		case 0:
+			response = binary.BigEndian.AppendUint64(response, connectionId)
+
+		case 1:
+			if ft.config.dropAnnouncements > 0 {
+				ft.config.dropAnnouncements -= 1
+				ft.mutex.Unlock()
+				continue
+			}
+
+			if ft.config.errorMessage != "" || binary.BigEndian.Uint64(request) != connectionId {
+				response = binary.BigEndian.AppendUint32(nil, 3)
+				response = binary.BigEndian.AppendUint32(response, transactionId)
+				response = append(response, ft.config.errorMessage...)
+				break
+			}
+
+			ft.peerId = append([]byte{}, request[36:56]...)
+			ft.announceEvent = binary.BigEndian.Uint32(request[80:])
+			ft.announceKeys = append(ft.announceKeys, binary.BigEndian.Uint32(request[88:]))
+
+			response = binary.BigEndian.AppendUint32(response, 1800)
+			response = binary.BigEndian.AppendUint32(response, 7)
+			response = binary.BigEndian.AppendUint32(response, 3)
+			response = append(response, 10, 0, 0, 1, 0x1A, 0xE1, 10, 0, 0, 2, 0x1A, 0xE2)
+
+		case 2:
+			for index := range (bytesRead - 16) / sha1.Size {
+				response = binary.BigEndian.AppendUint32(response, uint32(10+index))
+				response = binary.BigEndian.AppendUint32(response, uint32(20+index))
+				response = binary.BigEndian.AppendUint32(response, uint32(30+index))
+			}
+		}
+
+		ft.mutex.Unlock()
+		ft.conn.WriteToUDP(response, addr)
+	}
+}
+
+func newTestTorrent(t *testing.T) torrent.Torrent {
+	t.Helper()
+
+	trrnt, err := torrent.NewTorrent(testMagnetLink)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return trrnt
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	tracker := newFakeUDPTracker(t, fakeUDPTrackerConfig{})
+	trrnt := newTestTorrent(t)
+
+	result, err := trrnt.AnnounceToTracker(tracker.url())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Interval != 1800*time.Second {
+		t.Errorf("expected interval to be %v, but got %v", 1800*time.Second, result.Interval)
+	}
+
+	if result.Leechers != 7 || result.Seeders != 3 {
+		t.Errorf("expected 7 leechers and 3 seeders, but got %d leechers and %d seeders", result.Leechers, result.Seeders)
+	}
+
+	expectedPeers := []string{"10.0.0.1:6881", "10.0.0.2:6882"}
+
+	if strings.Join(result.Peers, ",") != strings.Join(expectedPeers, ",") {
+		t.Errorf("expected peers to be %v, but got %v", expectedPeers, result.Peers)
+	}
+
+	peerId := trrnt.PeerId()
+	receivedPeerId, event, _ := tracker.announcements()
+
+	if receivedPeerId != string(peerId[:]) {
+		t.Errorf("expected peer_id to be %q, but got %q", peerId, receivedPeerId)
+	}
+
+	if event != 2 {
+		t.Errorf("expected event to be 2 (started), but got %d", event)
+	}
+}
+
+func TestUDPTrackerReusesConnectionId(t *testing.T) {
+	tracker := newFakeUDPTracker(t, fakeUDPTrackerConfig{})
+	trrnt := newTestTorrent(t)
+
+	for range 3 {
+		if _, err := trrnt.AnnounceToTracker(tracker.url()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if connects := tracker.count(0); connects != 1 {
+		t.Errorf("expected 1 'connect' request, but got %d", connects)
+	}
+
+	if _, _, keys := tracker.announcements(); keys[0] != keys[1] || keys[1] != keys[2] {
+		t.Errorf("expected the same key to be sent in every announcement, but got %v", keys)
+	}
+}
+
+func TestUDPTrackerReconnectsAfterConnectionIdExpires(t *testing.T) {
+	defer torrent.SetUDPTrackerTimeouts(time.Second, 50*time.Millisecond)()
+
+	tracker := newFakeUDPTracker(t, fakeUDPTrackerConfig{})
+	trrnt := newTestTorrent(t)
+
+	for range 2 {
+		if _, err := trrnt.AnnounceToTracker(tracker.url()); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if connects := tracker.count(0); connects != 2 {
+		t.Errorf("expected 2 'connect' requests, but got %d", connects)
+	}
+}
+
+func TestUDPTrackerErrorResponse(t *testing.T) {
+	tracker := newFakeUDPTracker(t, fakeUDPTrackerConfig{errorMessage: "unregistered torrent"})
+	trrnt := newTestTorrent(t)
+
+	_, err := trrnt.AnnounceToTracker(tracker.url())
+
+	if err == nil || !strings.Contains(err.Error(), "unregistered torrent") {
+		t.Errorf("expected error to contain the tracker's message, but got '%v'", err)
+	}
+}
+
+func TestUDPTrackerRetransmitsRequests(t *testing.T) {
+	defer torrent.SetUDPTrackerTimeouts(100*time.Millisecond, time.Minute)()
+
+	tracker := newFakeUDPTracker(t, fakeUDPTrackerConfig{dropAnnouncements: 1})
+	trrnt := newTestTorrent(t)
+
+	if _, err := trrnt.AnnounceToTracker(tracker.url()); err != nil {
+		t.Fatal(err)
+	}
+
+	if announcements := tracker.count(1); announcements != 2 {
+		t.Errorf("expected 2 'announce' requests, but got %d", announcements)
+	}
+}
+
+func TestUDPTrackerReconnectsWhileRetransmitting(t *testing.T) {
+	// The third announcement is sent 300ms after the first, once the connection id has expired.
+	defer torrent.SetUDPTrackerTimeouts(100*time.Millisecond, 150*time.Millisecond)()
+
+	tracker := newFakeUDPTracker(t, fakeUDPTrackerConfig{dropAnnouncements: 2})
+	trrnt := newTestTorrent(t)
+
+	if _, err := trrnt.AnnounceToTracker(tracker.url()); err != nil {
+		t.Fatal(err)
+	}
+
+	if announcements := tracker.count(1); announcements != 3 {
+		t.Errorf("expected 3 'announce' requests, but got %d", announcements)
+	}
+
+	if connects := tracker.count(0); connects != 2 {
+		t.Errorf("expected 2 'connect' requests, but got %d", connects)
+	}
+}
+
+func TestUDPTrackerTimeout(t *testing.T) {
+	defer torrent.SetUDPTrackerTimeouts(20*time.Millisecond, time.Minute)()
+
+	tracker := newFakeUDPTracker(t, fakeUDPTrackerConfig{dropAnnouncements: 100})
+	trrnt := newTestTorrent(t)
+
+	if _, err := trrnt.AnnounceToTracker(tracker.url()); err == nil {
+		t.Error("expected announcement to an unresponsive tracker to fail")
+	}
+}
+
+func TestUDPTrackerScrape(t *testing.T) {
+	tracker := newFakeUDPTracker(t, fakeUDPTrackerConfig{})
+	result, err := torrent.ScrapeTracker(tracker.url(), sha1.Sum([]byte("a")))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Seeders != 10 || result.Completed != 20 || result.Leechers != 30 {
+		t.Errorf("unexpected scrape result: %+v", result)
+	}
+}
+
+func TestUDPTrackerFallthrough(t *testing.T) {
+	defer torrent.SetUDPTrackerTimeouts(50*time.Millisecond, time.Minute)()
+
+	tests := []struct {
+		name            string
+		hasAlternatives bool
+		// Number of times the unresponsive tracker is sent the 'announce' request.
+		expectedAnnouncements int
+		maxDuration           time.Duration
+	}{
+		{name: "only tracker in its tier", expectedAnnouncements: 3, maxDuration: time.Second},
+		// 50 + 100 milliseconds, instead of 50 + 100 + 200.
+		{name: "other trackers in its tier", hasAlternatives: true, expectedAnnouncements: 2, maxDuration: 300 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			udpTracker := newFakeUDPTracker(t, fakeUDPTrackerConfig{dropAnnouncements: 100})
+			httpTracker := newFakeHTTPTracker(t, nil)
+			trrnt := newTestTorrent(t)
+			tier := []string{udpTracker.url()}
+
+			if test.hasAlternatives {
+				tier = append(tier, httpTracker.tiers([][]string{{"a"}})[0][0])
+			}
+
+			trrnt.SetTrackerTiers([][]string{tier})
+
+			start := time.Now()
+			trrnt.AnnounceToTiers()
+
+			if elapsed := time.Since(start); elapsed > test.maxDuration {
+				t.Errorf("expected to give up on the tracker within %v, but took %v", test.maxDuration, elapsed)
+			}
+
+			if announcements := udpTracker.count(1); announcements != test.expectedAnnouncements {
+				t.Errorf("expected %d 'announce' requests, but got %d", test.expectedAnnouncements, announcements)
+			}
+
+			if announced := httpTracker.announcedTo(); test.hasAlternatives && len(announced) != 1 {
+				t.Errorf("expected to fall through to the next tracker, but announced to %v", announced)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package torrent
+
+import (
+	"time"
+
+	"github.com/MlkMahmud/hail/logging"
+)
+
+// Returns a block of a completed piece, requested by a peer.
+func (tr *Torrent) getBlock(pieceIndex int, begin int, length int) ([]byte, bool) {
+	tr.mutex.Lock()
+	dl := tr.download
+	tr.mutex.Unlock()
+
+	if dl == nil || !dl.picker.isPieceCompleted(pieceIndex) {
+		return nil, false
+	}
+
+	piece := dl.info.pieces[pieceIndex]
+
+	if begin < 0 || begin+length > piece.Length {
+		return nil, false
+	}
+
+	data, err := dl.storage.readBlock(piece, begin, length)
+
+	if err != nil {
+		tr.logger.Error("failed to read block", logging.PieceKey, pieceIndex, logging.ErrorKey, err)
+		return nil, false
+	}
+
+	return data, true
+}
+
+// Returns the pieces we have, or nil if the download hasn't started.
+func (tr *Torrent) completedPieces() []bool {
+	tr.mutex.Lock()
+	dl := tr.download
+	tr.mutex.Unlock()
+
+	if dl == nil {
+		return nil
+	}
+
+	return dl.picker.completedPieces()
+}
+
+func (tr *Torrent) recordUpload(n int) {
+	tr.counters.uploaded.Add(int64(n))
+	tr.uploadMeter.add(n)
+
+	tr.mutex.Lock()
+	tr.lastUpload = time.Now()
+	tr.mutex.Unlock()
+}
+
+// Tells every connected peer that we have a piece we just downloaded, so they can request it from us.
+func (tr *Torrent) broadcastHave(pieceIndex int) {
+	tr.mutex.Lock()
+
+	peerConnections := make([]*PeerConnection, 0, len(tr.peerConnections))
+
+	for _, peerConnection := range tr.peerConnections {
+		peerConnections = append(peerConnections, peerConnection)
+	}
+
+	tr.mutex.Unlock()
+
+	for _, peerConnection := range peerConnections {
+		peerConnection.sendHaveMessage(pieceIndex)
+	}
+}
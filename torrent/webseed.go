@@ -0,0 +1,331 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MlkMahmud/hail/logging"
+)
+
+type webSeedKind int
+
+const (
+	// BEP 19: the URL points to the torrent's files, which are downloaded with HTTP Range requests.
+	urlListWebSeed webSeedKind = iota
+	// BEP 17: the URL points to a script that serves whole pieces.
+	httpSeedWebSeed
+)
+
+/*
+An HTTP server that hosts the torrent's data.
+
+Web seeds take part in the download like regular peers that have every piece: they are handed pieces by the piece picker,
+and the pieces they serve must pass hash verification. A web seed that fails is retried after a delay that doubles after
+every consecutive failure.
+*/
+type webSeed struct {
+	kind webSeedKind
+	url  string
+
+	client *http.Client
+	// Limits the rate at which response bodies are read. Shared with the torrent's peer connections.
+	downloadLimiter *RateLimiter
+	// Number of consecutive failed requests.
+	failures int
+}
+
+// Returned by BEP 17 seeds that are too busy to serve the request.
+type webSeedBusyError struct {
+	retryAfter time.Duration
+}
+
+var (
+	webSeedRetryDelay    = 15 * time.Second
+	maxWebSeedRetryDelay = 10 * time.Minute
+	// Amount of time a web seed waits before asking the piece picker again when every remaining piece is being downloaded by other sources.
+	webSeedIdleDelay = 5 * time.Second
+	webSeedTimeout   = 30 * time.Second
+)
+
+func (e webSeedBusyError) Error() string {
+	return fmt.Sprintf("web seed is busy, retry in %s", e.retryAfter)
+}
+
+func newWebSeed(kind webSeedKind, url string) *webSeed {
+	return &webSeed{kind: kind, url: url, client: &http.Client{Timeout: webSeedTimeout}}
+}
+
+/*
+Parses the "url-list" (BEP 19) and "httpseeds" (BEP 17) properties of a metainfo file.
+
+"url-list" can either be a single URL or a list of URLs, while "httpseeds" is always a list.
+*/
+func parseWebSeeds(metainfo map[string]any) ([]*webSeed, error) {
+	webSeeds := []*webSeed{}
+	seen := make(map[string]bool)
+
+	add := func(kind webSeedKind, value any, property string) error {
+		urls := []any{}
+
+		switch value := value.(type) {
+		case string:
+			{
+				urls = append(urls, value)
+			}
+
+		case []any:
+			{
+				urls = value
+			}
+
+		default:
+			{
+				return fmt.Errorf("\"%s\" property should be a string or a list, but received '%T'", property, value)
+			}
+		}
+
+		for index, entry := range urls {
+			webSeedUrl, ok := entry.(string)
+
+			if !ok {
+				return fmt.Errorf("\"%s\" list contains an invalid entry at index %d", property, index)
+			}
+
+			if !isSupportedWebSeedURL(webSeedUrl) || seen[webSeedUrl] {
+				continue
+			}
+
+			seen[webSeedUrl] = true
+			webSeeds = append(webSeeds, newWebSeed(kind, webSeedUrl))
+		}
+
+		return nil
+	}
+
+	if value, ok := metainfo["url-list"]; ok {
+		if err := add(urlListWebSeed, value, "url-list"); err != nil {
+			return nil, err
+		}
+	}
+
+	if value, ok := metainfo["httpseeds"]; ok {
+		if _, isList := value.([]any); !isList {
+			return nil, fmt.Errorf("\"httpseeds\" property should be a list, but received '%T'", value)
+		}
+
+		if err := add(httpSeedWebSeed, value, "httpseeds"); err != nil {
+			return nil, err
+		}
+	}
+
+	return webSeeds, nil
+}
+
+func isSupportedWebSeedURL(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+}
+
+/*
+Returns the URL of a file hosted by a BEP 19 web seed.
+
+For single-file torrents, the URL points to the file itself, unless it ends with a slash, in which case the torrent's name is appended.
+For multi-file torrents, the URL points to a directory: the torrent's name and the file's path are appended to it.
+*/
+func (ws *webSeed) fileURL(info *torrentInfo, f *file) string {
+	if !info.isMultiFile && !strings.HasSuffix(ws.url, "/") {
+		return ws.url
+	}
+
+	segments := strings.Split(filepath.ToSlash(f.Name), "/")
+
+	for index, segment := range segments {
+		segments[index] = url.PathEscape(segment)
+	}
+
+	return strings.TrimSuffix(ws.url, "/") + "/" + strings.Join(segments, "/")
+}
+
+func (ws *webSeed) retryDelay() time.Duration {
+	delay := float64(webSeedRetryDelay) * math.Pow(2, float64(max(ws.failures-1, 0)))
+
+	return time.Duration(min(delay, float64(maxWebSeedRetryDelay)))
+}
+
+func (ws *webSeed) downloadPiece(info *torrentInfo, infoHash [sha1.Size]byte, piece Piece) ([]byte, error) {
+	if ws.kind == httpSeedWebSeed {
+		return ws.requestPiece(infoHash, piece)
+	}
+
+	data := make([]byte, piece.Length)
+	pieceOffset := piece.Index * info.pieceLength
+
+	// A piece of a multi-file torrent can span several files, each of which is requested separately.
+	// Padding files aren't served by web seeds: their bytes are left zeroed.
+	for _, section := range info.pieceSections(piece) {
+		sectionData, err := ws.requestRange(ws.fileURL(info, section.file), section.offset, section.length)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to download piece %d from web seed %s: %w", piece.Index, ws.url, err)
+		}
+
+		copy(data[section.file.Offset+section.offset-pieceOffset:], sectionData)
+	}
+
+	return data, nil
+}
+
+// Downloads `length` bytes of a file starting at `offset` with an HTTP Range request.
+func (ws *webSeed) requestRange(fileUrl string, offset int, length int) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, fileUrl, nil)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	res, err := ws.client.Do(req)
+
+	if err != nil {
+		return nil, fmt.Errorf("HTTP request failed: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	body := newRateLimitedReader(res.Body, ws.downloadLimiter)
+
+	// Servers that don't support range requests send the whole file.
+	if res.StatusCode == http.StatusOK {
+		if _, err := io.CopyN(io.Discard, body, int64(offset)); err != nil {
+			return nil, fmt.Errorf("failed to read HTTP response body: %w", err)
+		}
+	} else if res.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("received NON-OK HTTP status code \"%d\"", res.StatusCode)
+	}
+
+	data := make([]byte, length)
+
+	if _, err := io.ReadFull(body, data); err != nil {
+		return nil, fmt.Errorf("failed to read HTTP response body: %w", err)
+	}
+
+	return data, nil
+}
+
+/*
+Downloads a whole piece from a BEP 17 seed:
+
+	<url>?info_hash=<info hash>&piece=<piece index>
+
+Seeds that are too busy respond with a 503 status code and the number of seconds to wait before retrying as the body.
+*/
+func (ws *webSeed) requestPiece(infoHash [sha1.Size]byte, piece Piece) ([]byte, error) {
+	separator := "?"
+
+	if strings.Contains(ws.url, "?") {
+		separator = "&"
+	}
+
+	pieceUrl := fmt.Sprintf("%s%sinfo_hash=%s&piece=%d", ws.url, separator, url.QueryEscape(string(infoHash[:])), piece.Index)
+	res, err := ws.client.Get(pieceUrl)
+
+	if err != nil {
+		return nil, fmt.Errorf("HTTP request failed: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusServiceUnavailable {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 32))
+		seconds, err := strconv.Atoi(strings.TrimSpace(string(body)))
+
+		if err != nil || seconds < 0 {
+			seconds = int(webSeedRetryDelay.Seconds())
+		}
+
+		return nil, webSeedBusyError{retryAfter: time.Duration(seconds) * time.Second}
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received NON-OK HTTP status code \"%d\"", res.StatusCode)
+	}
+
+	data := make([]byte, piece.Length)
+
+	if _, err := io.ReadFull(newRateLimitedReader(res.Body, ws.downloadLimiter), data); err != nil {
+		return nil, fmt.Errorf("failed to read HTTP response body: %w", err)
+	}
+
+	return data, nil
+}
+
+// Downloads pieces from the web seed until every piece has been downloaded or the torrent is stopped.
+func (tr *Torrent) downloadFromWebSeed(ws *webSeed) {
+	dl, ok := tr.waitForDownload()
+
+	if !ok {
+		return
+	}
+
+	ws.downloadLimiter = tr.downloadLimiter
+
+	for {
+		if !tr.waitUntilResumed() {
+			return
+		}
+
+		piece, ok := dl.picker.pick(dl.info.canVerifyPiece)
+		delay := webSeedIdleDelay
+
+		if ok {
+			data, err := ws.downloadPiece(dl.info, tr.infoHash, piece)
+
+			if err == nil {
+				err = tr.storePiece(dl, piece, data, ws.url)
+			}
+
+			if err == nil {
+				ws.failures = 0
+				continue
+			}
+
+			dl.picker.release(piece.Index)
+			ws.failures += 1
+			delay = ws.retryDelay()
+
+			var busyErr webSeedBusyError
+
+			if errors.As(err, &busyErr) {
+				delay = busyErr.retryAfter
+			}
+
+			tr.webSeedLogger.Warn("web seed failed, retrying", "url", ws.url, "delay", delay, logging.ErrorKey, err)
+		}
+
+		select {
+		case <-tr.ctx.Done():
+			{
+				return
+			}
+
+		case <-dl.picker.completedCh:
+			{
+				return
+			}
+
+		case <-time.After(delay):
+			{
+				continue
+			}
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package torrent_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+func TestWebSeedSingleFile(t *testing.T) {
+	data := randomBytes(t, 3*testPieceLength+1234)
+	srcDir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(srcDir, "file.bin"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(srcDir)))
+	defer server.Close()
+
+	// The torrent's name is appended to URLs that end with a slash.
+	trrnt, outputDir := newTestTorrentFile(t, "file.bin", []testFile{{data: data}}, map[string]any{"url-list": server.URL + "/"})
+
+	if err := trrnt.DownloadFromWebSeeds(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	assertFileContents(t, filepath.Join(outputDir, "file.bin"), data)
+}
+
+func TestWebSeedDownloadRateLimit(t *testing.T) {
+	data := randomBytes(t, 4*testPieceLength)
+	srcDir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(srcDir, "limited.bin"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(srcDir)))
+	defer server.Close()
+
+	trrnt, outputDir := newTestTorrentFile(t, "limited.bin", []testFile{{data: data}}, map[string]any{"url-list": server.URL + "/limited.bin"})
+	// The bucket holds one second worth of bytes, so the other half of the data takes at least a second to download.
+	trrnt.UseRateLimiters(torrent.NewRateLimiter(2*testPieceLength), nil)
+	start := time.Now()
+
+	if err := trrnt.DownloadFromWebSeeds(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Fatalf("expected the download to be limited to %d bytes per second, but it took %v", 2*testPieceLength, elapsed)
+	}
+
+	assertFileContents(t, filepath.Join(outputDir, "limited.bin"), data)
+}
+
+func TestWebSeedMultiFile(t *testing.T) {
+	files := []testFile{
+		{path: []any{"a.txt"}, data: randomBytes(t, 10000)},
+		{path: []any{"sub dir", "b.txt"}, data: randomBytes(t, 30000)},
+		{path: []any{"c.txt"}, data: randomBytes(t, 5)},
+	}
+
+	srcDir := t.TempDir()
+
+	for _, f := range files {
+		path := filepath.Join(srcDir, "multi")
+
+		for _, segment := range f.path {
+			path = filepath.Join(path, segment.(string))
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, f.data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(srcDir)))
+	defer server.Close()
+
+	trrnt, outputDir := newTestTorrentFile(t, "multi", files, map[string]any{"url-list": []any{server.URL}})
+
+	if err := trrnt.DownloadFromWebSeeds(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	assertFileContents(t, filepath.Join(outputDir, "multi", "a.txt"), files[0].data)
+	assertFileContents(t, filepath.Join(outputDir, "multi", "sub dir", "b.txt"), files[1].data)
+	assertFileContents(t, filepath.Join(outputDir, "multi", "c.txt"), files[2].data)
+}
+
+func TestWebSeedRetriesAfterErrors(t *testing.T) {
+	defer torrent.SetWebSeedRetryDelay(10 * time.Millisecond)()
+
+	data := randomBytes(t, 2*testPieceLength)
+
+	var mutex sync.Mutex
+	numOfRequests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		numOfRequests += 1
+		requestNumber := numOfRequests
+		mutex.Unlock()
+
+		switch requestNumber {
+		case 1:
+			{
+				http.Error(w, "unavailable", http.StatusInternalServerError)
+			}
+
+		// Data that doesn't match the piece's hash.
+		case 2:
+			{
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(make([]byte, testPieceLength))
+			}
+
+		default:
+			{
+				http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+			}
+		}
+	}))
+	defer server.Close()
+
+	trrnt, outputDir := newTestTorrentFile(t, "file.bin", []testFile{{data: data}}, map[string]any{"url-list": server.URL + "/file.bin"})
+
+	if err := trrnt.DownloadFromWebSeeds(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	assertFileContents(t, filepath.Join(outputDir, "file.bin"), data)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if numOfRequests != 4 {
+		t.Errorf("expected 4 requests (2 failures and 2 pieces), but got %d", numOfRequests)
+	}
+}
+
+func TestHTTPSeed(t *testing.T) {
+	defer torrent.SetWebSeedRetryDelay(10 * time.Millisecond)()
+
+	data := randomBytes(t, 2*testPieceLength+100)
+
+	var mutex sync.Mutex
+	busy := true
+	infoHashes := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		infoHashes = append(infoHashes, r.URL.Query().Get("info_hash"))
+
+		// The first request is answered with the number of seconds to wait before retrying.
+		if busy {
+			busy = false
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("0"))
+
+			return
+		}
+
+		index, err := strconv.Atoi(r.URL.Query().Get("piece"))
+
+		if err != nil || index*testPieceLength >= len(data) {
+			http.Error(w, "invalid piece", http.StatusBadRequest)
+			return
+		}
+
+		w.Write(data[index*testPieceLength : min((index+1)*testPieceLength, len(data))])
+	}))
+	defer server.Close()
+
+	trrnt, outputDir := newTestTorrentFile(t, "file.bin", []testFile{{data: data}}, map[string]any{"httpseeds": []any{server.URL + "/seed"}})
+
+	if err := trrnt.DownloadFromWebSeeds(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	assertFileContents(t, filepath.Join(outputDir, "file.bin"), data)
+
+	infoHash := trrnt.InfoHash()
+
+	for _, received := range infoHashes {
+		if received != string(infoHash[:]) {
+			t.Errorf("expected info_hash parameter to be %x, but got %x", infoHash, received)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package tracker
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+
+	"github.com/MlkMahmud/hail/bencode"
+)
+
+func (t *Tracker) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/announce", t.handleHTTPAnnounce)
+	mux.HandleFunc("/scrape", t.handleHTTPScrape)
+	mux.HandleFunc("/stats", t.handleHTTPStats)
+
+	return mux
+}
+
+// Tracker errors are sent as a bencoded dictionary with a "failure reason" key and a 200 status code, as clients expect.
+func writeFailure(w http.ResponseWriter, reason string) {
+	writeBencoded(w, map[string]any{"failure reason": reason})
+}
+
+func writeBencoded(w http.ResponseWriter, value map[string]any) {
+	encodedValue, err := bencode.EncodeValue(value)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(encodedValue))
+}
+
+func parseInfoHash(value string) ([sha1.Size]byte, error) {
+	if len(value) != sha1.Size {
+		return [sha1.Size]byte{}, fmt.Errorf("info_hash must be %d bytes long", sha1.Size)
+	}
+
+	return [sha1.Size]byte([]byte(value)), nil
+}
+
+// Parses an address given in the "ip", "ipv4" or "ipv6" parameters, which may or may not include a port.
+func parseAddressParam(value string, defaultPort uint16) (netip.AddrPort, bool) {
+	if addrPort, err := netip.ParseAddrPort(value); err == nil {
+		return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()), true
+	}
+
+	if addr, err := netip.ParseAddr(value); err == nil {
+		return netip.AddrPortFrom(addr.Unmap(), defaultPort), true
+	}
+
+	return netip.AddrPort{}, false
+}
+
+func parseHTTPAnnounceRequest(r *http.Request) (announceRequest, bool, error) {
+	var req announceRequest
+
+	query, err := url.ParseQuery(r.URL.RawQuery)
+
+	if err != nil {
+		return req, false, fmt.Errorf("invalid query string")
+	}
+
+	if req.infoHash, err = parseInfoHash(query.Get("info_hash")); err != nil {
+		return req, false, err
+	}
+
+	if peerId := query.Get("peer_id"); len(peerId) == len(req.peerId) {
+		copy(req.peerId[:], peerId)
+	} else {
+		return req, false, fmt.Errorf("peer_id must be %d bytes long", len(req.peerId))
+	}
+
+	port, err := strconv.ParseUint(query.Get("port"), 10, 16)
+
+	if err != nil || port == 0 {
+		return req, false, fmt.Errorf("port is invalid")
+	}
+
+	if left := query.Get("left"); left != "" {
+		if req.left, err = strconv.ParseInt(left, 10, 64); err != nil {
+			return req, false, fmt.Errorf("left is invalid")
+		}
+	}
+
+	if numWant := query.Get("numwant"); numWant != "" {
+		req.numWant, _ = strconv.Atoi(numWant)
+	}
+
+	switch query.Get("event") {
+	case "started":
+		req.event = startedEvent
+	case "completed":
+		req.event = completedEvent
+	case "stopped":
+		req.event = stoppedEvent
+	}
+
+	// The peer is reachable on the address the request was sent from, and on the addresses it reports (BEP 7).
+	if remoteAddress, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		req.addresses = append(req.addresses, netip.AddrPortFrom(remoteAddress.Addr().Unmap(), uint16(port)))
+	}
+
+	for _, key := range []string{"ipv4", "ipv6"} {
+		address, ok := parseAddressParam(query.Get(key), uint16(port))
+
+		if !ok || (key == "ipv4" && !address.Addr().Is4()) || (key == "ipv6" && !address.Addr().Is6()) {
+			continue
+		}
+
+		if len(req.addresses) == 0 || req.addresses[0].Addr() != address.Addr() {
+			req.addresses = append(req.addresses, address)
+		}
+	}
+
+	compact := query.Get("compact") != "0"
+
+	return req, compact, nil
+}
+
+/*
+Handles an announce request and responds with the swarm's peers.
+
+Compact responses contain the IPv4 peers in the "peers" key (6 bytes per peer) and the IPv6 peers in the "peers6" key (18 bytes per peer).
+Otherwise, "peers" is a list of dictionaries with "ip" and "port" keys.
+*/
+func (t *Tracker) handleHTTPAnnounce(w http.ResponseWriter, r *http.Request) {
+	req, compact, err := parseHTTPAnnounceRequest(r)
+
+	if err != nil {
+		writeFailure(w, err.Error())
+		return
+	}
+
+	peers, stats, err := t.announce(req)
+
+	if err != nil {
+		writeFailure(w, err.Error())
+		return
+	}
+
+	response := map[string]any{
+		"complete":     stats.Seeders,
+		"incomplete":   stats.Leechers,
+		"interval":     int(t.config.Interval.Seconds()),
+		"min interval": int(t.config.Interval.Seconds() / 2),
+	}
+
+	if !compact {
+		peersList := make([]any, len(peers))
+
+		for index, peer := range peers {
+			peersList[index] = map[string]any{"ip": peer.Addr().String(), "port": int(peer.Port())}
+		}
+
+		response["peers"] = peersList
+		writeBencoded(w, response)
+
+		return
+	}
+
+	var peers4, peers6 []byte
+
+	for _, peer := range peers {
+		addr, _ := peer.Addr().MarshalBinary()
+		addr = binary.BigEndian.AppendUint16(addr, peer.Port())
+
+		if peer.Addr().Is4() {
+			peers4 = append(peers4, addr...)
+		} else {
+			peers6 = append(peers6, addr...)
+		}
+	}
+
+	response["peers"] = string(peers4)
+	response["peers6"] = string(peers6)
+
+	writeBencoded(w, response)
+}
+
+/*
+Handles a scrape request for the torrents given in the "info_hash" parameters:
+
+	d5:filesd20:<info hash>d8:completei<seeders>e10:downloadedi<completed>e10:incompletei<leechers>eeee
+
+If no info hash is given, every swarm is returned.
+*/
+func (t *Tracker) handleHTTPScrape(w http.ResponseWriter, r *http.Request) {
+	query, err := url.ParseQuery(r.URL.RawQuery)
+
+	if err != nil {
+		writeFailure(w, "invalid query string")
+		return
+	}
+
+	infoHashes := [][sha1.Size]byte{}
+
+	for _, value := range query["info_hash"] {
+		infoHash, err := parseInfoHash(value)
+
+		if err != nil {
+			writeFailure(w, err.Error())
+			return
+		}
+
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	var stats []SwarmStats
+
+	if len(infoHashes) == 0 {
+		t.numOfScrapes.Add(1)
+		stats = t.swarms.stats()
+	} else {
+		stats = t.scrape(infoHashes)
+	}
+
+	files := make(map[string]any, len(stats))
+
+	for _, swarmStats := range stats {
+		infoHash, err := swarmStats.rawInfoHash()
+
+		if err != nil {
+			continue
+		}
+
+		files[string(infoHash[:])] = map[string]any{
+			"complete":   swarmStats.Seeders,
+			"downloaded": swarmStats.Completed,
+			"incomplete": swarmStats.Leechers,
+		}
+	}
+
+	writeBencoded(w, map[string]any{"files": files})
+}
+
+func (t *Tracker) handleHTTPStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(t.Stats()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,213 @@
+package tracker
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+type announceEvent int
+
+// The values of the events match those used by the UDP tracker protocol.
+const (
+	noneEvent announceEvent = iota
+	completedEvent
+	startedEvent
+	stoppedEvent
+)
+
+// The parameters of an announce request, common to the HTTP and UDP protocols.
+type announceRequest struct {
+	// Addresses the peer accepts connections on. A peer can announce an IPv4 and an IPv6 address (BEP 7).
+	addresses []netip.AddrPort
+	event     announceEvent
+	infoHash  [sha1.Size]byte
+	left      int64
+	numWant   int
+	peerId    [20]byte
+}
+
+type peerEntry struct {
+	addresses []netip.AddrPort
+	lastSeen  time.Time
+	left      int64
+	peerId    [20]byte
+}
+
+// The peers of a single torrent.
+type swarm struct {
+	// Number of peers that reported completing the download.
+	completed int
+	// Keyed by peer Id.
+	peers map[[20]byte]*peerEntry
+}
+
+// The statistics of a single swarm, as returned by scrape requests.
+type SwarmStats struct {
+	Completed int    `json:"completed"`
+	InfoHash  string `json:"info_hash"`
+	Leechers  int    `json:"leechers"`
+	Seeders   int    `json:"seeders"`
+}
+
+// In-memory state of every swarm known to the tracker.
+type swarmStore struct {
+	mutex  sync.Mutex
+	swarms map[[sha1.Size]byte]*swarm
+}
+
+const (
+	defaultNumWant = 50
+	maxNumWant     = 200
+)
+
+func newSwarmStore() *swarmStore {
+	return &swarmStore{swarms: make(map[[sha1.Size]byte]*swarm)}
+}
+
+func (ss SwarmStats) rawInfoHash() ([sha1.Size]byte, error) {
+	var infoHash [sha1.Size]byte
+
+	decoded, err := hex.DecodeString(ss.InfoHash)
+
+	if err != nil || len(decoded) != sha1.Size {
+		return infoHash, fmt.Errorf("info hash '%s' is invalid", ss.InfoHash)
+	}
+
+	copy(infoHash[:], decoded)
+
+	return infoHash, nil
+}
+
+func (s *swarm) stats(infoHash [sha1.Size]byte) SwarmStats {
+	stats := SwarmStats{Completed: s.completed, InfoHash: hex.EncodeToString(infoHash[:])}
+
+	for _, peer := range s.peers {
+		if peer.left == 0 {
+			stats.Seeders += 1
+		} else {
+			stats.Leechers += 1
+		}
+	}
+
+	return stats
+}
+
+/*
+Records an announcement and returns up to `numWant` other peers of the swarm, along with the swarm's statistics.
+
+Peers that are done downloading are not sent other seeders, since they have nothing to exchange with them.
+*/
+func (ss *swarmStore) announce(req announceRequest) ([]netip.AddrPort, SwarmStats) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	s, ok := ss.swarms[req.infoHash]
+
+	if !ok {
+		s = &swarm{peers: make(map[[20]byte]*peerEntry)}
+		ss.swarms[req.infoHash] = s
+	}
+
+	if req.event == stoppedEvent {
+		delete(s.peers, req.peerId)
+
+		if len(s.peers) == 0 && s.completed == 0 {
+			delete(ss.swarms, req.infoHash)
+		}
+
+		return nil, s.stats(req.infoHash)
+	}
+
+	if req.event == completedEvent {
+		s.completed += 1
+	}
+
+	s.peers[req.peerId] = &peerEntry{
+		addresses: req.addresses,
+		lastSeen:  time.Now(),
+		left:      req.left,
+		peerId:    req.peerId,
+	}
+
+	numWant := req.numWant
+
+	if numWant <= 0 {
+		numWant = defaultNumWant
+	}
+
+	numWant = min(numWant, maxNumWant)
+	candidates := make([]*peerEntry, 0, len(s.peers))
+
+	for peerId, peer := range s.peers {
+		if peerId == req.peerId || (req.left == 0 && peer.left == 0) {
+			continue
+		}
+
+		candidates = append(candidates, peer)
+	}
+
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	peers := []netip.AddrPort{}
+
+	for _, candidate := range candidates[:min(numWant, len(candidates))] {
+		peers = append(peers, candidate.addresses...)
+	}
+
+	return peers, s.stats(req.infoHash)
+}
+
+func (ss *swarmStore) scrape(infoHash [sha1.Size]byte) SwarmStats {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	if s, ok := ss.swarms[infoHash]; ok {
+		return s.stats(infoHash)
+	}
+
+	return SwarmStats{InfoHash: hex.EncodeToString(infoHash[:])}
+}
+
+// Returns the statistics of every swarm, sorted by info hash.
+func (ss *swarmStore) stats() []SwarmStats {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	stats := make([]SwarmStats, 0, len(ss.swarms))
+
+	for infoHash, s := range ss.swarms {
+		stats = append(stats, s.stats(infoHash))
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].InfoHash < stats[j].InfoHash
+	})
+
+	return stats
+}
+
+// Removes the peers that haven't announced within `timeout`.
+func (ss *swarmStore) expire(timeout time.Duration) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	for infoHash, s := range ss.swarms {
+		for peerId, peer := range s.peers {
+			if time.Since(peer.lastSeen) > timeout {
+				delete(s.peers, peerId)
+			}
+		}
+
+		if len(s.peers) == 0 && s.completed == 0 {
+			delete(ss.swarms, infoHash)
+		}
+	}
+}
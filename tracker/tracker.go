@@ -0,0 +1,305 @@
+package tracker
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MlkMahmud/hail/logging"
+	"github.com/MlkMahmud/hail/torrent"
+)
+
+/*
+A BitTorrent tracker serving the HTTP (BEP 3) and UDP (BEP 15) tracker protocols.
+
+The state of every swarm is kept in memory: peers that stop announcing are removed after `Config.PeerTimeout`.
+*/
+type Tracker struct {
+	config Config
+
+	// Info hashes of the torrents the tracker accepts announcements for. Every torrent is accepted if nil.
+	allowlist map[[sha1.Size]byte]struct{}
+	swarms    *swarmStore
+
+	httpListener net.Listener
+	httpServer   *http.Server
+	udpConn      *net.UDPConn
+	// Secret used to generate the connection ids handed out to UDP clients.
+	udpSecret [16]byte
+
+	numOfAnnounces atomic.Uint64
+	numOfScrapes   atomic.Uint64
+
+	logger *slog.Logger
+
+	ctx        context.Context
+	cancelFunc context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+type Config struct {
+	// TCP address the HTTP tracker listens on, e.g ":8000". The HTTP tracker is disabled if empty.
+	HTTPAddress string
+	// UDP address the UDP tracker listens on, e.g ":6969". The UDP tracker is disabled if empty.
+	UDPAddress string
+	// Amount of time peers should wait between regular announcements.
+	Interval time.Duration
+	// Peers that haven't announced for this long are removed from their swarm. Defaults to twice the interval.
+	PeerTimeout time.Duration
+	// Directory containing ".torrent" files. If set, only the torrents in this directory are tracked.
+	AllowlistDir string
+	// Logger of the tracker, whose records are tagged with the "tracker" component. Defaults to `slog.Default()`.
+	Logger *slog.Logger
+}
+
+// The statistics of the tracker, served as JSON on the "/stats" endpoint.
+type Stats struct {
+	Announces uint64       `json:"announces"`
+	Leechers  int          `json:"leechers"`
+	Scrapes   uint64       `json:"scrapes"`
+	Seeders   int          `json:"seeders"`
+	Swarms    []SwarmStats `json:"swarms"`
+}
+
+const (
+	defaultInterval = 30 * time.Minute
+
+	expiryInterval = time.Minute
+)
+
+var errUnregisteredTorrent = errors.New("unregistered torrent")
+
+func New(config Config) (*Tracker, error) {
+	if config.HTTPAddress == "" && config.UDPAddress == "" {
+		return nil, fmt.Errorf("at least one of the HTTP or UDP addresses must be set")
+	}
+
+	if config.Interval <= 0 {
+		config.Interval = defaultInterval
+	}
+
+	if config.PeerTimeout <= 0 {
+		config.PeerTimeout = 2 * config.Interval
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+
+	t := &Tracker{
+		config: config,
+		swarms: newSwarmStore(),
+		logger: logging.Component(config.Logger, logging.ComponentTracker),
+
+		ctx:        ctx,
+		cancelFunc: cancelFunc,
+	}
+
+	if _, err := rand.Read(t.udpSecret[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate connection id secret: %w", err)
+	}
+
+	if config.AllowlistDir != "" {
+		allowlist, err := loadAllowlist(config.AllowlistDir)
+
+		if err != nil {
+			return nil, err
+		}
+
+		t.allowlist = allowlist
+	}
+
+	if config.HTTPAddress != "" {
+		listener, err := net.Listen("tcp", config.HTTPAddress)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on HTTP address: %w", err)
+		}
+
+		t.httpListener = listener
+		t.httpServer = &http.Server{Handler: t.httpHandler(), ReadHeaderTimeout: 10 * time.Second}
+	}
+
+	if config.UDPAddress != "" {
+		addr, err := net.ResolveUDPAddr("udp", config.UDPAddress)
+
+		if err == nil {
+			t.udpConn, err = net.ListenUDP("udp", addr)
+		}
+
+		if err != nil {
+			if t.httpListener != nil {
+				t.httpListener.Close()
+			}
+
+			return nil, fmt.Errorf("failed to listen on UDP address: %w", err)
+		}
+	}
+
+	if t.httpServer != nil {
+		t.wg.Add(1)
+
+		go func() {
+			defer t.wg.Done()
+
+			if err := t.httpServer.Serve(t.httpListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				t.logger.Error("HTTP tracker stopped", logging.ErrorKey, err)
+			}
+		}()
+	}
+
+	if t.udpConn != nil {
+		t.wg.Add(1)
+		go t.readUDPMessages()
+	}
+
+	t.wg.Add(1)
+	go t.expirePeers()
+
+	return t, nil
+}
+
+// Returns the info hashes of the ".torrent" files in the directory.
+func loadAllowlist(dir string) (map[[sha1.Size]byte]struct{}, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("failed to read allowlist directory: %w", err)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.torrent"))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list torrent files in '%s': %w", dir, err)
+	}
+
+	allowlist := make(map[[sha1.Size]byte]struct{})
+
+	for _, path := range paths {
+		trrnt, err := torrent.NewTorrent(path)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to load torrent file '%s': %w", path, err)
+		}
+
+		allowlist[trrnt.InfoHash()] = struct{}{}
+	}
+
+	return allowlist, nil
+}
+
+// Returns the address of the HTTP tracker, or nil if it is disabled.
+func (t *Tracker) HTTPAddr() net.Addr {
+	if t.httpListener == nil {
+		return nil
+	}
+
+	return t.httpListener.Addr()
+}
+
+// Returns the address of the UDP tracker, or nil if it is disabled.
+func (t *Tracker) UDPAddr() net.Addr {
+	if t.udpConn == nil {
+		return nil
+	}
+
+	return t.udpConn.LocalAddr()
+}
+
+func (t *Tracker) isAllowed(infoHash [sha1.Size]byte) bool {
+	if t.allowlist == nil {
+		return true
+	}
+
+	_, ok := t.allowlist[infoHash]
+
+	return ok
+}
+
+// Records an announcement received over either protocol and returns the peers to send back.
+func (t *Tracker) announce(req announceRequest) ([]netip.AddrPort, SwarmStats, error) {
+	if !t.isAllowed(req.infoHash) {
+		return nil, SwarmStats{}, errUnregisteredTorrent
+	}
+
+	t.numOfAnnounces.Add(1)
+	peers, stats := t.swarms.announce(req)
+
+	return peers, stats, nil
+}
+
+// Returns the statistics of the requested swarms. Torrents that aren't allowed are reported as empty swarms.
+func (t *Tracker) scrape(infoHashes [][sha1.Size]byte) []SwarmStats {
+	t.numOfScrapes.Add(1)
+	stats := make([]SwarmStats, len(infoHashes))
+
+	for index, infoHash := range infoHashes {
+		if t.isAllowed(infoHash) {
+			stats[index] = t.swarms.scrape(infoHash)
+		} else {
+			stats[index] = SwarmStats{InfoHash: hex.EncodeToString(infoHash[:])}
+		}
+	}
+
+	return stats
+}
+
+func (t *Tracker) Stats() Stats {
+	stats := Stats{
+		Announces: t.numOfAnnounces.Load(),
+		Scrapes:   t.numOfScrapes.Load(),
+		Swarms:    t.swarms.stats(),
+	}
+
+	for _, swarm := range stats.Swarms {
+		stats.Leechers += swarm.Leechers
+		stats.Seeders += swarm.Seeders
+	}
+
+	return stats
+}
+
+func (t *Tracker) expirePeers() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.ctx.Done():
+			{
+				return
+			}
+
+		case <-ticker.C:
+			{
+				t.swarms.expire(t.config.PeerTimeout)
+			}
+		}
+	}
+}
+
+func (t *Tracker) Close() error {
+	t.cancelFunc()
+
+	if t.httpServer != nil {
+		t.httpServer.Close()
+	}
+
+	if t.udpConn != nil {
+		t.udpConn.Close()
+	}
+
+	t.wg.Wait()
+
+	return nil
+}
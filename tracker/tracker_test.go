@@ -0,0 +1,337 @@
+package tracker_test
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MlkMahmud/hail/bencode"
+	"github.com/MlkMahmud/hail/torrent"
+	"github.com/MlkMahmud/hail/tracker"
+)
+
+var testInfoHash = sha1.Sum([]byte("hail"))
+
+func newTracker(t *testing.T, config tracker.Config) *tracker.Tracker {
+	t.Helper()
+
+	if config.HTTPAddress == "" {
+		config.HTTPAddress = "127.0.0.1:0"
+	}
+
+	if config.UDPAddress == "" {
+		config.UDPAddress = "127.0.0.1:0"
+	}
+
+	trckr, err := tracker.New(config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { trckr.Close() })
+
+	return trckr
+}
+
+func httpAnnounce(t *testing.T, trckr *tracker.Tracker, peerId string, port int, left int, extraParams url.Values) map[string]any {
+	t.Helper()
+
+	params := url.Values{}
+	params.Set("info_hash", string(testInfoHash[:]))
+	params.Set("peer_id", fmt.Sprintf("%-20s", peerId))
+	params.Set("port", fmt.Sprint(port))
+	params.Set("left", fmt.Sprint(left))
+
+	for key, values := range extraParams {
+		params[key] = values
+	}
+
+	return httpGet(t, fmt.Sprintf("http://%s/announce?%s", trckr.HTTPAddr(), params.Encode()))
+}
+
+func httpGet(t *testing.T, url string) map[string]any {
+	t.Helper()
+
+	res, err := http.Get(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decodedValue, _, err := bencode.DecodeValue(body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return decodedValue.(map[string]any)
+}
+
+func TestHTTPAnnounce(t *testing.T) {
+	trckr := newTracker(t, tracker.Config{Interval: 10 * time.Minute})
+
+	httpAnnounce(t, trckr, "seeder", 6881, 0, nil)
+	response := httpAnnounce(t, trckr, "leecher", 6882, 100, nil)
+
+	if response["interval"] != 600 {
+		t.Errorf("expected interval to be 600, but got %v", response["interval"])
+	}
+
+	if response["complete"] != 1 || response["incomplete"] != 1 {
+		t.Errorf("expected 1 seeder and 1 leecher, but got %v and %v", response["complete"], response["incomplete"])
+	}
+
+	expectedPeers := string([]byte{127, 0, 0, 1, 0x1A, 0xE1})
+
+	if response["peers"] != expectedPeers {
+		t.Errorf("expected compact peers to be %q, but got %q", expectedPeers, response["peers"])
+	}
+}
+
+func TestHTTPAnnounceNonCompact(t *testing.T) {
+	trckr := newTracker(t, tracker.Config{})
+
+	httpAnnounce(t, trckr, "first", 6881, 100, nil)
+	response := httpAnnounce(t, trckr, "second", 6882, 100, url.Values{"compact": {"0"}})
+
+	peers, ok := response["peers"].([]any)
+
+	if !ok || len(peers) != 1 {
+		t.Fatalf("expected peers to be a list with 1 entry, but got %v", response["peers"])
+	}
+
+	peer := peers[0].(map[string]any)
+
+	if peer["ip"] != "127.0.0.1" || peer["port"] != 6881 {
+		t.Errorf("expected peer to be 127.0.0.1:6881, but got %v", peer)
+	}
+}
+
+func TestHTTPAnnounceIPv6(t *testing.T) {
+	trckr := newTracker(t, tracker.Config{})
+
+	httpAnnounce(t, trckr, "first", 6881, 100, url.Values{"ipv6": {"2001:db8::1"}})
+	response := httpAnnounce(t, trckr, "second", 6882, 100, nil)
+
+	expectedPeers6 := string(append(net.ParseIP("2001:db8::1").To16(), 0x1A, 0xE1))
+
+	if response["peers6"] != expectedPeers6 {
+		t.Errorf("expected compact IPv6 peers to be %q, but got %q", expectedPeers6, response["peers6"])
+	}
+}
+
+func TestHTTPAnnounceStopped(t *testing.T) {
+	trckr := newTracker(t, tracker.Config{})
+
+	httpAnnounce(t, trckr, "first", 6881, 100, nil)
+	httpAnnounce(t, trckr, "first", 6881, 100, url.Values{"event": {"stopped"}})
+	response := httpAnnounce(t, trckr, "second", 6882, 100, nil)
+
+	if response["peers"] != "" {
+		t.Errorf("expected stopped peer to be removed from the swarm, but got peers %q", response["peers"])
+	}
+}
+
+func TestHTTPScrape(t *testing.T) {
+	trckr := newTracker(t, tracker.Config{})
+
+	httpAnnounce(t, trckr, "seeder", 6881, 0, nil)
+	httpAnnounce(t, trckr, "leecher", 6882, 100, url.Values{"event": {"completed"}})
+
+	params := url.Values{"info_hash": {string(testInfoHash[:])}}
+	response := httpGet(t, fmt.Sprintf("http://%s/scrape?%s", trckr.HTTPAddr(), params.Encode()))
+
+	files := response["files"].(map[string]any)
+	stats, ok := files[string(testInfoHash[:])].(map[string]any)
+
+	if !ok {
+		t.Fatalf("expected scrape response to include the torrent, but got %v", response)
+	}
+
+	if stats["complete"] != 1 || stats["incomplete"] != 1 || stats["downloaded"] != 1 {
+		t.Errorf("unexpected scrape response: %v", stats)
+	}
+}
+
+func TestScrapeWithClient(t *testing.T) {
+	trckr := newTracker(t, tracker.Config{})
+
+	httpAnnounce(t, trckr, "seeder", 6881, 0, nil)
+
+	magnetLink := fmt.Sprintf(
+		"magnet:?xt=urn:btih:%s&tr=%s&tr=%s",
+		hex.EncodeToString(testInfoHash[:]),
+		url.QueryEscape(fmt.Sprintf("http://%s/announce", trckr.HTTPAddr())),
+		url.QueryEscape(fmt.Sprintf("udp://%s", trckr.UDPAddr())),
+	)
+
+	trrnt, err := torrent.NewTorrent(magnetLink)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, result := range trrnt.Scrape() {
+		if result.Error != nil {
+			t.Errorf("failed to scrape %s: %v", result.Tracker, result.Error)
+			continue
+		}
+
+		if result.Seeders != 1 || result.Leechers != 0 {
+			t.Errorf("expected %s to report 1 seeder and 0 leechers, but got %+v", result.Tracker, result)
+		}
+	}
+}
+
+func udpRequest(t *testing.T, conn net.Conn, request []byte) []byte {
+	t.Helper()
+
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	response := make([]byte, 2048)
+	bytesRead, err := conn.Read(response)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return response[:bytesRead]
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	trckr := newTracker(t, tracker.Config{Interval: 10 * time.Minute})
+	conn, err := net.Dial("udp", trckr.UDPAddr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	connectRequest := binary.BigEndian.AppendUint64(nil, 0x41727101980)
+	connectRequest = binary.BigEndian.AppendUint32(connectRequest, 0)
+	connectRequest = binary.BigEndian.AppendUint32(connectRequest, 1)
+	connectResponse := udpRequest(t, conn, connectRequest)
+
+	if len(connectResponse) != 16 || binary.BigEndian.Uint32(connectResponse[4:]) != 1 {
+		t.Fatalf("unexpected 'connect' response: %v", connectResponse)
+	}
+
+	connectionId := binary.BigEndian.Uint64(connectResponse[8:])
+
+	announceRequest := func(connectionId uint64, peerId string, port uint16) []byte {
+		request := binary.BigEndian.AppendUint64(nil, connectionId)
+		request = binary.BigEndian.AppendUint32(request, 1)
+		request = binary.BigEndian.AppendUint32(request, 2)
+		request = append(request, testInfoHash[:]...)
+		request = append(request, fmt.Sprintf("%-20s", peerId)...)
+		request = append(request, make([]byte, 24)...)
+		request = binary.BigEndian.AppendUint32(request, 2)
+		request = append(request, make([]byte, 8)...)
+		request = binary.BigEndian.AppendUint32(request, 0xFFFFFFFF)
+
+		return binary.BigEndian.AppendUint16(request, port)
+	}
+
+	udpRequest(t, conn, announceRequest(connectionId, "first", 6881))
+	response := udpRequest(t, conn, announceRequest(connectionId, "second", 6882))
+
+	if action := binary.BigEndian.Uint32(response); action != 1 {
+		t.Fatalf("expected action to be 1 (announce), but got %d: %q", action, response[8:])
+	}
+
+	if interval := binary.BigEndian.Uint32(response[8:]); interval != 600 {
+		t.Errorf("expected interval to be 600, but got %d", interval)
+	}
+
+	if seeders := binary.BigEndian.Uint32(response[16:]); seeders != 2 {
+		t.Errorf("expected 2 seeders, but got %d", seeders)
+	}
+
+	response = udpRequest(t, conn, announceRequest(connectionId+1, "third", 6883))
+
+	if action := binary.BigEndian.Uint32(response); action != 3 {
+		t.Errorf("expected an invalid connection id to be rejected with an error, but got action %d", action)
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	dir := t.TempDir()
+	info := map[string]any{"length": 1, "name": "file", "piece length": 16384, "pieces": string(make([]byte, 20))}
+
+	metainfo, err := bencode.EncodeValue(map[string]any{"announce": "http://localhost/announce", "info": info})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "allowed.torrent"), []byte(metainfo), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	encodedInfo, _ := bencode.EncodeValue(info)
+	allowedInfoHash := sha1.Sum([]byte(encodedInfo))
+	trckr := newTracker(t, tracker.Config{AllowlistDir: dir})
+
+	response := httpAnnounce(t, trckr, "peer", 6881, 100, nil)
+
+	if response["failure reason"] != "unregistered torrent" {
+		t.Errorf("expected announcement for an unknown torrent to fail, but got %v", response)
+	}
+
+	response = httpAnnounce(t, trckr, "peer", 6881, 100, url.Values{"info_hash": {string(allowedInfoHash[:])}})
+
+	if reason, ok := response["failure reason"]; ok {
+		t.Errorf("expected announcement for an allowed torrent to succeed, but got '%v'", reason)
+	}
+}
+
+func TestStats(t *testing.T) {
+	trckr := newTracker(t, tracker.Config{})
+
+	httpAnnounce(t, trckr, "seeder", 6881, 0, nil)
+
+	res, err := http.Get(fmt.Sprintf("http://%s/stats", trckr.HTTPAddr()))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	var stats tracker.Stats
+
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Announces != 1 || stats.Seeders != 1 || len(stats.Swarms) != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	if stats.Swarms[0].InfoHash != hex.EncodeToString(testInfoHash[:]) {
+		t.Errorf("expected swarm info hash to be %x, but got %s", testInfoHash, stats.Swarms[0].InfoHash)
+	}
+}
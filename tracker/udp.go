@@ -0,0 +1,231 @@
+package tracker
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net/netip"
+	"time"
+)
+
+type udpActionId uint32
+
+const (
+	connectActionId udpActionId = iota
+	announceActionId
+	scrapeActionId
+	errorActionId
+)
+
+const (
+	udpProtocolId = 0x41727101980
+
+	udpConnectRequestSize  = 16
+	udpAnnounceRequestSize = 98
+	udpRequestHeaderSize   = 16
+	// Maximum number of info hashes in a scrape request.
+	maxUDPScrapeInfoHashes = 74
+
+	maxUDPMessageSize = 2048
+	// Connection ids are valid for one minute, but we accept ids generated in the previous window as well.
+	connectionIdWindow = time.Minute
+)
+
+/*
+Generates the connection id handed out to a client.
+
+Instead of storing the ids we hand out, they are derived from the client's address, a secret and the current time window,
+so they can be verified without keeping any state.
+*/
+func (t *Tracker) connectionId(address netip.AddrPort, window int64) uint64 {
+	hash := sha1.New()
+	hash.Write(t.udpSecret[:])
+	hash.Write([]byte(address.String()))
+	hash.Write(binary.BigEndian.AppendUint64(nil, uint64(window)))
+
+	return binary.BigEndian.Uint64(hash.Sum(nil))
+}
+
+func (t *Tracker) isValidConnectionId(address netip.AddrPort, connectionId uint64) bool {
+	window := time.Now().Unix() / int64(connectionIdWindow.Seconds())
+
+	return connectionId == t.connectionId(address, window) || connectionId == t.connectionId(address, window-1)
+}
+
+func (t *Tracker) readUDPMessages() {
+	defer t.wg.Done()
+
+	buffer := make([]byte, maxUDPMessageSize)
+
+	for {
+		bytesRead, address, err := t.udpConn.ReadFromUDPAddrPort(buffer)
+
+		if err != nil {
+			if t.ctx.Err() != nil {
+				return
+			}
+
+			continue
+		}
+
+		address = netip.AddrPortFrom(address.Addr().Unmap(), address.Port())
+		response := t.handleUDPRequest(buffer[:bytesRead], address)
+
+		if response != nil {
+			t.udpConn.WriteToUDPAddrPort(response, address)
+		}
+	}
+}
+
+/*
+Handles a single UDP request and returns the response, or nil if the request should be ignored.
+
+Every request starts with the same header:
+
+	Offset  Size            Name            Value
+	0       64-bit integer  connection_id   // protocol_id for 'connect' requests
+	8       32-bit integer  action
+	12      32-bit integer  transaction_id
+	16
+*/
+func (t *Tracker) handleUDPRequest(request []byte, address netip.AddrPort) []byte {
+	if len(request) < udpRequestHeaderSize {
+		return nil
+	}
+
+	connectionId := binary.BigEndian.Uint64(request)
+	action := udpActionId(binary.BigEndian.Uint32(request[8:]))
+	transactionId := binary.BigEndian.Uint32(request[12:])
+
+	if action == connectActionId {
+		if connectionId != udpProtocolId {
+			return nil
+		}
+
+		window := time.Now().Unix() / int64(connectionIdWindow.Seconds())
+		response := binary.BigEndian.AppendUint32(nil, uint32(connectActionId))
+		response = binary.BigEndian.AppendUint32(response, transactionId)
+
+		return binary.BigEndian.AppendUint64(response, t.connectionId(address, window))
+	}
+
+	if !t.isValidConnectionId(address, connectionId) {
+		return udpErrorResponse(transactionId, "invalid connection id")
+	}
+
+	switch action {
+	case announceActionId:
+		{
+			return t.handleUDPAnnounce(request, address, transactionId)
+		}
+
+	case scrapeActionId:
+		{
+			return t.handleUDPScrape(request, transactionId)
+		}
+
+	default:
+		{
+			return udpErrorResponse(transactionId, "unknown action")
+		}
+	}
+}
+
+func udpErrorResponse(transactionId uint32, message string) []byte {
+	response := binary.BigEndian.AppendUint32(nil, uint32(errorActionId))
+	response = binary.BigEndian.AppendUint32(response, transactionId)
+
+	return append(response, message...)
+}
+
+/*
+Handles an announce request:
+
+	Offset  Size            Name            Value
+	16      20-byte string  info_hash
+	36      20-byte string  peer_id
+	56      64-bit integer  downloaded
+	64      64-bit integer  left
+	72      64-bit integer  uploaded
+	80      32-bit integer  event           0 // 0: none; 1: completed; 2: started; 3: stopped
+	84      32-bit integer  IP address      0 // default
+	88      32-bit integer  key
+	92      32-bit integer  num_want        -1 // default
+	96      16-bit integer  port
+	98
+
+Requests received over IPv4 are answered with IPv4 peers (6 bytes each), and requests received over IPv6 with IPv6 peers (18 bytes each).
+The "IP address" field is ignored: peers are only registered with the address the request was sent from.
+*/
+func (t *Tracker) handleUDPAnnounce(request []byte, address netip.AddrPort, transactionId uint32) []byte {
+	if len(request) < udpAnnounceRequestSize {
+		return udpErrorResponse(transactionId, "announce request is too short")
+	}
+
+	req := announceRequest{
+		addresses: []netip.AddrPort{netip.AddrPortFrom(address.Addr(), binary.BigEndian.Uint16(request[96:]))},
+		event:     announceEvent(binary.BigEndian.Uint32(request[80:])),
+		infoHash:  [sha1.Size]byte(request[16:36]),
+		left:      int64(binary.BigEndian.Uint64(request[64:])),
+		numWant:   int(int32(binary.BigEndian.Uint32(request[92:]))),
+		peerId:    [20]byte(request[36:56]),
+	}
+
+	peers, stats, err := t.announce(req)
+
+	if err != nil {
+		return udpErrorResponse(transactionId, err.Error())
+	}
+
+	response := binary.BigEndian.AppendUint32(nil, uint32(announceActionId))
+	response = binary.BigEndian.AppendUint32(response, transactionId)
+	response = binary.BigEndian.AppendUint32(response, uint32(t.config.Interval.Seconds()))
+	response = binary.BigEndian.AppendUint32(response, uint32(stats.Leechers))
+	response = binary.BigEndian.AppendUint32(response, uint32(stats.Seeders))
+
+	for _, peer := range peers {
+		if peer.Addr().Is4() != address.Addr().Is4() || len(response) >= maxUDPMessageSize-18 {
+			continue
+		}
+
+		addr, _ := peer.Addr().MarshalBinary()
+		response = append(response, addr...)
+		response = binary.BigEndian.AppendUint16(response, peer.Port())
+	}
+
+	return response
+}
+
+/*
+Handles a scrape request:
+
+	Offset          Size            Name            Value
+	16 + 20 * n     20-byte string  info_hash
+	16 + 20 * N
+
+The response contains the seeders, completed and leechers counts of each torrent, in the order of the request.
+*/
+func (t *Tracker) handleUDPScrape(request []byte, transactionId uint32) []byte {
+	numOfInfoHashes := (len(request) - udpRequestHeaderSize) / sha1.Size
+
+	if numOfInfoHashes == 0 || numOfInfoHashes > maxUDPScrapeInfoHashes {
+		return udpErrorResponse(transactionId, "scrape request must contain between 1 and 74 info hashes")
+	}
+
+	infoHashes := make([][sha1.Size]byte, numOfInfoHashes)
+
+	for index := range infoHashes {
+		offset := udpRequestHeaderSize + sha1.Size*index
+		infoHashes[index] = [sha1.Size]byte(request[offset : offset+sha1.Size])
+	}
+
+	response := binary.BigEndian.AppendUint32(nil, uint32(scrapeActionId))
+	response = binary.BigEndian.AppendUint32(response, transactionId)
+
+	for _, stats := range t.scrape(infoHashes) {
+		response = binary.BigEndian.AppendUint32(response, uint32(stats.Seeders))
+		response = binary.BigEndian.AppendUint32(response, uint32(stats.Completed))
+		response = binary.BigEndian.AppendUint32(response, uint32(stats.Leechers))
+	}
+
+	return response
+}